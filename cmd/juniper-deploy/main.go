@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
 	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/deploy"
 )
 
@@ -21,8 +22,20 @@ Environments:
 Commands:
   juniper-deploy [env]           Deploy to environment
   juniper-deploy list [env]      List releases on target
-  juniper-deploy rollback [env]  Rollback to previous release
+  juniper-deploy rollback [env]  Rollback (pick a release interactively in a terminal)
+  juniper-deploy --steps N rollback [env]  Rollback N releases
   juniper-deploy status [env]    Show current deployment status
+  juniper-deploy deploy-region <region>  Deploy to every environment of a region in turn
+  juniper-deploy env-diff <env1> <env2>  Compare two environment configurations
+  juniper-deploy manifest [dir]  Generate build manifest (--stats for all file types)
+  juniper-deploy pin <env> <id>    Protect a release from cleanup
+  juniper-deploy unpin <env> <id>  Allow a pinned release to be cleaned up
+  juniper-deploy snapshot [env] [id] [output]  Archive a release (default: current) as .tar.xz
+  juniper-deploy restore <env> <file> [--release-id=ID]  Deploy and activate a snapshot archive
+  juniper-deploy gc [--dry-run]    Remove releases beyond keepN in every environment
+  juniper-deploy retention-report [env]  Show disk usage per release and cleanup savings
+  juniper-deploy config-init [--force] [--stdout]  Write a commented deploy.toml
+  juniper-deploy init <name> [--target=user@host] [--force]  Scaffold a new project here
 
 Flags:
 `
@@ -34,6 +47,22 @@ type cliFlags struct {
 	dryRun     bool
 	full       bool
 	noBuild    bool
+	fileMode   string
+	dirMode    string
+	followLink bool
+	skipReady  bool
+	noInteract bool
+	steps      int
+	stats      bool
+	lazy       bool
+	partial    bool
+	stash      bool
+	branch     string
+	noPromote  bool
+	cleanGit   bool
+	allowDirty bool
+	envFile    string
+	subPath    string
 }
 
 // parseFlags parses and returns CLI flags
@@ -43,6 +72,23 @@ func parseFlags() cliFlags {
 	dryRun := flag.Bool("dry-run", false, "Show what would be deployed without deploying")
 	full := flag.Bool("full", false, "Upload all files instead of delta")
 	noBuild := flag.Bool("no-build", false, "Skip Hugo build (use existing public/ directory)")
+	fileMode := flag.String("file-mode", "", "Octal mode for deployed files, e.g. 0644 (default: preserve)")
+	dirMode := flag.String("dir-mode", "", "Octal mode for deployed directories, e.g. 0755 (default: preserve)")
+	followLink := flag.Bool("follow-symlinks", false, "Deploy symlink targets as regular files instead of links")
+	skipReady := flag.Bool("skip-readiness-check", false, "Skip checking the target is reachable before building")
+	noColor := flag.Bool("no-color", false, "Disable colored output (also honors NO_COLOR)")
+	noInteract := flag.Bool("no-interactive", false, "Never show the interactive rollback picker")
+	steps := flag.Int("steps", 0, "Rollback: go back N releases instead of one")
+	branch := flag.String("branch", "", "Git branch to build, overriding the environment's branch")
+	cleanGit := flag.Bool("require-clean-git", false, "Fail instead of warning when the working tree has uncommitted changes")
+	allowDirty := flag.Bool("allow-dirty", false, "Only warn about uncommitted changes, even if the environment sets requireCleanGit")
+	noPromote := flag.Bool("no-auto-promote", false, "Do not deploy on to the environment's autoPromote target")
+	stash := flag.Bool("stash-before-build", false, "Stash uncommitted git changes during the build and restore them afterwards")
+	envFile := flag.String("env-file", "", "Variables for the Hugo build (default: .env if it exists)")
+	subPath := flag.String("sub-path", "", "Only deploy this directory of public/ into the live release, e.g. bible/drc")
+	partial := flag.Bool("partial-build", false, "Incremental Hugo build reusing its cache; falls back to a full build if the output diverges")
+	lazy := flag.Bool("lazy-manifest", false, "Only re-hash files whose size or mtime changed since the last manifest")
+	stats := flag.Bool("stats", false, "Manifest: list every file type in the breakdown")
 	help := flag.Bool("help", false, "Show help")
 	h := flag.Bool("h", false, "Show help")
 
@@ -52,6 +98,10 @@ func parseFlags() cliFlags {
 	}
 	flag.Parse()
 
+	if *noColor {
+		common.DisableColor()
+	}
+
 	if *help || *h {
 		flag.Usage()
 		os.Exit(0)
@@ -63,6 +113,22 @@ func parseFlags() cliFlags {
 		dryRun:     *dryRun,
 		full:       *full,
 		noBuild:    *noBuild,
+		fileMode:   *fileMode,
+		dirMode:    *dirMode,
+		followLink: *followLink,
+		skipReady:  *skipReady,
+		noInteract: *noInteract,
+		steps:      *steps,
+		stats:      *stats,
+		lazy:       *lazy,
+		partial:    *partial,
+		stash:      *stash,
+		branch:     *branch,
+		noPromote:  *noPromote,
+		cleanGit:   *cleanGit,
+		allowDirty: *allowDirty,
+		envFile:    *envFile,
+		subPath:    *subPath,
 	}
 }
 
@@ -74,7 +140,7 @@ func parseCommandAndEnv(args []string) (command, envName string) {
 		return
 	}
 	switch args[0] {
-	case "list", "rollback", "status", "manifest":
+	case "list", "rollback", "status", "manifest", "pin", "unpin", "snapshot", "restore", "env-diff", "gc", "retention-report", "config-init", "deploy-region", "init":
 		command = args[0]
 		if len(args) >= 2 {
 			envName = args[1]
@@ -93,51 +159,177 @@ func parseCommandLine() (command, envName string, args []string, flags cliFlags)
 	return
 }
 
-// loadEnvironment loads config and finds the environment
-func loadEnvironment(configPath, envName string) *deploy.Environment {
+// loadConfig loads the config file, exiting with an example if it is missing
+func loadConfig(configPath string) *deploy.Config {
 	config, err := deploy.LoadConfig(configPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		fmt.Fprintf(os.Stderr, "\nCreate a deploy.toml in your project root:\n\n%s", deploy.ExampleConfig())
 		os.Exit(1)
 	}
+	// Keep secret:// values out of logs from here on
+	common.MaskStdio()
+	return config
+}
 
+// loadEnvironment loads config and finds the environment
+func loadEnvironment(configPath, envName string) *deploy.Environment {
+	config := loadConfig(configPath)
 	foundEnv, ok := config.GetEnvironment(envName)
 	if !ok {
 		fmt.Fprintf(os.Stderr, "Error: unknown environment '%s'\n", envName)
 		fmt.Fprintf(os.Stderr, "Available environments: %s\n", availableEnvs(config))
-		os.Exit(1)
+		common.Exit(1)
 	}
 	return &foundEnv
 }
 
+// applyModeFlags overrides the environment's file and directory modes from flags
+func applyModeFlags(env *deploy.Environment, flags cliFlags) error {
+	if flags.fileMode != "" {
+		mode, err := deploy.ParseFileMode(flags.fileMode)
+		if err != nil {
+			return fmt.Errorf("--file-mode: %w", err)
+		}
+		env.FileMode = mode
+	}
+	if flags.dirMode != "" {
+		mode, err := deploy.ParseFileMode(flags.dirMode)
+		if err != nil {
+			return fmt.Errorf("--dir-mode: %w", err)
+		}
+		env.DirMode = mode
+	}
+	return nil
+}
+
+// deployOptions returns the deploy options set by flags
+func deployOptions(flags cliFlags) deploy.Options {
+	return deploy.Options{
+		ReleaseID:          flags.releaseID,
+		DryRun:             flags.dryRun,
+		Full:               flags.full,
+		NoBuild:            flags.noBuild,
+		FollowSymlinks:     flags.followLink,
+		SkipReadinessCheck: flags.skipReady,
+		LazyManifest:       flags.lazy,
+		PartialBuild:       flags.partial,
+		StashBeforeBuild:   flags.stash,
+		Branch:             flags.branch,
+		NoAutoPromote:      flags.noPromote,
+		RequireCleanGit:    flags.cleanGit,
+		AllowDirty:         flags.allowDirty,
+		EnvFile:            deploy.EnvFileOption(flags.envFile),
+		SubPath:            flags.subPath,
+	}
+}
+
 // runDeploy executes the deploy command
 func runDeploy(env *deploy.Environment, flags cliFlags) error {
-	opts := deploy.Options{
-		ReleaseID: flags.releaseID,
-		DryRun:    flags.dryRun,
-		Full:      flags.full,
-		NoBuild:   flags.noBuild,
+	if err := applyModeFlags(env, flags); err != nil {
+		return err
 	}
-	return deploy.Deploy(*env, opts)
+	opts := deployOptions(flags)
+	opts.Config = loadConfig(flags.configPath)
+	_, err := deploy.Deploy(*env, opts)
+	return err
+}
+
+// runDeployRegion deploys to every environment of the region named in args
+func runDeployRegion(args []string, flags cliFlags) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: juniper-deploy deploy-region <region>")
+	}
+	config := loadConfig(flags.configPath)
+	for i := range config.Environments {
+		if err := applyModeFlags(&config.Environments[i], flags); err != nil {
+			return err
+		}
+	}
+	_, err := deploy.DeployRegion(config, args[1], deployOptions(flags))
+	return err
 }
 
 // runRollback executes the rollback command
-func runRollback(env *deploy.Environment, args []string) error {
+func runRollback(env *deploy.Environment, args []string, flags cliFlags) error {
 	targetRelease := ""
 	if len(args) >= 3 {
 		targetRelease = args[2]
 	}
-	return deploy.Rollback(*env, targetRelease)
+	return deploy.Rollback(*env, targetRelease, flags.steps, !flags.noInteract)
 }
 
 // runManifest executes the manifest command
-func runManifest(args []string, releaseID string) error {
+func runManifest(args []string, releaseID string, fullStats bool) error {
 	buildDir := "public"
 	if len(args) >= 2 {
 		buildDir = args[1]
 	}
-	return deploy.GenerateManifestOnly(buildDir, releaseID)
+	return deploy.GenerateManifestOnly(buildDir, releaseID, fullStats)
+}
+
+// runGC executes the gc command across all environments
+func runGC(args []string, flags cliFlags) error {
+	dryRun := flags.dryRun
+	for _, a := range args[1:] {
+		if a == "--dry-run" || a == "-dry-run" {
+			dryRun = true
+		}
+	}
+	_, err := deploy.GarbageCollect(loadConfig(flags.configPath), dryRun)
+	return err
+}
+
+// runConfigInit executes the config-init command
+func runConfigInit(args []string, flags cliFlags) error {
+	var force, toStdout bool
+	for _, a := range args[1:] {
+		switch a {
+		case "--force", "-force":
+			force = true
+		case "--stdout", "-stdout":
+			toStdout = true
+		default:
+			return fmt.Errorf("usage: juniper-deploy config-init [--force] [--stdout]")
+		}
+	}
+	return deploy.ConfigInit(flags.configPath, force, toStdout)
+}
+
+// parseInitArgs returns the project name and options of the init command
+func parseInitArgs(args []string) (name, target string, force bool, err error) {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "--force" || a == "-force":
+			force = true
+		case a == "--target" || a == "-target":
+			if i+1 == len(args) {
+				return "", "", false, fmt.Errorf("--target needs a value")
+			}
+			i++
+			target = args[i]
+		case strings.HasPrefix(a, "--target=") || strings.HasPrefix(a, "-target="):
+			target = a[strings.Index(a, "=")+1:]
+		case name == "" && !strings.HasPrefix(a, "-"):
+			name = a
+		default:
+			return "", "", false, fmt.Errorf("unexpected argument %q", a)
+		}
+	}
+	if name == "" {
+		return "", "", false, fmt.Errorf("missing project name")
+	}
+	return name, target, force, nil
+}
+
+// runInit executes the init command
+func runInit(args []string) error {
+	name, target, force, err := parseInitArgs(args[1:])
+	if err != nil {
+		return fmt.Errorf("%w\nusage: juniper-deploy init <project-name> [--target=user@host] [--force]", err)
+	}
+	return deploy.InitProject(name, target, force)
 }
 
 // cmdHandler is a function type for command handlers
@@ -154,8 +346,67 @@ func cmdListHandler(env *deploy.Environment, _ []string, _ cliFlags) error {
 }
 
 // cmdRollbackHandler handles the rollback command
-func cmdRollbackHandler(env *deploy.Environment, args []string, _ cliFlags) error {
-	return runRollback(env, args)
+func cmdRollbackHandler(env *deploy.Environment, args []string, flags cliFlags) error {
+	return runRollback(env, args, flags)
+}
+
+// releaseArg returns the release ID argument following the environment
+func releaseArg(args []string) string {
+	if len(args) >= 3 {
+		return args[2]
+	}
+	return ""
+}
+
+// cmdPinHandler handles the pin command
+func cmdPinHandler(env *deploy.Environment, args []string, _ cliFlags) error {
+	return deploy.Pin(*env, releaseArg(args))
+}
+
+// cmdUnpinHandler handles the unpin command
+func cmdUnpinHandler(env *deploy.Environment, args []string, _ cliFlags) error {
+	return deploy.Unpin(*env, releaseArg(args))
+}
+
+// cmdSnapshotHandler handles the snapshot command
+func cmdSnapshotHandler(env *deploy.Environment, args []string, _ cliFlags) error {
+	outputPath := ""
+	if len(args) >= 4 {
+		outputPath = args[3]
+	}
+	return deploy.Snapshot(*env, releaseArg(args), outputPath)
+}
+
+// cmdRestoreHandler handles the restore command. --release-id may follow the
+// snapshot file; --release before the command works too.
+func cmdRestoreHandler(env *deploy.Environment, args []string, flags cliFlags) error {
+	if len(args) < 3 {
+		return fmt.Errorf("usage: juniper-deploy restore <env> <snapshot-file> [--release-id=ID]")
+	}
+	releaseID := flags.releaseID
+	rest := args[3:]
+	for i := 0; i < len(rest); i++ {
+		switch arg := strings.TrimPrefix(rest[i], "-"); {
+		case strings.HasPrefix(arg, "-release-id="):
+			releaseID = strings.TrimPrefix(arg, "-release-id=")
+		case arg == "-release-id" && i+1 < len(rest):
+			i++
+			releaseID = rest[i]
+		default:
+			return fmt.Errorf("usage: juniper-deploy restore <env> <snapshot-file> [--release-id=ID]")
+		}
+	}
+	return deploy.Restore(*env, args[2], releaseID)
+}
+
+// cmdEnvDiffHandler handles the env-diff command
+func cmdEnvDiffHandler(env *deploy.Environment, args []string, flags cliFlags) error {
+	if len(args) < 3 {
+		return fmt.Errorf("usage: juniper-deploy env-diff <env1> <env2>")
+	}
+	other := loadEnvironment(flags.configPath, args[2])
+	deploy.PrintEnvDiff(*env, *other)
+	return nil
 }
 
 // cmdStatusHandler handles the status command
@@ -163,18 +414,34 @@ func cmdStatusHandler(env *deploy.Environment, _ []string, _ cliFlags) error {
 	return deploy.Status(*env)
 }
 
+// cmdRetentionHandler handles the retention-report command
+func cmdRetentionHandler(env *deploy.Environment, _ []string, _ cliFlags) error {
+	stats, err := deploy.RetentionReport(*env)
+	if err != nil {
+		return err
+	}
+	deploy.PrintRetentionReport(*env, stats)
+	return nil
+}
+
 // cmdManifestHandler handles the manifest command
 func cmdManifestHandler(_ *deploy.Environment, args []string, flags cliFlags) error {
-	return runManifest(args, flags.releaseID)
+	return runManifest(args, flags.releaseID, flags.stats)
 }
 
 // cmdHandlers maps commands to handlers
 var cmdHandlers = map[string]cmdHandler{
-	"deploy":   cmdDeployHandler,
-	"list":     cmdListHandler,
-	"rollback": cmdRollbackHandler,
-	"status":   cmdStatusHandler,
-	"manifest": cmdManifestHandler,
+	"deploy":           cmdDeployHandler,
+	"list":             cmdListHandler,
+	"rollback":         cmdRollbackHandler,
+	"status":           cmdStatusHandler,
+	"manifest":         cmdManifestHandler,
+	"pin":              cmdPinHandler,
+	"unpin":            cmdUnpinHandler,
+	"snapshot":         cmdSnapshotHandler,
+	"restore":          cmdRestoreHandler,
+	"env-diff":         cmdEnvDiffHandler,
+	"retention-report": cmdRetentionHandler,
 }
 
 // executeCommand runs the specified command
@@ -188,11 +455,27 @@ func executeCommand(command string, env *deploy.Environment, args []string, flag
 
 func main() {
 	command, envName, args, flags := parseCommandLine()
-	env := loadEnvironment(flags.configPath, envName)
+	defer common.RestoreStdio()
 
-	if err := executeCommand(command, env, args, flags); err != nil {
+	var err error
+	switch command {
+	case "gc":
+		// gc spans every environment, so none is loaded
+		err = runGC(args, flags)
+	case "deploy-region":
+		// A region spans several environments, loaded by the handler
+		err = runDeployRegion(args, flags)
+	case "config-init":
+		err = runConfigInit(args, flags)
+	case "init":
+		err = runInit(args)
+	default:
+		env := loadEnvironment(flags.configPath, envName)
+		err = executeCommand(command, env, args, flags)
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		common.Exit(1)
 	}
 }
 
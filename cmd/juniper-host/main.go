@@ -3,10 +3,17 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/bootstrap"
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
 	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/deploycmd"
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/diagnose"
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/diskusage"
 	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/installer"
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/logs"
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/remoteexec"
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/sshkeys"
 	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/upgrade"
 	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/wizard"
 )
@@ -15,25 +22,70 @@ var version = "dev"
 
 // commandHandlers maps commands to their handlers
 var commandHandlers = map[string]func([]string){
-	"bootstrap": bootstrap.Run,
-	"install":   installer.Run,
-	"wizard":    wizard.Run,
-	"setup":     wizard.Run,
-	"upgrade":   upgrade.Run,
-	"deploy":    deploycmd.Run,
+	"bootstrap":   bootstrap.Run,
+	"install":     installer.Run,
+	"wizard":      wizard.Run,
+	"setup":       wizard.Run,
+	"upgrade":     upgrade.Run,
+	"deploy":      deploycmd.Run,
+	"redirects":   wizard.RunRedirects,
+	"gc":          upgrade.RunGC,
+	"disk-usage":  diskusage.Run,
+	"logs":        logs.Run,
+	"remote-exec": remoteexec.Run,
+	"add-key":     sshkeys.RunAdd,
+	"remove-key":  sshkeys.RunRemove,
+	"diagnose":    diagnose.Run,
+}
+
+// loggedCommands change the system and write to the host log file
+var loggedCommands = map[string]bool{
+	"bootstrap":  true,
+	"install":    true,
+	"wizard":     true,
+	"setup":      true,
+	"upgrade":    true,
+	"redirects":  true,
+	"gc":         true,
+	"add-key":    true,
+	"remove-key": true,
+}
+
+// stripLogFileFlag removes a global --log-file flag from args, returning the
+// remaining args and the requested path ("" for the default)
+func stripLogFileFlag(args []string) ([]string, string) {
+	out := args[:0:0]
+	path := ""
+	for i := 0; i < len(args); i++ {
+		a := strings.TrimLeft(args[i], "-")
+		switch {
+		case a == "log-file" && i+1 < len(args):
+			path = args[i+1]
+			i++
+		case strings.HasPrefix(a, "log-file="):
+			path = strings.TrimPrefix(a, "log-file=")
+		default:
+			out = append(out, args[i])
+		}
+	}
+	return out, path
 }
 
 func main() {
-	if len(os.Args) < 2 {
+	argv, logFile := stripLogFileFlag(common.StripNoColorFlag(os.Args[1:]))
+	if len(argv) < 1 {
 		printUsage()
 		os.Exit(1)
 	}
 
-	cmd := os.Args[1]
-	args := os.Args[2:]
+	cmd := argv[0]
+	args := argv[1:]
 
 	// Check for handlers
 	if handler, ok := commandHandlers[cmd]; ok {
+		if loggedCommands[cmd] {
+			common.InitLog(cmd, logFile)
+		}
 		handler(args)
 		return
 	}
@@ -55,7 +107,7 @@ func printUsage() {
 	fmt.Println(`juniper-host - NixOS server setup and deployment for Juniper Bible
 
 Usage:
-  juniper-host <command> [options]
+  juniper-host [--no-color] [--log-file=PATH] <command> [options]
 
 Commands:
   bootstrap    Full automated install (partition, format, install NixOS)
@@ -63,21 +115,142 @@ Commands:
   wizard       Interactive setup wizard (run after first boot)
   upgrade      Update configuration on local or remote host
   deploy       Deploy website with atomic delta sync
+  redirects    Manage custom Caddy redirects (add|remove|import|list)
+  gc           Remove NixOS generations older than 30 days (local or --host)
+  disk-usage   Show filesystem and release disk usage (local or --host)
+  logs         Show Caddy, nixos-rebuild or deploy logs (local or --host)
+  remote-exec  Run one command on a remote host, exiting with its status
+  add-key      Authorize an SSH key on one or more servers and rebuild
+  remove-key   Remove an SSH key by fingerprint from one or more servers
+  diagnose     Run troubleshooting checks (local or --host), exiting with the failure count
   version      Show version
   help         Show this help message
 
+Global Options:
+  --no-color           Disable colored output (also off when NO_COLOR is set,
+                       TERM=dumb, or output is not a terminal)
+  --log-file=PATH      Log file for bootstrap, install, wizard, upgrade,
+                       redirects, gc, add-key and remove-key
+                       (default: /var/log/juniper-host.log)
+
 Bootstrap Options:
   --disk=DEVICE        Target disk (auto-detects if not specified)
-  --ssh-key=KEY        SSH public key (prompts if not specified)
-  --ssh-key-file=PATH  Path to SSH public key file (e.g., ~/.ssh/id_ed25519.pub)
+  --ssh-key=KEY        SSH public key, repeatable (prompts if not specified)
+  --ssh-keys-file=PATH Path to SSH public key or authorized_keys file (all keys installed)
+  --github-user=NAME   Install the SSH keys from github.com/NAME.keys
+  --gitlab-user=NAME   Install the SSH keys from gitlab.com/NAME.keys
   --yes                Skip all confirmation prompts
   --enthusiastic-yes   Auto-detect disk, skip confirmations, only prompt for SSH key
+  --answers=PATH       TOML file of prompt answers (for runs without a terminal)
+  --config-sha256=HEX  Expected SHA-256 of configuration.nix (also for install)
+  --insecure-skip-verify  Skip the configuration.nix signature check (also for install)
+  --config-file=PATH   Install a local configuration.nix, no download (also for install)
+  --config-url=URL     Download configuration.nix from a mirror (also for install)
+  --force              With --yes, erase a disk that already holds data
+  --swap-size=SIZE     Swap partition size, e.g. 2G (0 for none)
+  --zram               Enable compressed swap in RAM (zram)
+  --substituter=URL    Binary cache mirror tried before cache.nixos.org (repeatable)
+  --trusted-public-key=KEY  Signing key of a --substituter cache (repeatable)
+  --filesystem=FS      Root filesystem: ext4 (default) or btrfs with subvolumes
+  --boot=MODE          Partition layout: auto (default), hybrid or uefi (no bios_grub)
+  --encrypt            Encrypt the root partition with LUKS2
+  --keyfile=PATH       With --encrypt, read the passphrase from PATH
+  --hostname=NAME      Hostname for the installed system
+  --timezone=TZ        Time zone, e.g. Europe/Berlin (default UTC)
+  --domain=DOMAIN      Site domain, pre-filled in the setup wizard
+  --ip=CIDR[,CIDR]     Static IPv4 and/or IPv6 address(es) instead of DHCP
+  --gateway=IP[,IP]    With --ip, default gateway(s)
+  --dns=IP[,IP]        With --ip, DNS servers (default 1.1.1.1,9.9.9.9)
+  --interface=NAME     With --ip, network interface (auto-detected)
+  --verify-before-reboot  Dry-build the installed configuration before rebooting
+  --min-disk-gb=N      Refuse disks smaller than N GB (default 15, 0 disables)
+  --dry-run            Print the disk, commands and configuration changes, then exit
+  --no-reboot          Leave /mnt mounted instead of rebooting at the end
+  --min-rsa-bits=N     Warn about RSA SSH keys shorter than N bits (default: 3072)
+
+Wizard Commands:
+  wizard restore-config  List configuration backups and restore one
+  wizard auto-deploy     Enable, change, or disable the scheduled site deploy
+
+Install Options:
+  --disk=DEVICE        GRUB boot device to write into configuration.nix
+  --ssh-key, --ssh-keys-file, --github-user, --gitlab-user
+                       SSH keys to authorize, as for bootstrap
+
+Wizard Options:
+  --yes                Without a terminal, accept defaults and answer yes
+  --answers=PATH       TOML file of prompt answers (for runs without a terminal)
+
+Redirects Commands:
+  redirects list                       Show configured redirects
+  redirects add FROM TO [STATUS]       Add or replace a redirect (default status 301)
+  redirects remove FROM                Remove a redirect
+  redirects import PATH                Merge the rules of a Netlify _redirects file
 
 Upgrade Options:
-  --host=HOST          Remote host (e.g., root@server or root@192.168.1.1)
+  --host=HOST          Remote host (e.g., root@server or root@192.168.1.1);
+                       repeat to upgrade several hosts
+  --hosts-file=PATH    Hosts to upgrade, one per line: HOST [IDENTITY_FILE]
+  --concurrency=N      Hosts upgraded at once (default: 4)
+  --serial             One host at a time, stopping at the first failure
   -i PATH              SSH identity file (optional)
   --yes                Skip confirmation prompts
   --config-only        Only update configuration, don't rebuild NixOS
+  --answers=PATH       TOML file of prompt answers (for runs without a terminal)
+  --config-sha256=HEX  Expected SHA-256 of configuration.nix
+  --insecure-skip-verify  Skip the configuration.nix signature check
+  --ref=REF            Tag, branch or commit to install (default: main)
+  --gc, --gc-after-upgrade  Remove generations older than 30 days after rebuilding
+                       and report the space reclaimed
+  --gc-keep=N          Collect garbage keeping the newest N system generations
+                       instead of those from the last 30 days
+  --auto-restore       Restore the previous configuration if checks fail after rebuilding
+  --reboot-if-needed   Schedule a reboot when the rebuild changed the kernel or initrd
+  --reboot-delay=DUR   Time before that reboot (default: 5m, 0 reboots at once)
+  --diff-only          Preview configuration changes and exit (0: none, 2: changes)
+  --check              Report whether an update is available, changing nothing
+                       (0: up to date, 10: update available, 1: error)
+  --rollback           Restore the configuration from before the last upgrade,
+                       rebuild, and check sshd and caddy are running
+  --install-timer=WHEN Upgrade unattended with --yes --gc on a systemd timer:
+                       daily, weekly or OnCalendar=EXPR
+  --remove-timer       Remove the unattended upgrade timer
+
+GC Options:
+  --host=HOST          Remote host (omit when running on the server itself)
+  -i PATH              SSH identity file (optional)
+
+Disk Usage Options:
+  --host=HOST          Remote host (omit when running on the server itself)
+  -i PATH              SSH identity file (optional)
+  --threshold=N        Exit 1 if any filesystem is more than N% full (for cron)
+
+Logs Options:
+  --host=HOST          Remote host (omit when running on the server itself)
+  -i PATH              SSH identity file (optional)
+  --service=NAME       caddy (default), nixos-rebuild or deploy
+  --lines=N            Number of lines to show (default: 50)
+  --follow             Keep printing new lines until Ctrl+C
+
+Remote Exec Options:
+  remote-exec [options] HOST COMMAND [ARGS...]
+  --host=HOST          Remote host, instead of the first argument
+  -i PATH              SSH identity file (optional)
+  --timeout=DURATION   Stop the command after DURATION, e.g. 30s (exits 124)
+  --no-tty             Do not allocate a remote terminal
+
+Diagnose Options:
+  --host=HOST          Remote host (omit when running on the server itself)
+  -i PATH              SSH identity file (optional)
+  --domain=DOMAIN      Domain whose TLS certificate is checked (default: from the Caddyfile)
+  --fix                Resolve fixable problems (abandoned deploy staging directories)
+
+SSH Key Options (add-key, remove-key):
+  --host=HOST          Remote host, repeatable (omit on the server itself)
+  -i PATH              SSH identity file (optional)
+  --user=LIST          Comma-separated users to change (default: deploy,root)
+  --key=KEY            add-key: SSH public key to authorize (no-op if present)
+  --fingerprint=FP     remove-key: SHA256 fingerprint of the key (ssh-keygen -lf)
 
 Examples:
   # Auto-detect disk, prompt for SSH key
@@ -87,7 +260,7 @@ Examples:
   juniper-host bootstrap --enthusiastic-yes
 
   # Use SSH key from file
-  juniper-host bootstrap --enthusiastic-yes --ssh-key-file=~/.ssh/id_ed25519.pub
+  juniper-host bootstrap --enthusiastic-yes --ssh-keys-file=~/.ssh/id_ed25519.pub
 
   # Specify disk and SSH key inline
   juniper-host bootstrap --disk=/dev/vda --ssh-key="ssh-ed25519 AAAA..."
@@ -101,12 +274,35 @@ Examples:
   # Upgrade local NixOS (run on the server itself)
   juniper-host upgrade
 
+  # Upgrade three servers, one at a time
+  juniper-host upgrade --serial --host=root@web1 --host=root@web2 --host=root@web3
+
+  # Install exactly the configuration tagged v1.2.3
+  juniper-host upgrade --ref=v1.2.3 --host=root@your-server
+
+  # Undo the last upgrade of a remote server
+  juniper-host upgrade --rollback --host=root@your-server
+
+  # Upgrade a remote server unattended every Sunday at 03:00
+  juniper-host upgrade --install-timer="OnCalendar=Sun 03:00" --host=root@your-server
+
+  # Restart Caddy on a remote server
+  juniper-host remote-exec root@your-server systemctl restart caddy
+
+  # Give a new team member access to two servers
+  juniper-host add-key --host=root@web1 --host=root@web2 --key="ssh-ed25519 AAAA... alice"
+
 Deploy Options:
   --config=PATH        Path to deploy.toml (default: deploy.toml)
   --release=ID         Release ID (default: auto-generated timestamp-hash)
   --dry-run            Show what would be deployed without deploying
   --full               Upload all files instead of delta
   --no-build           Skip Hugo build (use existing public/ directory)
+  --file-mode=MODE     Octal mode for deployed files (local targets, e.g. 0644)
+  --dir-mode=MODE      Octal mode for deployed directories (local targets, e.g. 0755)
+  --follow-symlinks    Deploy symlink targets as regular files instead of links
+  --skip-readiness-check  Skip checking the target is reachable before building
+  --no-interactive     Never show the interactive rollback picker
 
 Deploy Examples:
   # Deploy to local releases directory
@@ -13,14 +13,14 @@
 
   # TLS Mode Options:
   #   1 = ACME HTTP-01 (requires DNS pointing directly to server)
-  #   2 = ACME DNS-01 via Cloudflare (works behind proxy, requires API token)
+  #   2 = ACME DNS-01 via DNS provider API (works behind proxy, requires API credentials)
   #   3 = Custom certificate (provide cert/key paths)
   #   4 = HTTP only (no TLS, for localhost/testing)
   #   5 = Self-signed (default, works everywhere, browser warning)
   #
   # TLS_MODE = "5";
   # TLS_DOMAIN = "juniperbible.org";
-  # TLS_CF_API_TOKEN = "";  # For mode 2 only
+  # DNS credentials for mode 2 live in /var/lib/caddy/dns.env
   # TLS_CERT_PATH = "";     # For mode 3 only
   # TLS_KEY_PATH = "";      # For mode 3 only
 
@@ -106,6 +106,9 @@
     configFile = "/var/lib/caddy/Caddyfile";
   };
 
+  # DNS-01 provider credentials written by the setup wizard (optional file)
+  systemd.services.caddy.serviceConfig.EnvironmentFile = "-/var/lib/caddy/dns.env";
+
   # Create default Caddyfile in writable location
   # This file can be modified by the setup wizard
   systemd.tmpfiles.rules = [
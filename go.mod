@@ -5,4 +5,8 @@ go 1.26.0
 require (
 	github.com/BurntSushi/toml v1.3.2
 	github.com/ulikunitz/xz v0.5.11
+	golang.org/x/crypto v0.54.0
+	golang.org/x/term v0.46.0
 )
+
+require golang.org/x/sys v0.48.0 // indirect
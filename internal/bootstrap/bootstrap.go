@@ -4,234 +4,444 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
 )
 
+// Timeouts for disk preparation commands, which can hang on a busy or failing device
+const (
+	partedTimeout = time.Minute
+	settleTimeout = 2 * time.Minute
+	mkfsTimeout   = 10 * time.Minute
+	mountTimeout  = time.Minute
+)
+
 // bootstrapFlags holds all command line flags for bootstrap
 type bootstrapFlags struct {
 	disk            string
-	sshKey          string
-	sshKeyFile      string
+	sshKeys         common.StringList
+	sshKeysFile     string
+	githubUser      string
+	gitlabUser      string
 	yes             bool
 	enthusiasticYes bool
+	answers         string
+	configSHA256    string
+	configFile      string
+	configURL       string
+	skipVerify      bool
+	force           bool
+	swapSize        string
+	zram            bool
+	verifyReboot    bool
+	noReboot        bool
+	dryRun          bool
+	minDiskGB       int
+	encrypt         bool
+	keyfile         string
+	filesystem      string
+	boot            string
+	ip              string
+	gateway         string
+	dns             string
+	iface           string
+	hostname        string
+	timezone        string
+	domain          string
+
+	configSource common.ConfigSource // From --config-file/--config-url
+	stagedConfig []byte              // Custom configuration read and checked before erasing
+	caches       *binaryCaches       // From --substituter/--trusted-public-key; nil for none
+}
+
+// diskLayout describes how bootstrap partitions and formats the target disk
+type diskLayout struct {
+	swapMiB    int    // Swap partition size; 0 for none
+	passphrase string // LUKS passphrase; empty leaves the root unencrypted
+	filesystem string // Root filesystem: ext4 or btrfs
+	uefiOnly   bool   // ESP + root without bios_grub, booting with systemd-boot
 }
 
 // parseFlags parses command line arguments and returns bootstrapFlags
 func parseFlags(args []string) bootstrapFlags {
 	fs := flag.NewFlagSet("bootstrap", flag.ExitOnError)
 	disk := fs.String("disk", "", "Target disk (auto-detect if not specified)")
-	sshKey := fs.String("ssh-key", "", "SSH public key")
-	sshKeyFile := fs.String("ssh-key-file", "", "Path to SSH public key file")
+	var sshKeys common.StringList
+	fs.Var(&sshKeys, "ssh-key", "SSH public key (repeat for several keys)")
+	var substituters, trustedKeys common.StringList
+	fs.Var(&substituters, "substituter", "Binary cache mirror (https URL) tried before cache.nixos.org (repeatable)")
+	fs.Var(&trustedKeys, "trusted-public-key", "Public key signing a --substituter's cache, name:base64 (repeatable)")
+	sshKeysFile := fs.String("ssh-keys-file", "", "Path to an SSH public key or authorized_keys file (every key is installed)")
+	fs.StringVar(sshKeysFile, "ssh-key-file", "", "Deprecated alias for --ssh-keys-file")
+	githubUser := fs.String("github-user", "", "Install the SSH keys published at https://github.com/NAME.keys")
+	gitlabUser := fs.String("gitlab-user", "", "Install the SSH keys published at https://gitlab.com/NAME.keys")
 	yes := fs.Bool("yes", false, "Skip confirmation prompts")
 	enthusiasticYes := fs.Bool("enthusiastic-yes", false, "Auto-detect everything, only prompt for SSH key if not provided")
+	answers := fs.String("answers", "", "TOML file of prompt answers for runs without a terminal")
+	configSHA256 := fs.String("config-sha256", "", "Expected SHA-256 of configuration.nix")
+	configFile := fs.String("config-file", "", "Install this local configuration.nix instead of downloading it (offline installs)")
+	configURL := fs.String("config-url", "", "Download configuration.nix from this URL (e.g. an internal mirror)")
+	skipVerify := fs.Bool("insecure-skip-verify", false, "Do not verify the configuration.nix signature (unsafe)")
+	swapSize := fs.String("swap-size", "", "Swap partition size, e.g. 2G (0 for none; prompts if not specified)")
+	zram := fs.Bool("zram", false, "Enable compressed swap in RAM (zram) in configuration.nix")
+	boot := fs.String("boot", bootAuto, "Partition layout: auto, hybrid (BIOS+UEFI GRUB) or uefi (systemd-boot, no bios_grub)")
+	filesystem := fs.String("filesystem", filesystemExt4, "Root filesystem: ext4 or btrfs (subvolumes @, @home, @var with zstd compression)")
+	encrypt := fs.Bool("encrypt", false, "Encrypt the root partition with LUKS (passphrase needed at every boot)")
+	keyfile := fs.String("keyfile", "", "With --encrypt, read the passphrase from this file instead of prompting")
+	hostname := fs.String("hostname", "", "Hostname for the installed system (the setup wizard skips this step)")
+	timezone := fs.String("timezone", "", "Time zone for the installed system, e.g. Europe/Berlin (default UTC)")
+	domain := fs.String("domain", "", "Site domain, pre-filled in the setup wizard after first boot")
+	ip := fs.String("ip", "", "Static address(es) in CIDR form, comma separated (IPv4 and/or IPv6)")
+	gateway := fs.String("gateway", "", "With --ip, default gateway(s): one IPv4 and/or one IPv6")
+	dns := fs.String("dns", "", "With --ip, DNS server(s), comma separated (default "+defaultNameservers+")")
+	iface := fs.String("interface", "", "With --ip, network interface (auto-detect if not specified)")
+	verifyReboot := fs.Bool("verify-before-reboot", false, "Check the installed configuration with nixos-rebuild dry-build before rebooting")
+	minDiskGB := fs.Int("min-disk-gb", defaultMinDiskGB, "Refuse disks smaller than N GB (0 disables the check)")
+	dryRun := fs.Bool("dry-run", false, "Print the disk, commands and configuration changes, then exit without changing anything")
+	noReboot := fs.Bool("no-reboot", false, "Leave /mnt mounted and do not reboot when installation finishes")
+	minRSABits := fs.Int("min-rsa-bits", common.DefaultMinRSABits, "Warn about RSA SSH keys shorter than this (0 disables)")
+	force := fs.Bool("force", false, "With --yes, erase a disk that already holds partitions or filesystems without typing its name")
 	if err := fs.Parse(args); err != nil {
 		common.Error(fmt.Sprintf("Failed to parse arguments: %v", err))
-		os.Exit(1)
+		common.Exit(1)
 	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "ssh-key-file" {
+			common.Warning("--ssh-key-file is deprecated; use --ssh-keys-file")
+		}
+	})
 
 	flags := bootstrapFlags{
 		disk:            *disk,
-		sshKey:          *sshKey,
-		sshKeyFile:      *sshKeyFile,
+		sshKeys:         sshKeys,
+		sshKeysFile:     *sshKeysFile,
+		githubUser:      *githubUser,
+		gitlabUser:      *gitlabUser,
 		yes:             *yes,
 		enthusiasticYes: *enthusiasticYes,
+		answers:         *answers,
+		configSHA256:    *configSHA256,
+		configFile:      *configFile,
+		configURL:       *configURL,
+		skipVerify:      *skipVerify,
+		force:           *force,
+		swapSize:        *swapSize,
+		zram:            *zram,
+		verifyReboot:    *verifyReboot,
+		noReboot:        *noReboot,
+		dryRun:          *dryRun,
+		minDiskGB:       *minDiskGB,
+		encrypt:         *encrypt,
+		keyfile:         *keyfile,
+		filesystem:      *filesystem,
+		boot:            *boot,
+		ip:              *ip,
+		gateway:         *gateway,
+		dns:             *dns,
+		iface:           *iface,
+		hostname:        *hostname,
+		timezone:        *timezone,
+		domain:          *domain,
+	}
+
+	if !isValidFilesystem(flags.filesystem) {
+		common.Error(fmt.Sprintf("Unsupported filesystem %q (use ext4 or btrfs)", flags.filesystem))
+		common.Exit(1)
+	}
+
+	source, err := common.NewConfigSource(flags.configFile, flags.configURL)
+	if err != nil {
+		common.Error(err.Error())
+		common.Exit(1)
+	}
+	flags.configSource = source
+	if flags.caches, err = parseBinaryCaches(substituters, trustedKeys); err != nil {
+		common.Error(err.Error())
+		common.Exit(1)
+	}
+
+	if !isValidBootMode(flags.boot) {
+		common.Error(fmt.Sprintf("Unsupported boot layout %q (use auto, hybrid or uefi)", flags.boot))
+		common.Exit(1)
+	}
+
+	if flags.hostname != "" && !common.IsValidHostname(flags.hostname) {
+		common.Error(fmt.Sprintf("Invalid --hostname %q. Use alphanumerics and hyphens only (1-63 chars).", flags.hostname))
+		common.Exit(1)
+	}
+	if flags.domain != "" && !common.IsValidDomain(flags.domain) {
+		common.Error(fmt.Sprintf("Invalid --domain %q. Use alphanumerics, hyphens, and dots only.", flags.domain))
+		common.Exit(1)
+	}
+	if flags.timezone != "" && !common.IsValidTimeZone(flags.timezone) {
+		common.Error(fmt.Sprintf("Invalid --timezone %q (expected a name such as UTC or Europe/Berlin)", flags.timezone))
+		common.Exit(1)
 	}
 
 	// --enthusiastic-yes implies --yes for disk confirmation
 	if flags.enthusiasticYes {
 		flags.yes = true
 	}
+	common.ApplyInputFlags(flags.yes, flags.answers)
+	common.SetMinRSABits(*minRSABits)
 
 	return flags
 }
 
-// findFirstValidKey finds the first non-comment, non-empty line
-func findFirstValidKey(content string) (string, error) {
-	for _, line := range strings.Split(content, "\n") {
-		line = strings.TrimSpace(line)
-		if line != "" && !strings.HasPrefix(line, "#") {
-			return line, nil
+// listTargetDisks returns the disks that may be installed to, excluding the
+// one the live system is running from
+func listTargetDisks() []common.DiskCandidate {
+	disks, err := common.ListDisks()
+	if err != nil {
+		common.Error(fmt.Sprintf("Failed to list disks: %v", err))
+		common.Exit(1)
+	}
+	var candidates []common.DiskCandidate
+	for _, d := range disks {
+		if d.Live {
+			common.Info(fmt.Sprintf("Skipping %s (live system is running from it)", d.Path))
+			continue
 		}
+		candidates = append(candidates, d)
+	}
+	if len(candidates) == 0 {
+		common.Error("Could not detect disk")
+		fmt.Println("Please specify: juniper-host bootstrap --disk=/dev/sdX")
+		common.Exit(1)
 	}
-	return "", fmt.Errorf("no valid SSH key found in file")
+	return candidates
 }
 
-// readSSHKeyFromFile reads and validates an SSH key from a file
-func readSSHKeyFromFile(path string) (string, error) {
-	if strings.Contains(path, "..") {
-		return "", fmt.Errorf("SSH key file path cannot contain '..'")
+// printDiskCandidates lists disks with their sizes in a numbered menu
+func printDiskCandidates(disks []common.DiskCandidate) {
+	fmt.Println("Available disks:")
+	for i, d := range disks {
+		fmt.Printf("  %d) %s\n", i+1, d.Describe())
 	}
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return "", fmt.Errorf("failed to read SSH key file: %w", err)
+	fmt.Println()
+}
+
+// autoSelectDisk picks the only non-removable disk for --yes and non-interactive
+// runs, refusing to guess when there is more than one
+func autoSelectDisk(disks []common.DiskCandidate) string {
+	var fixed []common.DiskCandidate
+	for _, d := range disks {
+		if !d.Removable {
+			fixed = append(fixed, d)
+		}
+	}
+	if len(fixed) == 1 && !fixed[0].Mounted {
+		common.Info(fmt.Sprintf("Detected disk: %s", fixed[0].Describe()))
+		return fixed[0].Path
+	}
+
+	printDiskCandidates(disks)
+	switch {
+	case len(fixed) > 1:
+		common.Error("More than one disk found; refusing to pick one automatically")
+	case len(fixed) == 1:
+		common.Error(fmt.Sprintf("%s has mounted filesystems; refusing to pick it automatically", fixed[0].Path))
+	default:
+		common.Error("Only removable disks found; refusing to pick one automatically")
+	}
+	fmt.Println("Please specify: juniper-host bootstrap --disk=/dev/sdX")
+	common.Exit(1)
+	return ""
+}
+
+// promptForDisk shows a numbered list of disks and asks which one to install to
+func promptForDisk(disks []common.DiskCandidate) string {
+	fmt.Println()
+	printDiskCandidates(disks)
+	def := 1
+	for i, d := range disks {
+		if !d.Removable && !d.Mounted {
+			def = i + 1
+			break
+		}
 	}
-	keyStr := strings.TrimSpace(string(data))
-	if keyStr == "" {
-		return "", fmt.Errorf("SSH key file is empty")
+	const maxRetries = 3
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		answer := common.Prompt("Install to disk", strconv.Itoa(def))
+		n, err := strconv.Atoi(answer)
+		if err == nil && n >= 1 && n <= len(disks) {
+			return disks[n-1].Path
+		}
+		common.Error(fmt.Sprintf("Enter a number from 1 to %d", len(disks)))
+	}
+	common.Error("No disk selected")
+	common.Exit(1)
+	return ""
+}
+
+// selectDisk enumerates disks and lets the user choose one, or picks the only
+// candidate with --yes
+func selectDisk(yes bool) string {
+	disks := listTargetDisks()
+	if yes || !common.IsInteractive() {
+		return autoSelectDisk(disks)
 	}
-	return findFirstValidKey(keyStr)
+	return promptForDisk(disks)
 }
 
 // validateAndDetectDisk validates disk path or auto-detects it
-func validateAndDetectDisk(diskFlag string) string {
+func validateAndDetectDisk(diskFlag string, yes bool) string {
 	targetDisk := diskFlag
 	if targetDisk == "" {
-		targetDisk = common.DetectDisk()
-		if targetDisk == "" {
-			common.Error("Could not detect disk")
-			fmt.Println("Please specify: juniper-host bootstrap --disk=/dev/sdX")
-			os.Exit(1)
-		}
+		targetDisk = selectDisk(yes)
 	}
 
 	if !common.BlockDeviceExists(targetDisk) {
 		common.Error(fmt.Sprintf("Disk not found: %s", targetDisk))
-		os.Exit(1)
+		common.Exit(1)
 	}
 
 	if !common.IsValidDiskPath(targetDisk) {
 		common.Error(fmt.Sprintf("Invalid disk path format: %s", targetDisk))
-		fmt.Println("Expected format: /dev/vda, /dev/sda, /dev/nvme0n1, etc.")
-		os.Exit(1)
+		fmt.Println("Expected format: /dev/vda, /dev/sda, /dev/nvme0n1, /dev/mmcblk0, /dev/disk/by-id/..., etc.")
+		common.Exit(1)
+	}
+
+	if common.IsLiveSystemDisk(targetDisk) {
+		common.Error(fmt.Sprintf("%s is the disk the live system is running from", targetDisk))
+		common.Exit(1)
 	}
 
 	return targetDisk
 }
 
-// promptForSSHKey prompts user for SSH key if not provided
-func promptForSSHKey(existingKey string) string {
-	if existingKey != "" {
-		return existingKey
+// promptForSSHKey prompts user for SSH key if none was provided
+func promptForSSHKey(existingKeys []string) []string {
+	if len(existingKeys) > 0 {
+		return existingKeys
 	}
 	fmt.Println()
 	const maxKeyRetries = 5
 	for attempt := 0; attempt < maxKeyRetries; attempt++ {
 		key := common.Prompt("Enter your SSH public key (ssh-ed25519 or ssh-rsa)", "")
 		if key != "" {
-			return key
+			return []string{key}
 		}
 		if attempt < maxKeyRetries-1 {
 			common.Warning("No SSH key entered. You may be locked out without one.")
 		}
 	}
 	common.Warning("No SSH key provided. Continuing without SSH key.")
-	return ""
+	return nil
 }
 
-// configureSSHKey validates and injects the SSH key into configuration
-func configureSSHKey(key string) {
-	if key == "" {
+// configureSSHKey validates and injects the SSH keys into configuration
+func configureSSHKey(keys []string) {
+	if len(keys) == 0 {
 		return
 	}
-	if !common.IsValidSSHKey(key) {
-		common.Warning("SSH key failed validation (invalid format). Continuing without SSH key.")
+	valid := common.UsableSSHKeys(keys)
+	if len(valid) == 0 {
+		common.Warning("No valid SSH key. Continuing without SSH key.")
 		common.Warning("You may be locked out of the server!")
 		return
 	}
-	if err := injectSSHKey(key); err != nil {
+	if err := injectSSHKey(valid); err != nil {
 		common.Error(fmt.Sprintf("CRITICAL: Failed to inject SSH key: %v", err))
 		fmt.Println("\nWithout an SSH key, you will be LOCKED OUT of your server!")
 		fmt.Println("You must fix this issue before proceeding.")
-		os.Exit(1)
+		common.Exit(1)
 	}
-	common.Success("SSH key configured for deploy and root users")
-}
-
-// prepareFilesystems partitions, formats, and mounts the disk
-func prepareFilesystems(targetDisk string) {
-	_, espPart, rootPart := common.GetPartitions(targetDisk)
-
-	common.Info("Partitioning disk...")
-	if err := partition(targetDisk); err != nil {
-		common.Error(fmt.Sprintf("Partitioning failed: %v", err))
-		os.Exit(1)
-	}
-	time.Sleep(2 * time.Second)
-
-	common.Info("Formatting partitions...")
-	if err := format(espPart, rootPart); err != nil {
-		common.Error(fmt.Sprintf("Formatting failed: %v", err))
-		os.Exit(1)
+	common.Success(fmt.Sprintf("%d SSH key(s) configured for deploy and root users", len(valid)))
+	for _, key := range valid {
+		fmt.Printf("    %s\n", common.DescribeSSHKey(key))
 	}
+}
 
-	common.Info("Waiting for disk labels...")
-	if err := common.RunQuiet("udevadm", "settle"); err != nil {
-		common.Warning(fmt.Sprintf("udevadm settle returned error: %v (continuing anyway)", err))
-	}
-	time.Sleep(2 * time.Second)
-
-	common.Info("Mounting filesystems...")
-	if err := mount(espPart, rootPart); err != nil {
-		common.Error(fmt.Sprintf("Mount failed: %v", err))
-		os.Exit(1)
-	}
+// prepareFilesystems partitions, formats, and mounts the disk as described by layout
+func prepareFilesystems(targetDisk string, layout diskLayout) {
+	runDiskSteps(planFilesystems(targetDisk, layout))
 }
 
 // downloadAndConfigureNixOS downloads config and generates hardware config
-func downloadAndConfigureNixOS(targetDisk string) {
-	common.Info("Generating hardware configuration...")
-	if err := common.Run("nixos-generate-config", "--root", "/mnt"); err != nil {
-		common.Error(fmt.Sprintf("Failed to generate hardware config: %v", err))
-		os.Exit(1)
-	}
-
-	common.Info("Downloading configuration...")
-	configURL := common.RepoBase + "/configuration.nix"
-	if err := common.DownloadFile(configURL, "/mnt/etc/nixos/configuration.nix"); err != nil {
-		common.Error(fmt.Sprintf("Failed to download configuration: %v", err))
-		os.Exit(1)
-	}
-
-	common.Info("Configuring bootloader for " + targetDisk + "...")
-	if err := injectBootDevice(targetDisk); err != nil {
-		common.Warning(fmt.Sprintf("Failed to configure bootloader: %v", err))
-	} else {
-		common.Success("Bootloader configured for " + targetDisk)
-	}
+func downloadAndConfigureNixOS(targetDisk string, layout diskLayout, flags bootstrapFlags, network *staticNetwork) {
+	runConfigSteps(planConfiguration(targetDisk, layout, flags, network))
 }
 
 // installNixOS runs the NixOS installation
-func installNixOS() {
+func installNixOS(caches *binaryCaches) {
 	fmt.Println()
 	common.Info("Installing NixOS...")
 	common.Warning("This takes 10-30 minutes on VPS (downloading packages from cache.nixos.org)")
 	common.Info("Progress dots will appear every 5 seconds. Do NOT interrupt.")
 	fmt.Println()
-	if err := common.RunWithProgress("nixos-install", "--no-root-passwd"); err != nil {
+	args := append([]string{"--no-root-passwd"}, caches.installArgs()...)
+	if err := common.RunWithProgress("nixos-install", args...); err != nil {
 		common.Error(fmt.Sprintf("Installation failed: %v", err))
-		os.Exit(1)
+		common.Exit(1)
 	}
 }
 
-// resolveSSHKey gets SSH key from flags or file
-func resolveSSHKey(flags bootstrapFlags) string {
-	if flags.sshKeyFile != "" && flags.sshKey == "" {
-		key, err := readSSHKeyFromFile(flags.sshKeyFile)
-		if err != nil {
-			common.Error(err.Error())
-			os.Exit(1)
-		}
-		return key
+// resolveSSHKeys gets SSH keys from every --ssh-key, the keys file, and any
+// fetched for --github-user and --gitlab-user
+func resolveSSHKeys(flags bootstrapFlags) []string {
+	keys, err := common.SSHKeyOptions{
+		Keys:       flags.sshKeys,
+		KeysFile:   flags.sshKeysFile,
+		GitHubUser: flags.githubUser,
+		GitLabUser: flags.gitlabUser,
+	}.Resolve()
+	if err != nil {
+		common.Error(err.Error())
+		common.Exit(1)
 	}
-	return flags.sshKey
+	return keys
 }
 
-// confirmDiskErase prompts user to confirm disk erasure
-func confirmDiskErase(targetDisk string, yes bool) {
-	common.Warning(fmt.Sprintf("This will ERASE %s", targetDisk))
-	if !yes && !common.Confirm("Continue?", false) {
+// confirmDiskErase prompts user to confirm disk erasure. A disk that already
+// holds partitions or filesystems must be confirmed by typing its name, even
+// with --yes, unless --force is also given.
+func confirmDiskErase(targetDisk string, yes, force bool) {
+	contents, err := common.ProbeDisk(targetDisk)
+	if err != nil {
+		common.Warning(fmt.Sprintf("Could not inspect %s: %v", targetDisk, err))
+	}
+	if len(contents) == 0 {
+		common.Warning(fmt.Sprintf("This will ERASE %s", targetDisk))
+		if !yes && !common.Confirm("Continue?", false) {
+			fmt.Println("Aborted.")
+			os.Exit(0)
+		}
+		return
+	}
+
+	common.Warning(fmt.Sprintf("%s is not empty. This will ERASE:", targetDisk))
+	for _, c := range contents {
+		fmt.Printf("    %s\n", c.Describe())
+	}
+	fmt.Println()
+	if yes && force {
+		common.Warning("--force given; erasing without confirmation")
+		return
+	}
+	answer := common.Prompt(fmt.Sprintf("Type %s to erase it", targetDisk), "")
+	if answer != targetDisk {
 		fmt.Println("Aborted.")
-		os.Exit(0)
+		if !common.IsInteractive() {
+			fmt.Println("Pass --yes --force to erase a disk that holds data without a terminal.")
+		}
+		common.Exit(1)
 	}
 }
 
 // completeInstallation finishes installation and reboots
-func completeInstallation() {
+func completeInstallation(noReboot bool) {
+	clearBootstrapState()
 	fmt.Println()
 	common.Header("Installation complete!")
+	if noReboot {
+		fmt.Println("The new system is still mounted at /mnt for inspection.")
+		fmt.Println("Reboot when ready to boot into it.")
+		return
+	}
 	fmt.Println("Rebooting in 5 seconds... (Ctrl+C to cancel)")
 	time.Sleep(5 * time.Second)
 	if err := common.Run("reboot"); err != nil {
@@ -243,76 +453,163 @@ func completeInstallation() {
 // Run executes the bootstrap command
 func Run(args []string) {
 	flags := parseFlags(args)
-	sshKey := resolveSSHKey(flags)
+	sshKeys := resolveSSHKeys(flags)
 
-	if !common.IsRoot() {
+	if !common.IsRoot() && !flags.dryRun {
 		common.Error("Must be run as root")
 		fmt.Println("Usage: sudo juniper-host bootstrap")
-		os.Exit(1)
+		common.Exit(1)
 	}
 
-	targetDisk := validateAndDetectDisk(flags.disk)
-
 	common.Header("Juniper Bible - NixOS Bootstrap")
-	fmt.Printf("Disk: %s\n\n", targetDisk)
-
-	confirmDiskErase(targetDisk, flags.yes)
+	targetDisk := validateAndDetectDisk(flags.disk, flags.yes)
+	var state *bootstrapState
+	if !flags.dryRun {
+		state = offerResume(targetDisk)
+	}
+	var layout diskLayout
+	if state != nil {
+		layout = state.resumeLayout(&flags)
+	} else {
+		layout.uefiOnly = resolveBootMode(flags)
+	}
+	fmt.Printf("Disk: %s\n", targetDisk)
+	if flags.filesystem != filesystemExt4 {
+		fmt.Printf("Filesystem: %s\n", flags.filesystem)
+	}
+	if flags.encrypt {
+		fmt.Println("Encryption: enabled (LUKS2 root partition; passphrase required at every boot)")
+	}
+	if layout.uefiOnly {
+		fmt.Println("Boot: UEFI only (ESP + root, systemd-boot)")
+	}
+	fmt.Println()
+	if state == nil {
+		layout.swapMiB = resolveSwapSize(flags, targetDisk)
+		layout.filesystem = flags.filesystem
+		if flags.encrypt && layout.swapMiB > 0 {
+			common.Warning("The swap partition is not encrypted")
+		}
+		if flags.dryRun && flags.encrypt {
+			layout.passphrase = dryRunPassphrase
+		} else {
+			layout.passphrase = resolvePassphrase(flags)
+		}
+	}
+	network := resolveStaticNetwork(flags)
+	if network != nil {
+		fmt.Printf("Network: %s\n", network.Describe())
+	}
+	if flags.caches != nil {
+		flags.caches.probe()
+	}
+	if state == nil {
+		preflight(targetDisk, layout, flags)
+		if flags.configSource.Custom() {
+			flags.stagedConfig = stageConfig(flags, layout)
+		}
+	}
+	if flags.dryRun {
+		printDryRun(targetDisk, layout, flags, network, sshKeys)
+		return
+	}
 
-	prepareFilesystems(targetDisk)
-	downloadAndConfigureNixOS(targetDisk)
+	if state == nil {
+		confirmDiskErase(targetDisk, flags.yes, flags.force)
+		prepareFilesystems(targetDisk, layout)
+		state = newBootstrapState(targetDisk, layout)
+		state.markDone(stepFilesystems)
+	} else if err := ensureFilesystems(targetDisk, layout, state.Encrypted); err != nil {
+		common.Error(fmt.Sprintf("Cannot resume: %v", err))
+		fmt.Println("Run bootstrap again and decline resuming to start over.")
+		common.Exit(1)
+	}
 
-	sshKey = promptForSSHKey(sshKey)
-	configureSSHKey(sshKey)
+	if !state.done(stepConfigure) {
+		downloadAndConfigureNixOS(targetDisk, layout, flags, network)
+		sshKeys = promptForSSHKey(sshKeys)
+		configureSSHKey(sshKeys)
+		state.markDone(stepConfigure)
+	}
 
-	installNixOS()
-	completeInstallation()
+	if !state.done(stepInstall) {
+		installNixOS(flags.caches)
+		state.markDone(stepInstall)
+	}
+	if flags.verifyReboot {
+		verifyBeforeReboot(targetDisk)
+	}
+	completeInstallation(flags.noReboot)
 }
 
-func partition(disk string) error {
-	// Partition layout for hybrid BIOS/UEFI boot with GPT:
-	// 1. BIOS Boot Partition (1MB) - required for GRUB on GPT+BIOS
-	// 2. EFI System Partition (512MB) - for UEFI boot
-	// 3. Root partition (rest of disk)
-	cmds := [][]string{
-		{"parted", disk, "--", "mklabel", "gpt"},
-		{"parted", disk, "--", "mkpart", "bios_grub", "1MB", "2MB"},
-		{"parted", disk, "--", "set", "1", "bios_grub", "on"},
-		{"parted", disk, "--", "mkpart", "ESP", "fat32", "2MB", "514MB"},
-		{"parted", disk, "--", "set", "2", "esp", "on"},
-		{"parted", disk, "--", "mkpart", "primary", "514MB", "100%"},
-	}
-	for _, cmd := range cmds {
-		if err := common.Run(cmd[0], cmd[1:]...); err != nil {
-			return err
+// partitionCommands lays out disk for hybrid BIOS/UEFI boot with GPT:
+// 1. BIOS Boot Partition (1MB) - required for GRUB on GPT+BIOS
+// 2. EFI System Partition (512MB) - for UEFI boot
+// 3. Root partition (rest of disk)
+// 4. Swap (optional, at the end of the disk)
+// The UEFI-only layout drops the BIOS Boot Partition, so the others move up one.
+func partitionCommands(disk string, layout diskLayout) []diskCommand {
+	swapMiB := layout.swapMiB
+	rootEnd := "100%"
+	if swapMiB > 0 {
+		rootEnd = fmt.Sprintf("-%dMiB", swapMiB)
+	}
+	parted := [][]string{
+		{"mklabel", "gpt"},
+		{"mkpart", "bios_grub", "1MB", "2MB"},
+		{"set", "1", "bios_grub", "on"},
+		{"mkpart", "ESP", "fat32", "2MB", "514MB"},
+		{"set", "2", "esp", "on"},
+		{"mkpart", "primary", "514MB", rootEnd},
+	}
+	if layout.uefiOnly {
+		parted = [][]string{
+			{"mklabel", "gpt"},
+			{"mkpart", "ESP", "fat32", "1MB", "514MB"},
+			{"set", "1", "esp", "on"},
+			{"mkpart", "primary", "514MB", rootEnd},
 		}
 	}
+	if swapMiB > 0 {
+		parted = append(parted, []string{"mkpart", "swap", "linux-swap", rootEnd, "100%"})
+	}
+	var cmds []diskCommand
+	for _, args := range parted {
+		cmds = append(cmds, diskCommand{args: append([]string{"parted", disk, "--"}, args...), timeout: partedTimeout})
+	}
 	// Sync partition table to kernel
-	common.RunQuiet("partprobe", disk)
-	return nil
+	return append(cmds, diskCommand{args: []string{"partprobe", disk}, timeout: partedTimeout, quiet: true, optional: true})
 }
 
-func format(espPart, rootPart string) error {
-	// Format ESP as FAT32
-	if err := common.Run("mkfs.fat", "-F", "32", "-n", "boot", espPart); err != nil {
-		return err
+// mountCommands mounts the root filesystem at /mnt and the ESP at /mnt/boot
+func mountCommands(espPart, rootPart, filesystem string) []diskCommand {
+	var cmds []diskCommand
+	if filesystem == filesystemBtrfs {
+		cmds = btrfsMountCommands(rootPart)
+	} else {
+		cmds = []diskCommand{{args: []string{"mount", rootPart, "/mnt"}, timeout: mountTimeout}}
 	}
-	// Format root as ext4
-	return common.Run("mkfs.ext4", "-F", "-L", "nixos", rootPart)
+	return append(cmds, bootMountCommands(espPart)...)
 }
 
-func mount(espPart, rootPart string) error {
-	// Mount root partition first
-	if err := common.Run("mount", rootPart, "/mnt"); err != nil {
-		return err
-	}
-	// Create and mount boot directory
-	if err := os.MkdirAll("/mnt/boot", 0755); err != nil {
-		return err
+// bootMountCommands mounts the ESP at /mnt/boot
+func bootMountCommands(espPart string) []diskCommand {
+	return []diskCommand{
+		{args: []string{"mkdir", "-p", "/mnt/boot"}, timeout: mountTimeout},
+		{args: []string{"mount", espPart, "/mnt/boot"}, timeout: mountTimeout},
 	}
-	return common.Run("mount", espPart, "/mnt/boot")
 }
 
-func injectSSHKey(key string) error {
+// injectSSHKey authorizes keys for the deploy and root users
+func injectSSHKey(keys []string) error {
+	return common.PatchConfigFile("/mnt/etc/nixos/configuration.nix", func(content string) (string, error) {
+		return common.InjectSSHKeys(content, keys)
+	})
+}
+
+// injectSystemSettings sets the hostname and time zone in configuration.nix;
+// empty values keep the defaults
+func injectSystemSettings(hostname, timezone string) error {
 	configPath := "/mnt/etc/nixos/configuration.nix"
 	data, err := os.ReadFile(configPath)
 	if err != nil {
@@ -320,28 +617,24 @@ func injectSSHKey(key string) error {
 	}
 
 	content := string(data)
-	originalContent := content
-
-	// Escape for Nix string literals: backslashes, quotes, and $ (interpolation)
-	escapedKey := strings.ReplaceAll(key, `\`, `\\`)
-	escapedKey = strings.ReplaceAll(escapedKey, `"`, `\"`)
-	escapedKey = strings.ReplaceAll(escapedKey, `$`, `\$`)
-
-	// Replace both deploy and root user SSH key placeholders
-	old := `# "ssh-ed25519 AAAA... your-key-here"`
-	new := fmt.Sprintf(`"%s"`, escapedKey)
-	// Replace all occurrences (deploy and root users)
-	content = strings.ReplaceAll(content, old, new)
-
-	// Verify replacement occurred
-	if content == originalContent {
-		return fmt.Errorf("SSH key placeholder not found in configuration")
+	if hostname != "" {
+		if content, err = common.UpdateHostname(content, hostname); err != nil {
+			return err
+		}
+		common.Success("Hostname set to " + hostname)
+	}
+	if timezone != "" {
+		if content, err = common.UpdateTimeZone(content, timezone); err != nil {
+			return err
+		}
+		common.Success("Time zone set to " + timezone)
 	}
 
 	return os.WriteFile(configPath, []byte(content), 0600)
 }
 
-func injectBootDevice(disk string) error {
+// appendToConfig inserts snippet before the closing brace of configuration.nix
+func appendToConfig(snippet string) error {
 	configPath := "/mnt/etc/nixos/configuration.nix"
 	data, err := os.ReadFile(configPath)
 	if err != nil {
@@ -349,21 +642,19 @@ func injectBootDevice(disk string) error {
 	}
 
 	content := string(data)
-	originalContent := content
-
-	// Escape backslashes first, then quotes (order matters for Nix strings)
-	escapedDisk := strings.ReplaceAll(disk, `\`, `\\`)
-	escapedDisk = strings.ReplaceAll(escapedDisk, `"`, `\"`)
-	escapedDisk = strings.ReplaceAll(escapedDisk, `$`, `\$`)
-
-	// Replace the default /dev/vda with the actual disk
-	content = strings.Replace(content, `device = "/dev/vda";`, fmt.Sprintf(`device = "%s";`, escapedDisk), 1)
-
-	// Verify replacement occurred (only warn, don't fail - disk might already be correct)
-	if content == originalContent {
-		return fmt.Errorf("boot device placeholder '/dev/vda' not found")
+	end := strings.LastIndex(content, "}")
+	if end < 0 {
+		return fmt.Errorf("closing brace not found in configuration")
 	}
+	content = content[:end] + snippet + content[end:]
 
 	return os.WriteFile(configPath, []byte(content), 0600)
 }
 
+// injectBootDevice points GRUB at the target disk
+func injectBootDevice(disk string) error {
+	return common.PatchConfigFile("/mnt/etc/nixos/configuration.nix", func(content string) (string, error) {
+		return common.SetBootDevice(content, disk)
+	})
+}
+
@@ -0,0 +1,122 @@
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Root filesystems supported by --filesystem
+const (
+	filesystemExt4  = "ext4"
+	filesystemBtrfs = "btrfs"
+)
+
+// btrfsMountOptions are applied to every btrfs subvolume mount
+var btrfsMountOptions = []string{"compress=zstd", "noatime"}
+
+// btrfsSubvolume is a subvolume of the btrfs root and where it is mounted
+type btrfsSubvolume struct {
+	Name       string // Subvolume name, e.g. "@home"
+	MountPoint string // Mount point in the installed system, e.g. "/home"
+}
+
+// btrfsLayout lists the subvolumes created on a btrfs root, parents first
+var btrfsLayout = []btrfsSubvolume{
+	{Name: "@", MountPoint: "/"},
+	{Name: "@home", MountPoint: "/home"},
+	{Name: "@var", MountPoint: "/var"},
+}
+
+// fileSystemBlockRe matches a fileSystems."<mountpoint>" = { ... }; entry in
+// hardware-configuration.nix
+var fileSystemBlockRe = regexp.MustCompile(`(?s)fileSystems\."([^"]+)"\s*=\s*\{(.*?)\};`)
+
+// nixOptionsRe matches the options list inside a fileSystems entry
+var nixOptionsRe = regexp.MustCompile(`(?s)options\s*=\s*\[.*?\];`)
+
+// isValidFilesystem reports whether fs is a supported --filesystem value
+func isValidFilesystem(fs string) bool {
+	return fs == filesystemExt4 || fs == filesystemBtrfs
+}
+
+// subvolumeMountOptions returns the mount options for one subvolume
+func subvolumeMountOptions(sv btrfsSubvolume) []string {
+	return append([]string{"subvol=" + sv.Name}, btrfsMountOptions...)
+}
+
+// btrfsFormatCommands create a btrfs filesystem on rootPart with the
+// subvolumes in btrfsLayout, leaving it unmounted
+func btrfsFormatCommands(rootPart string) []diskCommand {
+	cmds := []diskCommand{
+		{args: []string{"mkfs.btrfs", "-f", "-L", "nixos", rootPart}, timeout: mkfsTimeout},
+		{args: []string{"mount", rootPart, "/mnt"}, timeout: mountTimeout},
+	}
+	for _, sv := range btrfsLayout {
+		cmds = append(cmds, diskCommand{args: []string{"btrfs", "subvolume", "create", filepath.Join("/mnt", sv.Name)}, timeout: mkfsTimeout, quiet: true})
+	}
+	return append(cmds, diskCommand{args: []string{"umount", "/mnt"}, timeout: mountTimeout})
+}
+
+// btrfsMountCommands mount each subvolume of rootPart under /mnt
+func btrfsMountCommands(rootPart string) []diskCommand {
+	var cmds []diskCommand
+	for _, sv := range btrfsLayout {
+		target := filepath.Join("/mnt", sv.MountPoint)
+		opts := strings.Join(subvolumeMountOptions(sv), ",")
+		cmds = append(cmds,
+			diskCommand{args: []string{"mkdir", "-p", target}, timeout: mountTimeout},
+			diskCommand{args: []string{"mount", "-o", opts, rootPart, target}, timeout: mountTimeout})
+	}
+	return cmds
+}
+
+// patchBtrfsOptions rewrites the options of the btrfs subvolume entries in
+// hardware-configuration.nix content so they carry btrfsMountOptions;
+// nixos-generate-config only records subvol=
+func patchBtrfsOptions(content string) (string, error) {
+	subvolumes := make(map[string]btrfsSubvolume)
+	for _, sv := range btrfsLayout {
+		subvolumes[sv.MountPoint] = sv
+	}
+
+	patched := 0
+	content = fileSystemBlockRe.ReplaceAllStringFunc(content, func(block string) string {
+		m := fileSystemBlockRe.FindStringSubmatch(block)
+		sv, ok := subvolumes[m[1]]
+		if !ok || !strings.Contains(m[2], `"btrfs"`) {
+			return block
+		}
+		patched++
+		quoted := make([]string, 0, len(btrfsMountOptions)+1)
+		for _, opt := range subvolumeMountOptions(sv) {
+			quoted = append(quoted, fmt.Sprintf("%q", opt))
+		}
+		options := "options = [ " + strings.Join(quoted, " ") + " ];"
+		if nixOptionsRe.MatchString(block) {
+			return nixOptionsRe.ReplaceAllLiteralString(block, options)
+		}
+		end := strings.LastIndex(block, "}")
+		return block[:end] + "  " + options + "\n    " + block[end:]
+	})
+	if patched != len(btrfsLayout) {
+		return content, fmt.Errorf("found %d of %d btrfs subvolume mounts", patched, len(btrfsLayout))
+	}
+	return content, nil
+}
+
+// patchHardwareConfig adds the btrfs mount options to the generated hardware configuration
+func patchHardwareConfig() error {
+	configPath := "/mnt/etc/nixos/hardware-configuration.nix"
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	content, err := patchBtrfsOptions(string(data))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(configPath, []byte(content), 0644)
+}
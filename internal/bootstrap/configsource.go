@@ -0,0 +1,56 @@
+package bootstrap
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// checkConfigPlaceholders confirms content has the lines bootstrap patches,
+// so a custom configuration that would install an unreachable or unbootable
+// system is rejected before the disk is erased
+func checkConfigPlaceholders(content string, layout diskLayout) error {
+	var errs []error
+	if !strings.Contains(content, "    "+common.SSHKeyPlaceholder+"\n") {
+		errs = append(errs, fmt.Errorf("SSH key placeholder %s not found", common.SSHKeyPlaceholder))
+	}
+	if layout.uefiOnly {
+		if !grubBlockRe.MatchString(content) {
+			errs = append(errs, errors.New("GRUB boot loader section not found (needed to switch to systemd-boot)"))
+		}
+	} else if !strings.Contains(content, common.BootDevicePlaceholder) {
+		errs = append(errs, fmt.Errorf("boot device placeholder %s not found", common.BootDevicePlaceholder))
+	}
+	return errors.Join(errs...)
+}
+
+// stageConfig reads the configuration from --config-file or --config-url
+// and checks its placeholders, exiting on failure
+func stageConfig(flags bootstrapFlags, layout diskLayout) []byte {
+	common.Info("Reading configuration from " + flags.configSource.String() + "...")
+	data, err := flags.configSource.Read(flags.configSHA256, flags.skipVerify)
+	if err != nil {
+		common.Error(fmt.Sprintf("Failed to read configuration: %v", err))
+		common.Exit(1)
+	}
+	if err := checkConfigPlaceholders(string(data), layout); err != nil {
+		common.Error(fmt.Sprintf("%s cannot be used: %v", flags.configSource, err))
+		fmt.Println("Start from the published configuration.nix and keep its placeholders; bootstrap fills them in.")
+		common.Exit(1)
+	}
+	common.Success("Configuration checked")
+	return data
+}
+
+// installConfig writes configuration.nix into the new system, using the
+// staged copy when there is one
+func installConfig(flags bootstrapFlags) error {
+	dest := "/mnt/etc/nixos/configuration.nix"
+	if flags.stagedConfig != nil {
+		return os.WriteFile(dest, flags.stagedConfig, 0600)
+	}
+	return flags.configSource.Install(dest, flags.configSHA256, flags.skipVerify)
+}
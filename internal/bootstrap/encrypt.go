@@ -0,0 +1,108 @@
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+const (
+	// luksName is the device-mapper name of the opened root partition
+	luksName = "cryptroot"
+
+	// luksTimeout bounds luksFormat and open, which spend seconds on key derivation
+	luksTimeout = 2 * time.Minute
+
+	// minPassphraseLength is the shortest passphrase accepted for --encrypt
+	minPassphraseLength = 8
+)
+
+// luksDevice is the opened root partition that holds the filesystem
+const luksDevice = "/dev/mapper/" + luksName
+
+// readPassphraseFile reads a LUKS passphrase from --keyfile, dropping the trailing newline
+func readPassphraseFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read keyfile: %w", err)
+	}
+	passphrase := strings.TrimRight(string(data), "\r\n")
+	if len(passphrase) < minPassphraseLength {
+		return "", fmt.Errorf("passphrase in %s must be at least %d characters", path, minPassphraseLength)
+	}
+	return passphrase, nil
+}
+
+// promptPassphrase asks for the LUKS passphrase twice with hidden input
+func promptPassphrase() string {
+	fmt.Println()
+	const maxRetries = 3
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		passphrase := common.PromptSecret("Disk encryption passphrase")
+		if len(passphrase) < minPassphraseLength {
+			common.Error(fmt.Sprintf("Passphrase must be at least %d characters.", minPassphraseLength))
+			continue
+		}
+		if common.PromptSecret("Repeat passphrase") != passphrase {
+			common.Error("Passphrases do not match.")
+			continue
+		}
+		return passphrase
+	}
+	common.Error("No passphrase set. Bootstrap cancelled.")
+	common.Exit(1)
+	return ""
+}
+
+// resolvePassphrase returns the LUKS passphrase for --encrypt, or "" when
+// encryption is off
+func resolvePassphrase(flags bootstrapFlags) string {
+	if !flags.encrypt {
+		if flags.keyfile != "" {
+			common.Error("--keyfile requires --encrypt")
+			common.Exit(1)
+		}
+		return ""
+	}
+	if flags.keyfile == "" {
+		return promptPassphrase()
+	}
+	passphrase, err := readPassphraseFile(flags.keyfile)
+	if err != nil {
+		common.Error(err.Error())
+		common.Exit(1)
+	}
+	return passphrase
+}
+
+// luksCommands encrypt the root partition and open it as luksDevice
+func luksCommands(rootPart, passphrase string) []diskCommand {
+	return []diskCommand{
+		{args: []string{"cryptsetup", "luksFormat", "--type", "luks2", "--batch-mode", "--key-file=-", rootPart}, timeout: luksTimeout, input: passphrase},
+		luksOpenCommand(rootPart, passphrase),
+	}
+}
+
+// luksOpenCommand opens the encrypted root partition as luksDevice
+func luksOpenCommand(rootPart, passphrase string) diskCommand {
+	return diskCommand{args: []string{"cryptsetup", "open", "--key-file=-", rootPart, luksName}, timeout: luksTimeout, input: passphrase}
+}
+
+// injectLUKS adds the initrd entry that unlocks the root partition at boot
+func injectLUKS(rootPart string) error {
+	uuid, err := common.RunOutput("blkid", "-s", "UUID", "-o", "value", rootPart)
+	if err != nil {
+		return fmt.Errorf("read LUKS UUID: %w", err)
+	}
+	uuid = strings.TrimSpace(uuid)
+	if uuid == "" {
+		return fmt.Errorf("no UUID found on %s", rootPart)
+	}
+	return appendToConfig(fmt.Sprintf(`
+  # Encrypted root partition (added by juniper-host bootstrap --encrypt)
+  boot.initrd.luks.devices.%q.device = "/dev/disk/by-uuid/%s";
+`, luksName, uuid))
+}
@@ -0,0 +1,149 @@
+package bootstrap
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// virtioUevents describes each virtio device the hypervisor provides
+	virtioUevents = "/sys/bus/virtio/devices/*/uevent"
+
+	// procModules lists the modules loaded in the installer's kernel
+	procModules = "/proc/modules"
+
+	// dmiSysVendor names the machine's vendor, e.g. "VMware, Inc."
+	dmiSysVendor = "/sys/class/dmi/id/sys_vendor"
+)
+
+// virtioDeviceModules maps virtio device IDs to the driver the initrd needs
+// for them: network, block and SCSI
+var virtioDeviceModules = map[int]string{
+	1: "virtio_net",
+	2: "virtio_blk",
+	8: "virtio_scsi",
+}
+
+// bootModules are loaded modules worth forcing into the initrd: storage and
+// bus drivers the root filesystem may sit behind
+var bootModules = map[string]bool{
+	"nvme":         true,
+	"virtio_pci":   true,
+	"virtio_mmio":  true,
+	"virtio_blk":   true,
+	"virtio_scsi":  true,
+	"virtio_net":   true,
+	"xen_blkfront": true,
+	"hv_vmbus":     true,
+	"hv_storvsc":   true,
+	"vmw_pvscsi":   true,
+	"mptspi":       true,
+}
+
+// vendorModules are added when the DMI system vendor starts with the key,
+// for hypervisors whose storage controller may not be loaded yet
+var vendorModules = map[string][]string{
+	"VMware":                {"vmw_pvscsi", "mptspi"},
+	"Microsoft Corporation": {"hv_vmbus", "hv_storvsc"},
+	"Xen":                   {"xen_blkfront"},
+}
+
+// detectHardwareModules returns the initrd kernel modules this machine
+// needs, from its virtio devices, the modules the installer loaded, and the
+// hypervisor vendor
+func detectHardwareModules() []string {
+	var uevents []string
+	paths, _ := filepath.Glob(virtioUevents)
+	for _, p := range paths {
+		if data, err := os.ReadFile(p); err == nil {
+			uevents = append(uevents, string(data))
+		}
+	}
+	loaded, _ := os.ReadFile(procModules)
+	vendor, _ := os.ReadFile(dmiSysVendor)
+	return hardwareModules(uevents, string(loaded), strings.TrimSpace(string(vendor)))
+}
+
+// hardwareModules picks the modules from the contents of the virtio uevent
+// files, /proc/modules and the DMI system vendor, sorted and without duplicates
+func hardwareModules(virtioUevents []string, procModules, vendor string) []string {
+	found := make(map[string]bool)
+	for _, uevent := range virtioUevents {
+		found["virtio_pci"] = true
+		if m := virtioUeventModule(uevent); m != "" {
+			found[m] = true
+		}
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(procModules))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && bootModules[fields[0]] {
+			found[fields[0]] = true
+		}
+	}
+
+	for prefix, modules := range vendorModules {
+		if strings.HasPrefix(vendor, prefix) {
+			for _, m := range modules {
+				found[m] = true
+			}
+		}
+	}
+
+	modules := make([]string, 0, len(found))
+	for m := range found {
+		modules = append(modules, m)
+	}
+	sort.Strings(modules)
+	return modules
+}
+
+// virtioUeventModule returns the driver for one virtio device from its
+// uevent: the bound DRIVER if it is one the initrd needs, otherwise the
+// driver for the hex device ID in MODALIAS (virtio:dXXXXXXXXvYYYYYYYY)
+func virtioUeventModule(uevent string) string {
+	var alias string
+	for _, line := range strings.Split(uevent, "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+		switch key {
+		case "DRIVER":
+			if bootModules[value] {
+				return value
+			}
+		case "MODALIAS":
+			alias = value
+		}
+	}
+	rest, ok := strings.CutPrefix(alias, "virtio:d")
+	if !ok || len(rest) < 8 {
+		return ""
+	}
+	id, err := strconv.ParseInt(rest[:8], 16, 32)
+	if err != nil {
+		return ""
+	}
+	return virtioDeviceModules[int(id)]
+}
+
+// hardwareModulesConfig renders the boot.initrd.kernelModules line for modules
+func hardwareModulesConfig(modules []string) string {
+	quoted := make([]string, len(modules))
+	for i, m := range modules {
+		quoted[i] = fmt.Sprintf("%q", m)
+	}
+	return fmt.Sprintf(`
+  # Initrd kernel modules for this hardware (added by juniper-host bootstrap)
+  boot.initrd.kernelModules = [ %s ];
+`, strings.Join(quoted, " "))
+}
+
+// injectHardwareModules loads modules in the initrd of the installed system
+func injectHardwareModules(modules []string) error {
+	return appendToConfig(hardwareModulesConfig(modules))
+}
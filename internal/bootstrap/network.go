@@ -0,0 +1,275 @@
+package bootstrap
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// defaultNameservers are used for a static address when --dns is not given
+const defaultNameservers = "1.1.1.1,9.9.9.9"
+
+// interfacePattern matches a Linux network interface name (IFNAMSIZ is 16)
+var interfacePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+
+// hostNameLineRe matches the networking.hostName line the static network
+// settings are inserted after
+var hostNameLineRe = regexp.MustCompile(`(?m)^([ \t]*)networking\.hostName = "[^"]*";[^\n]*\n`)
+
+// staticNetwork is a static address configuration for the installed system
+type staticNetwork struct {
+	Interface   string
+	Addresses   []*net.IPNet // IPv4 and IPv6 addresses with prefix length
+	Gateway4    net.IP
+	Gateway6    net.IP
+	Nameservers []net.IP
+}
+
+// splitList splits a comma or space separated flag value
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// isIPv4 reports whether ip is an IPv4 address
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+// parseStaticNetwork validates the --ip, --gateway, --dns and --interface values
+func parseStaticNetwork(ips, gateways, dns, iface string) (*staticNetwork, error) {
+	n := &staticNetwork{Interface: iface}
+	if !interfacePattern.MatchString(iface) {
+		return nil, fmt.Errorf("invalid interface name %q", iface)
+	}
+
+	hasIPv4, hasIPv6 := false, false
+	for _, s := range splitList(ips) {
+		ip, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q (expected CIDR, e.g. 203.0.113.10/24 or 2001:db8::10/64)", s)
+		}
+		ipNet.IP = ip
+		n.Addresses = append(n.Addresses, ipNet)
+		if isIPv4(ip) {
+			hasIPv4 = true
+		} else {
+			hasIPv6 = true
+		}
+	}
+	if len(n.Addresses) == 0 {
+		return nil, fmt.Errorf("no address given")
+	}
+
+	for _, s := range splitList(gateways) {
+		ip := net.ParseIP(s)
+		switch {
+		case ip == nil:
+			return nil, fmt.Errorf("invalid gateway %q", s)
+		case isIPv4(ip) && !hasIPv4, !isIPv4(ip) && !hasIPv6:
+			return nil, fmt.Errorf("gateway %s has no address of the same family", s)
+		case isIPv4(ip) && n.Gateway4 != nil, !isIPv4(ip) && n.Gateway6 != nil:
+			return nil, fmt.Errorf("more than one gateway of the same family as %s", s)
+		case isIPv4(ip):
+			n.Gateway4 = ip
+		default:
+			n.Gateway6 = ip
+		}
+	}
+	if n.Gateway4 == nil && n.Gateway6 == nil {
+		return nil, fmt.Errorf("a default gateway is required")
+	}
+
+	for _, s := range splitList(dns) {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid DNS server %q", s)
+		}
+		n.Nameservers = append(n.Nameservers, ip)
+	}
+	return n, nil
+}
+
+// hasDefaultRoute reports whether the live system has an IPv4 or IPv6
+// default route, which bootstrap takes as a sign that DHCP or SLAAC works
+func hasDefaultRoute() bool {
+	if data, err := os.ReadFile("/proc/net/route"); err == nil {
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) > 1 && fields[1] == "00000000" {
+				return true
+			}
+		}
+	}
+	if data, err := os.ReadFile("/proc/net/ipv6_route"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 10 && fields[0] == strings.Repeat("0", 32) && fields[1] == "00" && fields[9] != "lo" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// defaultInterface returns the first physical network interface, or "" if none
+func defaultInterface() string {
+	entries, err := os.ReadDir("/sys/class/net")
+	if err != nil {
+		return ""
+	}
+	for _, e := range entries {
+		if _, err := os.Stat("/sys/class/net/" + e.Name() + "/device"); err == nil {
+			return e.Name()
+		}
+	}
+	return ""
+}
+
+// promptStaticNetwork asks for a static address when the live system has no default route
+func promptStaticNetwork(yes bool) *staticNetwork {
+	common.Warning("No default route found; the provider may not offer DHCP")
+	if yes {
+		fmt.Println("    Pass --ip and --gateway if the installed system needs a static address.")
+		return nil
+	}
+	if !common.Confirm("Configure a static address?", true) {
+		return nil
+	}
+	const maxRetries = 3
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		iface := common.Prompt("Interface", defaultInterface())
+		ips := common.Prompt("Address(es) in CIDR form, comma separated", "")
+		gateways := common.Prompt("Gateway(s)", "")
+		dns := common.Prompt("DNS server(s)", defaultNameservers)
+		n, err := parseStaticNetwork(ips, gateways, dns, iface)
+		if err == nil {
+			return n
+		}
+		common.Error(err.Error())
+	}
+	common.Error("No valid static network configuration. Bootstrap cancelled.")
+	common.Exit(1)
+	return nil
+}
+
+// resolveStaticNetwork returns the static network configuration from the
+// flags, prompting for one when no flags were given and DHCP looks
+// unavailable; nil keeps the default DHCP setup
+func resolveStaticNetwork(flags bootstrapFlags) *staticNetwork {
+	if flags.ip == "" {
+		if flags.gateway != "" || flags.dns != "" || flags.iface != "" {
+			common.Error("--gateway, --dns and --interface require --ip")
+			common.Exit(1)
+		}
+		if hasDefaultRoute() {
+			return nil
+		}
+		return promptStaticNetwork(flags.yes)
+	}
+
+	iface := flags.iface
+	if iface == "" {
+		if iface = defaultInterface(); iface == "" {
+			common.Error("Could not detect a network interface; pass --interface")
+			common.Exit(1)
+		}
+	}
+	dns := flags.dns
+	if dns == "" {
+		dns = defaultNameservers
+	}
+	n, err := parseStaticNetwork(flags.ip, flags.gateway, dns, iface)
+	if err != nil {
+		common.Error(fmt.Sprintf("Invalid static network configuration: %v", err))
+		common.Exit(1)
+	}
+	return n
+}
+
+// Describe returns a one-line summary of the static network configuration
+func (n *staticNetwork) Describe() string {
+	addrs := make([]string, len(n.Addresses))
+	for i, a := range n.Addresses {
+		addrs[i] = a.String()
+	}
+	gateways := []string{}
+	for _, gw := range []net.IP{n.Gateway4, n.Gateway6} {
+		if gw != nil {
+			gateways = append(gateways, gw.String())
+		}
+	}
+	return fmt.Sprintf("%s %s via %s", n.Interface, strings.Join(addrs, ", "), strings.Join(gateways, ", "))
+}
+
+// nixConfig renders the networking.* settings for configuration.nix
+func (n *staticNetwork) nixConfig(indent string) string {
+	var v4, v6 []string
+	for _, a := range n.Addresses {
+		prefix, _ := a.Mask.Size()
+		entry := fmt.Sprintf(`{ address = "%s"; prefixLength = %d; }`, a.IP, prefix)
+		if isIPv4(a.IP) {
+			v4 = append(v4, entry)
+		} else {
+			v6 = append(v6, entry)
+		}
+	}
+
+	var b strings.Builder
+	line := func(format string, args ...any) {
+		fmt.Fprintf(&b, indent+format+"\n", args...)
+	}
+	line("# Static network (added by juniper-host bootstrap --ip)")
+	line("networking.useDHCP = false;")
+	line("networking.interfaces.%q = {", n.Interface)
+	if len(v4) > 0 {
+		line("  ipv4.addresses = [ %s ];", strings.Join(v4, " "))
+	}
+	if len(v6) > 0 {
+		line("  ipv6.addresses = [ %s ];", strings.Join(v6, " "))
+	}
+	line("};")
+	if n.Gateway4 != nil {
+		line("networking.defaultGateway = { address = %q; interface = %q; };", n.Gateway4.String(), n.Interface)
+	}
+	if n.Gateway6 != nil {
+		line("networking.defaultGateway6 = { address = %q; interface = %q; };", n.Gateway6.String(), n.Interface)
+	}
+	if len(n.Nameservers) > 0 {
+		quoted := make([]string, len(n.Nameservers))
+		for i, ns := range n.Nameservers {
+			quoted[i] = fmt.Sprintf("%q", ns.String())
+		}
+		line("networking.nameservers = [ %s ];", strings.Join(quoted, " "))
+	}
+	return b.String()
+}
+
+// injectStaticNetwork writes the static network settings into
+// configuration.nix after networking.hostName
+func injectStaticNetwork(n *staticNetwork) error {
+	configPath := "/mnt/etc/nixos/configuration.nix"
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	content := string(data)
+	originalContent := content
+
+	m := hostNameLineRe.FindStringSubmatchIndex(content)
+	if m != nil {
+		indent := content[m[2]:m[3]]
+		content = content[:m[1]] + "\n" + n.nixConfig(indent) + content[m[1]:]
+	}
+
+	// Verify replacement occurred
+	if content == originalContent {
+		return fmt.Errorf("networking.hostName not found in configuration")
+	}
+
+	return os.WriteFile(configPath, []byte(content), 0600)
+}
@@ -0,0 +1,356 @@
+package bootstrap
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/wizard"
+)
+
+// dryRunPassphrase stands in for the LUKS passphrase with --dry-run, which
+// never prompts for it; passphrases are not printed in any case
+const dryRunPassphrase = "dry-run"
+
+// diskCommand is one command run while preparing the disk
+type diskCommand struct {
+	args     []string      // Command and arguments
+	timeout  time.Duration // Kill the command after this long
+	input    string        // Written to stdin and never printed (the LUKS passphrase)
+	quiet    bool          // Hide the command's output
+	optional bool          // Failure only warns
+}
+
+// String renders the command as it would be typed, without its input
+func (c diskCommand) String() string {
+	s := strings.Join(c.args, " ")
+	if c.input != "" {
+		s += " <<< (passphrase)"
+	}
+	return s
+}
+
+// run executes the command
+func (c diskCommand) run() error {
+	switch {
+	case c.input != "":
+		return common.RunInputTimeout(c.timeout, c.input, c.args[0], c.args[1:]...)
+	case c.quiet:
+		return common.RunQuietTimeout(c.timeout, c.args[0], c.args[1:]...)
+	default:
+		return common.RunTimeout(c.timeout, c.args[0], c.args[1:]...)
+	}
+}
+
+// diskStep is a group of commands shown under one progress message
+type diskStep struct {
+	info    string        // Progress message
+	failure string        // Error prefix when a required command fails
+	cmds    []diskCommand // Commands in order
+	undo    []diskCommand // Run quietly when a command fails, before exiting
+	pause   time.Duration // Wait after the step for the kernel to catch up
+}
+
+// runDiskCommands runs cmds in order, warning about optional failures
+func runDiskCommands(cmds []diskCommand) error {
+	for _, c := range cmds {
+		if err := c.run(); err != nil {
+			if !c.optional {
+				return err
+			}
+			common.Warning(fmt.Sprintf("%s returned error: %v (continuing anyway)", c.args[0], err))
+		}
+	}
+	return nil
+}
+
+// planFilesystems lists the steps that partition, encrypt, format and mount
+// the disk as described by layout, and enable swap
+func planFilesystems(targetDisk string, layout diskLayout) []diskStep {
+	espPart, rootPart := layout.partitions(targetDisk)
+	steps := []diskStep{{
+		info:    "Partitioning disk...",
+		failure: "Partitioning failed",
+		cmds:    partitionCommands(targetDisk, layout),
+		pause:   2 * time.Second,
+	}}
+
+	if layout.passphrase != "" {
+		steps = append(steps, diskStep{
+			info:    "Encrypting root partition (LUKS2)...",
+			failure: "Encryption failed",
+			cmds:    luksCommands(rootPart, layout.passphrase),
+		})
+		rootPart = luksDevice
+	}
+
+	format := diskStep{
+		info:    "Formatting partitions...",
+		failure: "Formatting failed",
+		cmds:    []diskCommand{{args: []string{"mkfs.fat", "-F", "32", "-n", "boot", espPart}, timeout: mkfsTimeout}},
+	}
+	if layout.filesystem == filesystemBtrfs {
+		format.cmds = append(format.cmds, btrfsFormatCommands(rootPart)...)
+		format.undo = []diskCommand{{args: []string{"umount", "/mnt"}, timeout: mountTimeout, quiet: true}}
+	} else {
+		format.cmds = append(format.cmds, diskCommand{args: []string{"mkfs.ext4", "-F", "-L", "nixos", rootPart}, timeout: mkfsTimeout})
+	}
+
+	steps = append(steps, format,
+		diskStep{
+			info:  "Waiting for disk labels...",
+			cmds:  []diskCommand{{args: []string{"udevadm", "settle"}, timeout: settleTimeout, quiet: true, optional: true}},
+			pause: 2 * time.Second,
+		},
+		diskStep{
+			info:    "Mounting filesystems...",
+			failure: "Mount failed",
+			cmds:    mountCommands(espPart, rootPart, layout.filesystem),
+		})
+
+	if layout.swapMiB > 0 {
+		swapPart := layout.swapPartition(targetDisk)
+		steps = append(steps, diskStep{
+			info:    fmt.Sprintf("Enabling %d MiB swap on %s...", layout.swapMiB, swapPart),
+			failure: "Failed to enable swap",
+			cmds:    swapCommands(swapPart),
+		})
+	}
+	return steps
+}
+
+// runDiskSteps executes steps, exiting on the first required failure
+func runDiskSteps(steps []diskStep) {
+	for _, step := range steps {
+		common.Info(step.info)
+		if err := runDiskCommands(step.cmds); err != nil {
+			for _, c := range step.undo {
+				c.run()
+			}
+			common.Error(fmt.Sprintf("%s: %v", step.failure, err))
+			common.Exit(1)
+		}
+		time.Sleep(step.pause)
+	}
+}
+
+// printDiskSteps lists the commands in steps without running them
+func printDiskSteps(steps []diskStep) {
+	for _, step := range steps {
+		fmt.Println(step.info)
+		for _, c := range step.cmds {
+			fmt.Printf("    %s\n", c)
+		}
+	}
+}
+
+// configStep is one change made to the installed system's configuration
+type configStep struct {
+	desc    string       // What the step changes, for --dry-run
+	info    string       // Progress message ("" for none)
+	apply   func() error // Makes the change
+	failure string       // Message prefix when apply fails
+	fatal   bool         // Exit on failure instead of warning
+	success string       // Printed after apply succeeds ("" for none)
+}
+
+// planConfiguration lists the steps that generate and patch the NixOS configuration
+func planConfiguration(targetDisk string, layout diskLayout, flags bootstrapFlags, network *staticNetwork) []configStep {
+	steps := []configStep{{
+		desc: "Run nixos-generate-config --root /mnt",
+		info: "Generating hardware configuration...",
+		apply: func() error {
+			return common.RunTimeout(common.GenerateConfigTimeout, "nixos-generate-config", "--root", "/mnt")
+		},
+		failure: "Failed to generate hardware config",
+		fatal:   true,
+	}}
+
+	if flags.filesystem == filesystemBtrfs {
+		steps = append(steps, configStep{
+			desc:    "Add " + strings.Join(btrfsMountOptions, ",") + " to the btrfs mounts in hardware-configuration.nix",
+			apply:   patchHardwareConfig,
+			failure: "Failed to add btrfs mount options to hardware-configuration.nix",
+			success: "btrfs mount options added to hardware-configuration.nix",
+		})
+	}
+
+	verb, info, failure := "Download", "Downloading configuration...", "Failed to download configuration"
+	if flags.configSource.File != "" {
+		verb, info, failure = "Copy", "Copying configuration...", "Failed to copy configuration"
+	}
+	steps = append(steps, configStep{
+		desc:    verb + " " + flags.configSource.String() + " to /mnt/etc/nixos/configuration.nix",
+		info:    info,
+		apply:   func() error { return installConfig(flags) },
+		failure: failure,
+		fatal:   true,
+	})
+
+	if modules := detectHardwareModules(); len(modules) > 0 {
+		steps = append(steps, configStep{
+			desc:    "Load " + strings.Join(modules, ", ") + " in the initrd",
+			apply:   func() error { return injectHardwareModules(modules) },
+			failure: "Failed to add hardware kernel modules",
+			success: "Hardware kernel modules added: " + strings.Join(modules, " "),
+		})
+	}
+
+	if flags.encrypt {
+		_, rootPart := layout.partitions(targetDisk)
+		steps = append(steps, configStep{
+			desc:    fmt.Sprintf("Unlock %s as %s in the initrd", rootPart, luksName),
+			apply:   func() error { return injectLUKS(rootPart) },
+			failure: "Failed to configure LUKS unlock",
+			fatal:   true,
+			success: "LUKS unlock configured in initrd",
+		})
+	}
+
+	if flags.zram {
+		steps = append(steps, configStep{
+			desc:    "Enable zramSwap",
+			apply:   injectZram,
+			failure: "Failed to enable zram swap",
+			success: "zram swap enabled",
+		})
+	}
+
+	if flags.caches != nil {
+		steps = append(steps, configStep{
+			desc:    "Use binary cache(s) " + strings.Join(flags.caches.substituters, ", ") + " before cache.nixos.org",
+			apply:   func() error { return injectBinaryCaches(flags.caches) },
+			failure: "Failed to configure binary caches",
+			success: "Binary cache mirror(s) configured",
+		})
+	}
+
+	if flags.hostname != "" || flags.timezone != "" {
+		var settings []string
+		if flags.hostname != "" {
+			settings = append(settings, "networking.hostName = "+flags.hostname)
+		}
+		if flags.timezone != "" {
+			settings = append(settings, "time.timeZone = "+flags.timezone)
+		}
+		steps = append(steps, configStep{
+			desc:    "Set " + strings.Join(settings, ", "),
+			apply:   func() error { return injectSystemSettings(flags.hostname, flags.timezone) },
+			failure: "Failed to set hostname/time zone",
+			fatal:   true,
+		})
+	}
+	if flags.hostname != "" || flags.domain != "" {
+		steps = append(steps, configStep{
+			desc:    "Record the hostname and domain for the setup wizard",
+			apply:   func() error { return wizard.SavePreset("/mnt", flags.hostname, flags.domain) },
+			failure: "Failed to record settings for the setup wizard",
+		})
+	}
+
+	if network != nil {
+		steps = append(steps, configStep{
+			desc:    "Configure static network: " + network.Describe(),
+			info:    "Configuring static network on " + network.Interface + "...",
+			apply:   func() error { return injectStaticNetwork(network) },
+			failure: "Failed to configure static network",
+			fatal:   true,
+			success: "Static network configured: " + network.Describe(),
+		})
+	}
+
+	if layout.uefiOnly {
+		return append(steps, configStep{
+			desc:    "Replace GRUB with systemd-boot (UEFI only)",
+			info:    "Configuring systemd-boot...",
+			apply:   injectSystemdBoot,
+			failure: "Failed to configure systemd-boot",
+			fatal:   true,
+			success: "systemd-boot configured",
+		})
+	}
+	return append(steps, configStep{
+		desc:    "Set the GRUB boot device to " + targetDisk,
+		info:    "Configuring bootloader for " + targetDisk + "...",
+		apply:   func() error { return injectBootDevice(targetDisk) },
+		failure: "Failed to configure bootloader",
+		success: "Bootloader configured for " + targetDisk,
+	})
+}
+
+// runConfigSteps applies steps in order
+func runConfigSteps(steps []configStep) {
+	for _, step := range steps {
+		if step.info != "" {
+			common.Info(step.info)
+		}
+		if err := step.apply(); err != nil {
+			if !step.fatal {
+				common.Warning(fmt.Sprintf("%s: %v", step.failure, err))
+				continue
+			}
+			common.Error(fmt.Sprintf("%s: %v", step.failure, err))
+			common.Exit(1)
+		}
+		if step.success != "" {
+			common.Success(step.success)
+		}
+	}
+}
+
+// printDryRun shows everything bootstrap would do to targetDisk and exits
+func printDryRun(targetDisk string, layout diskLayout, flags bootstrapFlags, network *staticNetwork, sshKeys []string) {
+	fmt.Println()
+	common.Header("Dry run: nothing will be changed")
+
+	fmt.Printf("Disk: %s (%s)\n", targetDisk, common.FormatDiskSize(common.DiskSize(targetDisk)))
+	contents, err := common.ProbeDisk(targetDisk)
+	switch {
+	case err != nil:
+		common.Warning(fmt.Sprintf("Could not inspect %s: %v", targetDisk, err))
+	case len(contents) == 0:
+		fmt.Println("    (empty)")
+	default:
+		fmt.Println("Would be ERASED:")
+		for _, c := range contents {
+			fmt.Printf("    %s\n", c.Describe())
+		}
+	}
+
+	fmt.Println()
+	printDiskSteps(planFilesystems(targetDisk, layout))
+
+	fmt.Println()
+	fmt.Println("Configuration:")
+	for _, step := range planConfiguration(targetDisk, layout, flags, network) {
+		fmt.Printf("    %s\n", step.desc)
+	}
+	if len(sshKeys) == 0 {
+		fmt.Println("    Authorize SSH key(s) entered at the prompt for deploy and root")
+	} else {
+		fmt.Printf("    Authorize %d SSH key(s) for deploy and root:\n", len(sshKeys))
+		for _, key := range sshKeys {
+			fmt.Printf("        %s\n", common.DescribeSSHKey(key))
+		}
+	}
+
+	fmt.Println()
+	fmt.Println("Install:")
+	install := "nixos-install --no-root-passwd"
+	for _, arg := range flags.caches.installArgs() {
+		if strings.Contains(arg, " ") {
+			arg = "'" + arg + "'"
+		}
+		install += " " + arg
+	}
+	fmt.Println("    " + install)
+	if flags.verifyReboot {
+		fmt.Println("    nixos-rebuild dry-build inside /mnt")
+	}
+	if flags.noReboot {
+		fmt.Println("    Leave /mnt mounted without rebooting")
+	} else {
+		fmt.Println("    reboot")
+	}
+}
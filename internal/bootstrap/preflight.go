@@ -0,0 +1,102 @@
+package bootstrap
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+const (
+	// minMemory is the RAM below which nixos-install tends to run out of
+	// memory without swap. A "1 GB" machine reports a little less once the
+	// kernel has reserved its share, so the threshold sits under 1 GiB.
+	minMemory = 900 << 20
+
+	// defaultMinDiskGB is the smallest disk bootstrap installs to by default
+	defaultMinDiskGB = 15
+)
+
+// supportedArchitectures are the uname -m values the configuration supports
+var supportedArchitectures = map[string]bool{
+	"x86_64":  true,
+	"aarch64": true,
+}
+
+// goArchitectures maps GOARCH to uname -m, used when uname is unavailable
+var goArchitectures = map[string]string{
+	"amd64": "x86_64",
+	"arm64": "aarch64",
+}
+
+// machineArchitecture returns the kernel's architecture as uname -m reports it
+func machineArchitecture() string {
+	if out, err := common.RunOutput("uname", "-m"); err == nil && strings.TrimSpace(out) != "" {
+		return strings.TrimSpace(out)
+	}
+	if arch, ok := goArchitectures[runtime.GOARCH]; ok {
+		return arch
+	}
+	return runtime.GOARCH
+}
+
+// requiredTools lists the commands bootstrap runs for the given layout
+func requiredTools(layout diskLayout) []string {
+	tools := []string{"nixos-install", "nixos-generate-config", "parted", "mkfs.fat"}
+	if layout.filesystem == filesystemBtrfs {
+		tools = append(tools, "mkfs.btrfs", "btrfs")
+	} else {
+		tools = append(tools, "mkfs.ext4")
+	}
+	if layout.passphrase != "" {
+		tools = append(tools, "cryptsetup")
+	}
+	if layout.swapMiB > 0 {
+		tools = append(tools, "mkswap", "swapon")
+	}
+	return tools
+}
+
+// preflight checks the machine can take an install before anything is
+// erased. Problems that would only fail later are reported together and
+// bootstrap exits; low memory only warns.
+func preflight(targetDisk string, layout diskLayout, flags bootstrapFlags) {
+	var problems []string
+
+	if arch := machineArchitecture(); !supportedArchitectures[arch] {
+		problems = append(problems, fmt.Sprintf("Architecture %s is not supported; the server configuration is built for x86_64 and aarch64 only", arch))
+	}
+
+	if flags.minDiskGB > 0 {
+		size := common.DiskSize(targetDisk)
+		if minSize := int64(flags.minDiskGB) * 1000 * 1000 * 1000; size > 0 && size < minSize {
+			problems = append(problems, fmt.Sprintf("%s is %s; at least %d GB is needed for NixOS, the Nix store and site releases (override with --min-disk-gb=N, or 0 to skip this check)",
+				targetDisk, common.FormatDiskSize(size), flags.minDiskGB))
+		}
+	}
+
+	var missing []string
+	for _, tool := range requiredTools(layout) {
+		if _, err := exec.LookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	if len(missing) > 0 {
+		problems = append(problems, fmt.Sprintf("Missing %s; run bootstrap from the NixOS installer (minimal ISO), which provides them", strings.Join(missing, ", ")))
+	}
+
+	if mem := common.TotalMemory(); mem > 0 && mem < minMemory && layout.swapMiB == 0 {
+		common.Warning(fmt.Sprintf("Only %s of RAM; nixos-install may run out of memory. Add swap with --swap-size=%s",
+			common.FormatDiskSize(mem), suggestedSwap))
+	}
+
+	if len(problems) == 0 {
+		return
+	}
+	for _, p := range problems {
+		common.Error(p)
+	}
+	common.Exit(1)
+}
@@ -0,0 +1,173 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// stateFile records completed steps on the live system so a failed
+// bootstrap can resume instead of starting over from partitioning
+const stateFile = "/tmp/juniper-bootstrap-state.json"
+
+// Bootstrap steps that can be skipped on resume, in order
+const (
+	stepFilesystems = "filesystems" // Partition, encrypt, format and mount
+	stepConfigure   = "configure"   // Generate and patch the NixOS configuration
+	stepInstall     = "install"     // nixos-install
+)
+
+var bootstrapSteps = []string{stepFilesystems, stepConfigure, stepInstall}
+
+// bootstrapState is the on-disk progress of one bootstrap run
+type bootstrapState struct {
+	Disk       string   `json:"disk"`
+	Filesystem string   `json:"filesystem"`
+	Encrypted  bool     `json:"encrypted"`
+	SwapMiB    int      `json:"swapMiB"`
+	UEFIOnly   bool     `json:"uefiOnly,omitempty"`
+	Completed  []string `json:"completed"`
+}
+
+// newBootstrapState starts tracking a run on disk with the given layout
+func newBootstrapState(disk string, layout diskLayout) *bootstrapState {
+	return &bootstrapState{
+		Disk:       disk,
+		Filesystem: layout.filesystem,
+		Encrypted:  layout.passphrase != "",
+		SwapMiB:    layout.swapMiB,
+		UEFIOnly:   layout.uefiOnly,
+	}
+}
+
+// loadBootstrapState reads the state file, returning false if none is usable
+func loadBootstrapState() (*bootstrapState, bool) {
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		return nil, false
+	}
+	var s bootstrapState
+	if err := json.Unmarshal(data, &s); err != nil || len(s.Completed) == 0 || !isValidFilesystem(s.Filesystem) {
+		return nil, false
+	}
+	return &s, true
+}
+
+// done reports whether step finished in an earlier run
+func (s *bootstrapState) done(step string) bool {
+	return slices.Contains(s.Completed, step)
+}
+
+// nextStep returns the first step not yet completed
+func (s *bootstrapState) nextStep() string {
+	for _, step := range bootstrapSteps {
+		if !s.done(step) {
+			return step
+		}
+	}
+	return ""
+}
+
+// markDone records step as completed; failures only warn since resuming is optional
+func (s *bootstrapState) markDone(step string) {
+	s.Completed = append(s.Completed, step)
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		err = os.WriteFile(stateFile, data, 0600)
+	}
+	if err != nil {
+		common.Warning(fmt.Sprintf("Failed to save bootstrap progress: %v", err))
+	}
+}
+
+// resumeLayout returns the disk layout the earlier run used, asking for the
+// LUKS passphrase only if the encrypted root is not open any more. flags is
+// updated to match so the generated configuration agrees with the disk.
+func (s *bootstrapState) resumeLayout(flags *bootstrapFlags) diskLayout {
+	flags.filesystem = s.Filesystem
+	flags.encrypt = s.Encrypted
+	layout := diskLayout{swapMiB: s.SwapMiB, filesystem: s.Filesystem, uefiOnly: s.UEFIOnly}
+	if s.Encrypted && !common.FileExists(luksDevice) {
+		layout.passphrase = resolvePassphrase(*flags)
+	}
+	return layout
+}
+
+// clearBootstrapState removes the state file
+func clearBootstrapState() {
+	if err := os.Remove(stateFile); err != nil && !os.IsNotExist(err) {
+		common.Warning(fmt.Sprintf("Failed to remove %s: %v", stateFile, err))
+	}
+}
+
+// offerResume asks whether to continue an earlier bootstrap of disk.
+// It returns nil when there is nothing to resume or the user declines.
+func offerResume(disk string) *bootstrapState {
+	s, ok := loadBootstrapState()
+	if !ok {
+		return nil
+	}
+	if s.Disk != disk || s.nextStep() == "" {
+		clearBootstrapState()
+		return nil
+	}
+	fmt.Println()
+	common.Info(fmt.Sprintf("A previous bootstrap of %s stopped after: %s", disk, strings.Join(s.Completed, ", ")))
+	if !common.Confirm(fmt.Sprintf("Resume from the %s step?", s.nextStep()), true) {
+		clearBootstrapState()
+		return nil
+	}
+	return s
+}
+
+// blkidLabel returns the filesystem label of a device, or "" if it has none
+func blkidLabel(device string) string {
+	label, err := common.RunOutput("blkid", "-s", "LABEL", "-o", "value", device)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(label)
+}
+
+// ensureFilesystems checks the filesystems an earlier run created are still
+// present and mounts them under /mnt if they are not mounted already. The
+// passphrase is only needed when the LUKS device is not open yet.
+func ensureFilesystems(targetDisk string, layout diskLayout, encrypted bool) error {
+	espPart, rootPart := layout.partitions(targetDisk)
+	if encrypted {
+		if !common.FileExists(luksDevice) {
+			common.Info("Opening encrypted root partition...")
+			if err := luksOpenCommand(rootPart, layout.passphrase).run(); err != nil {
+				return fmt.Errorf("open %s: %w", rootPart, err)
+			}
+		}
+		rootPart = luksDevice
+	}
+
+	if label := blkidLabel(espPart); label != "boot" {
+		return fmt.Errorf("%s has label %q, expected \"boot\"", espPart, label)
+	}
+	if label := blkidLabel(rootPart); label != "nixos" {
+		return fmt.Errorf("%s has label %q, expected \"nixos\"", rootPart, label)
+	}
+
+	if !common.IsMountPoint("/mnt") {
+		common.Info("Mounting filesystems...")
+		if err := runDiskCommands(mountCommands(espPart, rootPart, layout.filesystem)); err != nil {
+			return err
+		}
+	} else if !common.IsMountPoint("/mnt/boot") {
+		if err := runDiskCommands(bootMountCommands(espPart)); err != nil {
+			return err
+		}
+	}
+	if layout.swapMiB > 0 {
+		// Fails harmlessly when the swap is still active from the earlier run
+		common.RunQuietTimeout(mountTimeout, "swapon", layout.swapPartition(targetDisk))
+	}
+	return nil
+}
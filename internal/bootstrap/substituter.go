@@ -0,0 +1,127 @@
+package bootstrap
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+const (
+	// defaultSubstituter stays last so anything missing from a mirror is
+	// still fetched from the official cache
+	defaultSubstituter = "https://cache.nixos.org"
+
+	// defaultTrustedKey signs cache.nixos.org and its plain mirrors
+	defaultTrustedKey = "cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY="
+
+	// substituterProbeTimeout bounds the connectivity check of a mirror
+	substituterProbeTimeout = 10 * time.Second
+)
+
+// trustedKeyRe matches a Nix signing public key: name:base64
+var trustedKeyRe = regexp.MustCompile(`^[A-Za-z0-9._-]+:[A-Za-z0-9+/]+={0,2}$`)
+
+// binaryCaches are the --substituter and --trusted-public-key values
+type binaryCaches struct {
+	substituters []string
+	trustedKeys  []string
+}
+
+// parseBinaryCaches validates the substituter URLs and public keys
+func parseBinaryCaches(substituters, keys []string) (*binaryCaches, error) {
+	if len(substituters) == 0 {
+		if len(keys) > 0 {
+			return nil, fmt.Errorf("--trusted-public-key needs at least one --substituter")
+		}
+		return nil, nil
+	}
+	c := &binaryCaches{}
+	for _, s := range substituters {
+		u, err := url.Parse(s)
+		if err != nil || u.Scheme != "https" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return nil, fmt.Errorf("invalid --substituter %q (expected an https:// URL)", s)
+		}
+		c.substituters = append(c.substituters, strings.TrimSuffix(s, "/"))
+	}
+	for _, k := range keys {
+		if !trustedKeyRe.MatchString(k) {
+			return nil, fmt.Errorf("invalid --trusted-public-key %q (expected name:base64, e.g. %s)", k, defaultTrustedKey)
+		}
+		c.trustedKeys = append(c.trustedKeys, k)
+	}
+	return c, nil
+}
+
+// probe warns about substituters that do not answer with a nix-cache-info.
+// A mirror that cannot be reached only slows the install down, since Nix
+// falls back to the next substituter.
+func (c *binaryCaches) probe() {
+	client := &http.Client{Timeout: substituterProbeTimeout}
+	for _, s := range c.substituters {
+		resp, err := client.Get(s + "/nix-cache-info")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("HTTP %d for nix-cache-info", resp.StatusCode)
+			}
+		}
+		if err != nil {
+			common.Warning(fmt.Sprintf("Binary cache %s is not reachable: %v", s, err))
+			fmt.Println("    nixos-install will fall back to " + defaultSubstituter + ", which may be slow or blocked.")
+			continue
+		}
+		common.Success("Binary cache reachable: " + s)
+	}
+}
+
+// allSubstituters returns the mirrors followed by the default cache
+func (c *binaryCaches) allSubstituters() []string {
+	return append(append([]string{}, c.substituters...), defaultSubstituter)
+}
+
+// allTrustedKeys returns the extra keys followed by the default cache's key
+func (c *binaryCaches) allTrustedKeys() []string {
+	return append(append([]string{}, c.trustedKeys...), defaultTrustedKey)
+}
+
+// installArgs passes the caches to nixos-install, which runs before the
+// installed configuration's nix.settings take effect
+func (c *binaryCaches) installArgs() []string {
+	if c == nil {
+		return nil
+	}
+	return []string{
+		"--option", "substituters", strings.Join(c.allSubstituters(), " "),
+		"--option", "trusted-public-keys", strings.Join(c.allTrustedKeys(), " "),
+	}
+}
+
+// nixList formats values as a Nix list of strings
+func nixList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = `"` + common.EscapeNixString(v) + `"`
+	}
+	return "[ " + strings.Join(quoted, " ") + " ]"
+}
+
+// config returns the nix.settings added to configuration.nix. NixOS adds
+// cache.nixos.org and its key after these definitions itself.
+func (c *binaryCaches) config() string {
+	snippet := "\n  # Binary cache mirrors (added by juniper-host bootstrap --substituter)\n" +
+		"  nix.settings.substituters = " + nixList(c.substituters) + ";\n"
+	if len(c.trustedKeys) > 0 {
+		snippet += "  nix.settings.trusted-public-keys = " + nixList(c.trustedKeys) + ";\n"
+	}
+	return snippet
+}
+
+// injectBinaryCaches adds the substituters to configuration.nix
+func injectBinaryCaches(c *binaryCaches) error {
+	return appendToConfig(c.config())
+}
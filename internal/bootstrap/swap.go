@@ -0,0 +1,105 @@
+package bootstrap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+const (
+	// swapPartition is the number of the optional swap partition; it sits
+	// after root so the ESP and root keep their usual numbers
+	swapPartition = 4
+
+	// uefiSwapPartition is the swap partition on the UEFI-only layout,
+	// which has no bios_grub partition
+	uefiSwapPartition = 3
+
+	// minRootMiB is the smallest root partition left after carving out swap
+	minRootMiB = 8 * 1024
+
+	// lowMemory is the RAM size below which swap is suggested by default
+	lowMemory = 2 << 30
+
+	// suggestedSwap is the default swap size on low-memory machines
+	suggestedSwap = "2G"
+)
+
+// zramConfig is appended to configuration.nix by --zram
+const zramConfig = `
+  # Compressed swap in RAM (added by juniper-host bootstrap --zram)
+  zramSwap.enable = true;
+  zramSwap.memoryPercent = 50;
+`
+
+// parseSwapSize parses a size such as "2G", "512M" or "0" into MiB
+func parseSwapSize(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "0" {
+		return 0, nil
+	}
+	upper := strings.ToUpper(s)
+	multiplier := 0
+	for _, unit := range []struct {
+		suffix string
+		mib    int
+	}{{"GIB", 1024}, {"GB", 1024}, {"G", 1024}, {"MIB", 1}, {"MB", 1}, {"M", 1}} {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper = strings.TrimSuffix(upper, unit.suffix)
+			multiplier = unit.mib
+			break
+		}
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(upper))
+	if multiplier == 0 || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid swap size %q (expected e.g. 2G, 512M or 0)", s)
+	}
+	return n * multiplier, nil
+}
+
+// defaultSwapSize suggests swap on machines with little RAM, where
+// nixos-install is otherwise likely to run out of memory
+func defaultSwapSize() string {
+	if mem := common.TotalMemory(); mem > 0 && mem < lowMemory {
+		return suggestedSwap
+	}
+	return "0"
+}
+
+// resolveSwapSize returns the swap partition size in MiB from --swap-size,
+// prompting for it when the flag was not given
+func resolveSwapSize(flags bootstrapFlags, disk string) int {
+	size := flags.swapSize
+	if size == "" {
+		if flags.zram {
+			return 0
+		}
+		size = common.Prompt("Swap partition size (e.g. 2G, 0 for none)", defaultSwapSize())
+	}
+	mib, err := parseSwapSize(size)
+	if err != nil {
+		common.Error(err.Error())
+		common.Exit(1)
+	}
+	if diskMiB := int(common.DiskSize(disk) >> 20); mib > 0 && diskMiB > 0 && diskMiB-514-mib < minRootMiB {
+		common.Error(fmt.Sprintf("Swap size %s leaves less than %d GiB for the root partition on %s", size, minRootMiB/1024, disk))
+		common.Exit(1)
+	}
+	return mib
+}
+
+// swapCommands format and activate the swap partition, so nixos-install can
+// use it and nixos-generate-config records it in hardware-configuration.nix
+func swapCommands(swapPart string) []diskCommand {
+	return []diskCommand{
+		{args: []string{"mkswap", "-L", "swap", swapPart}, timeout: mkfsTimeout},
+		{args: []string{"swapon", swapPart}, timeout: mountTimeout},
+	}
+}
+
+// injectZram enables zram swap in configuration.nix
+func injectZram() error {
+	return appendToConfig(zramConfig)
+}
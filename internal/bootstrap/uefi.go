@@ -0,0 +1,106 @@
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// Partition layouts selected by --boot
+const (
+	bootAuto   = "auto"   // UEFI-only on aarch64, hybrid elsewhere
+	bootHybrid = "hybrid" // bios_grub + ESP + root, GRUB for BIOS and UEFI
+	bootUEFI   = "uefi"   // ESP + root, systemd-boot
+)
+
+// grubBlockRe matches the GRUB section of the stock configuration.nix,
+// from its comment through boot.loader.efi.canTouchEfiVariables
+var grubBlockRe = regexp.MustCompile(`(?s)\n  # Boot loader - GRUB[^\n]*\n.*?boot\.loader\.grub = \{.*?\n  \};\n  boot\.loader\.efi\.canTouchEfiVariables = false;\n`)
+
+// systemdBootConfig replaces the GRUB section on UEFI-only disks.
+// canTouchEfiVariables stays off so bootctl also installs the removable
+// fallback loader and the machine boots without NVRAM entries.
+const systemdBootConfig = `
+  # Boot loader - systemd-boot on a UEFI-only disk (set by juniper-host bootstrap)
+  boot.loader.systemd-boot.enable = true;
+  boot.loader.efi.canTouchEfiVariables = false;
+`
+
+// isValidBootMode reports whether mode is a supported --boot value
+func isValidBootMode(mode string) bool {
+	return mode == bootAuto || mode == bootHybrid || mode == bootUEFI
+}
+
+// firmwareIsUEFI reports whether the live system was booted through UEFI
+func firmwareIsUEFI() bool {
+	return common.FileExists("/sys/firmware/efi")
+}
+
+// resolveBootMode decides whether to use the UEFI-only layout. aarch64
+// machines only boot through UEFI and have no use for bios_grub; on x86 the
+// hybrid layout stays the default so the disk also boots under BIOS.
+func resolveBootMode(flags bootstrapFlags) bool {
+	arch := machineArchitecture()
+	switch flags.boot {
+	case bootUEFI:
+		if !firmwareIsUEFI() {
+			common.Error("--boot=uefi needs the live system to be booted in UEFI mode (/sys/firmware/efi is missing)")
+			fmt.Println("Reboot the installer in UEFI mode, or use --boot=hybrid.")
+			common.Exit(1)
+		}
+		return true
+	case bootHybrid:
+		if arch == "aarch64" {
+			common.Error("--boot=hybrid is not supported on aarch64, which has no BIOS boot")
+			common.Exit(1)
+		}
+		return false
+	}
+	return arch == "aarch64"
+}
+
+// partitions returns the ESP and root partitions of disk for this layout
+func (l diskLayout) partitions(disk string) (esp, root string) {
+	if l.uefiOnly {
+		return common.GetUEFIPartitions(disk)
+	}
+	_, esp, root = common.GetPartitions(disk)
+	return esp, root
+}
+
+// swapPartition returns the optional swap partition, which follows root
+func (l diskLayout) swapPartition(disk string) string {
+	if l.uefiOnly {
+		return common.PartitionPath(disk, uefiSwapPartition)
+	}
+	return common.PartitionPath(disk, swapPartition)
+}
+
+// useSystemdBoot replaces the GRUB section of configuration.nix content
+// with systemd-boot
+func useSystemdBoot(content string) (string, error) {
+	if !grubBlockRe.MatchString(content) {
+		return "", fmt.Errorf("GRUB boot loader section not found in configuration")
+	}
+	return grubBlockRe.ReplaceAllLiteralString(content, systemdBootConfig), nil
+}
+
+// injectSystemdBoot switches the installed configuration to systemd-boot
+func injectSystemdBoot() error {
+	configPath := "/mnt/etc/nixos/configuration.nix"
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	content, err := useSystemdBoot(string(data))
+	if err != nil {
+		return err
+	}
+	if strings.Contains(content, "boot.loader.grub") {
+		return fmt.Errorf("configuration still enables GRUB")
+	}
+	return os.WriteFile(configPath, []byte(content), 0600)
+}
@@ -0,0 +1,68 @@
+package bootstrap
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// dryBuildTimeout bounds evaluating the installed configuration
+const dryBuildTimeout = 15 * time.Minute
+
+// VerifyInstall checks the configuration installed under mountPath: it must
+// exist, have SSH keys injected, and point the bootloader at disk rather than
+// the default /dev/vda.
+func VerifyInstall(mountPath, disk string) error {
+	configPath := filepath.Join(mountPath, "etc/nixos/configuration.nix")
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", configPath, err)
+	}
+	content := string(data)
+
+	var errs []error
+	if strings.Contains(content, common.SSHKeyPlaceholder) {
+		errs = append(errs, errors.New("no SSH keys injected (placeholder still present)"))
+	}
+	if strings.Contains(content, common.BootDevicePlaceholder) && disk != "/dev/vda" {
+		errs = append(errs, fmt.Errorf("bootloader device is still /dev/vda, expected %s", disk))
+	}
+	return errors.Join(errs...)
+}
+
+// dryBuildInstall evaluates the installed configuration inside the new
+// system to catch errors that would only show up after rebooting
+func dryBuildInstall(mountPath string) error {
+	return common.RunQuietTimeout(dryBuildTimeout, "nixos-enter", "--root", mountPath, "-c", "nixos-rebuild dry-build")
+}
+
+// verifyBeforeReboot checks the installation and asks whether to reboot
+// anyway if something is wrong. Without a terminal a failure aborts instead.
+func verifyBeforeReboot(disk string) {
+	fmt.Println()
+	common.Info("Verifying installation...")
+	err := VerifyInstall("/mnt", disk)
+	if err == nil {
+		common.Info("Running nixos-rebuild dry-build in the installed system...")
+		err = dryBuildInstall("/mnt")
+	}
+	if err == nil {
+		common.Success("Installation verified")
+		return
+	}
+
+	common.Error(fmt.Sprintf("Verification failed: %v", err))
+	if !common.IsInteractive() {
+		fmt.Println("Not rebooting. Fix the configuration under /mnt/etc/nixos, then reboot manually.")
+		common.Exit(1)
+	}
+	if !common.Confirm("Reboot anyway?", false) {
+		fmt.Println("Not rebooting. Fix the configuration under /mnt/etc/nixos, then reboot manually.")
+		common.Exit(1)
+	}
+}
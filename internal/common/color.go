@@ -0,0 +1,51 @@
+package common
+
+import (
+	"os"
+
+	"golang.org/x/term"
+)
+
+// ANSI color codes. They are empty when color is disabled; see init.
+var (
+	Reset   = "\033[0m"
+	Red     = "\033[0;31m"
+	Green   = "\033[0;32m"
+	Yellow  = "\033[1;33m"
+	Blue    = "\033[0;34m"
+	Cyan    = "\033[0;36m"
+	Bold    = "\033[1m"
+	Gray    = "\033[0;90m"
+	Reverse = "\033[7m"
+)
+
+// init disables color when stdout is not a terminal, NO_COLOR is set
+// (https://no-color.org), or TERM=dumb
+func init() {
+	if !StdoutIsTerminal() || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		DisableColor()
+	}
+}
+
+// StdoutIsTerminal reports whether stdout is a terminal
+func StdoutIsTerminal() bool {
+	return term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// DisableColor clears all color codes, e.g. for --no-color
+func DisableColor() {
+	Reset, Red, Green, Yellow, Blue, Cyan, Bold, Gray, Reverse = "", "", "", "", "", "", "", "", ""
+}
+
+// StripNoColorFlag removes --no-color from args, disabling color if present
+func StripNoColorFlag(args []string) []string {
+	out := args[:0:0]
+	for _, a := range args {
+		if a == "--no-color" || a == "-no-color" {
+			DisableColor()
+			continue
+		}
+		out = append(out, a)
+	}
+	return out
+}
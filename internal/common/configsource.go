@@ -0,0 +1,113 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// DefaultConfigURL is the published configuration.nix
+const DefaultConfigURL = RepoBase + "/configuration.nix"
+
+// refPattern matches a branch, tag or commit name that is safe in a URL path
+var refPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+// IsValidRef reports whether ref can name a tag, branch or commit of the repository
+func IsValidRef(ref string) bool {
+	return len(ref) <= 255 && refPattern.MatchString(ref) &&
+		!strings.Contains(ref, "..") && !strings.Contains(ref, "//") && !strings.HasSuffix(ref, "/")
+}
+
+// RepoFileURL returns the raw URL of a file in the repository at ref
+func RepoFileURL(ref, file string) string {
+	return RepoRawURL + "/" + ref + "/" + file
+}
+
+// ConfigSource is where configuration.nix comes from: a local file for
+// air-gapped installs, an internal mirror, or the published copy
+type ConfigSource struct {
+	File string // Local file copied instead of downloading
+	URL  string // Download URL; empty uses DefaultConfigURL
+}
+
+// NewConfigSource validates --config-file and --config-url, which are
+// mutually exclusive
+func NewConfigSource(file, url string) (ConfigSource, error) {
+	if file != "" && url != "" {
+		return ConfigSource{}, fmt.Errorf("--config-file and --config-url cannot be used together")
+	}
+	if url != "" && !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		return ConfigSource{}, fmt.Errorf("--config-url must be an http:// or https:// URL, got %q", url)
+	}
+	if file != "" {
+		if info, err := os.Stat(file); err != nil {
+			return ConfigSource{}, fmt.Errorf("--config-file: %w", err)
+		} else if !info.Mode().IsRegular() {
+			return ConfigSource{}, fmt.Errorf("--config-file: %s is not a regular file", file)
+		}
+	}
+	return ConfigSource{File: file, URL: url}, nil
+}
+
+// Custom reports whether the configuration does not come from the published copy
+func (s ConfigSource) Custom() bool {
+	return s.File != "" || s.URL != ""
+}
+
+// url returns the address the configuration is downloaded from
+func (s ConfigSource) url() string {
+	if s.URL != "" {
+		return s.URL
+	}
+	return DefaultConfigURL
+}
+
+// String describes the source for messages
+func (s ConfigSource) String() string {
+	if s.File != "" {
+		return s.File
+	}
+	return s.url()
+}
+
+// Read returns the configuration. A local file is only checked against
+// expectedSHA256 when given; downloads are verified like DownloadVerifiedFile.
+func (s ConfigSource) Read(expectedSHA256 string, skipVerify bool) ([]byte, error) {
+	if s.File != "" {
+		data, err := os.ReadFile(s.File)
+		if err != nil {
+			return nil, err
+		}
+		if expectedSHA256 != "" {
+			if actual := bytesSHA256(data); !strings.EqualFold(actual, expectedSHA256) {
+				return nil, fmt.Errorf("%w for %s: expected %s, got %s", ErrChecksumMismatch, s.File, expectedSHA256, actual)
+			}
+		}
+		return data, nil
+	}
+
+	tmp, err := os.CreateTemp("", "configuration-*.nix")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := DownloadVerifiedFile(s.url(), tmp.Name(), expectedSHA256, skipVerify); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(tmp.Name())
+}
+
+// Install writes the configuration to dest, copying a local file or
+// downloading it
+func (s ConfigSource) Install(dest, expectedSHA256 string, skipVerify bool) error {
+	if s.File == "" {
+		return DownloadVerifiedFile(s.url(), dest, expectedSHA256, skipVerify)
+	}
+	data, err := s.Read(expectedSHA256, skipVerify)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dest, data, 0600)
+}
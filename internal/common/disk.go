@@ -0,0 +1,308 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const sysBlock = "/sys/block"
+
+// liveMountPoints are where a running live system (or installed OS) mounts
+// the medium it booted from; a disk holding any of them is never a target
+var liveMountPoints = map[string]bool{
+	"/":                    true,
+	"/iso":                 true, // NixOS installer ISO
+	"/nix/.ro-store":       true,
+	"/cdrom":               true,
+	"/run/initramfs/live":  true,
+	"/run/archiso/bootmnt": true,
+}
+
+// DiskCandidate describes a whole disk that could be installed to
+type DiskCandidate struct {
+	Path      string // Device path, e.g. /dev/sda
+	Size      int64  // Size in bytes
+	Model     string // Model reported by the device, if any
+	Removable bool   // Kernel reports removable media
+	Mounted   bool   // The disk or one of its partitions holds a mounted filesystem
+	Live      bool   // The running live system booted from this disk
+}
+
+// Describe returns a one-line summary such as "/dev/sda  500.1 GB  Samsung SSD [mounted]"
+func (d DiskCandidate) Describe() string {
+	desc := fmt.Sprintf("%-14s %10s", d.Path, FormatDiskSize(d.Size))
+	if d.Model != "" {
+		desc += "  " + d.Model
+	}
+	if d.Removable {
+		desc += " [removable]"
+	}
+	if d.Live {
+		desc += " [live system]"
+	} else if d.Mounted {
+		desc += " [mounted]"
+	}
+	return desc
+}
+
+// FormatDiskSize formats a byte count using decimal units, as disks are sold
+func FormatDiskSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB", "PB"}
+	value := float64(size)
+	i := 0
+	for value >= 1000 && i < len(units)-1 {
+		value /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
+
+// ListDisks enumerates whole disks from /sys/block, skipping loop devices,
+// optical drives, and empty devices
+func ListDisks() ([]DiskCandidate, error) {
+	entries, err := os.ReadDir(sysBlock)
+	if err != nil {
+		return nil, err
+	}
+	mounts := readMounts()
+
+	var disks []DiskCandidate
+	for _, entry := range entries {
+		name := entry.Name()
+		path := "/dev/" + name
+		if strings.HasPrefix(name, "loop") || !diskPathPattern.MatchString(path) {
+			continue
+		}
+		size := readSysInt(filepath.Join(sysBlock, name, "size")) * 512
+		if size == 0 {
+			continue
+		}
+		disk := DiskCandidate{
+			Path:      path,
+			Size:      size,
+			Model:     readSysString(filepath.Join(sysBlock, name, "device", "model")),
+			Removable: readSysInt(filepath.Join(sysBlock, name, "removable")) == 1,
+		}
+		for dev, mountPoints := range mounts {
+			if !deviceOnDisk(dev, name) {
+				continue
+			}
+			disk.Mounted = true
+			for _, mp := range mountPoints {
+				if liveMountPoints[mp] {
+					disk.Live = true
+				}
+			}
+		}
+		disks = append(disks, disk)
+	}
+	sort.Slice(disks, func(i, j int) bool { return disks[i].Path < disks[j].Path })
+	return disks, nil
+}
+
+// IsLiveSystemDisk reports whether path is the disk the running system booted from
+func IsLiveSystemDisk(path string) bool {
+	disks, err := ListDisks()
+	if err != nil {
+		return false
+	}
+	resolved := resolveDiskPath(path)
+	for _, d := range disks {
+		if d.Path == resolved {
+			return d.Live
+		}
+	}
+	return false
+}
+
+// DiskContent is a partition table, partition, or filesystem found on a disk
+type DiskContent struct {
+	Path       string // Device path, e.g. /dev/sda1
+	Type       string // lsblk device type: disk, part, lvm, crypt, ...
+	Size       int64  // Size in bytes
+	FSType     string // Filesystem or signature type (ext4, vfat, LVM2_member, ...)
+	Label      string // Filesystem label, if any
+	PartTable  string // Partition table type (gpt, dos) on the disk itself
+	MountPoint string // Where it is mounted, if anywhere
+}
+
+// Describe returns a one-line summary such as "/dev/sda1  512.0 MB  vfat  BOOT"
+func (c DiskContent) Describe() string {
+	desc := fmt.Sprintf("%-16s %10s", c.Path, FormatDiskSize(c.Size))
+	if c.PartTable != "" {
+		desc += "  " + c.PartTable + " partition table"
+	}
+	if c.FSType != "" {
+		desc += "  " + c.FSType
+	}
+	if c.Label != "" {
+		desc += fmt.Sprintf("  %q", c.Label)
+	}
+	if c.MountPoint != "" {
+		desc += "  mounted on " + c.MountPoint
+	}
+	return desc
+}
+
+// lsblkDevice is one entry of `lsblk -J` output
+type lsblkDevice struct {
+	Name       string        `json:"name"`
+	Path       string        `json:"path"`
+	Size       lsblkSize     `json:"size"`
+	Type       string        `json:"type"`
+	FSType     string        `json:"fstype"`
+	Label      string        `json:"label"`
+	PartTable  string        `json:"pttype"`
+	MountPoint string        `json:"mountpoint"`
+	Children   []lsblkDevice `json:"children"`
+}
+
+// lsblkSize accepts sizes as JSON numbers (util-linux 2.33+) or strings (older releases)
+type lsblkSize int64
+
+func (s *lsblkSize) UnmarshalJSON(data []byte) error {
+	str := strings.Trim(string(data), `"`)
+	if str == "null" || str == "" {
+		*s = 0
+		return nil
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid lsblk size %s", data)
+	}
+	*s = lsblkSize(n)
+	return nil
+}
+
+// ProbeDisk lists the partition table, partitions, and filesystems on disk.
+// An empty result means no signatures were found.
+func ProbeDisk(disk string) ([]DiskContent, error) {
+	out, err := RunOutput("lsblk", "-J", "-b", "-o", "NAME,PATH,SIZE,TYPE,FSTYPE,LABEL,PTTYPE,MOUNTPOINT", disk)
+	if err != nil {
+		return nil, err
+	}
+	return ParseLsblk([]byte(out))
+}
+
+// ParseLsblk extracts everything that holds data from `lsblk -J -b` output.
+// The whole disk is included only when it carries a partition table or a
+// filesystem directly; partitions and nested devices (LVM, crypt) are always included.
+func ParseLsblk(data []byte) ([]DiskContent, error) {
+	var parsed struct {
+		BlockDevices []lsblkDevice `json:"blockdevices"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, fmt.Errorf("parse lsblk output: %w", err)
+	}
+	var contents []DiskContent
+	var walk func(devs []lsblkDevice, top bool)
+	walk = func(devs []lsblkDevice, top bool) {
+		for _, d := range devs {
+			if !top || d.PartTable != "" || d.FSType != "" {
+				path := d.Path
+				if path == "" {
+					path = "/dev/" + d.Name
+				}
+				contents = append(contents, DiskContent{
+					Path:       path,
+					Type:       d.Type,
+					Size:       int64(d.Size),
+					FSType:     d.FSType,
+					Label:      d.Label,
+					PartTable:  d.PartTable,
+					MountPoint: d.MountPoint,
+				})
+			}
+			walk(d.Children, false)
+		}
+	}
+	walk(parsed.BlockDevices, true)
+	return contents, nil
+}
+
+// deviceOnDisk reports whether the kernel device name dev is disk or one of its partitions
+func deviceOnDisk(dev, disk string) bool {
+	if dev == disk {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(sysBlock, disk, dev))
+	return err == nil
+}
+
+// IsMountPoint reports whether a block device is mounted at path
+func IsMountPoint(path string) bool {
+	for _, points := range readMounts() {
+		if slices.Contains(points, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// readMounts maps mounted kernel device names (e.g. "sda1") to their mount points
+func readMounts() map[string][]string {
+	mounts := make(map[string][]string)
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return mounts
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		dev := fields[0]
+		if resolved, err := filepath.EvalSymlinks(dev); err == nil {
+			dev = resolved
+		}
+		name := filepath.Base(dev)
+		mounts[name] = append(mounts[name], unescapeMountPath(fields[1]))
+	}
+	return mounts
+}
+
+// unescapeMountPath decodes the octal escapes (\040 for space) used in /proc/self/mounts
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// readSysString reads a sysfs attribute, returning "" if it is missing
+func readSysString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readSysInt reads a numeric sysfs attribute, returning 0 if it is missing
+func readSysInt(path string) int64 {
+	n, _ := strconv.ParseInt(readSysString(path), 10, 64)
+	return n
+}
@@ -0,0 +1,205 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Download retry policy: attempts are spaced 2s, 4s, 8s apart
+const (
+	downloadAttempts = 4
+	downloadBackoff  = 2 * time.Second
+)
+
+// ErrChecksumMismatch is returned when a download does not match its expected SHA-256
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var (
+	errDownloadTooLarge = fmt.Errorf("download exceeded maximum size of %d bytes", MaxDownloadSize)
+	errRangeRejected    = errors.New("server rejected resume range")
+)
+
+// DownloadFile downloads a file from URL to destination.
+// The body is written to dest+".part" and renamed into place only once it is
+// complete and, when expectedSHA256 is non-empty, its hash matches. Timeouts,
+// connection errors, 429 and 5xx responses are retried with exponential
+// backoff, resuming the partial file with an HTTP Range request when the
+// server supports it.
+func DownloadFile(url, dest, expectedSHA256 string) error {
+	if err := validateDownloadParams(url, dest); err != nil {
+		return err
+	}
+	partPath := dest + ".part"
+	if err := validateDownloadParams(url, partPath); err != nil {
+		return err
+	}
+	expectedSHA256 = strings.ToLower(strings.TrimSpace(expectedSHA256))
+	if expectedSHA256 != "" && !IsValidSHA256(expectedSHA256) {
+		return fmt.Errorf("invalid SHA-256 checksum: %q", expectedSHA256)
+	}
+
+	// A leftover .part from an earlier run may be a different version of the file
+	os.Remove(partPath)
+	defer os.Remove(partPath)
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	d := &download{client: client, url: url, partPath: partPath}
+	backoff := downloadBackoff
+	var err error
+	for attempt := 1; attempt <= downloadAttempts; attempt++ {
+		if err = d.fetch(); err == nil {
+			break
+		}
+		if !isTransientDownloadError(err) || attempt == downloadAttempts {
+			return err
+		}
+		Warning(fmt.Sprintf("Download failed (attempt %d/%d): %v; retrying in %s", attempt, downloadAttempts, err, backoff))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	if expectedSHA256 != "" {
+		actual, err := fileSHA256(partPath)
+		if err != nil {
+			return err
+		}
+		if actual != expectedSHA256 {
+			return fmt.Errorf("%w for %s: expected %s, got %s", ErrChecksumMismatch, url, expectedSHA256, actual)
+		}
+	}
+	return os.Rename(partPath, dest)
+}
+
+// download tracks one file across retry attempts
+type download struct {
+	client   *http.Client
+	url      string
+	partPath string
+	etag     string // ETag of the partial body, used to resume only the same version
+}
+
+// fetch downloads the rest of the file, resuming from the partial file when possible
+func (d *download) fetch() error {
+	offset := d.resumeOffset()
+	req, err := http.NewRequest(http.MethodGet, d.url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", d.etag)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// Full body: the server ignored the range or the file changed
+		flags |= os.O_TRUNC
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Start over on the next attempt
+		d.etag = ""
+		return errRangeRejected
+	default:
+		return &HTTPError{StatusCode: resp.StatusCode, URL: d.url}
+	}
+	if resp.StatusCode == http.StatusOK {
+		// Weak validators cannot be used with If-Range
+		if d.etag = resp.Header.Get("ETag"); strings.HasPrefix(d.etag, "W/") {
+			d.etag = ""
+		}
+	}
+
+	out, err := os.OpenFile(d.partPath, flags, 0600)
+	if err != nil {
+		return err
+	}
+	limitedReader := io.LimitReader(resp.Body, MaxDownloadSize-offset+1)
+	written, copyErr := io.Copy(out, limitedReader)
+	closeErr := out.Close()
+
+	if copyErr != nil {
+		return copyErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if offset+written > MaxDownloadSize {
+		return errDownloadTooLarge
+	}
+	if resp.ContentLength >= 0 && written < resp.ContentLength {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// resumeOffset returns the size of the partial file, or 0 when it cannot be
+// resumed safely (no partial data or no ETag to guard against a changed file)
+func (d *download) resumeOffset() int64 {
+	if d.etag == "" {
+		return 0
+	}
+	info, err := os.Stat(d.partPath)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// isTransientDownloadError reports whether a failed attempt is worth retrying
+func isTransientDownloadError(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= 500 || httpErr.StatusCode == http.StatusTooManyRequests
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		// Local file errors will not fix themselves
+		return false
+	}
+	return !errors.Is(err, errDownloadTooLarge)
+}
+
+// IsValidSHA256 reports whether s is a hex-encoded SHA-256 digest
+func IsValidSHA256(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// fileSHA256 returns the lowercase hex SHA-256 of a file
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// bytesSHA256 returns the lowercase hex SHA-256 of data
+func bytesSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -2,6 +2,9 @@ package common
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -10,25 +13,150 @@ import (
 	"time"
 )
 
+// maxStderrInError bounds how much captured stderr is appended to an error
+const maxStderrInError = 1024
+
+// waitDelay is how long a cancelled command's output pipes may stay open
+// (e.g. held by a child process) before Wait gives up on them
+const waitDelay = 5 * time.Second
+
+// GenerateConfigTimeout bounds nixos-generate-config, which probes hardware
+const GenerateConfigTimeout = 5 * time.Minute
+
+// TimeoutError is returned when a command is killed because its context deadline passed
+type TimeoutError struct {
+	Name    string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("command %s timed out after %.0fs", e.Name, e.Timeout.Seconds())
+}
+
+// commandContext creates a command that is killed when ctx is done
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = waitDelay
+	return cmd
+}
+
+// commandError turns a context deadline into a TimeoutError and appends any
+// captured stderr, so failures explain more than "exit status 1"
+func commandError(ctx context.Context, name string, start time.Time, err error, stderr []byte) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		timeout := time.Since(start)
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = deadline.Sub(start)
+		}
+		return &TimeoutError{Name: name, Timeout: timeout.Round(time.Second)}
+	}
+	msg := strings.TrimSpace(string(stderr))
+	if msg == "" {
+		return err
+	}
+	if len(msg) > maxStderrInError {
+		msg = "..." + msg[len(msg)-maxStderrInError:]
+	}
+	return fmt.Errorf("%w: %s", err, msg)
+}
+
+// RunTimeout runs a command like Run, killing it after timeout
+func RunTimeout(timeout time.Duration, name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return RunCtx(ctx, name, args...)
+}
+
+// RunQuietTimeout runs a command like RunQuiet, killing it after timeout
+func RunQuietTimeout(timeout time.Duration, name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return RunQuietCtx(ctx, name, args...)
+}
+
 // Run executes a command and streams output to stdout/stderr
 func Run(name string, args ...string) error {
-	cmd := exec.Command(name, args...)
+	return RunCtx(context.Background(), name, args...)
+}
+
+// RunCtx executes a command and streams output to stdout/stderr until ctx is done
+func RunCtx(ctx context.Context, name string, args ...string) error {
+	start := time.Now()
+	cmd := commandContext(ctx, name, args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
-	return cmd.Run()
+	err := commandError(ctx, name, start, cmd.Run(), nil)
+	LogCommand(name, args, err)
+	return err
 }
 
-// RunQuiet executes a command without output
-func RunQuiet(name string, args ...string) error {
+// RunLogged executes a command, streaming output to stdout/stderr and appending it to logPath
+func RunLogged(logPath, name string, args ...string) error {
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("open log %s: %w", logPath, err)
+	}
+	defer logFile.Close()
+
+	fmt.Fprintf(logFile, "\n==> %s %s (%s)\n", name, strings.Join(args, " "), time.Now().Format(time.RFC3339))
 	cmd := exec.Command(name, args...)
-	return cmd.Run()
+	cmd.Stdout = io.MultiWriter(os.Stdout, logFile)
+	cmd.Stderr = io.MultiWriter(os.Stderr, logFile)
+	cmd.Stdin = os.Stdin
+	err = cmd.Run()
+	LogCommand(name, args, err)
+	return err
+}
+
+// RunQuiet executes a command without output; stderr is included in the error
+func RunQuiet(name string, args ...string) error {
+	return RunQuietCtx(context.Background(), name, args...)
 }
 
-// RunOutput executes a command and returns its output
+// RunQuietCtx executes a command without output until ctx is done
+func RunQuietCtx(ctx context.Context, name string, args ...string) error {
+	start := time.Now()
+	cmd := commandContext(ctx, name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := commandError(ctx, name, start, cmd.Run(), stderr.Bytes())
+	LogCommand(name, args, err)
+	return err
+}
+
+// RunInputTimeout runs a command quietly with input on stdin, killing it after
+// timeout. Use it for secrets: the input is never logged.
+func RunInputTimeout(timeout time.Duration, input, name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	cmd := commandContext(ctx, name, args...)
+	cmd.Stdin = strings.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := commandError(ctx, name, start, cmd.Run(), stderr.Bytes())
+	LogCommand(name, args, err)
+	return err
+}
+
+// RunOutput executes a command and returns its output; stderr is included in the error
 func RunOutput(name string, args ...string) (string, error) {
-	cmd := exec.Command(name, args...)
+	return RunOutputCtx(context.Background(), name, args...)
+}
+
+// RunOutputCtx executes a command and returns its output until ctx is done
+func RunOutputCtx(ctx context.Context, name string, args ...string) (string, error) {
+	start := time.Now()
+	cmd := commandContext(ctx, name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
 	out, err := cmd.Output()
+	err = commandError(ctx, name, start, err, stderr.Bytes())
+	LogCommand(name, args, err)
 	return strings.TrimSpace(string(out)), err
 }
 
@@ -65,9 +193,23 @@ func RunWithOutput(name string, args ...string) (string, error) {
 
 	var output strings.Builder
 	if err := readAndPrintOutput(bufio.NewReader(stdout), &output); err != nil {
+		LogCommand(name, args, err)
 		return output.String(), err
 	}
-	return output.String(), cmd.Wait()
+	err = cmd.Wait()
+	LogCommand(name, args, err)
+	return output.String(), err
+}
+
+// SSHArgs returns the ssh options used to reach a server, with the identity
+// file when sshKeyPath is set
+func SSHArgs(sshKeyPath string) []string {
+	sshArgs := []string{}
+	if sshKeyPath != "" {
+		sshArgs = append(sshArgs, "-i", sshKeyPath)
+	}
+	sshArgs = append(sshArgs, "-o", "StrictHostKeyChecking=accept-new")
+	return sshArgs
 }
 
 // IsRoot checks if running as root
@@ -131,5 +273,6 @@ func RunWithProgress(name string, args ...string) error {
 	close(done)
 	<-finished
 	fmt.Println()
+	LogCommand(name, args, err)
 	return err
 }
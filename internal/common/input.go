@@ -0,0 +1,159 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/term"
+)
+
+// stdinReader is shared by all prompts so buffered piped input is not lost
+// between calls
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// Non-interactive answer sources, set from --answers and --yes
+var (
+	answers   map[string]*answerList
+	assumeYes bool
+)
+
+// answerList holds the recorded answers for one prompt. A single value is
+// reused every time the prompt is asked; a list is consumed in order and then
+// answers with an empty string, which ends "Enter to finish" loops.
+type answerList struct {
+	values []string
+	repeat bool
+}
+
+// next returns the next recorded answer
+func (a *answerList) next() string {
+	if len(a.values) == 0 {
+		return ""
+	}
+	v := a.values[0]
+	if !a.repeat {
+		a.values = a.values[1:]
+	}
+	return v
+}
+
+// answerString converts a TOML value to prompt input
+func answerString(v interface{}) string {
+	if b, ok := v.(bool); ok {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	return fmt.Sprint(v)
+}
+
+// StringList is a flag that may be given more than once
+type StringList []string
+
+func (l *StringList) String() string { return strings.Join(*l, ", ") }
+
+func (l *StringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// IsInteractive reports whether stdin is a terminal
+func IsInteractive() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// SetAssumeYes makes prompts without a recorded answer take their default and
+// confirmations answer yes when stdin is not a terminal
+func SetAssumeYes(yes bool) {
+	assumeYes = yes
+}
+
+// LoadAnswers reads prompt answers from a TOML file keyed by the exact prompt
+// text, e.g. "Deploy site?" = true, "TLS mode" = "1", or
+// "SSH key (or Enter to finish)" = ["ssh-ed25519 AAAA..."]
+func LoadAnswers(path string) error {
+	var raw map[string]interface{}
+	if _, err := toml.DecodeFile(path, &raw); err != nil {
+		return fmt.Errorf("read answers file: %w", err)
+	}
+	answers = make(map[string]*answerList, len(raw))
+	for question, v := range raw {
+		list, ok := v.([]interface{})
+		if !ok {
+			answers[question] = &answerList{values: []string{answerString(v)}, repeat: true}
+			continue
+		}
+		a := &answerList{}
+		for _, item := range list {
+			a.values = append(a.values, answerString(item))
+		}
+		answers[question] = a
+	}
+	return nil
+}
+
+// ApplyInputFlags configures the answer sources from --yes and --answers,
+// exiting if the answers file cannot be read
+func ApplyInputFlags(yes bool, answersPath string) {
+	SetAssumeYes(yes)
+	if answersPath == "" {
+		return
+	}
+	if err := LoadAnswers(answersPath); err != nil {
+		Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// recordedAnswer returns the answer for question from the answers file
+func recordedAnswer(question string) (string, bool) {
+	a, ok := answers[question]
+	if !ok {
+		return "", false
+	}
+	answer := a.next()
+	fmt.Printf("%s %s(from answers file)%s\n", answer, Cyan, Reset)
+	return answer, true
+}
+
+// PromptSecret asks for a secret without echoing it. The value is never printed
+// back. Without a terminal it uses the answers file, then a line read from
+// stdin, and aborts if neither supplies a value.
+func PromptSecret(question string) string {
+	fmt.Printf("%s: ", question)
+	if a, ok := answers[question]; ok {
+		fmt.Printf("%s(from answers file)%s\n", Cyan, Reset)
+		return a.next()
+	}
+
+	if IsInteractive() {
+		secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(secret))
+	}
+
+	input, err := stdinReader.ReadString('\n')
+	fmt.Println()
+	input = strings.TrimSpace(input)
+	if input == "" && err != nil {
+		requireInteractive(question)
+	}
+	return input
+}
+
+// requireInteractive aborts when stdin is not a terminal and no answer source applies
+func requireInteractive(question string) {
+	if IsInteractive() {
+		return
+	}
+	fmt.Println()
+	Error(fmt.Sprintf("Interactive input required for %q; pass --yes/--answers", question))
+	os.Exit(1)
+}
@@ -0,0 +1,169 @@
+package common
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// publicIPURL echoes the caller's address over whichever family connects
+	publicIPURL = "https://api64.ipify.org"
+
+	// publicIPTimeout bounds each public address lookup
+	publicIPTimeout = 3 * time.Second
+)
+
+// Addresses holds the best IPv4 and IPv6 address of this machine, either
+// of which may be empty
+type Addresses struct {
+	IPv4 string
+	IPv6 string
+}
+
+// List returns the addresses present, IPv4 first
+func (a Addresses) List() []string {
+	var list []string
+	for _, ip := range []string{a.IPv4, a.IPv6} {
+		if ip != "" {
+			list = append(list, ip)
+		}
+	}
+	return list
+}
+
+// String returns the addresses present separated by commas, or "N/A"
+func (a Addresses) String() string {
+	if list := a.List(); len(list) > 0 {
+		return strings.Join(list, ", ")
+	}
+	return "N/A"
+}
+
+// addressRank orders candidate addresses: public global unicast first, then
+// private ones; loopback, link-local and the like are not usable at all
+func addressRank(ip net.IP) int {
+	switch {
+	case !ip.IsGlobalUnicast():
+		return 0
+	case ip.IsPrivate():
+		return 1
+	default:
+		return 2
+	}
+}
+
+// pickAddresses returns the best-ranked IPv4 and IPv6 address of ips,
+// keeping the first of equally ranked ones
+func pickAddresses(ips []net.IP) Addresses {
+	var a Addresses
+	best4, best6 := 0, 0
+	for _, ip := range ips {
+		rank := addressRank(ip)
+		if ip.To4() != nil {
+			if rank > best4 {
+				a.IPv4, best4 = ip.String(), rank
+			}
+		} else if rank > best6 {
+			a.IPv6, best6 = ip.String(), rank
+		}
+	}
+	return a
+}
+
+// GetAddresses returns the best IPv4 and IPv6 address of the interfaces
+// that are up, preferring public global unicast addresses
+func GetAddresses() Addresses {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return Addresses{}
+	}
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+	return pickAddresses(ips)
+}
+
+// lookupPublicIP asks publicIPURL for this machine's address over network
+// ("tcp4" or "tcp6"), returning "" when that fails
+func lookupPublicIP(network string) string {
+	dialer := &net.Dialer{Timeout: publicIPTimeout}
+	client := &http.Client{
+		Timeout: publicIPTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	resp, err := client.Get(publicIPURL)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(data)))
+	if ip == nil || (network == "tcp4") != (ip.To4() != nil) {
+		return ""
+	}
+	return ip.String()
+}
+
+// isPublicIP reports whether ip is a public global unicast address
+func isPublicIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && addressRank(parsed) == 2
+}
+
+// PublicAddresses returns GetAddresses, asking a "what's my IP" service for
+// each family that has no public address locally, so a NATed host shows the
+// address it is reached on. Families the lookup fails for keep their local
+// address.
+func PublicAddresses() Addresses {
+	a := GetAddresses()
+	lookups := make(map[string]chan string)
+	for network, addr := range map[string]string{"tcp4": a.IPv4, "tcp6": a.IPv6} {
+		if !isPublicIP(addr) {
+			result := make(chan string, 1)
+			go func() { result <- lookupPublicIP(network) }()
+			lookups[network] = result
+		}
+	}
+	if ip := receiveLookup(lookups["tcp4"]); ip != "" {
+		a.IPv4 = ip
+	}
+	if ip := receiveLookup(lookups["tcp6"]); ip != "" {
+		a.IPv6 = ip
+	}
+	return a
+}
+
+// receiveLookup waits for a lookup started by PublicAddresses, returning ""
+// for one that was not started
+func receiveLookup(result chan string) string {
+	if result == nil {
+		return ""
+	}
+	return <-result
+}
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLogPath is where UI messages and executed commands are logged
+const DefaultLogPath = "/var/log/juniper-host.log"
+
+var (
+	logMu      sync.Mutex
+	logFile    *os.File
+	logPath    string
+	logCommand string
+)
+
+// ansiRe matches ANSI escape sequences, which are stripped from log lines
+var ansiRe = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+
+// InitLog starts appending log lines for the named subcommand to path
+// (DefaultLogPath if empty). If the file cannot be opened, a file in the
+// temp directory is used instead; if that also fails, logging is disabled.
+func InitLog(command, path string) {
+	if path == "" {
+		path = DefaultLogPath
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		path = filepath.Join(os.TempDir(), "juniper-host.log")
+		if f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			return
+		}
+	}
+	logMu.Lock()
+	logFile, logPath, logCommand = f, path, command
+	logMu.Unlock()
+	Logf("START", "juniper-host %s", strings.Join(os.Args[1:], " "))
+}
+
+// LogPath returns the active log file path, or "" when logging is disabled
+func LogPath() string {
+	logMu.Lock()
+	defer logMu.Unlock()
+	return logPath
+}
+
+// Logf writes a timestamped line to the log file without printing it
+func Logf(level, format string, args ...interface{}) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	if logFile == nil {
+		return
+	}
+	msg := ansiRe.ReplaceAllString(fmt.Sprintf(format, args...), "")
+	fmt.Fprintf(logFile, "%s [%s] %-7s %s\n", time.Now().Format(time.RFC3339), logCommand, level, msg)
+}
+
+// LogWriter returns a writer that appends raw output to the log file
+func LogWriter() io.Writer {
+	logMu.Lock()
+	defer logMu.Unlock()
+	if logFile == nil {
+		return io.Discard
+	}
+	return logFile
+}
+
+// LogCommand records an executed command and its exit status
+func LogCommand(name string, args []string, err error) {
+	cmdline := strings.TrimSpace(name + " " + strings.Join(args, " "))
+	Logf("EXEC", "%s", cmdline)
+	if err == nil {
+		Logf("EXIT", "0")
+		return
+	}
+	Logf("EXIT", "%v", err)
+}
+
+// Exit exits with code, pointing at the log file when the code signals
+// failure, after flushing output masked by MaskStdio
+func Exit(code int) {
+	if path := LogPath(); path != "" && code != 0 {
+		Logf("EXIT", "juniper-host exiting with status %d", code)
+		fmt.Printf("Full log: %s\n", path)
+	}
+	RestoreStdio()
+	os.Exit(code)
+}
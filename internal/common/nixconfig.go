@@ -0,0 +1,147 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	// SSHKeyPlaceholder is the commented-out key in the stock configuration.nix
+	SSHKeyPlaceholder = `# "ssh-ed25519 AAAA... your-key-here"`
+
+	// BootDevicePlaceholder is the GRUB device replaced with the target disk
+	BootDevicePlaceholder = `device = "/dev/vda";`
+)
+
+var (
+	hostNameSettingPattern = regexp.MustCompile(`networking\.hostName = "[^"]*"`)
+	timeZoneSettingPattern = regexp.MustCompile(`time\.timeZone = "[^"]*"`)
+	timeZonePattern        = regexp.MustCompile(`^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+){0,2}$`)
+	userNamePattern        = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+	nixKeyLinePattern      = regexp.MustCompile(`^\s*"((?:[^"\\]|\\.)*)"`)
+)
+
+// EscapeNixString escapes special characters for Nix string literals
+func EscapeNixString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, `$`, `\$`)
+	return s
+}
+
+// NixSSHKeyList renders keys as the body of an authorizedKeys.keys list,
+// one quoted key per line indented for the top level of configuration.nix
+func NixSSHKeyList(keys []string) string {
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString(fmt.Sprintf("    \"%s\"\n", EscapeNixString(key)))
+	}
+	return b.String()
+}
+
+// UnescapeNixString reverses EscapeNixString
+func UnescapeNixString(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// IsValidUserName validates a Unix account name such as "deploy"
+func IsValidUserName(user string) bool {
+	return userNamePattern.MatchString(user)
+}
+
+// userSSHKeysPattern matches a user's authorizedKeys.keys list
+func userSSHKeysPattern(user string) *regexp.Regexp {
+	return regexp.MustCompile(fmt.Sprintf(`users\.users\.%s\.openssh\.authorizedKeys\.keys = \[([\s\S]*?)\];`, regexp.QuoteMeta(user)))
+}
+
+// UserSSHKeys returns the keys in a user's authorizedKeys.keys list in
+// configuration.nix content; commented-out lines are not keys
+func UserSSHKeys(content, user string) ([]string, error) {
+	m := userSSHKeysPattern(user).FindStringSubmatch(content)
+	if m == nil {
+		return nil, fmt.Errorf("no SSH key list for user %s in configuration", user)
+	}
+	var keys []string
+	for _, line := range strings.Split(m[1], "\n") {
+		if km := nixKeyLinePattern.FindStringSubmatch(line); km != nil {
+			keys = append(keys, UnescapeNixString(km[1]))
+		}
+	}
+	return keys, nil
+}
+
+// SetUserSSHKeys replaces a user's authorizedKeys.keys list in
+// configuration.nix content with keys
+func SetUserSSHKeys(content, user string, keys []string) (string, error) {
+	re := userSSHKeysPattern(user)
+	if !re.MatchString(content) {
+		return "", fmt.Errorf("no SSH key list for user %s in configuration", user)
+	}
+	list := fmt.Sprintf("users.users.%s.openssh.authorizedKeys.keys = [\n%s  ];", user, NixSSHKeyList(keys))
+	return re.ReplaceAllLiteralString(content, list), nil
+}
+
+// IsValidTimeZone validates a tz database name such as "UTC" or "Europe/Berlin"
+func IsValidTimeZone(tz string) bool {
+	return len(tz) <= 64 && timeZonePattern.MatchString(tz)
+}
+
+// UpdateHostname sets networking.hostName in configuration.nix content
+func UpdateHostname(content, hostname string) (string, error) {
+	setting := fmt.Sprintf(`networking.hostName = "%s"`, EscapeNixString(hostname))
+	if !hostNameSettingPattern.MatchString(content) {
+		return "", fmt.Errorf("failed to find hostname configuration in file")
+	}
+	return hostNameSettingPattern.ReplaceAllLiteralString(content, setting), nil
+}
+
+// UpdateTimeZone sets time.timeZone in configuration.nix content
+func UpdateTimeZone(content, tz string) (string, error) {
+	setting := fmt.Sprintf(`time.timeZone = "%s"`, EscapeNixString(tz))
+	if !timeZoneSettingPattern.MatchString(content) {
+		return "", fmt.Errorf("failed to find time zone configuration in file")
+	}
+	return timeZoneSettingPattern.ReplaceAllLiteralString(content, setting), nil
+}
+
+// InjectSSHKeys replaces the deploy and root SSH key placeholder lines in
+// configuration.nix content with keys
+func InjectSSHKeys(content string, keys []string) (string, error) {
+	updated := strings.ReplaceAll(content, "    "+SSHKeyPlaceholder+"\n", NixSSHKeyList(keys))
+	if updated == content {
+		return "", fmt.Errorf("SSH key placeholder not found in configuration")
+	}
+	return updated, nil
+}
+
+// SetBootDevice points the GRUB boot device in configuration.nix content at disk
+func SetBootDevice(content, disk string) (string, error) {
+	setting := fmt.Sprintf(`device = "%s";`, EscapeNixString(disk))
+	updated := strings.Replace(content, BootDevicePlaceholder, setting, 1)
+	if updated == content {
+		return "", fmt.Errorf("boot device placeholder '/dev/vda' not found")
+	}
+	return updated, nil
+}
+
+// PatchConfigFile applies patch to the configuration.nix at path
+func PatchConfigFile(path string, patch func(string) (string, error)) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	content, err := patch(string(data))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(content), 0600)
+}
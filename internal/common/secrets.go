@@ -0,0 +1,209 @@
+package common
+
+import (
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// secretMask replaces each registered secret in masked output
+const secretMask = "***"
+
+// SecretMasker replaces registered secret strings in text written through it
+type SecretMasker struct {
+	mu       sync.RWMutex
+	secrets  map[string]bool
+	replacer *strings.Replacer
+}
+
+// NewSecretMasker returns a masker with no secrets registered
+func NewSecretMasker() *SecretMasker {
+	return &SecretMasker{secrets: make(map[string]bool)}
+}
+
+// Register adds s to the secrets masked; an empty s is ignored, since
+// masking it would insert the mask between every character
+func (m *SecretMasker) Register(s string) {
+	if s == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.secrets[s] {
+		return
+	}
+	m.secrets[s] = true
+
+	// Longest first, so a secret containing another is masked whole
+	sorted := make([]string, 0, len(m.secrets))
+	for secret := range m.secrets {
+		sorted = append(sorted, secret)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	pairs := make([]string, 0, 2*len(sorted))
+	for _, secret := range sorted {
+		pairs = append(pairs, secret, secretMask)
+	}
+	m.replacer = strings.NewReplacer(pairs...)
+}
+
+// Active reports whether any secret is registered
+func (m *SecretMasker) Active() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.replacer != nil
+}
+
+// Mask returns s with every registered secret replaced by ***
+func (m *SecretMasker) Mask(s string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.replacer == nil {
+		return s
+	}
+	return m.replacer.Replace(s)
+}
+
+// partialSuffix returns the length of the longest suffix of s that is the
+// start of a secret, which must be held back until the rest arrives
+func (m *SecretMasker) partialSuffix(s string) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	longest := 0
+	for secret := range m.secrets {
+		for n := min(len(secret)-1, len(s)); n > longest; n-- {
+			if strings.HasSuffix(s, secret[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
+
+// maskedWriter masks each write before passing it on
+type maskedWriter struct {
+	masker *SecretMasker
+	w      io.Writer
+}
+
+// Write masks p and writes it; a secret split across two writes is not
+// recognised, so callers should write whole messages
+func (mw maskedWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(mw.w, mw.masker.Mask(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Writer returns a writer that masks the secrets of m in everything written
+// to w
+func (m *SecretMasker) Writer(w io.Writer) io.Writer {
+	return maskedWriter{masker: m, w: w}
+}
+
+// secrets is the process-wide masker behind RegisterSecret
+var secrets = NewSecretMasker()
+
+// RegisterSecret masks s in output written through MaskedWriter and, once
+// MaskStdio is called, on stdout and stderr; an empty s is ignored
+func RegisterSecret(s string) {
+	secrets.Register(s)
+}
+
+// MaskedWriter returns a writer that masks registered secrets before
+// writing to w
+func MaskedWriter(w io.Writer) io.Writer {
+	return secrets.Writer(w)
+}
+
+// maskedStream is stdout or stderr redirected through a pipe to the masker
+type maskedStream struct {
+	file *os.File      // os.Stdout or os.Stderr as it was before masking
+	pipe *os.File      // Write end now installed in its place
+	done chan struct{} // Closed once the copier has drained the pipe
+}
+
+var (
+	maskedStreamsMu sync.Mutex
+	maskedStreams   []*maskedStream
+)
+
+// copyMasked copies the pipe r to w, masking secrets. A tail that may be
+// the start of a secret is held back until the next read completes it.
+func copyMasked(w io.Writer, r io.Reader, done chan struct{}) {
+	defer close(done)
+	buf := make([]byte, 32*1024)
+	pending := ""
+	for {
+		n, err := r.Read(buf)
+		data := secrets.Mask(pending + string(buf[:n]))
+		keep := secrets.partialSuffix(data)
+		if err != nil {
+			keep = 0
+		}
+		io.WriteString(w, data[:len(data)-keep])
+		pending = data[len(data)-keep:]
+		if err != nil {
+			return
+		}
+	}
+}
+
+// maskStream installs a masking pipe in place of *f, returning nil when f
+// is a terminal or the pipe cannot be created
+func maskStream(f **os.File) *maskedStream {
+	if term.IsTerminal(int((*f).Fd())) {
+		return nil
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil
+	}
+	s := &maskedStream{file: *f, pipe: w, done: make(chan struct{})}
+	go copyMasked(s.file, r, s.done)
+	*f = w
+	return s
+}
+
+// MaskStdio routes stdout and stderr, including the output of commands
+// started afterwards, through the registered secrets so they never reach CI
+// logs. Terminals are left alone: output there is only seen by whoever
+// supplied the secrets, and interactive features keep working. It does
+// nothing until a secret is registered. RestoreStdio must run before the
+// process exits, which Exit does.
+func MaskStdio() {
+	maskedStreamsMu.Lock()
+	defer maskedStreamsMu.Unlock()
+	if !secrets.Active() || maskedStreams != nil {
+		return
+	}
+	maskedStreams = []*maskedStream{}
+	for _, f := range []**os.File{&os.Stdout, &os.Stderr} {
+		if s := maskStream(f); s != nil {
+			maskedStreams = append(maskedStreams, s)
+		}
+	}
+}
+
+// RestoreStdio undoes MaskStdio, waiting until everything written so far
+// has been masked and passed on
+func RestoreStdio() {
+	maskedStreamsMu.Lock()
+	defer maskedStreamsMu.Unlock()
+	for _, s := range maskedStreams {
+		if os.Stdout == s.pipe {
+			os.Stdout = s.file
+		}
+		if os.Stderr == s.pipe {
+			os.Stderr = s.file
+		}
+		s.pipe.Close()
+		<-s.done
+	}
+	maskedStreams = nil
+}
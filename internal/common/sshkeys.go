@@ -0,0 +1,212 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// forgeKeysTimeout bounds fetching a user's public keys
+	forgeKeysTimeout = 30 * time.Second
+
+	// maxForgeKeysSize caps the .keys response; real ones are a few KB
+	maxForgeKeysSize = 64 << 10
+)
+
+// forgeUserPattern matches GitHub and GitLab usernames
+var forgeUserPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,254}$`)
+
+// SSHKeyOptions are the key sources accepted by bootstrap and install
+type SSHKeyOptions struct {
+	Keys       []string // Every --ssh-key
+	KeysFile   string   // --ssh-keys-file
+	GitHubUser string   // --github-user
+	GitLabUser string   // --gitlab-user
+}
+
+// ReadSSHKeysFile reads every SSH key from a public key or
+// authorized_keys file. Comments and blank lines are ignored; lines that are
+// not valid keys (including ones with authorized_keys options) are skipped
+// with a warning.
+func ReadSSHKeysFile(path string) ([]string, error) {
+	if strings.Contains(path, "..") {
+		return nil, fmt.Errorf("SSH key file path cannot contain '..'")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key file: %w", err)
+	}
+	keys := ParseSSHKeys(string(data), path)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no valid SSH key found in file")
+	}
+	return keys, nil
+}
+
+// ParseSSHKeys returns the distinct valid keys in authorized_keys content,
+// warning about invalid lines; source names the content in warnings
+func ParseSSHKeys(data, source string) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := CheckSSHKey(line); err != nil {
+			Warning(fmt.Sprintf("%s line %d: not a valid SSH public key (%v), skipping", source, i+1, err))
+			continue
+		}
+		if seen[line] {
+			continue
+		}
+		seen[line] = true
+		keys = append(keys, line)
+	}
+	return keys
+}
+
+// forgeKeySource is a code forge that publishes users' SSH keys at <base>/<user>.keys
+type forgeKeySource struct {
+	name string // Display name
+	base string // Site URL
+	user string // Username from the flag
+}
+
+// url returns the address of the user's public keys
+func (s forgeKeySource) url() string {
+	return fmt.Sprintf("%s/%s.keys", s.base, s.user)
+}
+
+// forgeKeySources returns the forges named by --github-user and --gitlab-user
+func (o SSHKeyOptions) forgeKeySources() []forgeKeySource {
+	var sources []forgeKeySource
+	if o.GitHubUser != "" {
+		sources = append(sources, forgeKeySource{"GitHub", "https://github.com", o.GitHubUser})
+	}
+	if o.GitLabUser != "" {
+		sources = append(sources, forgeKeySource{"GitLab", "https://gitlab.com", o.GitLabUser})
+	}
+	return sources
+}
+
+// fetchForgeKeys downloads and validates a user's public keys
+func fetchForgeKeys(s forgeKeySource) ([]string, error) {
+	if !forgeUserPattern.MatchString(s.user) {
+		return nil, fmt.Errorf("invalid %s username %q", s.name, s.user)
+	}
+	client := &http.Client{Timeout: forgeKeysTimeout}
+	resp, err := client.Get(s.url())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned HTTP %d", s.url(), resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxForgeKeysSize))
+	if err != nil {
+		return nil, err
+	}
+	keys := ParseSSHKeys(string(data), s.url())
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s user %s has no SSH keys", s.name, s.user)
+	}
+	return keys, nil
+}
+
+// printKeyFingerprints lists keys the way ssh-keygen -l does
+func printKeyFingerprints(keys []string) {
+	for _, key := range keys {
+		keyType, bits, _ := ValidateSSHKeyStrength(key)
+		fingerprint, err := SSHKeyFingerprint(key)
+		if err != nil {
+			fingerprint = "(unparseable)"
+		}
+		fmt.Printf("    %d %s (%s)\n", bits, fingerprint, keyType)
+	}
+}
+
+// resolveForgeKeys fetches the keys of --github-user and --gitlab-user and
+// asks before using them. Failures only warn, so the caller falls back to
+// the other key sources or a prompt.
+func (o SSHKeyOptions) resolveForgeKeys() []string {
+	var keys []string
+	for _, s := range o.forgeKeySources() {
+		Info(fmt.Sprintf("Fetching SSH keys for %s user %s...", s.name, s.user))
+		fetched, err := fetchForgeKeys(s)
+		if err != nil {
+			Warning(fmt.Sprintf("Could not fetch %s keys: %v", s.name, err))
+			continue
+		}
+		fmt.Printf("Found %d key(s) at %s:\n", len(fetched), s.url())
+		printKeyFingerprints(fetched)
+		if !Confirm(fmt.Sprintf("Install these %d key(s)?", len(fetched)), true) {
+			continue
+		}
+		for _, key := range fetched {
+			if !slices.Contains(keys, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// Resolve gets SSH keys from every --ssh-key, the keys file, and any
+// fetched for --github-user and --gitlab-user. Only an unreadable keys file
+// is an error.
+func (o SSHKeyOptions) Resolve() ([]string, error) {
+	keys := slices.Clone(o.Keys)
+	var fileKeys []string
+	if o.KeysFile != "" {
+		var err error
+		if fileKeys, err = ReadSSHKeysFile(o.KeysFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range append(fileKeys, o.resolveForgeKeys()...) {
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// DescribeSSHKey returns a key's type, SHA256 fingerprint and comment for
+// confirmation output, to compare against ssh-keygen -lf
+func DescribeSSHKey(key string) string {
+	fields := strings.Fields(key)
+	description := fields[0]
+	if fingerprint, err := SSHKeyFingerprint(key); err == nil {
+		description += " " + fingerprint
+	}
+	if len(fields) < 3 {
+		return description + " (no comment)"
+	}
+	return description + " " + strings.Join(fields[2:], " ")
+}
+
+// UsableSSHKeys drops keys that fail validation and warns about weak ones,
+// which are still kept since rejecting the only key would lock the user out
+func UsableSSHKeys(keys []string) []string {
+	var valid []string
+	for _, key := range keys {
+		if err := CheckSSHKey(key); err != nil {
+			Warning(fmt.Sprintf("SSH key failed validation (%v), skipping it.", err))
+			continue
+		}
+		if _, _, err := ValidateSSHKeyStrength(key); err != nil {
+			Warning(fmt.Sprintf("SSH key is weaker than recommended: %v", err))
+			Warning("Replace it with an ssh-ed25519 key (ssh-keygen -t ed25519) soon.")
+		}
+		valid = append(valid, key)
+	}
+	return valid
+}
@@ -2,24 +2,37 @@ package common
 
 import (
 	"bufio"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
-	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 const (
-	RepoBase = "https://raw.githubusercontent.com/JuniperBible/Public.Tool.Server.JuniperBible/main"
+	// RepoRawURL serves raw files of the repository; a ref and path follow it
+	RepoRawURL = "https://raw.githubusercontent.com/JuniperBible/Public.Tool.Server.JuniperBible"
+
+	// DefaultRef is the branch files are fetched from unless a ref is given
+	DefaultRef = "main"
+
+	RepoBase = RepoRawURL + "/" + DefaultRef
 )
 
 // Pre-compiled regex patterns for validation
 var (
-	// Note: ssh-dss (DSA) is excluded as it's deprecated and limited to 1024 bits
-	sshKeyPattern = regexp.MustCompile(`^(ssh-rsa|ssh-ed25519|ecdsa-sha2-nistp256|ecdsa-sha2-nistp384|ecdsa-sha2-nistp521)\s+[A-Za-z0-9+/]+=*(\s+[^\s].*)?$`)
-	diskPathPattern = regexp.MustCompile(`^/dev/(nvme\d+n\d+|[svx]d[a-z]+|loop\d+)$`)
+	sshKeyPattern   = regexp.MustCompile(`^(` + sshKeyTypeAlternation() + `)\s+[A-Za-z0-9+/]+=*(\s+[^\s].*)?$`)
+	diskPathPattern = regexp.MustCompile(`^/dev/(nvme\d+n\d+|[svx]d[a-z]+|loop\d+|mmcblk\d+)$`)
+	// Stable names for whole disks; "-partN" entries are partitions and rejected
+	diskByIDPattern = regexp.MustCompile(`^/dev/disk/by-id/[A-Za-z0-9._:+@-]+$`)
+	byIDPartPattern = regexp.MustCompile(`-part\d+$`)
 	hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
 	domainPattern   = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
 )
@@ -33,15 +46,10 @@ func GetHostname() string {
 	return hostname
 }
 
-// GetIP returns the first IP address
+// GetIP returns the best local address, IPv4 if there is one (see GetAddresses)
 func GetIP() string {
-	out, err := RunOutput("hostname", "-I")
-	if err != nil {
-		return "N/A"
-	}
-	parts := strings.Fields(out)
-	if len(parts) > 0 {
-		return parts[0]
+	if list := GetAddresses().List(); len(list) > 0 {
+		return list[0]
 	}
 	return "N/A"
 }
@@ -76,25 +84,71 @@ func GetKernel() string {
 	return out
 }
 
-// DetectDisk auto-detects the primary disk
-func DetectDisk() string {
-	disks := []string{"/dev/vda", "/dev/sda", "/dev/nvme0n1", "/dev/xvda"}
-	for _, disk := range disks {
-		if BlockDeviceExists(disk) {
-			return disk
+// GetPartitions returns the partition paths for a disk
+// Returns: bios_grub (1), ESP (2), root (3)
+// /dev/disk/by-id paths are resolved to the kernel device first.
+func GetPartitions(disk string) (biosGrub, esp, root string) {
+	return PartitionPath(disk, 1), PartitionPath(disk, 2), PartitionPath(disk, 3)
+}
+
+// GetUEFIPartitions returns the partition paths for a UEFI-only disk
+// Returns: ESP (1), root (2)
+func GetUEFIPartitions(disk string) (esp, root string) {
+	return PartitionPath(disk, 1), PartitionPath(disk, 2)
+}
+
+// PartitionPath returns the path of partition n on disk
+// /dev/disk/by-id paths are resolved to the kernel device first.
+func PartitionPath(disk string, n int) string {
+	disk = resolveDiskPath(disk)
+	// Devices whose name ends in a digit use a "p" separator
+	// (e.g., nvme0n1p1, loop0p1, mmcblk0p1)
+	if last := disk[len(disk)-1]; last >= '0' && last <= '9' {
+		return fmt.Sprintf("%sp%d", disk, n)
+	}
+	return fmt.Sprintf("%s%d", disk, n)
+}
+
+// DiskSize returns the size of a whole disk in bytes, or 0 if unknown
+func DiskSize(disk string) int64 {
+	name := filepath.Base(resolveDiskPath(disk))
+	return readSysInt(filepath.Join(sysBlock, name, "size")) * 512
+}
+
+// TotalMemory returns the installed RAM in bytes, or 0 if unknown
+func TotalMemory() int64 {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb * 1024
 		}
 	}
-	return ""
+	return 0
 }
 
-// GetPartitions returns the partition paths for a disk
-// Returns: bios_grub (1), ESP (2), root (3)
-func GetPartitions(disk string) (biosGrub, esp, root string) {
-	// NVMe and loop devices use "p" separator (e.g., nvme0n1p1, loop0p1)
-	if strings.Contains(disk, "nvme") || strings.Contains(disk, "loop") {
-		return disk + "p1", disk + "p2", disk + "p3"
+// resolveDiskPath follows a /dev/disk/by-id symlink to its kernel device
+// (e.g., /dev/sda); other paths, or links that cannot be resolved, are
+// returned unchanged
+func resolveDiskPath(disk string) string {
+	if !strings.HasPrefix(disk, "/dev/disk/by-id/") {
+		return disk
+	}
+	resolved, err := filepath.EvalSymlinks(disk)
+	if err != nil {
+		return disk
 	}
-	return disk + "1", disk + "2", disk + "3"
+	return resolved
 }
 
 // MaxDownloadSize is the maximum file size for downloads (100MB)
@@ -113,50 +167,6 @@ func validateDownloadParams(url, dest string) error {
 	return nil
 }
 
-// writeDownloadToFile writes response body to file with size limit
-func writeDownloadToFile(body io.ReadCloser, dest string) error {
-	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
-	}
-
-	limitedReader := io.LimitReader(body, MaxDownloadSize+1)
-	written, copyErr := io.Copy(out, limitedReader)
-	closeErr := out.Close()
-
-	if copyErr != nil {
-		return copyErr
-	}
-	if closeErr != nil {
-		return closeErr
-	}
-	if written > MaxDownloadSize {
-		os.Remove(dest)
-		return fmt.Errorf("download exceeded maximum size of %d bytes", MaxDownloadSize)
-	}
-	return nil
-}
-
-// DownloadFile downloads a file from URL to destination
-func DownloadFile(url, dest string) error {
-	if err := validateDownloadParams(url, dest); err != nil {
-		return err
-	}
-
-	client := &http.Client{Timeout: 5 * time.Minute}
-	resp, err := client.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return &HTTPError{StatusCode: resp.StatusCode, URL: url}
-	}
-
-	return writeDownloadToFile(resp.Body, dest)
-}
-
 // HTTPError represents an HTTP error
 type HTTPError struct {
 	StatusCode int
@@ -167,28 +177,144 @@ func (e *HTTPError) Error() string {
 	return fmt.Sprintf("HTTP %d from %s", e.StatusCode, e.URL)
 }
 
-// MaxSSHKeyLength is the maximum allowed SSH key length
-const MaxSSHKeyLength = 8192
+// SSHKeyTypes are the accepted SSH public key types, each also accepted as
+// an OpenSSH certificate (see SSHCertType). The sk- types are FIDO2 security
+// keys such as a YubiKey. ssh-dss (DSA) is excluded as it's deprecated and
+// limited to 1024 bits.
+var SSHKeyTypes = []string{
+	"ssh-ed25519",
+	"ssh-rsa",
+	"ecdsa-sha2-nistp256",
+	"ecdsa-sha2-nistp384",
+	"ecdsa-sha2-nistp521",
+	"sk-ssh-ed25519@openssh.com",
+	"sk-ecdsa-sha2-nistp256@openssh.com",
+}
 
-// IsValidSSHKey validates an SSH public key format
-func IsValidSSHKey(key string) bool {
+// SSHCertType returns the certificate type for an SSH key type, e.g.
+// ssh-ed25519-cert-v01@openssh.com for ssh-ed25519
+func SSHCertType(keyType string) string {
+	return strings.TrimSuffix(keyType, "@openssh.com") + "-cert-v01@openssh.com"
+}
+
+// sshKeyTypeAlternation returns a regexp alternation of every accepted key
+// and certificate type
+func sshKeyTypeAlternation() string {
+	var types []string
+	for _, t := range SSHKeyTypes {
+		types = append(types, regexp.QuoteMeta(t), regexp.QuoteMeta(SSHCertType(t)))
+	}
+	return strings.Join(types, "|")
+}
+
+// SSHKeyTypesDescription lists the accepted key types for error messages
+func SSHKeyTypesDescription() string {
+	return strings.Join(SSHKeyTypes, ", ") + " (or their -cert-v01@openssh.com certificates)"
+}
+
+// MaxSSHKeyLength is the maximum allowed SSH key length, enough for a
+// certificate of a 16384-bit RSA key signed by a 16384-bit RSA CA
+const MaxSSHKeyLength = 16384
+
+// CheckSSHKey validates an SSH public key, saying what is wrong with it. The
+// pattern is only a cheap pre-filter; the key must also parse, so a
+// truncated or mistyped blob is caught now rather than at the first login.
+func CheckSSHKey(key string) error {
 	key = strings.TrimSpace(key)
 	// Reject keys with newlines (multi-key injection)
 	if strings.ContainsAny(key, "\n\r") {
-		return false
+		return errors.New("contains a line break; enter one key at a time")
 	}
 	// Reject extremely long keys
 	if len(key) > MaxSSHKeyLength {
-		return false
+		return fmt.Errorf("longer than %d characters", MaxSSHKeyLength)
 	}
 	// Validate format: type + space + base64 + optional comment
-	return sshKeyPattern.MatchString(key)
+	if !sshKeyPattern.MatchString(key) {
+		return fmt.Errorf("not of a supported type (%s) followed by the key data", SSHKeyTypesDescription())
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return errors.New("key data does not decode; it may be truncated or mistyped")
+	}
+	if keyType := strings.Fields(key)[0]; pub.Type() != keyType {
+		return fmt.Errorf("key data is %s but the key says %s", pub.Type(), keyType)
+	}
+	return nil
+}
+
+// IsValidSSHKey reports whether CheckSSHKey accepts key
+func IsValidSSHKey(key string) bool {
+	return CheckSSHKey(key) == nil
+}
+
+// DefaultMinRSABits is the shortest RSA key accepted without a warning
+const DefaultMinRSABits = 3072
+
+// minRSABits is the RSA key length policy applied by ValidateSSHKeyStrength
+var minRSABits = DefaultMinRSABits
+
+// ErrWeakSSHKey is returned for keys below the key-strength policy
+var ErrWeakSSHKey = errors.New("weak SSH key")
+
+// SetMinRSABits sets the shortest RSA key ValidateSSHKeyStrength accepts (0 disables the check)
+func SetMinRSABits(bits int) {
+	minRSABits = bits
+}
+
+// ValidateSSHKeyStrength parses an authorized_keys line and reports its type
+// and length in bits. RSA keys shorter than the configured minimum return an
+// error wrapping ErrWeakSSHKey; Ed25519 and ECDSA keys are always accepted.
+// A certificate is judged by the key it certifies.
+func ValidateSSHKeyStrength(key string) (keyType string, bitLength int, err error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(key)))
+	if err != nil {
+		return "", 0, fmt.Errorf("parse SSH key: %w", err)
+	}
+	keyType = pub.Type()
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		pub = cert.Key
+	}
+	cryptoKey, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return keyType, 0, nil
+	}
+	switch k := cryptoKey.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		bitLength = k.N.BitLen()
+		if bitLength < minRSABits {
+			return keyType, bitLength, fmt.Errorf("%w: %d-bit RSA key, at least %d bits required", ErrWeakSSHKey, bitLength, minRSABits)
+		}
+	case *ecdsa.PublicKey:
+		bitLength = k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		bitLength = 256
+	}
+	return keyType, bitLength, nil
+}
+
+// SSHKeyFingerprint returns the SHA256 fingerprint of an authorized_keys
+// line, as printed by ssh-keygen -l
+func SSHKeyFingerprint(key string) (string, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(key)))
+	if err != nil {
+		return "", fmt.Errorf("parse SSH key: %w", err)
+	}
+	return ssh.FingerprintSHA256(pub), nil
 }
 
 // IsValidDiskPath validates a disk device path
 func IsValidDiskPath(path string) bool {
-	// Match standard Linux disk paths: /dev/vda, /dev/sda, /dev/sdaa, /dev/nvme0n1, /dev/xvda, etc.
-	return diskPathPattern.MatchString(path)
+	// Match standard Linux disk paths: /dev/vda, /dev/sda, /dev/sdaa, /dev/nvme0n1, /dev/xvda, /dev/mmcblk0, etc.
+	if diskPathPattern.MatchString(path) {
+		return true
+	}
+	// Whole-disk /dev/disk/by-id links, which must point at a supported device
+	if !diskByIDPattern.MatchString(path) || byIDPartPattern.MatchString(path) {
+		return false
+	}
+	resolved := resolveDiskPath(path)
+	return resolved == path || diskPathPattern.MatchString(resolved)
 }
 
 // IsValidHostname validates a hostname format
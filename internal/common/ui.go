@@ -1,26 +1,16 @@
 package common
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"os"
 	"strings"
-)
-
-// ANSI color codes
-const (
-	Reset  = "\033[0m"
-	Red    = "\033[0;31m"
-	Green  = "\033[0;32m"
-	Yellow = "\033[1;33m"
-	Blue   = "\033[0;34m"
-	Cyan   = "\033[0;36m"
-	Bold   = "\033[1m"
+	"sync"
+	"time"
 )
 
 // Banner prints the Juniper Bible ASCII art banner
-func Banner(hostname, ip, osVersion, kernel string) {
+func Banner(hostname string, addrs Addresses, osVersion, kernel string) {
 	fmt.Print(Cyan)
 	fmt.Println(`                                 ▄`)
 	fmt.Println(`                                ▟ ▙`)
@@ -47,7 +37,15 @@ func Banner(hostname, ip, osVersion, kernel string) {
 	fmt.Printf("%s                Welcome to Juniper Bible Server%s\n", Bold, Reset)
 	fmt.Println("                ─────────────────────────────────")
 	fmt.Printf("                Hostname:  %s\n", hostname)
-	fmt.Printf("                IP:        %s\n", ip)
+	if addrs.IPv4 == "" && addrs.IPv6 == "" {
+		fmt.Printf("                IP:        %s\n", addrs)
+	}
+	if addrs.IPv4 != "" {
+		fmt.Printf("                IPv4:      %s\n", addrs.IPv4)
+	}
+	if addrs.IPv6 != "" {
+		fmt.Printf("                IPv6:      %s\n", addrs.IPv6)
+	}
 	fmt.Printf("                OS:        NixOS %s\n", osVersion)
 	fmt.Printf("                Kernel:    %s\n", kernel)
 	fmt.Println()
@@ -55,6 +53,7 @@ func Banner(hostname, ip, osVersion, kernel string) {
 
 // Header prints a section header
 func Header(title string) {
+	Logf("HEADER", "%s", title)
 	fmt.Println("========================================")
 	fmt.Printf("%s%s%s\n", Bold, title, Reset)
 	fmt.Println("========================================")
@@ -63,33 +62,48 @@ func Header(title string) {
 
 // Success prints a success message
 func Success(msg string) {
+	Logf("SUCCESS", "%s", msg)
 	fmt.Printf("%s✓ %s%s\n", Green, msg, Reset)
 }
 
 // Error prints an error message
 func Error(msg string) {
+	Logf("ERROR", "%s", msg)
 	fmt.Printf("%s✗ %s%s\n", Red, msg, Reset)
 }
 
 // Warning prints a warning message
 func Warning(msg string) {
+	Logf("WARNING", "%s", msg)
 	fmt.Printf("%s⚠ %s%s\n", Yellow, msg, Reset)
 }
 
 // Info prints an info message
 func Info(msg string) {
+	Logf("INFO", "%s", msg)
 	fmt.Printf("%s→ %s%s\n", Cyan, msg, Reset)
 }
 
-// Prompt asks for user input with a default value
+// Prompt asks for user input with a default value.
+// Without a terminal, the answers file or --yes default is used instead.
 func Prompt(question, defaultVal string) string {
-	reader := bufio.NewReader(os.Stdin)
 	if defaultVal != "" {
 		fmt.Printf("%s [%s]: ", question, defaultVal)
 	} else {
 		fmt.Printf("%s: ", question)
 	}
-	input, err := reader.ReadString('\n')
+	if answer, ok := recordedAnswer(question); ok {
+		if answer == "" {
+			return defaultVal
+		}
+		return answer
+	}
+	if assumeYes && !IsInteractive() {
+		fmt.Println(defaultVal)
+		return defaultVal
+	}
+	requireInteractive(question)
+	input, err := stdinReader.ReadString('\n')
 	if err != nil && err != io.EOF {
 		return defaultVal
 	}
@@ -115,40 +129,129 @@ func parseConfirmInput(input string, defaultYes bool) bool {
 	if input == "" {
 		return defaultYes
 	}
-	return input == "y" || input == "yes"
+	return input == "y" || input == "yes" || input == "true"
 }
 
-// Confirm asks for yes/no confirmation
+// Confirm asks for yes/no confirmation.
+// Without a terminal, the answers file or --yes is used instead.
 func Confirm(question string, defaultYes bool) bool {
-	reader := bufio.NewReader(os.Stdin)
 	fmt.Printf("%s %s: ", question, getConfirmPrompt(defaultYes))
-	input, err := reader.ReadString('\n')
+	if answer, ok := recordedAnswer(question); ok {
+		return parseConfirmInput(answer, defaultYes)
+	}
+	if assumeYes && !IsInteractive() {
+		fmt.Println("yes")
+		return true
+	}
+	requireInteractive(question)
+	input, err := stdinReader.ReadString('\n')
 	if err != nil && err != io.EOF {
 		return defaultYes
 	}
 	return parseConfirmInput(input, defaultYes)
 }
 
-// WaitForEnter waits for the user to press Enter
+// WaitForEnter waits for the user to press Enter.
+// Without a terminal it returns immediately if --yes or --answers was given.
 func WaitForEnter(msg string) {
-	reader := bufio.NewReader(os.Stdin)
 	if msg == "" {
 		msg = "Press Enter to continue..."
 	}
 	fmt.Printf("%s%s%s\n", Yellow, msg, Reset)
-	_, err := reader.ReadString('\n')
+	if !IsInteractive() && (assumeYes || answers != nil) {
+		return
+	}
+	requireInteractive(msg)
+	_, err := stdinReader.ReadString('\n')
 	if err != nil && err != io.EOF {
 		return
 	}
 }
 
-// ClearScreen clears the terminal
+// ClearScreen clears the terminal; output that is not a terminal gets a blank line instead
 func ClearScreen() {
+	if !StdoutIsTerminal() {
+		fmt.Println()
+		return
+	}
 	fmt.Print("\033[H\033[2J")
 }
 
 // Step prints a step header
 func Step(num, total int, title string) {
+	Logf("STEP", "%d/%d %s", num, total, title)
 	ClearScreen()
 	fmt.Printf("%sStep %d/%d: %s%s\n\n", Bold, num, total, title, Reset)
 }
+
+// spinnerFrames are drawn in turn by Spinner
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// spinnerInterval is the time between spinner frames
+const spinnerInterval = 100 * time.Millisecond
+
+// Spinner animates a message on one line while a slow operation runs. It
+// draws nothing when stdout is not a terminal or CI is set, so logs stay
+// clean. The zero value is ready to use; Stop and Fail are no-ops unless
+// the spinner is running, so a deferred Stop is always safe.
+type Spinner struct {
+	Indent string // Printed before the frame, e.g. to line up with other output
+
+	mu   sync.Mutex
+	stop chan struct{} // Closed to end the animation; nil when not running
+	done chan struct{} // Closed once the line has been cleared
+}
+
+// spinnerEnabled reports whether spinners are drawn
+func spinnerEnabled() bool {
+	return StdoutIsTerminal() && os.Getenv("CI") == ""
+}
+
+// Start shows msg with the animation, replacing any message already shown
+func (s *Spinner) Start(msg string) {
+	s.Stop()
+	if !spinnerEnabled() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.animate(msg, s.stop, s.done)
+}
+
+// animate redraws the line until stop is closed, then clears it
+func (s *Spinner) animate(msg string, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(spinnerInterval)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		fmt.Printf("\r%s%s%s%s %s", s.Indent, Cyan, spinnerFrames[i%len(spinnerFrames)], Reset, msg)
+		select {
+		case <-stop:
+			fmt.Print("\r\033[K")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop ends the animation and clears its line
+func (s *Spinner) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.stop, s.done = nil, nil
+}
+
+// Fail stops the spinner and leaves msg in its place as a failure. The
+// message is printed even when the spinner is not drawn.
+func (s *Spinner) Fail(msg string) {
+	s.Stop()
+	Logf("ERROR", "%s", msg)
+	fmt.Printf("%s%s✗ %s%s\n", s.Indent, Red, msg, Reset)
+}
@@ -0,0 +1,22 @@
+package common
+import ("testing";"os";"os/exec";"fmt";"bytes";"strings")
+func TestZZ(t *testing.T){
+ m:=NewSecretMasker(); m.Register(""); m.Register("hunter2"); m.Register("hunter2-long")
+ var b bytes.Buffer; w:=m.Writer(&b)
+ fmt.Fprint(w,"line1 hunter2\nline2 hunter2-long and hunter2\nnone here\n")
+ t.Logf("%q",b.String())
+ m2:=NewSecretMasker(); m2.Register(""); var b2 bytes.Buffer; m2.Writer(&b2).Write([]byte("abc\n")); t.Logf("%q",b2.String())
+ t.Log(m.partialSuffix("xx hunt"), m.partialSuffix("xx hunter2-lo"), m.partialSuffix("abc"))
+ if os.Getenv("ZZCHILD")=="1"{
+  RegisterSecret("s3cr3tvalue"); MaskStdio()
+  fmt.Println("go: s3cr3tvalue")
+  fmt.Fprint(os.Stdout,"split: s3cr"); fmt.Fprint(os.Stdout,"3tvalue end\n")
+  c:=exec.Command("sh","-c","echo child: s3cr3tvalue; echo err: s3cr3tvalue >&2"); c.Stdout=os.Stdout; c.Stderr=os.Stderr; c.Run()
+  fmt.Print("prompt-no-newline: ")
+  Exit(0)
+ }
+ out,_:=exec.Command(os.Args[0],"-test.run","TestZZ").CombinedOutput()
+ _=out
+ c:=exec.Command(os.Args[0],"-test.run","TestZZ"); c.Env=append(os.Environ(),"ZZCHILD=1"); o,_:=c.CombinedOutput()
+ t.Logf("%s", o); if strings.Contains(string(o),"s3cr3t"){t.Fatal("leak")}
+}
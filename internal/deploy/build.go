@@ -1,14 +1,283 @@
 package deploy
 
 import (
+	"bufio"
 	"fmt"
 	"os"
 	"os/exec"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 )
 
-// BuildHugo runs Hugo with the given release ID and base URL.
-func BuildHugo(releaseID, baseURL string) error {
+// stashRef returns the commit at the top of the git stash, or "" if there is none.
+func stashRef() string {
+	out, err := exec.Command("git", "rev-parse", "-q", "--verify", "refs/stash").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// StashChanges stashes uncommitted and untracked changes before a build.
+// It returns the stash commit, or "" when the tree was clean and nothing was stashed.
+func StashChanges(releaseID string) (string, error) {
+	before := stashRef()
+	cmd := exec.Command("git", "stash", "push", "--include-untracked", "--message", "juniper-deploy-"+releaseID)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("git stash: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	after := stashRef()
+	if after == before {
+		return "", nil
+	}
+	return after, nil
+}
+
+// UnstashChanges restores the stash created by StashChanges.
+// Failures are reported as warnings since the deployment itself succeeded or failed independently.
+func UnstashChanges(stash string) {
+	if stashRef() != stash {
+		fmt.Printf("Warning: stash %s is no longer on top of the stash list; restore it manually with 'git stash list'\n", stash)
+		return
+	}
+	output, err := exec.Command("git", "stash", "pop").CombinedOutput()
+	if err != nil {
+		fmt.Printf("Warning: git stash pop failed: %s\n", strings.TrimSpace(string(output)))
+		fmt.Println("         Your changes are still in the stash; restore them with 'git stash pop'")
+		return
+	}
+	fmt.Println("==> Restored stashed changes")
+}
+
+// maxDirtyFilesShown limits how many changed files are listed for a dirty working tree.
+const maxDirtyFilesShown = 20
+
+// dirtyFiles returns the `git status --porcelain` lines for uncommitted and
+// untracked changes; it is empty when the working tree is clean.
+func dirtyFiles() ([]string, error) {
+	out, err := exec.Command("git", "status", "--porcelain").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git status: %w", err)
+	}
+	return parsePorcelain(string(out)), nil
+}
+
+// parsePorcelain splits `git status --porcelain` output into its non-empty lines.
+func parsePorcelain(out string) []string {
+	var files []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) != "" {
+			files = append(files, line)
+		}
+	}
+	return files
+}
+
+// CheckWorkingTree reports whether the build would include uncommitted or
+// untracked changes, listing them. With requireClean it fails with
+// ErrDirtyWorkingTree instead of warning. Outside a git repository there is
+// nothing to check.
+func CheckWorkingTree(requireClean bool) (bool, error) {
+	files, err := dirtyFiles()
+	if err != nil {
+		fmt.Println("    Not a git repository; skipping working tree check")
+		return false, nil
+	}
+	if len(files) == 0 {
+		return false, nil
+	}
+
+	if requireClean {
+		fmt.Printf("%d uncommitted or untracked file(s):\n", len(files))
+	} else {
+		fmt.Printf("Warning: deploying with %d uncommitted or untracked file(s); the release cannot be reproduced from git:\n", len(files))
+	}
+	for i, line := range files {
+		if i == maxDirtyFilesShown {
+			fmt.Printf("         ... and %d more\n", len(files)-maxDirtyFilesShown)
+			break
+		}
+		fmt.Printf("         %s\n", line)
+	}
+	if requireClean {
+		return true, fmt.Errorf("%w: commit them, use --stash-before-build, or pass --allow-dirty", ErrDirtyWorkingTree)
+	}
+	return true, nil
+}
+
+// currentBranch returns the checked-out branch, or "HEAD" when detached.
+func currentBranch() (string, error) {
+	out, err := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD").Output()
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// CheckoutBranch switches to branch for the build. It refuses to switch when
+// the working tree is dirty or the branch does not exist. It returns false
+// when branch was already checked out, in which case there is nothing to restore.
+func CheckoutBranch(branch string) (bool, error) {
+	if strings.HasPrefix(branch, "-") {
+		return false, fmt.Errorf("invalid branch name %q", branch)
+	}
+	if output, err := exec.Command("git", "rev-parse", "--verify", "--quiet", branch).Output(); err != nil || len(output) == 0 {
+		return false, fmt.Errorf("branch %q does not exist", branch)
+	}
+	current, err := currentBranch()
+	if err != nil {
+		return false, err
+	}
+	if current == branch {
+		return false, nil
+	}
+	status, err := exec.Command("git", "status", "--porcelain").Output()
+	if err != nil {
+		return false, fmt.Errorf("git status: %w", err)
+	}
+	if len(strings.TrimSpace(string(status))) > 0 {
+		return false, fmt.Errorf("working tree has uncommitted changes; commit them or use --stash-before-build before deploying branch %q", branch)
+	}
+	if output, err := exec.Command("git", "checkout", branch, "--").CombinedOutput(); err != nil {
+		return false, fmt.Errorf("git checkout %s: %s: %w", branch, strings.TrimSpace(string(output)), err)
+	}
+	return true, nil
+}
+
+// RestoreBranch switches back to the branch checked out before CheckoutBranch.
+// Failures are reported as warnings since the deployment itself succeeded or failed independently.
+func RestoreBranch() {
+	output, err := exec.Command("git", "checkout", "-").CombinedOutput()
+	if err != nil {
+		fmt.Printf("Warning: git checkout - failed: %s\n", strings.TrimSpace(string(output)))
+		fmt.Println("         Switch back to your branch manually")
+		return
+	}
+	fmt.Println("==> Restored previous branch")
+}
+
+// hugoCacheDir returns the Hugo cache directory shared by all builds.
+func hugoCacheDir() string {
+	return os.ExpandEnv("$HOME/.cache/hugo")
+}
+
+// DefaultEnvFile is loaded into the Hugo build environment when it exists
+// and no other file is given.
+const DefaultEnvFile = ".env"
+
+// envKeyPattern matches a variable name in a .env file.
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// EnvFileOption returns path, or DefaultEnvFile when path is empty and that
+// file exists, for Options.EnvFile.
+func EnvFileOption(path string) string {
+	if path != "" {
+		return path
+	}
+	if _, err := os.Stat(DefaultEnvFile); err == nil {
+		return DefaultEnvFile
+	}
+	return ""
+}
+
+// LoadDotEnv parses a .env file of KEY=value lines. Blank lines and lines
+// starting with # are ignored, as is an "export " prefix. A value may be
+// double-quoted, with backslash escapes, or single-quoted, taken literally;
+// an unquoted value ends at " #".
+func LoadDotEnv(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !envKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", path, n)
+		}
+		value, err := parseDotEnvValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", path, n, key, err)
+		}
+		vars[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// parseDotEnvValue unquotes one .env value.
+func parseDotEnvValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		end := closingQuote(value)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated double quote")
+		}
+		unquoted, err := strconv.Unquote(value[:end+1])
+		if err != nil {
+			return "", fmt.Errorf("invalid double-quoted value")
+		}
+		return unquoted, nil
+	case strings.HasPrefix(value, "'"):
+		end := strings.Index(value[1:], "'")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated single quote")
+		}
+		return value[1 : end+1], nil
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
+
+// closingQuote returns the index of the unescaped double quote ending the
+// string value starts with, or -1.
+func closingQuote(value string) int {
+	for i := 1; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// dotEnvList renders vars as KEY=value entries for exec.Cmd.Env, sorted by key.
+func dotEnvList(vars map[string]string) []string {
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	env := make([]string, len(keys))
+	for i, key := range keys {
+		env[i] = key + "=" + vars[key]
+	}
+	return env
+}
+
+// runHugo runs Hugo with the given release ID and base URL plus extra
+// arguments and environment variables. Variables from dotEnv come first, so
+// the process environment and the variables set here take precedence: a
+// .env file cannot override RELEASE_ID.
+func runHugo(releaseID, baseURL string, dotEnv map[string]string, extraArgs, extraEnv []string) error {
 	args := []string{"--minify"}
 
 	if baseURL != "" {
@@ -16,11 +285,13 @@ func BuildHugo(releaseID, baseURL string) error {
 	}
 
 	// Use Hugo cache for faster builds
-	cacheDir := os.ExpandEnv("$HOME/.cache/hugo")
-	args = append(args, "--cacheDir", cacheDir)
+	args = append(args, "--cacheDir", hugoCacheDir())
+	args = append(args, extraArgs...)
 
 	cmd := exec.Command("hugo", args...)
-	cmd.Env = append(os.Environ(),
+	cmd.Env = append(dotEnvList(dotEnv), os.Environ()...)
+	cmd.Env = append(cmd.Env, extraEnv...)
+	cmd.Env = append(cmd.Env,
 		fmt.Sprintf("RELEASE_ID=%s", releaseID),
 		fmt.Sprintf("GOMAXPROCS=%d", runtime.NumCPU()),
 	)
@@ -30,9 +301,15 @@ func BuildHugo(releaseID, baseURL string) error {
 	return cmd.Run()
 }
 
+// BuildHugo runs Hugo with the given release ID and base URL, adding the
+// variables loaded from a .env file to its environment.
+func BuildHugo(releaseID, baseURL string, dotEnv map[string]string) error {
+	return runHugo(releaseID, baseURL, dotEnv, nil, nil)
+}
+
 // BuildHugoWithSitemaps runs Hugo and generates sitemaps.
-func BuildHugoWithSitemaps(releaseID, baseURL string) error {
-	if err := BuildHugo(releaseID, baseURL); err != nil {
+func BuildHugoWithSitemaps(releaseID, baseURL string, dotEnv map[string]string) error {
+	if err := BuildHugo(releaseID, baseURL, dotEnv); err != nil {
 		return err
 	}
 
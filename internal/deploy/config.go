@@ -1,10 +1,16 @@
 package deploy
 
 import (
+	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 
 	"github.com/BurntSushi/toml"
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
 )
 
 // Config represents the deploy.toml configuration file.
@@ -16,6 +22,12 @@ type Config struct {
 func ExampleConfig() string {
 	return `# deploy.toml - Deployment configuration
 # Place this file in your project root.
+#
+# Keep secrets out of this file: any string value may be a reference that is
+# resolved when the file is loaded, e.g.
+#   target = "secret://env:DEPLOY_TARGET"           (environment variable)
+#   target = "secret://file:/run/secrets/target"     (file contents)
+#   target = "secret://cmd:pass show deploy/target"  (command output)
 
 [[environments]]
 name = "local"
@@ -23,6 +35,9 @@ target = ""
 path = "./deploy"
 keepN = 3
 baseURL = "http://localhost:1314"
+# Optional: force permissions on deployed files (0 preserves source modes)
+# fileMode = 0o644
+# dirMode = 0o755
 
 [[environments]]
 name = "prod"
@@ -30,6 +45,19 @@ target = "user@host"
 path = "/var/www/site"
 keepN = 5
 baseURL = "https://example.com"
+# Optional: upload with rsync instead of ssh-tar (no xz needed on the host)
+# transport = "rsync"
+# Optional: build from this git branch (the original checkout is restored)
+# branch = "main"
+# Optional: deploy the same release to this environment after a healthy deploy
+# autoPromote = "prod"
+# Optional: rules healthz.json must satisfy after activation
+# healthzValidation = ["$.status == 'ok'", "$.releaseId != ''"]
+# Optional: refuse to build with uncommitted changes instead of warning
+# requireCleanGit = true
+# Optional: region this target serves; deploy-region deploys every
+# environment of a region in the order they appear here
+# region = "us-east"
 `
 }
 
@@ -47,18 +75,47 @@ func parseConfigFile(data []byte) (*Config, error) {
 	if _, err := toml.Decode(string(data), &config); err != nil {
 		return nil, err
 	}
+	for i := range config.Environments {
+		config.Environments[i].Path = NormalizePath(config.Environments[i].Path)
+	}
 	return &config, nil
 }
 
-// LoadConfig loads configuration from deploy.toml.
-// Returns an error if the config file is not found.
+// NormalizePath converts backslashes in a path from deploy.toml to forward
+// slashes and cleans the result, so a config edited on Windows works on
+// every platform. The slash form is kept because remote paths are always
+// POSIX; local deploys hand it to filepath, which accepts slashes on
+// Windows too. An empty path stays empty.
+func NormalizePath(p string) string {
+	if p == "" {
+		return ""
+	}
+	return path.Clean(strings.ReplaceAll(p, `\`, "/"))
+}
+
+// NormalizeReleaseID strips path separators from a release ID given with
+// --release, so it always names a directory directly under releases/.
+func NormalizeReleaseID(id string) string {
+	return strings.NewReplacer("/", "", `\`, "").Replace(id)
+}
+
+// LoadConfig loads configuration from deploy.toml and resolves secret://
+// references. Returns an error if the config file is not found or a secret
+// cannot be resolved.
 func LoadConfig(configPath string) (*Config, error) {
 	path := defaultConfigPath(configPath)
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	return parseConfigFile(data)
+	config, err := parseConfigFile(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := resolveSecrets(config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
 }
 
 // GetEnvironment returns the environment configuration for the given name.
@@ -94,3 +151,80 @@ func FindConfigFile() string {
 
 	return ""
 }
+
+// ParseFileMode parses an octal permission string such as "0644" or "755".
+// An empty string returns 0, meaning the original mode is preserved.
+func ParseFileMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid octal mode %q", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// maskedValue replaces secret values in environment diffs.
+const maskedValue = "***"
+
+// FieldDiff compares one Environment field between two environments.
+type FieldDiff struct {
+	Field  string
+	ValueA interface{}
+	ValueB interface{}
+	Equal  bool
+}
+
+// DiffEnvironments compares every Environment field of a and b.
+// Fields tagged `diff:"secret"` are compared but their values are masked.
+func DiffEnvironments(a, b Environment) []FieldDiff {
+	t := reflect.TypeOf(Environment{})
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	diffs := make([]FieldDiff, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		x, y := va.Field(i).Interface(), vb.Field(i).Interface()
+		d := FieldDiff{Field: field.Name, ValueA: x, ValueB: y, Equal: reflect.DeepEqual(x, y)}
+		if field.Tag.Get("diff") == "secret" {
+			d.ValueA, d.ValueB = maskedValue, maskedValue
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
+
+// formatDiffValue renders a field value for the diff table.
+func formatDiffValue(v interface{}) string {
+	switch val := v.(type) {
+	case os.FileMode:
+		if val == 0 {
+			return "(preserve)"
+		}
+		return fmt.Sprintf("%#o", uint32(val))
+	case string:
+		if val == "" {
+			return `""`
+		}
+		return val
+	}
+	return fmt.Sprint(v)
+}
+
+// PrintEnvDiff prints a table comparing two environments.
+// Equal fields are gray and differing fields yellow.
+func PrintEnvDiff(a, b Environment) {
+	diffs := DiffEnvironments(a, b)
+	fmt.Printf("%-10s %-32s %-32s\n", "Field", a.Name, b.Name)
+	differing := 0
+	for _, d := range diffs {
+		color := common.Gray
+		if !d.Equal {
+			color = common.Yellow
+			differing++
+		}
+		fmt.Printf("%s%-10s %-32s %-32s%s\n", color, d.Field,
+			formatDiffValue(d.ValueA), formatDiffValue(d.ValueB), common.Reset)
+	}
+	fmt.Printf("\n%d of %d fields differ\n", differing, len(diffs))
+}
@@ -1,12 +1,17 @@
 package deploy
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+	"golang.org/x/term"
 )
 
 const (
@@ -17,32 +22,170 @@ const (
 // newDeployer creates the appropriate deployer for the environment.
 func newDeployer(env Environment) Deployer {
 	if env.Target == "" {
-		return NewLocalDeployer(env.Path)
+		d := NewLocalDeployer(env.Path)
+		d.SetModes(env.FileMode, env.DirMode)
+		d.SetHealthzValidation(env.HealthzValidation)
+		return d
+	}
+	d := NewRemoteDeployer(env.Target, env.Path, env.Transport)
+	d.SetHealthzValidation(env.HealthzValidation)
+	return d
+}
+
+// checkReadiness verifies the target before building.
+func checkReadiness(deployer Deployer) error {
+	fmt.Println("==> Checking target readiness...")
+	if err := CheckTargetReady(deployer); err != nil {
+		return fmt.Errorf("readiness check: %w", err)
+	}
+	fmt.Println("    OK")
+	fmt.Println()
+	return nil
+}
+
+// progressBarWidth is the number of cells in the hashing progress bar.
+const progressBarWidth = 30
+
+// terminalProgressBar redraws a line like "Hashing: [=====>    ] 450/1000",
+// ending it once every file is hashed.
+func terminalProgressBar(hashed, total int) {
+	if total == 0 {
+		return
+	}
+	filled := hashed * progressBarWidth / total
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+	fmt.Printf("\r    Hashing: [%s] %d/%d", bar, hashed, total)
+	if hashed == total {
+		fmt.Println()
+	}
+}
+
+// hashProgress returns terminalProgressBar when stdout is a terminal, and nil
+// otherwise so CI logs are not filled with redraws.
+func hashProgress() func(hashed, total int) {
+	if !term.IsTerminal(int(os.Stdout.Fd())) {
+		return nil
 	}
-	return NewRemoteDeployer(env.Target, env.Path)
+	return terminalProgressBar
 }
 
 // buildAndGenerateManifest builds Hugo and generates manifest.
-func buildAndGenerateManifest(releaseID string, env Environment, noBuild bool) (*Manifest, error) {
-	if !noBuild {
-		fmt.Println("==> Building Hugo...")
-		if err := BuildHugo(releaseID, env.BaseURL); err != nil {
-			return nil, fmt.Errorf("hugo build failed: %w", err)
+// A partial build is checked against the last full build of the same source
+// and replaced by a clean full build when their checksums diverge.
+func buildAndGenerateManifest(releaseID string, env Environment, opts Options) (*Manifest, error) {
+	if opts.NoBuild {
+		// Keep the state recorded when public/ was built
+		dirty := false
+		if prev := loadBuildManifest("public"); prev != nil {
+			dirty = prev.GitDirty
+		}
+		return generateBuildManifest(releaseID, env, opts, dirty)
+	}
+
+	requireClean := (env.RequireCleanGit || opts.RequireCleanGit) && !opts.AllowDirty
+	dirty, err := CheckWorkingTree(requireClean)
+	if err != nil {
+		return nil, err
+	}
+	if dirty {
+		fmt.Println()
+	}
+
+	var dotEnv map[string]string
+	if opts.EnvFile != "" {
+		if dotEnv, err = LoadDotEnv(opts.EnvFile); err != nil {
+			return nil, fmt.Errorf("load env file: %w", err)
+		}
+		fmt.Printf("==> Loaded %d variable(s) from %s\n", len(dotEnv), opts.EnvFile)
+	}
+
+	build, kind := BuildHugo, "Hugo"
+	if opts.PartialBuild {
+		build, kind = BuildHugoPartial, "Hugo (partial)"
+	}
+	fmt.Printf("==> Building %s...\n", kind)
+	if err := build(releaseID, env.BaseURL, dotEnv); err != nil {
+		return nil, fmt.Errorf("hugo build failed: %w", err)
+	}
+	fmt.Println()
+
+	manifest, err := generateBuildManifest(releaseID, env, opts, dirty)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.PartialBuild {
+		if opts.SubPath == "" {
+			recordFullBuild(manifest)
+		}
+		return manifest, nil
+	}
+
+	fmt.Println("==> Verifying partial build...")
+	if verifyPartialBuild("public", manifest, opts.SubPath) {
+		fmt.Println()
+		return manifest, nil
+	}
+	fmt.Println()
+	fmt.Println("==> Falling back to a full build...")
+	if err := os.RemoveAll("public"); err != nil {
+		return nil, fmt.Errorf("clear public: %w", err)
+	}
+	if err := BuildHugo(releaseID, env.BaseURL, dotEnv); err != nil {
+		return nil, fmt.Errorf("hugo build failed: %w", err)
+	}
+	fmt.Println()
+	if manifest, err = generateBuildManifest(releaseID, env, opts, dirty); err != nil {
+		return nil, err
+	}
+	if opts.SubPath == "" {
+		recordFullBuild(manifest)
+	}
+	return manifest, nil
+}
+
+// generateBuildManifest hashes public/ and writes public/build-manifest.json,
+// recording whether the build included uncommitted changes. With
+// opts.SubPath only that subtree is hashed and nothing is written yet; the
+// manifest of the updated live release is written by deploySubPath.
+func generateBuildManifest(releaseID string, env Environment, opts Options, gitDirty bool) (*Manifest, error) {
+	if opts.SubPath != "" {
+		fmt.Printf("==> Generating build manifest for %s...\n", opts.SubPath)
+		manifest, err := generateSubPathManifest("public", releaseID, opts.SubPath, opts)
+		if err != nil {
+			return nil, fmt.Errorf("manifest generation failed: %w", err)
 		}
+		manifest.Branch = env.Branch
+		manifest.GitDirty = gitDirty
+		fmt.Printf("    %d files hashed\n", len(manifest.Files))
 		fmt.Println()
+		return manifest, nil
 	}
 
 	fmt.Println("==> Generating build manifest...")
-	manifest, err := GenerateManifestWithWorkers("public", releaseID, DefaultWorkers)
+	var prev *Manifest
+	if opts.LazyManifest {
+		prev = loadBuildManifest("public")
+	}
+	manifest, err := GenerateManifestWithWorkers("public", releaseID, DefaultWorkers, opts.FollowSymlinks, prev, hashProgress())
 	if err != nil {
 		return nil, fmt.Errorf("manifest generation failed: %w", err)
 	}
+	manifest.Branch = env.Branch
+	manifest.GitDirty = gitDirty
 
 	manifestPath := filepath.Join("public", "build-manifest.json")
 	if err := WriteManifest(manifest, manifestPath); err != nil {
 		return nil, fmt.Errorf("write manifest: %w", err)
 	}
-	fmt.Printf("    %d files hashed\n", len(manifest.Files))
+	if prev != nil {
+		fmt.Printf("    %d files (%d re-hashed, %d unchanged)\n",
+			len(manifest.Files), manifest.Rehashed, len(manifest.Files)-manifest.Rehashed)
+	} else {
+		fmt.Printf("    %d files hashed\n", len(manifest.Files))
+	}
 	fmt.Println()
 
 	return manifest, nil
@@ -80,6 +223,39 @@ func printDeltaStats(delta *Delta, localManifest *Manifest) {
 	fmt.Println()
 }
 
+// statsSummaryTypes is how many file types are listed before grouping the rest.
+const statsSummaryTypes = 5
+
+// printManifestStats prints the per-type breakdown. At most limit types are
+// listed individually (0 lists all); the rest are folded into "other".
+func printManifestStats(s Stats, limit int) {
+	fmt.Println("==> File types...")
+	types := s.Types
+	var other TypeStats
+	if limit > 0 && len(types) > limit {
+		for _, ts := range types[limit:] {
+			other.Files += ts.Files
+			other.Bytes += ts.Bytes
+		}
+		types = append([]TypeStats(nil), types[:limit]...)
+		other.Ext = fmt.Sprintf("other (%d types)", len(s.Types)-limit)
+	}
+	if other.Files > 0 {
+		types = append(types, other)
+	}
+	for _, ts := range types {
+		pct := 0.0
+		if s.TotalBytes > 0 {
+			pct = float64(ts.Bytes) / float64(s.TotalBytes) * 100
+		}
+		fmt.Printf("    %-18s %6d files %10.2f MB (%4.1f%%)\n",
+			ts.Ext, ts.Files, float64(ts.Bytes)/(1024*1024), pct)
+	}
+	fmt.Printf("    Compressed: ~%.2f MB (estimated %.0f%% of original)\n",
+		float64(s.CompressedBytes)/(1024*1024), s.CompressionRatio()*100)
+	fmt.Println()
+}
+
 // uploadFiles uploads files to the release directory.
 func uploadFiles(deployer Deployer, releaseID string, delta *Delta, remoteManifest *Manifest, full bool) error {
 	if full || len(remoteManifest.Files) == 0 {
@@ -98,14 +274,26 @@ func uploadFiles(deployer Deployer, releaseID string, delta *Delta, remoteManife
 func printDeployHeader(env Environment, releaseID string) {
 	fmt.Printf("==> Deploying to %s\n", env.Name)
 	fmt.Printf("    Release: %s\n", releaseID)
+	if env.Branch != "" {
+		fmt.Printf("    Branch:  %s\n", env.Branch)
+	}
 	fmt.Printf("    Target:  %s\n", targetDescription(env))
 	fmt.Println()
 }
 
+// newSpinner returns a spinner indented like the rest of the deploy output.
+func newSpinner() *common.Spinner {
+	return &common.Spinner{Indent: "    "}
+}
+
 // createReleaseDir creates the release directory
 func createReleaseDir(deployer Deployer, releaseID string) error {
 	fmt.Println("==> Creating release directory...")
+	spin := newSpinner()
+	defer spin.Stop()
+	spin.Start("Copying the current release")
 	if err := deployer.CreateRelease(releaseID); err != nil {
+		spin.Fail("Failed")
 		return fmt.Errorf("create release: %w", err)
 	}
 	return nil
@@ -114,9 +302,14 @@ func createReleaseDir(deployer Deployer, releaseID string) error {
 // activateRelease activates the release and prints status
 func activateRelease(deployer Deployer, releaseID string) error {
 	fmt.Println("==> Activating release...")
+	spin := newSpinner()
+	defer spin.Stop()
+	spin.Start("Switching the current symlink")
 	if err := deployer.Activate(releaseID); err != nil {
+		spin.Fail("Failed")
 		return fmt.Errorf("activate: %w", err)
 	}
+	spin.Stop()
 	fmt.Println()
 	return nil
 }
@@ -124,37 +317,107 @@ func activateRelease(deployer Deployer, releaseID string) error {
 // cleanupOldReleases cleans up old releases
 func cleanupOldReleases(deployer Deployer, keepN int) {
 	fmt.Printf("==> Cleaning old releases (keeping %d)...\n", keepN)
+	spin := newSpinner()
+	defer spin.Stop()
+	spin.Start("Removing expired releases")
 	if err := deployer.Cleanup(keepN); err != nil {
-		fmt.Printf("    Warning: cleanup failed: %v\n", err)
+		spin.Fail(fmt.Sprintf("Warning: cleanup failed: %v", err))
 	}
+	spin.Stop()
 	fmt.Println()
 }
 
+// expiredReleases returns the releases Cleanup(keepN) removes: unpinned
+// releases beyond the newest keepN unpinned ones, never the current release.
+// releases must be sorted newest first, as ListReleases returns them.
+func expiredReleases(releases []Release, keepN int) []Release {
+	var unpinned []Release
+	for _, release := range releases {
+		if !release.Pinned {
+			unpinned = append(unpinned, release)
+		}
+	}
+	if len(unpinned) <= keepN {
+		return nil
+	}
+	var expired []Release
+	for _, release := range unpinned[keepN:] {
+		if !release.Current {
+			expired = append(expired, release)
+		}
+	}
+	return expired
+}
+
 // runHealthCheck runs the health check
-func runHealthCheck(deployer Deployer, releaseID string) {
+// It reports whether the check passed; failures are only warnings.
+func runHealthCheck(deployer Deployer, releaseID string) bool {
 	fmt.Println("==> Health check...")
-	if err := deployer.HealthCheck(releaseID); err != nil {
+	err := deployer.HealthCheck(releaseID)
+	if err != nil {
 		fmt.Printf("    Warning: %v\n", err)
 	} else {
 		fmt.Println("    OK")
 	}
 	fmt.Println()
+	return err == nil
 }
 
-// executeDeployment performs the actual deployment steps
-func executeDeployment(deployer Deployer, releaseID string, delta *Delta, remoteManifest *Manifest, env Environment, full bool) error {
+// executeDeployment performs the actual deployment steps and reports whether
+// the health check passed
+func executeDeployment(deployer Deployer, releaseID string, delta *Delta, remoteManifest *Manifest, env Environment, full bool) (bool, error) {
 	if err := createReleaseDir(deployer, releaseID); err != nil {
-		return err
+		return false, err
 	}
 	if err := uploadFiles(deployer, releaseID, delta, remoteManifest, full); err != nil {
-		return fmt.Errorf("upload: %w", err)
+		return false, fmt.Errorf("upload: %w", err)
 	}
 	fmt.Println()
 	if err := activateRelease(deployer, releaseID); err != nil {
-		return err
+		return false, err
 	}
 	cleanupOldReleases(deployer, env.KeepN)
-	runHealthCheck(deployer, releaseID)
+	return runHealthCheck(deployer, releaseID), nil
+}
+
+// autoPromote deploys the release just built to env.AutoPromote, reusing the
+// build output. Promotion chains stop after MaxAutoPromoteDepth levels, or on
+// reaching an environment already deployed in the chain, so a cycle such as
+// A -> B -> A cannot loop forever.
+func autoPromote(env Environment, releaseID string, opts Options) error {
+	chain := append(slices.Clone(opts.promotedFrom), env.Name)
+	if len(chain) > MaxAutoPromoteDepth {
+		fmt.Printf("Warning: auto-promote depth limit (%d) reached; not promoting to %s\n", MaxAutoPromoteDepth, env.AutoPromote)
+		return nil
+	}
+	if slices.Contains(chain, env.AutoPromote) {
+		fmt.Printf("Warning: auto-promote cycle (%s -> %s); not promoting again\n", strings.Join(chain, " -> "), env.AutoPromote)
+		return nil
+	}
+	if opts.Config == nil {
+		return fmt.Errorf("auto-promote to %s: no configuration to look up the environment", env.AutoPromote)
+	}
+	next, ok := opts.Config.GetEnvironment(env.AutoPromote)
+	if !ok {
+		return fmt.Errorf("auto-promote: unknown environment '%s'", env.AutoPromote)
+	}
+
+	fmt.Println()
+	fmt.Printf("==> Auto-promoting to %s...\n", next.Name)
+	fmt.Println()
+	promoteOpts := Options{
+		ReleaseID:          releaseID,
+		Full:               opts.Full,
+		NoBuild:            true,
+		FollowSymlinks:     opts.FollowSymlinks,
+		SkipReadinessCheck: opts.SkipReadinessCheck,
+		LazyManifest:       opts.LazyManifest,
+		Config:             opts.Config,
+		promotedFrom:       chain,
+	}
+	if _, err := Deploy(next, promoteOpts); err != nil {
+		return fmt.Errorf("auto-promote to %s: %w", next.Name, err)
+	}
 	return nil
 }
 
@@ -167,42 +430,133 @@ func printDryRunChanges(delta *Delta) {
 }
 
 // Deploy performs a deployment to the given environment.
-func Deploy(env Environment, opts Options) error {
-	releaseID := opts.ReleaseID
+func Deploy(env Environment, opts Options) (*DeployResult, error) {
+	if opts.Branch != "" {
+		env.Branch = opts.Branch
+	}
+	if opts.NoBuild {
+		// Nothing is built, so the branch would not describe the release
+		env.Branch = ""
+	}
+	if opts.RequireCleanGit && opts.AllowDirty {
+		return nil, fmt.Errorf("--require-clean-git and --allow-dirty cannot be used together")
+	}
+	releaseID := NormalizeReleaseID(opts.ReleaseID)
+	if releaseID == "." || releaseID == ".." || (releaseID == "" && opts.ReleaseID != "") {
+		return nil, fmt.Errorf("invalid release ID %q", opts.ReleaseID)
+	}
 	if releaseID == "" {
-		releaseID = GenerateReleaseID()
+		releaseID = generateReleaseID(env.Branch)
 	}
 
+	deployer := newDeployer(env)
+	if opts.SubPath != "" {
+		if opts.ReleaseID != "" {
+			return nil, fmt.Errorf("--sub-path updates the live release and cannot be combined with --release")
+		}
+		subPath, err := ValidateSubPath(opts.SubPath)
+		if err != nil {
+			return nil, err
+		}
+		opts.SubPath = subPath
+		if releaseID, err = liveRelease(deployer); err != nil {
+			return nil, err
+		}
+	}
+	result := &DeployResult{ReleaseID: releaseID}
+
 	printDeployHeader(env, releaseID)
+	if opts.SubPath != "" {
+		fmt.Printf("==> Updating only %s of the live release\n", opts.SubPath)
+		fmt.Println()
+	}
+
+	if !opts.SkipReadinessCheck {
+		if err := checkReadiness(deployer); err != nil {
+			return result, err
+		}
+	}
 
-	localManifest, err := buildAndGenerateManifest(releaseID, env, opts.NoBuild)
+	if opts.StashBeforeBuild && !opts.NoBuild {
+		fmt.Println("==> Stashing uncommitted changes...")
+		stash, err := StashChanges(releaseID)
+		if err != nil {
+			return result, err
+		}
+		if stash == "" {
+			fmt.Println("    Working tree clean, nothing stashed")
+		} else {
+			result.Stashed = true
+			defer UnstashChanges(stash)
+		}
+		fmt.Println()
+	}
+
+	if env.Branch != "" {
+		fmt.Printf("==> Checking out %s...\n", env.Branch)
+		switched, err := CheckoutBranch(env.Branch)
+		if err != nil {
+			return result, err
+		}
+		if switched {
+			defer RestoreBranch()
+		} else {
+			fmt.Println("    Already on this branch")
+		}
+		fmt.Println()
+	}
+
+	localManifest, err := buildAndGenerateManifest(releaseID, env, opts)
 	if err != nil {
-		return err
+		return result, err
+	}
+
+	if opts.SubPath != "" {
+		return result, deploySubPath(deployer, releaseID, localManifest, opts)
 	}
 
-	deployer := newDeployer(env)
 	remoteManifest := fetchRemoteManifest(deployer)
-	delta := CalculateDelta(localManifest, remoteManifest)
+	delta := CalculateDelta(localManifest, remoteManifest, "")
 	printDeltaStats(delta, localManifest)
+	printManifestStats(ManifestStats(localManifest), statsSummaryTypes)
 
 	if opts.DryRun {
 		printDryRunChanges(delta)
-		return nil
+		return result, nil
 	}
 
-	if err := executeDeployment(deployer, releaseID, delta, remoteManifest, env, opts.Full); err != nil {
-		return err
+	healthy, err := executeDeployment(deployer, releaseID, delta, remoteManifest, env, opts.Full)
+	if err != nil {
+		return result, err
 	}
 	fmt.Printf("Done! Release %s is now live.\n", releaseID)
-	return nil
+	recordLatency(env, result)
+
+	if env.AutoPromote == "" || opts.NoAutoPromote {
+		return result, nil
+	}
+	if !healthy {
+		fmt.Printf("Skipping auto-promote to %s: health check failed\n", env.AutoPromote)
+		return result, nil
+	}
+	return result, autoPromote(env, releaseID, opts)
 }
 
 // GenerateReleaseID creates a release ID in format YYYYMMDD-HHMMSS-{git_hash}.
 func GenerateReleaseID() string {
+	return generateReleaseID("")
+}
+
+// generateReleaseID creates a release ID using the hash of branch, or of HEAD if empty.
+func generateReleaseID(branch string) string {
 	timestamp := time.Now().UTC().Format("20060102-150405")
 
+	rev := "HEAD"
+	if branch != "" && !strings.HasPrefix(branch, "-") {
+		rev = branch
+	}
 	// Get git hash
-	cmd := exec.Command("git", "rev-parse", "--short", "HEAD")
+	cmd := exec.Command("git", "rev-parse", "--short", rev)
 	output, err := cmd.Output()
 	if err != nil {
 		return timestamp
@@ -228,7 +582,12 @@ func printReleaseList(releases []Release, env Environment) {
 		if r.Current {
 			current = " (current)"
 		}
-		fmt.Printf("  %s  %s%s\n",
+		pin := "  "
+		if r.Pinned {
+			pin = "🔒"
+		}
+		fmt.Printf("  %s %s  %s%s\n",
+			pin,
 			r.CreatedAt.Format("2006-01-02 15:04:05"),
 			r.ID,
 			current,
@@ -236,6 +595,151 @@ func printReleaseList(releases []Release, env Environment) {
 	}
 }
 
+// Pin protects a release from automatic cleanup.
+func Pin(env Environment, releaseID string) error {
+	if releaseID == "" {
+		return fmt.Errorf("release ID required")
+	}
+	if err := newDeployer(env).SetPinned(releaseID, true); err != nil {
+		return err
+	}
+	fmt.Printf("Pinned %s on %s\n", releaseID, env.Name)
+	return nil
+}
+
+// Unpin makes a pinned release eligible for cleanup again.
+func Unpin(env Environment, releaseID string) error {
+	if releaseID == "" {
+		return fmt.Errorf("release ID required")
+	}
+	if err := newDeployer(env).SetPinned(releaseID, false); err != nil {
+		return err
+	}
+	fmt.Printf("Unpinned %s on %s\n", releaseID, env.Name)
+	return nil
+}
+
+// Snapshot archives a release as a portable tar.xz for off-server storage.
+// An empty releaseID selects the current release; an empty outputPath writes
+// <env>-<releaseID>-snapshot.tar.xz in the current directory. The archive
+// is read back and checked against the release's manifest before it is kept.
+func Snapshot(env Environment, releaseID, outputPath string) error {
+	deployer := newDeployer(env)
+	id := NormalizeReleaseID(releaseID)
+	if id == "." || id == ".." || (id == "" && releaseID != "") {
+		return fmt.Errorf("invalid release ID %q", releaseID)
+	}
+	if id == "" {
+		current, err := currentReleaseID(deployer)
+		if err != nil {
+			return err
+		}
+		id = current
+	}
+	releaseID = id
+	if outputPath == "" {
+		outputPath = snapshotPath(env, releaseID)
+	}
+
+	fmt.Printf("Snapshotting %s on %s...\n", releaseID, targetDescription(env))
+	tmpPath := outputPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	m, err := writeSnapshot(deployer, releaseID, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = verifySnapshot(tmpPath, m)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, outputPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("snapshot %s: %w", releaseID, err)
+	}
+
+	var size int64
+	if info, _ := os.Stat(outputPath); info != nil {
+		size = info.Size()
+	}
+	fmt.Printf("Wrote %s (%d files, %s)\n", outputPath, len(m.Files)+1, formatSize(size))
+	return nil
+}
+
+// Restore deploys a snapshot archive as a new release and activates it,
+// without building. The archive is unpacked to a temporary directory and
+// checked against its build-manifest.json before anything reaches the
+// target. An empty releaseID reuses the release ID recorded in the manifest.
+func Restore(env Environment, snapshotPath, releaseID string) error {
+	id := NormalizeReleaseID(releaseID)
+	if id == "." || id == ".." || (id == "" && releaseID != "") {
+		return fmt.Errorf("invalid release ID %q", releaseID)
+	}
+
+	fmt.Printf("==> Unpacking %s...\n", snapshotPath)
+	tmpDir, err := os.MkdirTemp("", "juniper-restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := extractSnapshot(snapshotPath, tmpDir); err != nil {
+		return fmt.Errorf("unpack snapshot: %w", err)
+	}
+	m := loadBuildManifest(tmpDir)
+	if m == nil {
+		return fmt.Errorf("snapshot has no %s", manifestFile)
+	}
+	if err := verifyExtracted(tmpDir, m); err != nil {
+		return fmt.Errorf("snapshot failed verification: %w", err)
+	}
+	fmt.Printf("    %d files verified against the manifest\n", len(m.Files))
+	fmt.Println()
+
+	if id == "" {
+		id = NormalizeReleaseID(m.ReleaseID)
+	} else if id != m.ReleaseID {
+		fmt.Printf("Note: snapshot was taken from release %s\n\n", m.ReleaseID)
+	}
+	if id == "" || id == "." || id == ".." {
+		return fmt.Errorf("snapshot manifest has no usable release ID; pass one explicitly")
+	}
+
+	env.Branch = "" // Nothing is built, so the branch would not describe the release
+	printDeployHeader(env, id)
+	deployer := newDeployer(env)
+	if err := checkReadiness(deployer); err != nil {
+		return err
+	}
+	exists, err := releaseExists(deployer, id)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("release %s already exists on %s", id, env.Name)
+	}
+
+	if err := createReleaseDir(deployer, id); err != nil {
+		return err
+	}
+	fmt.Println("==> Uploading snapshot files...")
+	if err := deployer.UploadFull(tmpDir, id); err != nil {
+		return fmt.Errorf("upload: %w", err)
+	}
+	fmt.Println()
+	if err := activateRelease(deployer, id); err != nil {
+		return err
+	}
+	cleanupOldReleases(deployer, env.KeepN)
+	// healthz.json was generated for the release the snapshot came from
+	runHealthCheck(deployer, m.ReleaseID)
+	fmt.Printf("Done! Release %s restored from %s and now live.\n", id, filepath.Base(snapshotPath))
+	return nil
+}
+
 // ListReleases lists releases on the target.
 func ListReleases(env Environment) error {
 	deployer := newDeployer(env)
@@ -251,28 +755,102 @@ func ListReleases(env Environment) error {
 	return nil
 }
 
-// findPreviousRelease finds the first non-current release
-func findPreviousRelease(deployer Deployer) (string, error) {
+// findPreviousRelease finds the release steps back from current, counting
+// only non-current releases (steps=1 is the previous release).
+func findPreviousRelease(deployer Deployer, steps int) (string, error) {
 	releases, err := deployer.ListReleases()
 	if err != nil {
 		return "", err
 	}
+	return nthPreviousRelease(releases, steps)
+}
+
+// nthPreviousRelease returns the ID of the steps-th non-current release.
+func nthPreviousRelease(releases []Release, steps int) (string, error) {
+	if steps < 1 {
+		steps = 1
+	}
+	var previous []string
 	for _, r := range releases {
 		if !r.Current {
-			return r.ID, nil
+			previous = append(previous, r.ID)
 		}
 	}
-	return "", fmt.Errorf("no previous release found")
+	if len(previous) == 0 {
+		return "", fmt.Errorf("no previous release found")
+	}
+	if steps > len(previous) {
+		return "", ErrInsufficientReleases{Requested: steps, Available: len(previous)}
+	}
+	return previous[steps-1], nil
+}
+
+// fillReleaseSizes populates Release.Size for each release.
+func fillReleaseSizes(deployer Deployer, releases []Release) {
+	var sizes map[string]int64
+	switch d := deployer.(type) {
+	case *LocalDeployer:
+		sizes = d.releaseSizes(releases)
+	case *RemoteDeployer:
+		sizes = d.releaseSizes(releases)
+	default:
+		return
+	}
+	for i := range releases {
+		releases[i].Size = sizes[releases[i].ID]
+	}
+}
+
+// pickRollbackTarget lets the user choose a release interactively.
+// Returns "" if the user cancelled.
+func pickRollbackTarget(deployer Deployer, env Environment) (string, error) {
+	releases, err := deployer.ListReleases()
+	if err != nil {
+		return "", err
+	}
+	fillReleaseSizes(deployer, releases)
+
+	fmt.Printf("Releases on %s:\n\n", targetDescription(env))
+	picked, err := PickRelease(releases)
+	if errors.Is(err, errPickerCancelled) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Printf("Selected release: %s\n", picked)
+	if !confirmRollback(env.Name, picked) {
+		return "", nil
+	}
+	return picked, nil
 }
 
 // Rollback switches to a previous release.
-func Rollback(env Environment, releaseID string) error {
+// When steps > 0 the release that many steps back is used and releaseID is
+// ignored. With no release ID and interactive set, a picker is shown when
+// running in a terminal; otherwise the previous release is used.
+func Rollback(env Environment, releaseID string, steps int, interactive bool) error {
 	deployer := newDeployer(env)
 
 	targetID := releaseID
+	if steps > 0 {
+		targetID = ""
+	}
+	if targetID == "" && steps == 0 && interactive && IsInteractive() {
+		picked, err := pickRollbackTarget(deployer, env)
+		if err != nil {
+			return err
+		}
+		if picked == "" {
+			fmt.Println("Rollback cancelled")
+			return nil
+		}
+		targetID = picked
+	}
 	if targetID == "" {
 		var err error
-		targetID, err = findPreviousRelease(deployer)
+		targetID, err = findPreviousRelease(deployer, steps)
 		if err != nil {
 			return err
 		}
@@ -333,18 +911,19 @@ func Status(env Environment) error {
 	if env.Target == "" {
 		return printLocalStatus(NewLocalDeployer(env.Path))
 	}
-	printRemoteStatus(NewRemoteDeployer(env.Target, env.Path))
+	printRemoteStatus(NewRemoteDeployer(env.Target, env.Path, env.Transport))
 	return nil
 }
 
 // GenerateManifestOnly generates a build manifest without deploying.
-func GenerateManifestOnly(buildDir, releaseID string) error {
+// With fullStats every file type is listed instead of the largest few.
+func GenerateManifestOnly(buildDir, releaseID string, fullStats bool) error {
 	if releaseID == "" {
 		releaseID = GenerateReleaseID()
 	}
 
 	fmt.Println("==> Generating build manifest...")
-	manifest, err := GenerateManifestWithWorkers(buildDir, releaseID, DefaultWorkers)
+	manifest, err := GenerateManifestWithWorkers(buildDir, releaseID, DefaultWorkers, false, nil, hashProgress())
 	if err != nil {
 		return err
 	}
@@ -357,6 +936,88 @@ func GenerateManifestOnly(buildDir, releaseID string) error {
 	fmt.Printf("Manifest written to %s\n", manifestPath)
 	fmt.Printf("  Files: %d\n", len(manifest.Files))
 	fmt.Printf("  Size:  %.2f MB\n", float64(manifest.TotalSize())/(1024*1024))
+	fmt.Println()
 
+	limit := statsSummaryTypes
+	if fullStats {
+		limit = 0
+	}
+	printManifestStats(ManifestStats(manifest), limit)
 	return nil
 }
+
+// collectEnvironment cleans one environment, measuring the releases first.
+func collectEnvironment(env Environment, dryRun bool) EnvGCStats {
+	stats := EnvGCStats{Env: env.Name, KeepN: env.KeepN}
+	deployer := newDeployer(env)
+	releases, err := deployer.ListReleases()
+	if err != nil {
+		stats.Err = err
+		return stats
+	}
+	expired := expiredReleases(releases, env.KeepN)
+	if len(expired) == 0 {
+		return stats
+	}
+	fillReleaseSizes(deployer, expired)
+	for _, r := range expired {
+		stats.Releases = append(stats.Releases, r.ID)
+		stats.BytesFreed += r.Size
+	}
+	if !dryRun {
+		stats.Err = deployer.Cleanup(env.KeepN)
+	}
+	return stats
+}
+
+// printEnvGCStats prints the result for one environment.
+func printEnvGCStats(s EnvGCStats, dryRun bool) {
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	switch {
+	case s.Err != nil:
+		fmt.Printf("    Error: %v\n", s.Err)
+	case len(s.Releases) == 0:
+		fmt.Printf("    Nothing to remove (keeping %d)\n", s.KeepN)
+	default:
+		for _, id := range s.Releases {
+			fmt.Printf("    %s %s\n", verb, id)
+		}
+		fmt.Printf("    %d release(s), ~%s\n", len(s.Releases), formatSize(s.BytesFreed))
+	}
+	fmt.Println()
+}
+
+// GarbageCollect removes releases beyond KeepN in every configured environment.
+// With dryRun it only reports what would be removed. Failures in one
+// environment do not stop the others; they are recorded in the result and
+// returned together.
+func GarbageCollect(config *Config, dryRun bool) (GCResult, error) {
+	result := GCResult{DryRun: dryRun}
+	var errs []error
+	for _, env := range config.Environments {
+		fmt.Printf("==> %s: %s\n", env.Name, targetDescription(env))
+		stats := collectEnvironment(env, dryRun)
+		printEnvGCStats(stats, dryRun)
+		if stats.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", env.Name, stats.Err))
+		} else {
+			result.ReleasesDeleted += len(stats.Releases)
+			result.BytesFreed += stats.BytesFreed
+		}
+		result.Environments = append(result.Environments, stats)
+	}
+
+	summary := "Removed"
+	if dryRun {
+		summary = "Would remove"
+	}
+	fmt.Printf("%s %d release(s) across %d environment(s)", summary, result.ReleasesDeleted, len(config.Environments))
+	if result.BytesFreed > 0 {
+		fmt.Printf(", ~%s", formatSize(result.BytesFreed))
+	}
+	fmt.Println()
+	return result, errors.Join(errs...)
+}
@@ -0,0 +1,233 @@
+package deploy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// healthzOperators are the comparison operators accepted in healthz rules,
+// longest first so "<=" is not read as "<".
+var healthzOperators = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// healthzRule is a parsed healthz validation rule such as "$.status == 'ok'".
+// A rule without an operator only requires the path to exist.
+type healthzRule struct {
+	path  []string // Object keys and array indexes after "$"
+	op    string   // Comparison operator, or "" for an existence check
+	value any      // Literal to compare against, decoded like JSON
+}
+
+// parseHealthzRule parses a rule of the form "<path> [<op> <literal>]".
+// Paths start at "$" and use .key, ['key'] and [index] segments; literals are
+// quoted strings, numbers, true, false or null.
+func parseHealthzRule(rule string) (healthzRule, error) {
+	expr, op, literal := strings.TrimSpace(rule), "", ""
+	if i, o := findOperator(expr); i >= 0 {
+		expr, op, literal = strings.TrimSpace(expr[:i]), o, strings.TrimSpace(expr[i+len(o):])
+	}
+
+	path, err := parseJSONPath(expr)
+	if err != nil {
+		return healthzRule{}, err
+	}
+	r := healthzRule{path: path, op: op}
+	if op == "" {
+		return r, nil
+	}
+	if r.value, err = parseLiteral(literal); err != nil {
+		return healthzRule{}, err
+	}
+	if _, isNum := r.value.(float64); !isNum && op != "==" && op != "!=" {
+		return healthzRule{}, fmt.Errorf("operator %s needs a number", op)
+	}
+	return r, nil
+}
+
+// findOperator returns the position and text of the first operator outside quotes.
+func findOperator(expr string) (int, string) {
+	var quote byte
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		default:
+			for _, op := range healthzOperators {
+				if strings.HasPrefix(expr[i:], op) {
+					return i, op
+				}
+			}
+		}
+	}
+	return -1, ""
+}
+
+// parseJSONPath splits a path such as $.checks[0]['db'] into its segments.
+func parseJSONPath(expr string) ([]string, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("path %q must start with $", expr)
+	}
+	var segments []string
+	rest := expr[1:]
+	for rest != "" {
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, fmt.Errorf("empty key in path %q", expr)
+			}
+			segments = append(segments, key)
+			rest = rest[end+1:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in path %q", expr)
+			}
+			key := rest[1:end]
+			if unquoted, err := unquoteLiteral(key); err == nil {
+				key = unquoted
+			} else if _, err := strconv.Atoi(key); err != nil {
+				return nil, fmt.Errorf("invalid index [%s] in path %q", key, expr)
+			}
+			segments = append(segments, key)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %q in path %q", rest, expr)
+		}
+	}
+	return segments, nil
+}
+
+// unquoteLiteral strips matching single or double quotes.
+func unquoteLiteral(s string) (string, error) {
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1], nil
+	}
+	return "", errors.New("not a quoted string")
+}
+
+// parseLiteral decodes the right-hand side of a rule.
+func parseLiteral(s string) (any, error) {
+	if str, err := unquoteLiteral(s); err == nil {
+		return str, nil
+	}
+	switch s {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid literal %q", s)
+	}
+	return n, nil
+}
+
+// lookup walks the path through decoded JSON.
+func (r healthzRule) lookup(doc any) (any, bool) {
+	cur := doc
+	for _, seg := range r.path {
+		switch node := cur.(type) {
+		case map[string]any:
+			v, ok := node[seg]
+			if !ok {
+				return nil, false
+			}
+			cur = v
+		case []any:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			cur = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// evaluate checks the rule against decoded JSON, returning why it failed.
+func (r healthzRule) evaluate(doc any) error {
+	got, ok := r.lookup(doc)
+	if !ok {
+		return errors.New("path not found")
+	}
+	if r.op == "" {
+		return nil
+	}
+
+	var pass bool
+	switch r.op {
+	case "==":
+		pass = got == r.value
+	case "!=":
+		pass = got != r.value
+	default:
+		n, isNum := got.(float64)
+		if !isNum {
+			return fmt.Errorf("got %s, not a number", formatJSONValue(got))
+		}
+		want := r.value.(float64)
+		pass = (r.op == "<" && n < want) || (r.op == ">" && n > want) ||
+			(r.op == "<=" && n <= want) || (r.op == ">=" && n >= want)
+	}
+	if !pass {
+		return fmt.Errorf("got %s", formatJSONValue(got))
+	}
+	return nil
+}
+
+// formatJSONValue renders a decoded JSON value for error messages.
+func formatJSONValue(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// ValidateHealthz checks a healthz.json body: it must mention releaseID and
+// satisfy every rule. All failed rules are reported together.
+func ValidateHealthz(body []byte, releaseID string, rules []string) error {
+	if !strings.Contains(string(body), releaseID) {
+		return fmt.Errorf("release ID %s not found in healthz.json", releaseID)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return fmt.Errorf("parse healthz.json: %w", err)
+	}
+	var failures []string
+	for _, rule := range rules {
+		r, err := parseHealthzRule(rule)
+		if err == nil {
+			err = r.evaluate(doc)
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", rule, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("healthz.json failed %d of %d rule(s):\n    %s",
+			len(failures), len(rules), strings.Join(failures, "\n    "))
+	}
+	return nil
+}
@@ -7,13 +7,16 @@ import (
 	"os/exec"
 	"path/filepath"
 	"sort"
-	"strings"
 	"time"
 )
 
 // LocalDeployer implements Deployer for local filesystem deployments.
 type LocalDeployer struct {
 	basePath string
+	fileMode os.FileMode // Forced mode for deployed files (0 preserves source mode)
+	dirMode  os.FileMode // Forced mode for deployed directories (0 preserves source mode)
+
+	healthzRules []string // Extra rules checked against healthz.json
 }
 
 // NewLocalDeployer creates a new local deployer.
@@ -21,6 +24,46 @@ func NewLocalDeployer(basePath string) *LocalDeployer {
 	return &LocalDeployer{basePath: basePath}
 }
 
+// SetModes overrides the permissions applied to deployed files and directories.
+// A zero mode preserves the original permissions.
+func (d *LocalDeployer) SetModes(fileMode, dirMode os.FileMode) {
+	d.fileMode = fileMode
+	d.dirMode = dirMode
+}
+
+// SetHealthzValidation sets the rules HealthCheck evaluates against healthz.json.
+func (d *LocalDeployer) SetHealthzValidation(rules []string) {
+	d.healthzRules = rules
+}
+
+// mkdirMode returns the configured directory mode, or fallback if unset.
+func (d *LocalDeployer) mkdirMode(fallback os.FileMode) os.FileMode {
+	if d.dirMode != 0 {
+		return d.dirMode
+	}
+	return fallback
+}
+
+// applyFileMode sets the configured file mode on path, if one is configured.
+func (d *LocalDeployer) applyFileMode(path string) error {
+	if d.fileMode == 0 {
+		return nil
+	}
+	return os.Chmod(path, d.fileMode)
+}
+
+// makeDir creates a directory and applies the configured directory mode.
+// MkdirAll is subject to umask, so an explicit chmod follows when a mode is forced.
+func (d *LocalDeployer) makeDir(path string, fallback os.FileMode) error {
+	if err := os.MkdirAll(path, d.mkdirMode(fallback)); err != nil {
+		return err
+	}
+	if d.dirMode == 0 {
+		return nil
+	}
+	return os.Chmod(path, d.dirMode)
+}
+
 // releasesDir returns the path to the releases directory.
 func (d *LocalDeployer) releasesDir() string {
 	return filepath.Join(d.basePath, "releases")
@@ -60,11 +103,15 @@ func (d *LocalDeployer) CreateRelease(releaseID string) error {
 		if output, err := cmd.CombinedOutput(); err != nil {
 			return fmt.Errorf("hardlink copy failed: %s: %w", output, err)
 		}
+		// A pin belongs to the release it was set on, not its copies
+		if err := os.Remove(filepath.Join(releaseDir, PinnedFile)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("clear copied pin: %w", err)
+		}
 		return nil
 	}
 
 	// First release - create empty directory
-	if err := os.MkdirAll(releaseDir, 0755); err != nil {
+	if err := d.makeDir(releaseDir, 0755); err != nil {
 		return fmt.Errorf("create release dir: %w", err)
 	}
 	return nil
@@ -72,40 +119,74 @@ func (d *LocalDeployer) CreateRelease(releaseID string) error {
 
 // UploadFull copies all files to the release directory.
 func (d *LocalDeployer) UploadFull(buildDir, releaseID string) error {
-	releaseDir := d.releaseDir(releaseID)
+	return d.copyTree(buildDir, buildDir, d.releaseDir(releaseID), "", loadBuildManifest(buildDir))
+}
 
-	// Walk and copy all files
-	return filepath.Walk(buildDir, func(path string, info os.FileInfo, err error) error {
+// copyTree copies srcDir into dstDir. relBase is srcDir's path relative to
+// buildDir, used to look up symlink handling in the build manifest.
+func (d *LocalDeployer) copyTree(buildDir, srcDir, dstDir, relBase string, m *Manifest) error {
+	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		relPath, err := filepath.Rel(buildDir, path)
+		relPath, err := filepath.Rel(srcDir, path)
 		if err != nil {
 			return err
 		}
 
-		dstPath := filepath.Join(releaseDir, relPath)
+		dstPath := filepath.Join(dstDir, relPath)
 
 		if info.IsDir() {
-			return os.MkdirAll(dstPath, info.Mode())
+			return d.makeDir(dstPath, info.Mode())
+		}
+
+		// CreateRelease hardlinks the current release, so replace files
+		// rather than writing through the link into it
+		os.Remove(dstPath)
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return d.copyLinkEntry(buildDir, path, dstPath, filepath.Join(relBase, relPath), m)
 		}
 
-		return copyFile(path, dstPath)
+		if err := copyFile(path, dstPath); err != nil {
+			return err
+		}
+		return d.applyFileMode(dstPath)
 	})
 }
 
+// copyLinkEntry deploys a symlink found in the build directory, either as a
+// link or, when the manifest was generated following symlinks, as its contents.
+func (d *LocalDeployer) copyLinkEntry(buildDir, path, dstPath, relPath string, m *Manifest) error {
+	if _, isLink := symlinkTarget(m, buildDir, relPath); isLink {
+		return copySymlink(path, dstPath)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return d.copyTree(buildDir, path+string(filepath.Separator), dstPath, relPath, m)
+	}
+	if err := copyFile(path, dstPath); err != nil {
+		return err
+	}
+	return d.applyFileMode(dstPath)
+}
+
 // UploadDelta copies only changed files to the release directory.
 // Removes existing files first to break hardlinks and preserve rollback integrity.
 func (d *LocalDeployer) UploadDelta(buildDir, releaseID string, files []string) error {
 	releaseDir := d.releaseDir(releaseID)
+	m := loadBuildManifest(buildDir)
 
 	for _, file := range files {
 		src := filepath.Join(buildDir, file)
 		dst := filepath.Join(releaseDir, file)
 
 		// Ensure parent directory exists
-		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		if err := d.makeDir(filepath.Dir(dst), 0755); err != nil {
 			return err
 		}
 
@@ -113,9 +194,19 @@ func (d *LocalDeployer) UploadDelta(buildDir, releaseID string, files []string)
 		// This preserves the original in the source release
 		os.Remove(dst)
 
+		if target, isLink := symlinkTarget(m, buildDir, file); isLink {
+			if err := os.Symlink(target, dst); err != nil {
+				return fmt.Errorf("symlink %s: %w", file, err)
+			}
+			continue
+		}
+
 		if err := copyFile(src, dst); err != nil {
 			return fmt.Errorf("copy %s: %w", file, err)
 		}
+		if err := d.applyFileMode(dst); err != nil {
+			return fmt.Errorf("chmod %s: %w", file, err)
+		}
 	}
 
 	return nil
@@ -164,12 +255,9 @@ func (d *LocalDeployer) Activate(releaseID string) error {
 	return d.atomicSymlinkSwap(releaseDir, d.currentLink())
 }
 
-// removeOldReleases removes releases beyond keepN, skipping current
+// removeOldReleases removes unpinned releases beyond keepN, skipping current
 func (d *LocalDeployer) removeOldReleases(releases []Release, keepN int) error {
-	for _, release := range releases[keepN:] {
-		if release.Current {
-			continue
-		}
+	for _, release := range expiredReleases(releases, keepN) {
 		if err := os.RemoveAll(release.Path); err != nil {
 			return fmt.Errorf("remove %s: %w", release.ID, err)
 		}
@@ -183,25 +271,38 @@ func (d *LocalDeployer) Cleanup(keepN int) error {
 	if err != nil {
 		return err
 	}
-	if len(releases) <= keepN {
-		return nil
-	}
 	return d.removeOldReleases(releases, keepN)
 }
 
+// SetPinned pins or unpins a release by creating or removing its PinnedFile.
+func (d *LocalDeployer) SetPinned(releaseID string, pinned bool) error {
+	releaseDir := d.releaseDir(releaseID)
+	info, err := os.Stat(releaseDir)
+	if err != nil {
+		return fmt.Errorf("release %s not found: %w", releaseID, err)
+	}
+	pinPath := filepath.Join(releaseDir, PinnedFile)
+	if pinned {
+		err = os.WriteFile(pinPath, nil, 0644)
+	} else if err = os.Remove(pinPath); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("set pinned %s: %w", releaseID, err)
+	}
+	// Releases are ordered by directory mtime, so keep it unchanged
+	return os.Chtimes(releaseDir, info.ModTime(), info.ModTime())
+}
+
 // HealthCheck verifies the deployment was successful.
 func (d *LocalDeployer) HealthCheck(releaseID string) error {
 	healthzPath := filepath.Join(d.currentLink(), "healthz.json")
-	manifest, err := os.ReadFile(healthzPath)
+	body, err := os.ReadFile(healthzPath)
 	if err != nil {
 		return fmt.Errorf("read healthz.json: %w", err)
 	}
 
-	if !strings.Contains(string(manifest), releaseID) {
-		return fmt.Errorf("release ID %s not found in healthz.json", releaseID)
-	}
-
-	return nil
+	return ValidateHealthz(body, releaseID, d.healthzRules)
 }
 
 // getCurrentTarget returns the resolved current symlink target
@@ -223,11 +324,13 @@ func (d *LocalDeployer) entryToRelease(entry os.DirEntry, currentTarget string)
 		return nil
 	}
 	releasePath := filepath.Join(d.releasesDir(), entry.Name())
+	_, pinErr := os.Lstat(filepath.Join(releasePath, PinnedFile))
 	return &Release{
 		ID:        entry.Name(),
 		Path:      releasePath,
 		CreatedAt: info.ModTime(),
 		Current:   releasePath == currentTarget,
+		Pinned:    pinErr == nil,
 	}
 }
 
@@ -255,6 +358,22 @@ func (d *LocalDeployer) ListReleases() ([]Release, error) {
 	return releases, nil
 }
 
+// releaseSizes returns the size in bytes of each release directory, keyed by ID.
+func (d *LocalDeployer) releaseSizes(releases []Release) map[string]int64 {
+	sizes := make(map[string]int64)
+	for _, r := range releases {
+		var total int64
+		filepath.Walk(r.Path, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				total += info.Size()
+			}
+			return nil
+		})
+		sizes[r.ID] = total
+	}
+	return sizes
+}
+
 // findPreviousReleaseID finds the first non-current release ID
 func (d *LocalDeployer) findPreviousReleaseID() (string, error) {
 	releases, err := d.ListReleases()
@@ -313,3 +432,12 @@ func copyFile(src, dst string) error {
 	// Preserve modification time
 	return os.Chtimes(dst, time.Now(), srcInfo.ModTime())
 }
+
+// copySymlink recreates the symlink at src as dst, pointing at the same target.
+func copySymlink(src, dst string) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, dst)
+}
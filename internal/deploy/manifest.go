@@ -4,26 +4,56 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 // GenerateManifest creates a build manifest for the given directory.
 // Files are hashed in parallel using all available CPU cores.
+// Symlinks are recorded as links rather than followed.
 func GenerateManifest(dir string, releaseID string) (*Manifest, error) {
-	return GenerateManifestWithWorkers(dir, releaseID, runtime.NumCPU())
+	return GenerateManifestWithWorkers(dir, releaseID, runtime.NumCPU(), false, nil, nil)
 }
 
-// collectFiles walks directory and returns list of relative file paths
-func collectFiles(dir string) ([]string, error) {
-	var files []string
-	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+// GenerateManifestWithProgress creates a build manifest like GenerateManifest,
+// calling cb with the number of files hashed so far and the total after each file.
+func GenerateManifestWithProgress(dir, releaseID string, workers int, cb func(hashed, total int)) (*Manifest, error) {
+	return GenerateManifestWithWorkers(dir, releaseID, workers, false, nil, cb)
+}
+
+// fileCollector gathers regular files and symlinks beneath a build directory
+type fileCollector struct {
+	followSymlinks bool
+	files          []string          // Relative paths of files to hash
+	links          map[string]string // Relative symlink path -> link target (when not following)
+}
+
+// collectFiles walks directory and returns relative file paths and, when
+// symlinks are not followed, a map of relative symlink paths to their targets
+func collectFiles(dir string, followSymlinks bool) ([]string, map[string]string, error) {
+	c := &fileCollector{followSymlinks: followSymlinks, links: make(map[string]string)}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := c.walk(dir, "", []string{root}); err != nil {
+		return nil, nil, err
+	}
+	return c.files, c.links, nil
+}
+
+// walk collects entries under dir, prefixing relative paths with relBase.
+// chain holds the resolved directories currently being walked, for cycle detection.
+func (c *fileCollector) walk(dir, relBase string, chain []string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil || d.IsDir() {
 			return err
 		}
@@ -31,54 +61,142 @@ func collectFiles(dir string) ([]string, error) {
 		if err != nil {
 			return err
 		}
-		if relPath != "build-manifest.json" {
-			files = append(files, relPath)
+		relPath = filepath.Join(relBase, relPath)
+		if relPath == "build-manifest.json" {
+			return nil
 		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			return c.addSymlink(path, relPath, chain)
+		}
+		c.files = append(c.files, relPath)
 		return nil
 	})
-	return files, err
 }
 
-// hashWorker processes files from channel and adds to manifest
-func hashWorker(dir string, fileChan <-chan string, manifest *Manifest, mu *sync.Mutex, errChan chan<- error, wg *sync.WaitGroup) {
+// addSymlink records a symlink, or follows it when followSymlinks is set
+func (c *fileCollector) addSymlink(path, relPath string, chain []string) error {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return err
+	}
+	if !c.followSymlinks {
+		c.links[relPath] = target
+		return nil
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("dangling symlink: %s -> %s", relPath, target)
+		}
+		return fmt.Errorf("resolve symlink %s -> %s: %w", relPath, target, err)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		c.files = append(c.files, relPath)
+		return nil
+	}
+	for _, seen := range chain {
+		if seen == resolved {
+			return fmt.Errorf("symlink cycle detected: %s -> %s", relPath, target)
+		}
+	}
+	return c.walk(path+string(filepath.Separator), relPath, append(chain, resolved))
+}
+
+// reusableInfo returns the previous entry for a file whose size and mtime are unchanged
+func reusableInfo(prev *Manifest, fullPath, relPath string) (FileInfo, bool) {
+	if prev == nil {
+		return FileInfo{}, false
+	}
+	old, ok := prev.Files[relPath]
+	if !ok || old.SymlinkTarget != "" || old.MTime.IsZero() {
+		return FileInfo{}, false
+	}
+	stat, err := os.Stat(fullPath)
+	if err != nil || stat.Size() != old.Size || !stat.ModTime().Equal(old.MTime) {
+		return FileInfo{}, false
+	}
+	return old, true
+}
+
+// hashWorker processes files from channel and adds to manifest.
+// Entries from prev are reused for files whose size and mtime are unchanged.
+// done is called with mu held after each file is added.
+func hashWorker(dir string, fileChan <-chan string, manifest, prev *Manifest, mu *sync.Mutex, done func(), errChan chan<- error, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for relPath := range fileChan {
 		fullPath := filepath.Join(dir, relPath)
-		info, err := hashFile(fullPath)
-		if err != nil {
-			select {
-			case errChan <- err:
-			default:
+		info, reused := reusableInfo(prev, fullPath, relPath)
+		if !reused {
+			var err error
+			info, err = hashFile(fullPath)
+			if err != nil {
+				select {
+				case errChan <- err:
+				default:
+				}
+				continue
 			}
-			continue
 		}
 		mu.Lock()
 		manifest.Files[relPath] = info
+		if !reused {
+			manifest.Rehashed++
+		}
+		done()
 		mu.Unlock()
 	}
 }
 
+// symlinkInfo returns manifest metadata for a symlink that is not followed.
+// The hash covers the link target so retargeted links show up in the delta.
+func symlinkInfo(target string) FileInfo {
+	sum := sha256.Sum256([]byte(target))
+	return FileInfo{
+		SHA256:        hex.EncodeToString(sum[:]),
+		SymlinkTarget: target,
+	}
+}
+
 // GenerateManifestWithWorkers creates a build manifest using the specified number of workers.
-func GenerateManifestWithWorkers(dir string, releaseID string, workers int) (*Manifest, error) {
+// When followSymlinks is false, symlinks are recorded with their target instead of hashed.
+// When prev is non-nil, files whose size and mtime match prev are not re-hashed.
+// A non-nil progress is called after each file with the count so far and the
+// total; calls never overlap.
+func GenerateManifestWithWorkers(dir string, releaseID string, workers int, followSymlinks bool, prev *Manifest, progress func(hashed, total int)) (*Manifest, error) {
 	manifest := &Manifest{
 		Files:     make(map[string]FileInfo),
 		ReleaseID: releaseID,
 		BuildTime: time.Now().UTC(),
 	}
 
-	files, err := collectFiles(dir)
+	files, links, err := collectFiles(dir, followSymlinks)
 	if err != nil {
 		return nil, err
 	}
+	for relPath, target := range links {
+		manifest.Files[relPath] = symlinkInfo(target)
+	}
 
 	var mu sync.Mutex
+	hashed := 0
+	done := func() {
+		hashed++
+		if progress != nil {
+			progress(hashed, len(files))
+		}
+	}
 	fileChan := make(chan string, len(files))
 	errChan := make(chan error, 1)
 	var wg sync.WaitGroup
 
 	for i := 0; i < workers; i++ {
 		wg.Add(1)
-		go hashWorker(dir, fileChan, manifest, &mu, errChan, &wg)
+		go hashWorker(dir, fileChan, manifest, prev, &mu, done, errChan, &wg)
 	}
 
 	for _, f := range files {
@@ -117,6 +235,7 @@ func hashFile(path string) (FileInfo, error) {
 	return FileInfo{
 		SHA256: hex.EncodeToString(h.Sum(nil)),
 		Size:   stat.Size(),
+		MTime:  stat.ModTime(),
 	}, nil
 }
 
@@ -148,11 +267,35 @@ func ReadManifest(path string) (*Manifest, error) {
 	return &m, nil
 }
 
-// findChangedFiles finds files that are new or changed in local manifest
-func findChangedFiles(local, remote *Manifest) (changed, unchanged []string) {
+// loadBuildManifest reads build-manifest.json from buildDir, returning nil if absent.
+func loadBuildManifest(buildDir string) *Manifest {
+	m, err := ReadManifest(filepath.Join(buildDir, "build-manifest.json"))
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+// symlinkTarget reports whether relPath should be deployed as a symlink, and its target.
+// The build manifest decides when it lists the path; otherwise the filesystem is checked.
+func symlinkTarget(m *Manifest, buildDir, relPath string) (string, bool) {
+	if m != nil {
+		if info, ok := m.Files[relPath]; ok {
+			return info.SymlinkTarget, info.SymlinkTarget != ""
+		}
+	}
+	target, err := os.Readlink(filepath.Join(buildDir, relPath))
+	return target, err == nil
+}
+
+// findChangedFiles finds files under subPath that are new or changed in local manifest
+func findChangedFiles(local, remote *Manifest, subPath string) (changed, unchanged []string) {
 	for path, info := range local.Files {
+		if !inSubPath(path, subPath) {
+			continue
+		}
 		remoteInfo, exists := remote.Files[path]
-		if !exists || remoteInfo.SHA256 != info.SHA256 {
+		if !exists || remoteInfo.SHA256 != info.SHA256 || remoteInfo.SymlinkTarget != info.SymlinkTarget {
 			changed = append(changed, path)
 		} else {
 			unchanged = append(unchanged, path)
@@ -161,10 +304,13 @@ func findChangedFiles(local, remote *Manifest) (changed, unchanged []string) {
 	return
 }
 
-// findDeletedFiles finds files that exist in remote but not in local
-func findDeletedFiles(local, remote *Manifest) []string {
+// findDeletedFiles finds files under subPath that exist in remote but not in local
+func findDeletedFiles(local, remote *Manifest, subPath string) []string {
 	var deleted []string
 	for path := range remote.Files {
+		if !inSubPath(path, subPath) {
+			continue
+		}
 		if _, exists := local.Files[path]; !exists {
 			deleted = append(deleted, path)
 		}
@@ -173,9 +319,10 @@ func findDeletedFiles(local, remote *Manifest) []string {
 }
 
 // CalculateDelta compares local and remote manifests to find changed files.
-func CalculateDelta(local, remote *Manifest) *Delta {
-	changed, unchanged := findChangedFiles(local, remote)
-	deleted := findDeletedFiles(local, remote)
+// A non-empty subPath limits the comparison to files under that directory.
+func CalculateDelta(local, remote *Manifest, subPath string) *Delta {
+	changed, unchanged := findChangedFiles(local, remote, subPath)
+	deleted := findDeletedFiles(local, remote, subPath)
 
 	sort.Strings(changed)
 	sort.Strings(unchanged)
@@ -193,6 +340,59 @@ func (m *Manifest) TotalSize() int64 {
 	return total
 }
 
+// compressionSavings estimates the fraction of bytes saved by HTTP compression
+// for each extension. Text compresses well; images and fonts are already compressed.
+var compressionSavings = map[string]float64{
+	".html": 0.70, ".htm": 0.70, ".css": 0.70, ".js": 0.70, ".mjs": 0.70,
+	".json": 0.70, ".xml": 0.70, ".svg": 0.70, ".txt": 0.70, ".map": 0.70,
+	".png": 0.05, ".jpg": 0.05, ".jpeg": 0.05, ".gif": 0.05, ".webp": 0.05,
+	".avif": 0.05, ".ico": 0.05, ".woff": 0.05, ".woff2": 0.05,
+	".xz": 0, ".gz": 0, ".br": 0, ".zip": 0,
+}
+
+// defaultCompressionSavings applies to extensions not in compressionSavings.
+const defaultCompressionSavings = 0.30
+
+// ManifestStats groups manifest files by extension and estimates compressed size.
+func ManifestStats(m *Manifest) Stats {
+	byExt := make(map[string]*TypeStats)
+	var s Stats
+	var compressed float64
+	for path, info := range m.Files {
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext == "" {
+			ext = "(none)"
+		}
+		ts, ok := byExt[ext]
+		if !ok {
+			ts = &TypeStats{Ext: ext}
+			byExt[ext] = ts
+		}
+		ts.Files++
+		ts.Bytes += info.Size
+		s.TotalFiles++
+		s.TotalBytes += info.Size
+
+		savings, ok := compressionSavings[ext]
+		if !ok {
+			savings = defaultCompressionSavings
+		}
+		compressed += float64(info.Size) * (1 - savings)
+	}
+	s.CompressedBytes = int64(compressed)
+
+	for _, ts := range byExt {
+		s.Types = append(s.Types, *ts)
+	}
+	sort.Slice(s.Types, func(i, j int) bool {
+		if s.Types[i].Bytes != s.Types[j].Bytes {
+			return s.Types[i].Bytes > s.Types[j].Bytes
+		}
+		return s.Types[i].Ext < s.Types[j].Ext
+	})
+	return s
+}
+
 // DeltaSize returns the total size of changed files.
 func DeltaSize(m *Manifest, changed []string) int64 {
 	var total int64
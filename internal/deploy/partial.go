@@ -0,0 +1,157 @@
+package deploy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+)
+
+// partialBuildArgs make Hugo reuse its cache and the existing output
+// directory instead of rendering from scratch.
+var partialBuildArgs = []string{"--gc", "--templateMetrics", "--ignoreCache=false"}
+
+// partialBuildEnv keeps Hugo from forcing a full re-render.
+var partialBuildEnv = []string{"HUGO_DISABLE_FAST_RENDER=false"}
+
+// maxDivergentShown limits how many divergent files are listed before falling back.
+const maxDivergentShown = 5
+
+// BuildHugoPartial runs an incremental Hugo build that keeps $HOME/.cache/hugo
+// and the existing output, so only changed content is re-rendered.
+func BuildHugoPartial(releaseID, baseURL string, dotEnv map[string]string) error {
+	return runHugo(releaseID, baseURL, dotEnv, partialBuildArgs, partialBuildEnv)
+}
+
+// fullBuildRecord is the manifest of the last full build and the source it was built from.
+type fullBuildRecord struct {
+	Source    string            `json:"source"`    // sourceFingerprint at build time
+	ReleaseID string            `json:"releaseId"` // Release the build was made for
+	Files     map[string]string `json:"files"`     // Path to SHA-256
+}
+
+// sourceFingerprint identifies the checked-out content, including uncommitted
+// and untracked changes. It returns "" outside a git repository.
+func sourceFingerprint() string {
+	h := sha256.New()
+	for _, args := range [][]string{
+		{"rev-parse", "HEAD^{tree}"},
+		{"diff", "HEAD"},
+		{"ls-files", "--others", "--exclude-standard"},
+	} {
+		out, err := exec.Command("git", args...).Output()
+		if err != nil {
+			return ""
+		}
+		h.Write(out)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fullBuildRecordPath returns where the full build of the current project is
+// recorded; the name is keyed by the project path since the cache is shared.
+func fullBuildRecordPath() string {
+	wd, err := os.Getwd()
+	if err != nil {
+		wd = "."
+	}
+	sum := sha256.Sum256([]byte(wd))
+	return filepath.Join(hugoCacheDir(), "juniper-full-build-"+hex.EncodeToString(sum[:4])+".json")
+}
+
+// recordFullBuild saves the manifest of a full build for verifying later
+// partial builds of the same source. Failures only warn.
+func recordFullBuild(m *Manifest) {
+	source := sourceFingerprint()
+	if source == "" {
+		return
+	}
+	rec := fullBuildRecord{Source: source, ReleaseID: m.ReleaseID, Files: make(map[string]string, len(m.Files))}
+	for path, info := range m.Files {
+		rec.Files[path] = info.SHA256
+	}
+	data, err := json.Marshal(rec)
+	if err == nil {
+		err = os.WriteFile(fullBuildRecordPath(), data, 0644)
+	}
+	if err != nil {
+		fmt.Printf("Warning: could not record full build manifest: %v\n", err)
+	}
+}
+
+// loadFullBuildRecord returns the recorded full build of the current source,
+// or nil when the source changed since or nothing was recorded.
+func loadFullBuildRecord() *fullBuildRecord {
+	data, err := os.ReadFile(fullBuildRecordPath())
+	if err != nil {
+		return nil
+	}
+	var rec fullBuildRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil
+	}
+	if source := sourceFingerprint(); source == "" || rec.Source != source {
+		return nil
+	}
+	return &rec
+}
+
+// mentionsRelease reports whether a built file contains releaseID; such
+// files legitimately differ between builds of the same content.
+func mentionsRelease(buildDir, path, releaseID string) bool {
+	data, err := os.ReadFile(filepath.Join(buildDir, filepath.FromSlash(path)))
+	return err == nil && bytes.Contains(data, []byte(releaseID))
+}
+
+// divergentFiles lists files under subPath whose checksums differ between a
+// partial build and the full build of the same source. Files that only differ
+// because they embed the release ID are ignored.
+func divergentFiles(buildDir string, partial *Manifest, full *fullBuildRecord, subPath string) []string {
+	var diverged []string
+	for path, info := range partial.Files {
+		if sum, ok := full.Files[path]; ok && sum == info.SHA256 {
+			continue
+		}
+		if _, ok := full.Files[path]; ok && mentionsRelease(buildDir, path, partial.ReleaseID) {
+			continue
+		}
+		diverged = append(diverged, path)
+	}
+	for path := range full.Files {
+		if _, ok := partial.Files[path]; !ok && inSubPath(path, subPath) {
+			diverged = append(diverged, path)
+		}
+	}
+	sort.Strings(diverged)
+	return diverged
+}
+
+// verifyPartialBuild compares a partial build with the recorded full build
+// of the same source, within subPath when one is given. It returns false
+// when their checksums diverge.
+func verifyPartialBuild(buildDir string, m *Manifest, subPath string) bool {
+	full := loadFullBuildRecord()
+	if full == nil {
+		fmt.Println("    No full build of this source recorded; partial build not verified")
+		return true
+	}
+	diverged := divergentFiles(buildDir, m, full, subPath)
+	if len(diverged) == 0 {
+		fmt.Printf("    Partial build matches full build %s\n", full.ReleaseID)
+		return true
+	}
+	fmt.Printf("    Partial build differs from full build %s in %d file(s):\n", full.ReleaseID, len(diverged))
+	for i, path := range diverged {
+		if i == maxDivergentShown {
+			fmt.Printf("      ... and %d more\n", len(diverged)-maxDivergentShown)
+			break
+		}
+		fmt.Printf("      %s\n", path)
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package deploy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+	"golang.org/x/term"
+)
+
+// errPickerCancelled is returned when the user cancels the release picker.
+var errPickerCancelled = errors.New("cancelled")
+
+// Key codes recognised by the release picker.
+const (
+	keyNone = iota
+	keyUp
+	keyDown
+	keyEnter
+	keyCancel
+)
+
+// IsInteractive reports whether stdin and stdout are both terminals.
+func IsInteractive() bool {
+	return term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// formatSize formats a byte count as megabytes, or "-" when unknown.
+func formatSize(size int64) string {
+	if size <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f MB", float64(size)/(1024*1024))
+}
+
+// renderReleaseList writes the picker list with the cursor row highlighted.
+// Lines end in \r\n because the terminal is in raw mode while picking.
+func renderReleaseList(w io.Writer, releases []Release, cursor int) {
+	for i, r := range releases {
+		marker := "  "
+		if i == cursor {
+			marker = "> "
+		}
+		current := ""
+		if r.Current {
+			current = " (current)"
+		}
+		line := fmt.Sprintf("%s%s  %-28s %10s%s",
+			marker,
+			r.CreatedAt.Format("2006-01-02 15:04:05"),
+			r.ID,
+			formatSize(r.Size),
+			current,
+		)
+		if i == cursor {
+			line = common.Reverse + line + common.Reset
+		}
+		fmt.Fprint(w, line+"\r\n")
+	}
+	fmt.Fprint(w, "\r\n↑/↓ to move, Enter to select, Esc/q to cancel\r\n")
+}
+
+// readKey reads one keypress from a raw-mode terminal.
+func readKey(r io.Reader) (int, error) {
+	buf := make([]byte, 3)
+	n, err := r.Read(buf)
+	if err != nil {
+		return keyNone, err
+	}
+	switch {
+	case n == 3 && buf[0] == 0x1b && buf[1] == '[' && buf[2] == 'A':
+		return keyUp, nil
+	case n == 3 && buf[0] == 0x1b && buf[1] == '[' && buf[2] == 'B':
+		return keyDown, nil
+	case n == 1 && (buf[0] == 0x1b || buf[0] == 'q' || buf[0] == 3):
+		return keyCancel, nil
+	case n == 1 && (buf[0] == '\r' || buf[0] == '\n'):
+		return keyEnter, nil
+	case n == 1 && buf[0] == 'k':
+		return keyUp, nil
+	case n == 1 && buf[0] == 'j':
+		return keyDown, nil
+	}
+	return keyNone, nil
+}
+
+// pickLoop redraws the list and handles keys until a selection or cancel.
+func pickLoop(releases []Release, cursor int) (string, error) {
+	lines := len(releases) + 2
+	for {
+		renderReleaseList(os.Stdout, releases, cursor)
+		key, err := readKey(os.Stdin)
+		if err != nil {
+			return "", err
+		}
+		switch key {
+		case keyUp:
+			if cursor > 0 {
+				cursor--
+			}
+		case keyDown:
+			if cursor < len(releases)-1 {
+				cursor++
+			}
+		case keyEnter:
+			return releases[cursor].ID, nil
+		case keyCancel:
+			return "", errPickerCancelled
+		}
+		// Move back to the top of the list and clear it before redrawing
+		fmt.Printf("\033[%dA\033[J", lines)
+	}
+}
+
+// PickRelease shows an arrow-key picker and returns the chosen release ID.
+// The cursor starts on the first non-current release.
+func PickRelease(releases []Release) (string, error) {
+	if len(releases) == 0 {
+		return "", fmt.Errorf("no releases found")
+	}
+	cursor := 0
+	for i, r := range releases {
+		if !r.Current {
+			cursor = i
+			break
+		}
+	}
+
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return "", fmt.Errorf("enable raw mode: %w", err)
+	}
+	defer term.Restore(fd, state)
+
+	return pickLoop(releases, cursor)
+}
+
+// confirmRollback asks the user to confirm rolling back to releaseID.
+func confirmRollback(envName, releaseID string) bool {
+	fmt.Printf("Roll back %s to %s? [y/N]: ", envName, releaseID)
+	input, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false
+	}
+	input = strings.TrimSpace(strings.ToLower(input))
+	return input == "y" || input == "yes"
+}
@@ -0,0 +1,172 @@
+package deploy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// placeholderTargetValue is the prod target ExampleConfig ships with.
+const placeholderTargetValue = "user@host"
+
+// projectFile is one file written by InitProject.
+type projectFile struct {
+	path    string
+	content string
+	mode    os.FileMode
+}
+
+// projectMakefile builds and deploys the site with juniper-deploy.
+const projectMakefile = `# %s - build and deploy with juniper-deploy
+.PHONY: build deploy-local deploy-prod
+
+build:
+	hugo --minify
+
+deploy-local:
+	juniper-deploy local
+
+deploy-prod:
+	juniper-deploy prod
+`
+
+// projectGitignore keeps build output, local releases and build secrets out of git.
+const projectGitignore = `# Hugo output
+public/
+
+# Releases of the local environment
+deploy/
+
+# Build-time variables loaded by juniper-deploy
+.env
+`
+
+// projectSitemapsScript is the stub run by BuildHugoWithSitemaps.
+const projectSitemapsScript = `#!/bin/sh
+# generate-sitemaps.sh PUBLIC_DIR BASE_URL
+#
+# Runs after the Hugo build to add sitemaps to PUBLIC_DIR beyond the
+# sitemap.xml Hugo writes itself. Replace this stub with your own.
+set -eu
+
+public_dir="${1:-public}"
+base_url="${2:-}"
+
+echo "generate-sitemaps: nothing to generate for $public_dir ($base_url)"
+`
+
+// projectFiles returns the files of a new project named name whose prod
+// environment deploys to target; an empty target keeps the placeholder.
+func projectFiles(name, target string) ([]projectFile, error) {
+	v := ScaffoldValues{Project: name, Target: target, BaseURL: "https://example.com", KeepN: 5}
+	if v.Target == "" {
+		v.Target = placeholderTargetValue
+	}
+	config, err := ScaffoldConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	return []projectFile{
+		{"deploy.toml", config, 0644},
+		{"Makefile", fmt.Sprintf(projectMakefile, name), 0644},
+		{".gitignore", projectGitignore, 0644},
+		{filepath.Join("scripts", "generate-sitemaps.sh"), projectSitemapsScript, 0755},
+	}, nil
+}
+
+// dirEntries returns the names in dir, sorted.
+func dirEntries(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// confirmNonEmptyDir asks before writing files into a directory that already
+// has content, naming the files that would be replaced.
+func confirmNonEmptyDir(files []projectFile, force bool) error {
+	names, err := dirEntries(".")
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 || force {
+		return nil
+	}
+	var existing []string
+	for _, f := range files {
+		if common.FileExists(f.path) {
+			existing = append(existing, f.path)
+		}
+	}
+	fmt.Printf("The current directory is not empty (%d entries).\n", len(names))
+	if len(existing) > 0 {
+		fmt.Println("These files will be replaced:")
+		for _, p := range existing {
+			fmt.Printf("    %s\n", p)
+		}
+	}
+	if !common.Confirm("Write the project files here?", false) {
+		return fmt.Errorf("directory is not empty (use --force to write anyway)")
+	}
+	return nil
+}
+
+// InitProject scaffolds a new project named name in the current directory:
+// deploy.toml, a Makefile, a .gitignore and a sitemap script stub. target
+// pre-fills the prod environment. A directory that is not empty is only
+// written to after confirmation or with force.
+func InitProject(name, target string, force bool) error {
+	files, err := projectFiles(name, target)
+	if err != nil {
+		return err
+	}
+	if err := confirmNonEmptyDir(files, force); err != nil {
+		return err
+	}
+
+	fmt.Printf("==> Creating project %s...\n", name)
+	for _, f := range files {
+		if dir := filepath.Dir(f.path); dir != "." {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+		if err := os.WriteFile(f.path, []byte(f.content), f.mode); err != nil {
+			return err
+		}
+		// WriteFile keeps the mode of a file it replaces
+		if err := os.Chmod(f.path, f.mode); err != nil {
+			return err
+		}
+		fmt.Printf("    %s\n", f.path)
+	}
+	if _, err := LoadConfig("deploy.toml"); err != nil {
+		return fmt.Errorf("deploy.toml was written but does not load: %w", err)
+	}
+
+	printNextSteps(target)
+	return nil
+}
+
+// printNextSteps tells the user how to go from the scaffold to a deploy.
+func printNextSteps(target string) {
+	fmt.Println()
+	fmt.Println("Next steps:")
+	fmt.Println("    1. Add your Hugo site here (hugo.toml, content/, layouts/)")
+	if target == "" {
+		fmt.Println("    2. Set target and baseURL of the prod environment in deploy.toml")
+	} else {
+		fmt.Println("    2. Set baseURL of the prod environment in deploy.toml")
+	}
+	fmt.Println("    3. make deploy-local   # build and deploy to ./deploy")
+	fmt.Println("    4. make deploy-prod    # build and deploy to production")
+}
@@ -0,0 +1,87 @@
+package deploy
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// readinessCache remembers readiness results for the life of the process,
+// keyed by target, so repeated checks don't reconnect.
+var (
+	readinessMu    sync.Mutex
+	readinessCache = make(map[string]error)
+)
+
+// CheckTargetReady verifies the deployment target is reachable and usable
+// before any expensive work (such as the Hugo build) starts.
+func CheckTargetReady(deployer Deployer) error {
+	var key string
+	var check func() error
+	switch d := deployer.(type) {
+	case *RemoteDeployer:
+		key, check = "remote:"+d.host+":"+d.basePath, d.checkReady
+	case *LocalDeployer:
+		key, check = "local:"+d.basePath, d.checkReady
+	default:
+		return nil
+	}
+
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+	if err, ok := readinessCache[key]; ok {
+		return err
+	}
+	err := check()
+	readinessCache[key] = err
+	return err
+}
+
+// checkReady verifies the base path can be created and written to.
+func (d *LocalDeployer) checkReady() error {
+	if err := os.MkdirAll(d.basePath, d.mkdirMode(0755)); err != nil {
+		return fmt.Errorf("target %s not writable: %w", d.basePath, err)
+	}
+	f, err := os.CreateTemp(d.basePath, ".juniper-ready-*")
+	if err != nil {
+		return fmt.Errorf("target %s not writable: %w", d.basePath, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// requiredCommands returns the commands the remote host must provide.
+func (d *RemoteDeployer) requiredCommands() []string {
+	if d.transport == TransportRsync {
+		return []string{"rsync", "cp", "readlink", "df"}
+	}
+	return []string{"xz", "tar", "cp", "readlink", "df"}
+}
+
+// checkReady verifies SSH connectivity and that required commands exist remotely.
+func (d *RemoteDeployer) checkReady() error {
+	script := fmt.Sprintf(`
+		echo ready
+		for c in %s; do
+			command -v "$c" >/dev/null 2>&1 || echo "missing $c"
+		done
+	`, strings.Join(d.requiredCommands(), " "))
+
+	output, err := d.ssh(script)
+	if err != nil {
+		return fmt.Errorf("target %s unreachable: %s: %w", d.host, strings.TrimSpace(string(output)), err)
+	}
+
+	var missing []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if cmd, ok := strings.CutPrefix(strings.TrimSpace(line), "missing "); ok {
+			missing = append(missing, cmd)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("target %s is missing required commands: %s", d.host, strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package deploy
+
+import (
+	"fmt"
+	"time"
+)
+
+// RegionEnvironments returns the environments serving region, in config order.
+func (c *Config) RegionEnvironments(region string) []Environment {
+	var envs []Environment
+	for _, env := range c.Environments {
+		if env.Region == region {
+			envs = append(envs, env)
+		}
+	}
+	return envs
+}
+
+// recordLatency measures the SSH round trip to a remote environment with a
+// Region and adds it to result. A failed measurement is only a warning: the
+// release is already live.
+func recordLatency(env Environment, result *DeployResult) {
+	if env.Region == "" || env.Target == "" {
+		return
+	}
+	latency, err := PingLatency(env.Target)
+	if err != nil {
+		fmt.Printf("Warning: could not measure latency to %s: %v\n", env.Name, err)
+		return
+	}
+	if result.RegionLatencies == nil {
+		result.RegionLatencies = make(map[string]time.Duration)
+	}
+	result.RegionLatencies[env.Name] = latency
+	fmt.Printf("Latency to %s (%s): %s\n", env.Name, env.Region, latency.Round(time.Millisecond))
+}
+
+// DeployRegion deploys to every environment of region in the order they
+// appear in config. The site is built once for the first environment and
+// the same release is deployed to the rest; the first failure stops the
+// run. Auto-promote is not followed, since the region already names the
+// environments to deploy.
+func DeployRegion(config *Config, region string, opts Options) (*DeployResult, error) {
+	envs := config.RegionEnvironments(region)
+	if len(envs) == 0 {
+		return nil, fmt.Errorf("no environments in region '%s'", region)
+	}
+	opts.Config = config
+	opts.NoAutoPromote = true
+
+	result := &DeployResult{ReleaseID: opts.ReleaseID}
+	for i, env := range envs {
+		if i > 0 {
+			fmt.Println()
+			opts.ReleaseID = result.ReleaseID
+			opts.NoBuild = true
+			opts.StashBeforeBuild = false
+			opts.Branch = ""
+		}
+		envResult, err := Deploy(env, opts)
+		if envResult != nil {
+			result.ReleaseID = envResult.ReleaseID
+			result.Stashed = result.Stashed || envResult.Stashed
+			for name, latency := range envResult.RegionLatencies {
+				if result.RegionLatencies == nil {
+					result.RegionLatencies = make(map[string]time.Duration)
+				}
+				result.RegionLatencies[name] = latency
+			}
+		}
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", env.Name, err)
+		}
+	}
+
+	if !opts.DryRun {
+		printRegionSummary(region, envs, result)
+	}
+	return result, nil
+}
+
+// printRegionSummary lists each environment of a region deploy with its latency.
+func printRegionSummary(region string, envs []Environment, result *DeployResult) {
+	fmt.Println()
+	fmt.Printf("==> Region %s: release %s deployed to %d environment(s)\n", region, result.ReleaseID, len(envs))
+	for _, env := range envs {
+		latency := "-"
+		if l, ok := result.RegionLatencies[env.Name]; ok {
+			latency = l.Round(time.Millisecond).String()
+		}
+		fmt.Printf("    %-16s %-32s %s\n", env.Name, targetDescription(env), latency)
+	}
+}
@@ -18,18 +18,36 @@ import (
 
 // RemoteDeployer implements Deployer for SSH-based deployments.
 type RemoteDeployer struct {
-	host     string // user@host
-	basePath string // /var/www/juniperbible
+	host      string // user@host
+	basePath  string // /var/www/juniperbible
+	transport string // TransportSSHTar or TransportRsync
+
+	healthzRules []string // Extra rules checked against healthz.json
 }
 
 // NewRemoteDeployer creates a new remote deployer.
-func NewRemoteDeployer(host, basePath string) *RemoteDeployer {
+// An empty transport selects TransportSSHTar.
+func NewRemoteDeployer(host, basePath, transport string) *RemoteDeployer {
+	if transport == "" {
+		transport = TransportSSHTar
+	}
+	if transport == TransportRsync {
+		if _, err := exec.LookPath("rsync"); err != nil {
+			fmt.Println("    Warning: rsync transport selected but rsync is not installed locally")
+		}
+	}
 	return &RemoteDeployer{
-		host:     host,
-		basePath: basePath,
+		host:      host,
+		basePath:  basePath,
+		transport: transport,
 	}
 }
 
+// SetHealthzValidation sets the rules HealthCheck evaluates against healthz.json.
+func (d *RemoteDeployer) SetHealthzValidation(rules []string) {
+	d.healthzRules = rules
+}
+
 // releasesDir returns the path to the releases directory.
 func (d *RemoteDeployer) releasesDir() string {
 	return filepath.Join(d.basePath, "releases")
@@ -101,10 +119,11 @@ func (d *RemoteDeployer) CreateRelease(releaseID string) error {
 		set -e
 		if [ -d '%s' ]; then
 			cp -al "$(readlink -f '%s')" '%s'
+			rm -f '%s/%s'
 		else
 			mkdir -p '%s'
 		fi
-	`, currentLink, currentLink, releaseDir, releaseDir)
+	`, currentLink, currentLink, releaseDir, releaseDir, PinnedFile, releaseDir)
 
 	output, err := d.ssh(script)
 	if err != nil {
@@ -115,7 +134,23 @@ func (d *RemoteDeployer) CreateRelease(releaseID string) error {
 }
 
 // UploadFull uploads all files to the release directory.
+// With the rsync transport the release is mirrored with --delete.
+// Otherwise files listed in the build manifest are used when present, so followed
+// symlinks are uploaded as their contents.
 func (d *RemoteDeployer) UploadFull(buildDir, releaseID string) error {
+	if d.transport == TransportRsync {
+		return d.rsync(buildDir, releaseID, "--delete")
+	}
+
+	if m := loadBuildManifest(buildDir); m != nil {
+		files := []string{"build-manifest.json"}
+		for path := range m.Files {
+			files = append(files, path)
+		}
+		sort.Strings(files)
+		return d.UploadDelta(buildDir, releaseID, files)
+	}
+
 	// Collect all files
 	var files []string
 	err := filepath.Walk(buildDir, func(path string, info os.FileInfo, err error) error {
@@ -135,9 +170,16 @@ func (d *RemoteDeployer) UploadFull(buildDir, releaseID string) error {
 
 // writeFilesToTar writes files to tar writer and returns total size
 func writeFilesToTar(tarWriter *tar.Writer, buildDir string, files []string) (int64, error) {
+	m := loadBuildManifest(buildDir)
 	var totalSize int64
 	for _, file := range files {
 		fullPath := filepath.Join(buildDir, file)
+		if target, isLink := symlinkTarget(m, buildDir, file); isLink {
+			if err := addSymlinkToTar(tarWriter, file, target); err != nil {
+				return 0, fmt.Errorf("add %s to tar: %w", file, err)
+			}
+			continue
+		}
 		if err := addFileToTar(tarWriter, fullPath, file); err != nil {
 			return 0, fmt.Errorf("add %s to tar: %w", file, err)
 		}
@@ -161,12 +203,57 @@ func streamTarXZ(stdin io.WriteCloser, buildDir string, files []string) (int64,
 	return totalSize, writeErr
 }
 
-// UploadDelta uploads only changed files to the release directory via SSH + XZ.
+// rsync copies buildDir into the release directory with rsync over SSH.
+// rsync writes each file to a temporary name and renames it into place,
+// which breaks hardlinks just like tar --unlink-first.
+func (d *RemoteDeployer) rsync(buildDir, releaseID string, extraArgs ...string) error {
+	args := append([]string{"-avz"}, extraArgs...)
+	args = append(args,
+		strings.TrimSuffix(buildDir, "/")+"/",
+		fmt.Sprintf("%s:%s/", d.host, d.releaseDir(releaseID)),
+	)
+	cmd := exec.Command("rsync", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("rsync failed: %w", err)
+	}
+	return nil
+}
+
+// rsyncFiles uploads the listed files with rsync --files-from.
+func (d *RemoteDeployer) rsyncFiles(buildDir, releaseID string, files []string) error {
+	listFile, err := os.CreateTemp("", "juniper-deploy-files-*.txt")
+	if err != nil {
+		return fmt.Errorf("create file list: %w", err)
+	}
+	defer os.Remove(listFile.Name())
+
+	_, writeErr := listFile.WriteString(strings.Join(files, "\n") + "\n")
+	if closeErr := listFile.Close(); writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr != nil {
+		return fmt.Errorf("write file list: %w", writeErr)
+	}
+
+	if err := d.rsync(buildDir, releaseID, "--files-from="+listFile.Name()); err != nil {
+		return err
+	}
+	fmt.Printf("    Uploaded %d files via rsync\n", len(files))
+	return nil
+}
+
+// UploadDelta uploads only changed files to the release directory via SSH + XZ,
+// or via rsync when that transport is configured.
 // Uses --unlink-first to break hardlinks before extraction, preserving rollback integrity.
 func (d *RemoteDeployer) UploadDelta(buildDir, releaseID string, files []string) error {
 	if len(files) == 0 {
 		return nil
 	}
+	if d.transport == TransportRsync {
+		return d.rsyncFiles(buildDir, releaseID, files)
+	}
 
 	// --unlink-first removes existing files before extracting, breaking hardlinks
 	// so the original file in the source release remains intact for rollback
@@ -192,6 +279,17 @@ func (d *RemoteDeployer) UploadDelta(buildDir, releaseID string, files []string)
 	return nil
 }
 
+// addSymlinkToTar adds a symlink entry to the tar archive.
+func addSymlinkToTar(tw *tar.Writer, relPath, target string) error {
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     relPath,
+		Linkname: target,
+		Mode:     0777,
+		ModTime:  time.Now(),
+	})
+}
+
 // addFileToTar adds a file to the tar archive.
 func addFileToTar(tw *tar.Writer, fullPath, relPath string) error {
 	f, err := os.Open(fullPath)
@@ -251,10 +349,21 @@ func (d *RemoteDeployer) Activate(releaseID string) error {
 }
 
 // Cleanup removes old releases, keeping the specified number.
+// Pinned releases and the current release are never removed.
 func (d *RemoteDeployer) Cleanup(keepN int) error {
 	script := fmt.Sprintf(`
-		cd '%s' && ls -1t | tail -n +%d | xargs -r rm -rf
-	`, d.releasesDir(), keepN+1)
+		current=$(readlink -f '%s' 2>/dev/null || echo "")
+		cd '%s' || exit 1
+		n=0
+		ls -1t | while IFS= read -r dir; do
+			[ -d "$dir" ] || continue
+			[ -e "$dir/%s" ] && continue
+			n=$((n+1))
+			[ "$n" -le %d ] && continue
+			[ "%s/$dir" = "$current" ] && continue
+			rm -rf "$dir"
+		done
+	`, d.currentLink(), d.releasesDir(), PinnedFile, keepN, d.releasesDir())
 
 	output, err := d.ssh(script)
 	if err != nil {
@@ -264,19 +373,36 @@ func (d *RemoteDeployer) Cleanup(keepN int) error {
 	return nil
 }
 
+// SetPinned pins or unpins a release by creating or removing its PinnedFile.
+func (d *RemoteDeployer) SetPinned(releaseID string, pinned bool) error {
+	op := "rm -f"
+	if pinned {
+		op = "touch"
+	}
+	script := fmt.Sprintf(`
+		dir='%s'
+		[ -d "$dir" ] || { echo "release %s not found"; exit 1; }
+		mtime=$(stat -c '%%Y' "$dir")
+		%s "$dir/%s"
+		touch -d "@$mtime" "$dir"
+	`, d.releaseDir(releaseID), releaseID, op, PinnedFile)
+
+	output, err := d.ssh(script)
+	if err != nil {
+		return fmt.Errorf("set pinned: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
 // HealthCheck verifies the deployment was successful.
+// healthz.json is fetched over SSH and validated locally.
 func (d *RemoteDeployer) HealthCheck(releaseID string) error {
-	script := fmt.Sprintf(
-		"curl -sf http://localhost/healthz.json | grep -q '%s'",
-		releaseID,
-	)
-
-	_, err := d.ssh(script)
+	body, err := d.ssh("curl -sf http://localhost/healthz.json")
 	if err != nil {
-		return fmt.Errorf("health check failed: release %s not live", releaseID)
+		return fmt.Errorf("health check failed: fetch healthz.json: %w", err)
 	}
 
-	return nil
+	return ValidateHealthz(body, releaseID, d.healthzRules)
 }
 
 // ListReleases returns all available releases.
@@ -290,9 +416,11 @@ func (d *RemoteDeployer) ListReleases() ([]Release, error) {
 			mtime=$(stat -c '%%Y' "$dir" 2>/dev/null || echo "0")
 			is_current="false"
 			[ "%s/$dir" = "$current" ] && is_current="true"
-			echo "$dir $mtime $is_current"
+			is_pinned="false"
+			[ -e "$dir/%s" ] && is_pinned="true"
+			echo "$dir $mtime $is_current $is_pinned"
 		done
-	`, d.releasesDir(), d.currentLink(), d.releasesDir())
+	`, d.releasesDir(), d.currentLink(), d.releasesDir(), PinnedFile)
 
 	output, err := d.ssh(script)
 	if err != nil {
@@ -319,6 +447,7 @@ func (d *RemoteDeployer) ListReleases() ([]Release, error) {
 			Path:      filepath.Join(d.releasesDir(), parts[0]),
 			CreatedAt: time.Unix(mtime, 0),
 			Current:   parts[2] == "true",
+			Pinned:    len(parts) > 3 && parts[3] == "true",
 		})
 	}
 
@@ -330,6 +459,38 @@ func (d *RemoteDeployer) ListReleases() ([]Release, error) {
 	return releases, nil
 }
 
+// releaseSizes returns the size in bytes of each release directory, keyed by ID.
+// Each release is measured with its own du so hardlinks shared between
+// releases count toward every release that contains them.
+func (d *RemoteDeployer) releaseSizes(releases []Release) map[string]int64 {
+	dirs := make([]string, len(releases))
+	for i, r := range releases {
+		dirs[i] = "'" + r.ID + "'"
+	}
+	script := fmt.Sprintf(`
+		cd '%s' 2>/dev/null || exit 0
+		for dir in %s; do
+			echo "$dir $(du -sb "$dir" 2>/dev/null | cut -f1)"
+		done
+	`, d.releasesDir(), strings.Join(dirs, " "))
+
+	sizes := make(map[string]int64)
+	output, err := d.ssh(script)
+	if err != nil {
+		return sizes
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			continue
+		}
+		var size int64
+		fmt.Sscanf(parts[1], "%d", &size)
+		sizes[parts[0]] = size
+	}
+	return sizes
+}
+
 // findPreviousReleaseID finds the first non-current release ID
 func (d *RemoteDeployer) findPreviousReleaseID() (string, error) {
 	releases, err := d.ListReleases()
@@ -390,6 +551,21 @@ func (d *RemoteDeployer) GetCurrentRelease() (string, error) {
 	return strings.TrimSpace(string(output)), nil
 }
 
+// PingLatency measures the round trip of an SSH echo to target, including
+// connection setup, as a rough indication of how far away the host is.
+func PingLatency(target string) (time.Duration, error) {
+	start := time.Now()
+	output, err := exec.Command("ssh", target, "echo pong").CombinedOutput()
+	elapsed := time.Since(start)
+	if err != nil {
+		return 0, fmt.Errorf("ssh %s: %w: %s", target, err, bytes.TrimSpace(output))
+	}
+	if strings.TrimSpace(string(output)) != "pong" {
+		return 0, fmt.Errorf("ssh %s: unexpected reply %q", target, bytes.TrimSpace(output))
+	}
+	return elapsed, nil
+}
+
 // GetHealthz returns the current healthz.json content.
 func (d *RemoteDeployer) GetHealthz() ([]byte, error) {
 	output, err := d.ssh("curl -sf http://localhost/healthz.json")
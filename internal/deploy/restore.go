@@ -0,0 +1,137 @@
+package deploy
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+)
+
+// extractSnapshot unpacks a snapshot archive into dir. Entries that would
+// land outside dir, directly or through a symlink in the archive, are
+// refused.
+func extractSnapshot(archivePath, dir string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	xzReader, err := xz.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("read xz: %w", err)
+	}
+	tr := tar.NewReader(xzReader)
+	links := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read tar: %w", err)
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if name == "." {
+			continue
+		}
+		if err := checkSnapshotEntry(name, links); err != nil {
+			return err
+		}
+		if err := extractEntry(tr, hdr, filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			return fmt.Errorf("extract %s: %w", name, err)
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			links[name] = true
+		}
+	}
+}
+
+// checkSnapshotEntry refuses names that escape the release directory or
+// pass through a symlink extracted earlier.
+func checkSnapshotEntry(name string, links map[string]bool) error {
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("archive entry %q is outside the release", name)
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if links[dir] {
+			return fmt.Errorf("archive entry %q is inside symlink %s", name, dir)
+		}
+	}
+	return nil
+}
+
+// extractEntry writes one archive entry to dest.
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dest string) error {
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(dest, 0755)
+	case tar.TypeSymlink:
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		return os.Symlink(hdr.Linkname, dest)
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(hdr.Mode)&0777)
+		if err != nil {
+			return err
+		}
+		_, copyErr := io.Copy(out, io.LimitReader(tr, hdr.Size))
+		if closeErr := out.Close(); copyErr == nil {
+			copyErr = closeErr
+		}
+		if copyErr != nil {
+			return copyErr
+		}
+		return os.Chtimes(dest, hdr.ModTime, hdr.ModTime)
+	}
+	return fmt.Errorf("unsupported entry type %q", hdr.Typeflag)
+}
+
+// verifyExtracted checks every file the manifest lists against its recorded
+// hash, or its link target for symlinks.
+func verifyExtracted(dir string, m *Manifest) error {
+	for file, want := range m.Files {
+		fullPath := filepath.Join(dir, filepath.FromSlash(file))
+		if want.SymlinkTarget != "" {
+			target, err := os.Readlink(fullPath)
+			if err != nil {
+				return fmt.Errorf("%s: %w", file, err)
+			}
+			if target != want.SymlinkTarget {
+				return fmt.Errorf("%s: links to %s, manifest says %s", file, target, want.SymlinkTarget)
+			}
+			continue
+		}
+		got, err := hashFile(fullPath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if got.SHA256 != want.SHA256 || got.Size != want.Size {
+			return fmt.Errorf("%s: checksum does not match the manifest", file)
+		}
+	}
+	return nil
+}
+
+// releaseExists reports whether the target already has a release named releaseID.
+func releaseExists(deployer Deployer, releaseID string) (bool, error) {
+	releases, err := deployer.ListReleases()
+	if err != nil {
+		return false, fmt.Errorf("list releases: %w", err)
+	}
+	for _, r := range releases {
+		if r.ID == releaseID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
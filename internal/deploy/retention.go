@@ -0,0 +1,155 @@
+package deploy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// diskUsage returns the bytes each release adds when releases are measured
+// in order, counting every hardlinked file only the first time it is seen.
+// This matches a single du -sb over all the directories.
+func (d *LocalDeployer) diskUsage(releases []Release) map[string]int64 {
+	type inode struct{ dev, ino uint64 }
+	seen := make(map[inode]bool)
+	usage := make(map[string]int64)
+	for _, r := range releases {
+		var total int64
+		filepath.Walk(r.Path, func(_ string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				key := inode{uint64(st.Dev), st.Ino}
+				if seen[key] {
+					return nil
+				}
+				seen[key] = true
+			}
+			total += info.Size()
+			return nil
+		})
+		usage[r.ID] = total
+	}
+	return usage
+}
+
+// diskUsage returns the bytes each release adds when releases are measured
+// in order. A single du counts each hardlinked file only once.
+func (d *RemoteDeployer) diskUsage(releases []Release) map[string]int64 {
+	dirs := make([]string, len(releases))
+	for i, r := range releases {
+		dirs[i] = "'" + r.ID + "'"
+	}
+	script := fmt.Sprintf(`
+		cd '%s' 2>/dev/null || exit 0
+		du -sb %s 2>/dev/null
+	`, d.releasesDir(), strings.Join(dirs, " "))
+
+	usage := make(map[string]int64)
+	output, _ := d.ssh(script)
+	for _, line := range strings.Split(string(output), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			continue
+		}
+		var size int64
+		fmt.Sscanf(parts[0], "%d", &size)
+		usage[parts[1]] = size
+	}
+	return usage
+}
+
+// measureDiskUsage dispatches diskUsage to the concrete deployer.
+func measureDiskUsage(deployer Deployer, releases []Release) map[string]int64 {
+	switch d := deployer.(type) {
+	case *LocalDeployer:
+		return d.diskUsage(releases)
+	case *RemoteDeployer:
+		return d.diskUsage(releases)
+	}
+	return nil
+}
+
+// RetentionReport measures the disk usage of every release in env and how
+// much Cleanup(env.KeepN) would free.
+func RetentionReport(env Environment) (*RetentionStats, error) {
+	deployer := newDeployer(env)
+	releases, err := deployer.ListReleases()
+	if err != nil {
+		return nil, fmt.Errorf("list releases: %w", err)
+	}
+	fillReleaseSizes(deployer, releases)
+
+	expired := make(map[string]bool)
+	for _, r := range expiredReleases(releases, env.KeepN) {
+		expired[r.ID] = true
+	}
+	var ordered []Release
+	for _, r := range releases {
+		if !expired[r.ID] {
+			ordered = append(ordered, r)
+		}
+	}
+	for _, r := range releases {
+		if expired[r.ID] {
+			ordered = append(ordered, r)
+		}
+	}
+
+	usage := measureDiskUsage(deployer, ordered)
+	stats := &RetentionStats{Env: env.Name, KeepN: env.KeepN}
+	for _, r := range ordered {
+		u := ReleaseUsage{Release: r, DiskBytes: usage[r.ID], Expired: expired[r.ID]}
+		stats.Releases = append(stats.Releases, u)
+		stats.ApparentBytes += r.Size
+		stats.DiskBytes += u.DiskBytes
+		if u.Expired {
+			stats.ProjectedSavings += u.DiskBytes
+		}
+	}
+	return stats, nil
+}
+
+// retentionStatus labels a release in the retention table.
+func retentionStatus(u ReleaseUsage) string {
+	switch {
+	case u.Current:
+		return "current"
+	case u.Expired:
+		return "remove"
+	case u.Pinned:
+		return "pinned"
+	}
+	return "keep"
+}
+
+// PrintRetentionReport prints a table of per-release usage with totals.
+func PrintRetentionReport(env Environment, stats *RetentionStats) {
+	fmt.Printf("==> Retention report for %s: %s\n", env.Name, targetDescription(env))
+	if len(stats.Releases) == 0 {
+		fmt.Println("    No releases found")
+		return
+	}
+	fmt.Printf("    %-24s %-8s %12s %12s\n", "RELEASE", "STATUS", "SIZE", "DISK")
+	for _, u := range stats.Releases {
+		fmt.Printf("    %-24s %-8s %12s %12s\n", u.ID, retentionStatus(u), formatSize(u.Size), formatSize(u.DiskBytes))
+	}
+	fmt.Println()
+	fmt.Printf("    Releases:     %d\n", len(stats.Releases))
+	fmt.Printf("    Total size:   %s (sum of release sizes)\n", formatSize(stats.ApparentBytes))
+	fmt.Printf("    Disk usage:   %s (hardlinks save %s)\n", formatSize(stats.DiskBytes), formatSize(stats.HardlinkSavings()))
+	expired := 0
+	for _, u := range stats.Releases {
+		if u.Expired {
+			expired++
+		}
+	}
+	if expired == 0 {
+		fmt.Printf("    Cleanup:      nothing to remove (keeping %d)\n", stats.KeepN)
+		return
+	}
+	fmt.Printf("    Cleanup:      would remove %d release(s), freeing ~%s (keeping %d)\n", expired, formatSize(stats.ProjectedSavings), stats.KeepN)
+}
@@ -0,0 +1,159 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// ScaffoldValues are the production settings config-init fills into ExampleConfig.
+type ScaffoldValues struct {
+	Project string // Project name, used for the release path under /var/www
+	Target  string // SSH target, e.g. deploy@server
+	BaseURL string // Public site URL
+	KeepN   int    // Releases to keep
+}
+
+// Placeholders in ExampleConfig's prod environment, each replaced once.
+const (
+	placeholderTarget  = `target = "user@host"`
+	placeholderPath    = `path = "/var/www/site"`
+	placeholderKeepN   = `keepN = 5`
+	placeholderBaseURL = `baseURL = "https://example.com"`
+)
+
+// tomlString quotes s as a TOML basic string.
+func tomlString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// Validate checks the values produce a usable production environment.
+func (v ScaffoldValues) Validate() error {
+	var errs []error
+	if v.Project == "" || strings.ContainsAny(v.Project, `/\`) || strings.HasPrefix(v.Project, ".") {
+		errs = append(errs, fmt.Errorf("invalid project name %q", v.Project))
+	}
+	if v.Target == "" || strings.ContainsAny(v.Target, " \t\n") {
+		errs = append(errs, fmt.Errorf("invalid SSH target %q (expected user@host)", v.Target))
+	}
+	if !strings.HasPrefix(v.BaseURL, "https://") && !strings.HasPrefix(v.BaseURL, "http://") {
+		errs = append(errs, fmt.Errorf("base URL must start with http:// or https://, got %q", v.BaseURL))
+	}
+	if v.KeepN < 1 {
+		errs = append(errs, fmt.Errorf("keep count must be at least 1, got %d", v.KeepN))
+	}
+	return errors.Join(errs...)
+}
+
+// ScaffoldConfig returns ExampleConfig with the prod environment set to v.
+// The result is parsed before returning so a broken file is never written.
+func ScaffoldConfig(v ScaffoldValues) (string, error) {
+	if err := v.Validate(); err != nil {
+		return "", err
+	}
+	content := ExampleConfig()
+	for placeholder, value := range map[string]string{
+		placeholderTarget:  "target = " + tomlString(v.Target),
+		placeholderPath:    "path = " + tomlString(path.Join("/var/www", v.Project)),
+		placeholderKeepN:   "keepN = " + strconv.Itoa(v.KeepN),
+		placeholderBaseURL: "baseURL = " + tomlString(strings.TrimSuffix(v.BaseURL, "/")),
+	} {
+		if !strings.Contains(content, placeholder) {
+			return "", fmt.Errorf("example config has no %s placeholder", placeholder)
+		}
+		content = strings.Replace(content, placeholder, value, 1)
+	}
+
+	config, err := parseConfigFile([]byte(content))
+	if err != nil {
+		return "", fmt.Errorf("generated config does not parse: %w", err)
+	}
+	if env, ok := config.GetEnvironment("prod"); !ok || env.Target != v.Target || env.KeepN != v.KeepN {
+		return "", fmt.Errorf("generated config does not contain the prod settings")
+	}
+	return content, nil
+}
+
+// projectNameFromRemote derives a project name from a git remote URL, e.g.
+// git@github.com:org/site.git or https://github.com/org/site.
+func projectNameFromRemote(remote string) string {
+	remote = strings.TrimSuffix(strings.TrimSpace(remote), "/")
+	remote = strings.TrimSuffix(remote, ".git")
+	if i := strings.LastIndexAny(remote, "/:"); i >= 0 {
+		remote = remote[i+1:]
+	}
+	return remote
+}
+
+// suggestProjectName returns the origin remote's repository name, or the
+// current directory's name outside a git repository.
+func suggestProjectName() string {
+	if out, err := exec.Command("git", "remote", "get-url", "origin").Output(); err == nil {
+		if name := projectNameFromRemote(string(out)); name != "" {
+			return name
+		}
+	}
+	if wd, err := os.Getwd(); err == nil {
+		return filepath.Base(wd)
+	}
+	return "site"
+}
+
+// promptScaffoldValues asks for the production settings, suggesting defaults.
+func promptScaffoldValues() (ScaffoldValues, error) {
+	project := common.Prompt("Project name", suggestProjectName())
+	v := ScaffoldValues{
+		Project: project,
+		Target:  common.Prompt("Production SSH target (user@host)", ""),
+		BaseURL: common.Prompt("Production base URL (https://...)", ""),
+	}
+	keep := common.Prompt("Releases to keep", "5")
+	n, err := strconv.Atoi(keep)
+	if err != nil {
+		return v, fmt.Errorf("invalid keep count %q", keep)
+	}
+	v.KeepN = n
+	return v, v.Validate()
+}
+
+// ConfigInit writes a deploy.toml to configPath from answers to a few
+// prompts. An existing file is only replaced after confirmation or with
+// force; toStdout prints the result without writing anything.
+func ConfigInit(configPath string, force, toStdout bool) error {
+	configPath = defaultConfigPath(configPath)
+	if !toStdout && !force && common.FileExists(configPath) {
+		if !common.Confirm(configPath+" already exists. Overwrite?", false) {
+			return fmt.Errorf("%s already exists (use --force to overwrite)", configPath)
+		}
+	}
+
+	v, err := promptScaffoldValues()
+	if err != nil {
+		return err
+	}
+	content, err := ScaffoldConfig(v)
+	if err != nil {
+		return err
+	}
+	if toStdout {
+		fmt.Print(content)
+		return nil
+	}
+
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		return err
+	}
+	if _, err := LoadConfig(configPath); err != nil {
+		return fmt.Errorf("%s was written but does not load: %w", configPath, err)
+	}
+	fmt.Printf("\nWrote %s:\n\n%s", configPath, content)
+	return nil
+}
@@ -0,0 +1,93 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// secretPrefix marks a string field whose value is resolved when the config loads.
+const secretPrefix = "secret://"
+
+// secretCommandTimeout bounds a secret://cmd: lookup, e.g. a password manager.
+const secretCommandTimeout = 30 * time.Second
+
+// resolveSecret returns the value a secret:// reference points at:
+//
+//	secret://env:VAR           the environment variable VAR (must be set)
+//	secret://file:/path        the file's contents
+//	secret://cmd:command args  the command's standard output
+//
+// Trailing newlines are trimmed from file contents and command output.
+func resolveSecret(ref string) (string, error) {
+	scheme, arg, ok := strings.Cut(strings.TrimPrefix(ref, secretPrefix), ":")
+	if !ok || strings.TrimSpace(arg) == "" {
+		return "", fmt.Errorf("invalid secret reference %q (expected secret://env:VAR, secret://file:PATH or secret://cmd:COMMAND)", ref)
+	}
+	switch scheme {
+	case "env":
+		value, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", arg)
+		}
+		return value, nil
+	case "file":
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case "cmd":
+		return runSecretCommand(arg)
+	}
+	return "", fmt.Errorf("unknown secret scheme %q in %q", scheme, ref)
+}
+
+// runSecretCommand runs command without a shell and returns its output.
+func runSecretCommand(command string) (string, error) {
+	args := strings.Fields(command)
+	ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %w: %s", args[0], err, msg)
+		}
+		return "", fmt.Errorf("%s: %w", args[0], err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// resolveSecrets replaces every secret:// string field of every environment
+// with the value it refers to, registering each value with
+// common.RegisterSecret so it is masked in output.
+func resolveSecrets(config *Config) error {
+	for i := range config.Environments {
+		env := &config.Environments[i]
+		v := reflect.ValueOf(env).Elem()
+		t := v.Type()
+		for j := 0; j < t.NumField(); j++ {
+			field := v.Field(j)
+			if field.Kind() != reflect.String || !strings.HasPrefix(field.String(), secretPrefix) {
+				continue
+			}
+			value, err := resolveSecret(field.String())
+			if err != nil {
+				return fmt.Errorf("environment %q, %s: %w", env.Name, t.Field(j).Name, err)
+			}
+			field.SetString(value)
+			common.RegisterSecret(value)
+		}
+	}
+	return nil
+}
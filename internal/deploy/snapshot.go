@@ -0,0 +1,146 @@
+package deploy
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+)
+
+// manifestFile is the build manifest every release carries.
+const manifestFile = "build-manifest.json"
+
+// snapshotFiles returns the files a snapshot of a release holds: its
+// manifest and every file the manifest lists. Files a delta deploy left
+// behind in a hardlinked release are not part of it and are skipped.
+func snapshotFiles(m *Manifest) []string {
+	files := make([]string, 0, len(m.Files)+1)
+	files = append(files, manifestFile)
+	for file := range m.Files {
+		files = append(files, file)
+	}
+	sort.Strings(files[1:])
+	return files
+}
+
+// snapshot writes a tar.xz of the release to w and returns its manifest.
+func (d *LocalDeployer) snapshot(releaseID string, w io.WriteCloser) (*Manifest, error) {
+	releaseDir := d.releaseDir(releaseID)
+	m := loadBuildManifest(releaseDir)
+	if m == nil {
+		return nil, fmt.Errorf("release %s has no %s", releaseID, manifestFile)
+	}
+	if _, err := streamTarXZ(w, releaseDir, snapshotFiles(m)); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// snapshot has the remote host archive the release with tar cJf and streams
+// the archive to w, returning the release's manifest.
+func (d *RemoteDeployer) snapshot(releaseID string, w io.WriteCloser) (*Manifest, error) {
+	releaseDir := d.releaseDir(releaseID)
+	output, err := d.ssh(fmt.Sprintf("cat '%s/%s'", releaseDir, manifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("release %s has no %s: %s", releaseID, manifestFile, strings.TrimSpace(string(output)))
+	}
+	var m Manifest
+	if err := json.Unmarshal(output, &m); err != nil {
+		return nil, fmt.Errorf("parse manifest: %w", err)
+	}
+
+	// The file list goes over stdin, NUL-separated, so no name needs quoting
+	list := strings.Join(snapshotFiles(&m), "\x00") + "\x00"
+	var stderr bytes.Buffer
+	cmd := exec.Command("ssh", d.host, fmt.Sprintf("cd '%s' && tar cJf - --null -T -", releaseDir))
+	cmd.Stdin = strings.NewReader(list)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("remote tar: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return &m, nil
+}
+
+// writeSnapshot dispatches snapshot to the concrete deployer.
+func writeSnapshot(deployer Deployer, releaseID string, w io.WriteCloser) (*Manifest, error) {
+	switch d := deployer.(type) {
+	case *LocalDeployer:
+		return d.snapshot(releaseID, w)
+	case *RemoteDeployer:
+		return d.snapshot(releaseID, w)
+	}
+	return nil, fmt.Errorf("snapshots are not supported for this target")
+}
+
+// verifySnapshot reads the archive back and checks it holds the manifest
+// plus exactly the files it lists.
+func verifySnapshot(archivePath string, m *Manifest) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	xzReader, err := xz.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("read xz: %w", err)
+	}
+	tr := tar.NewReader(xzReader)
+	seen := make(map[string]bool)
+	entries := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read tar: %w", err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		seen[path.Clean(strings.TrimPrefix(hdr.Name, "./"))] = true
+		entries++
+	}
+
+	if !seen[manifestFile] {
+		return fmt.Errorf("archive has no %s", manifestFile)
+	}
+	for file := range m.Files {
+		if !seen[file] {
+			return fmt.Errorf("archive is missing %s", file)
+		}
+	}
+	if entries-1 != len(m.Files) {
+		return fmt.Errorf("archive holds %d files, manifest lists %d", entries-1, len(m.Files))
+	}
+	return nil
+}
+
+// currentReleaseID returns the ID of the release current points at.
+func currentReleaseID(deployer Deployer) (string, error) {
+	releases, err := deployer.ListReleases()
+	if err != nil {
+		return "", fmt.Errorf("list releases: %w", err)
+	}
+	for _, r := range releases {
+		if r.Current {
+			return r.ID, nil
+		}
+	}
+	return "", fmt.Errorf("no current release")
+}
+
+// snapshotPath returns the default snapshot filename for a release.
+func snapshotPath(env Environment, releaseID string) string {
+	return fmt.Sprintf("%s-%s-snapshot.tar.xz", env.Name, releaseID)
+}
@@ -0,0 +1,149 @@
+package deploy
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ValidateSubPath checks a sub-path given with --sub-path and returns it
+// cleaned, in slash form. It must name a directory inside the build output.
+func ValidateSubPath(p string) (string, error) {
+	p = filepath.ToSlash(strings.TrimSpace(p))
+	if strings.HasPrefix(p, "/") || strings.HasPrefix(p, "..") {
+		return "", fmt.Errorf("sub-path %q must be relative to the build output and not start with / or ..", p)
+	}
+	cleaned := path.Clean(p)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("sub-path %q does not name a directory inside the build output", p)
+	}
+	return cleaned, nil
+}
+
+// inSubPath reports whether the manifest path p lies under subPath; every
+// path does when subPath is empty.
+func inSubPath(p, subPath string) bool {
+	return subPath == "" || p == subPath || strings.HasPrefix(p, subPath+"/")
+}
+
+// scopeManifest returns the entries of m under subPath, with paths made
+// relative to it, so a previous build manifest can be reused for hashing
+// only that subtree. It returns nil for a nil m.
+func scopeManifest(m *Manifest, subPath string) *Manifest {
+	if m == nil {
+		return nil
+	}
+	scoped := &Manifest{Files: make(map[string]FileInfo), ReleaseID: m.ReleaseID}
+	for p, info := range m.Files {
+		if rel, ok := strings.CutPrefix(p, subPath+"/"); ok {
+			scoped.Files[rel] = info
+		}
+	}
+	return scoped
+}
+
+// generateSubPathManifest hashes only buildDir/subPath and returns its
+// entries keyed by their path within buildDir.
+func generateSubPathManifest(buildDir, releaseID, subPath string, opts Options) (*Manifest, error) {
+	dir := filepath.Join(buildDir, filepath.FromSlash(subPath))
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("sub-path %s is not a directory in %s", subPath, buildDir)
+	}
+	var prev *Manifest
+	if opts.LazyManifest {
+		prev = scopeManifest(loadBuildManifest(buildDir), subPath)
+	}
+	m, err := GenerateManifestWithWorkers(dir, releaseID, DefaultWorkers, opts.FollowSymlinks, prev, hashProgress())
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]FileInfo, len(m.Files))
+	for p, info := range m.Files {
+		files[path.Join(subPath, p)] = info
+	}
+	m.Files = files
+	return m, nil
+}
+
+// mergeSubPathManifest returns the manifest of the live release after
+// subPath is replaced by the files of local: remote entries outside subPath
+// are kept and everything under it comes from local. The caller sets the
+// release ID.
+func mergeSubPathManifest(remote, local *Manifest, subPath string) *Manifest {
+	merged := &Manifest{
+		Files:     make(map[string]FileInfo, len(remote.Files)),
+		Branch:    remote.Branch,
+		GitDirty:  remote.GitDirty || local.GitDirty,
+		BuildTime: time.Now(),
+	}
+	for p, info := range remote.Files {
+		if !inSubPath(p, subPath) {
+			merged.Files[p] = info
+		}
+	}
+	for p, info := range local.Files {
+		merged.Files[p] = info
+	}
+	return merged
+}
+
+// liveRelease returns the ID of the release the current symlink points to.
+func liveRelease(deployer Deployer) (string, error) {
+	releases, err := deployer.ListReleases()
+	if err != nil {
+		return "", fmt.Errorf("list releases: %w", err)
+	}
+	for _, r := range releases {
+		if r.Current {
+			return r.ID, nil
+		}
+	}
+	return "", fmt.Errorf("no live release to update; deploy the whole site first")
+}
+
+// deploySubPath uploads the files under opts.SubPath into the live release
+// releaseID in place. No new release is created or activated; uploads
+// replace files by unlinking them first, so releases sharing them through
+// hardlinks keep their copies.
+func deploySubPath(deployer Deployer, releaseID string, localManifest *Manifest, opts Options) error {
+	fmt.Println("==> Fetching remote manifest...")
+	remoteManifest, err := deployer.FetchManifest()
+	if err != nil {
+		return fmt.Errorf("a sub-path deploy needs the manifest of the live release: %w", err)
+	}
+	fmt.Printf("    Live release: %s\n", releaseID)
+	fmt.Println()
+
+	delta := CalculateDelta(localManifest, remoteManifest, opts.SubPath)
+	printDeltaStats(delta, localManifest)
+
+	if opts.DryRun {
+		printDryRunChanges(delta)
+		return nil
+	}
+
+	merged := mergeSubPathManifest(remoteManifest, localManifest, opts.SubPath)
+	merged.ReleaseID = releaseID
+	if err := WriteManifest(merged, filepath.Join("public", "build-manifest.json")); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+
+	files := delta.Changed
+	if opts.Full {
+		files = slices.Concat(delta.Changed, delta.Unchanged)
+		slices.Sort(files)
+	}
+	fmt.Printf("==> Uploading %s into the live release...\n", opts.SubPath)
+	if err := deployer.UploadDelta("public", releaseID, append(files, "build-manifest.json")); err != nil {
+		return fmt.Errorf("upload: %w", err)
+	}
+	fmt.Println()
+
+	runHealthCheck(deployer, releaseID)
+	fmt.Printf("Done! %s updated in live release %s.\n", opts.SubPath, releaseID)
+	return nil
+}
@@ -3,37 +3,109 @@
 package deploy
 
 import (
+	"errors"
+	"fmt"
+	"os"
 	"time"
 )
 
+// PinnedFile marks a release as pinned; pinned releases are never cleaned up.
+const PinnedFile = ".pinned"
+
+// Upload transports for remote environments.
+const (
+	TransportSSHTar = "ssh-tar" // XZ-compressed tar streamed over SSH (default)
+	TransportRsync  = "rsync"   // rsync over SSH; no xz needed on the remote host
+)
+
 // Environment defines a deployment target.
 type Environment struct {
-	Name    string // Environment name (local, dev, prod)
-	Target  string // SSH target (user@host) or empty for local
-	Path    string // Base path on target
-	KeepN   int    // Number of releases to keep
-	BaseURL string // Base URL for Hugo build
+	Name              string      // Environment name (local, dev, prod)
+	Target            string      // SSH target (user@host) or empty for local
+	Path              string      // Base path on target
+	KeepN             int         // Number of releases to keep
+	BaseURL           string      // Base URL for Hugo build
+	FileMode          os.FileMode // Mode applied to deployed files (0 preserves source mode)
+	DirMode           os.FileMode // Mode applied to deployed directories (0 preserves source mode)
+	Transport         string      // Remote upload transport: "ssh-tar" (default) or "rsync"
+	Branch            string      // Git branch to check out for the build (empty builds the current checkout)
+	AutoPromote       string      // Environment to deploy the same release to after a healthy deploy
+	HealthzValidation []string    // Rules healthz.json must satisfy, e.g. "$.status == 'ok'"
+	RequireCleanGit   bool        // Refuse to build with uncommitted or untracked changes instead of warning
+	Region            string      // Region the target serves, e.g. "us-east"; deploy-region deploys every environment in it
 }
 
 // Options configures a deployment.
 type Options struct {
-	ReleaseID string // Override auto-generated release ID
-	DryRun    bool   // Show what would be deployed without doing it
-	Full      bool   // Force full upload (skip delta)
-	NoBuild   bool   // Skip Hugo build
+	ReleaseID          string  // Override auto-generated release ID
+	DryRun             bool    // Show what would be deployed without doing it
+	Full               bool    // Force full upload (skip delta)
+	NoBuild            bool    // Skip Hugo build
+	FollowSymlinks     bool    // Hash symlink targets instead of deploying links
+	SkipReadinessCheck bool    // Skip the pre-build target readiness check
+	LazyManifest       bool    // Reuse hashes from the previous build manifest for unchanged files
+	PartialBuild       bool    // Incremental Hugo build reusing the cache and public/; falls back to full if it diverges
+	StashBeforeBuild   bool    // Stash uncommitted git changes for the build, restoring them afterwards
+	Branch             string  // Git branch to build, overriding Environment.Branch
+	NoAutoPromote      bool    // Ignore Environment.AutoPromote for this run
+	RequireCleanGit    bool    // Refuse to build from a dirty working tree, overriding Environment.RequireCleanGit
+	AllowDirty         bool    // Only warn about a dirty working tree, overriding Environment.RequireCleanGit
+	EnvFile            string  // .env file loaded into the Hugo build environment; "" for none (see EnvFileOption)
+	SubPath            string  // Only deploy this directory of the build, into the live release, without activating a new one
+	Config             *Config // Configuration used to look up AutoPromote environments
+
+	promotedFrom []string // Environments already deployed earlier in an auto-promote chain
+}
+
+// MaxAutoPromoteDepth limits how many environments one deploy can auto-promote through.
+const MaxAutoPromoteDepth = 3
+
+// DeployResult describes a completed deployment.
+type DeployResult struct {
+	ReleaseID       string                   // Release that was deployed (or would be, for a dry run)
+	Stashed         bool                     // Whether uncommitted changes were stashed for the build
+	RegionLatencies map[string]time.Duration // SSH round trip per deployed environment with a Region, by environment name
 }
 
 // Manifest represents a build manifest with file checksums.
 type Manifest struct {
 	Files     map[string]FileInfo `json:"files"`
 	ReleaseID string              `json:"releaseId,omitempty"`
+	Branch    string              `json:"branch,omitempty"`   // Git branch the release was built from
+	GitDirty  bool                `json:"gitDirty,omitempty"` // Built with uncommitted or untracked changes
 	BuildTime time.Time           `json:"buildTime,omitempty"`
+	Rehashed  int                 `json:"-"` // Files hashed during generation (excludes reused entries)
 }
 
 // FileInfo contains file metadata.
 type FileInfo struct {
-	SHA256 string `json:"sha256"`
-	Size   int64  `json:"size"`
+	SHA256        string    `json:"sha256"`
+	Size          int64     `json:"size"`
+	SymlinkTarget string    `json:"symlinkTarget,omitempty"` // Link target; empty for regular files
+	MTime         time.Time `json:"mtime,omitzero"`          // Modification time when hashed
+}
+
+// TypeStats holds file count and size for one file extension.
+type TypeStats struct {
+	Ext   string // Lowercase extension including the dot, or "(none)"
+	Files int    // Number of files
+	Bytes int64  // Total size in bytes
+}
+
+// Stats summarises a manifest by file type.
+type Stats struct {
+	Types           []TypeStats // Per-extension totals, largest first
+	TotalFiles      int         // Number of files
+	TotalBytes      int64       // Total size in bytes
+	CompressedBytes int64       // Estimated size after gzip/brotli
+}
+
+// CompressionRatio returns the estimated compressed size as a fraction of the total.
+func (s Stats) CompressionRatio() float64 {
+	if s.TotalBytes == 0 {
+		return 1
+	}
+	return float64(s.CompressedBytes) / float64(s.TotalBytes)
 }
 
 // Delta represents the difference between local and remote manifests.
@@ -49,6 +121,64 @@ type Release struct {
 	Path      string    // Full path to release
 	CreatedAt time.Time // When the release was created
 	Current   bool      // Whether this is the current release
+	Size      int64     // Size in bytes (0 unless filled by fillReleaseSizes)
+	Pinned    bool      // Whether the release is protected from cleanup
+}
+
+// EnvGCStats holds garbage collection results for one environment.
+type EnvGCStats struct {
+	Env        string   // Environment name
+	KeepN      int      // Releases kept
+	Releases   []string // Release IDs deleted (or that would be, in a dry run)
+	BytesFreed int64    // Estimated bytes freed; hardlinked files shared with kept releases are included
+	Err        error    // Error for this environment, if any
+}
+
+// GCResult aggregates garbage collection results across environments.
+type GCResult struct {
+	Environments    []EnvGCStats // Per-environment results in config order
+	ReleasesDeleted int          // Total releases deleted
+	BytesFreed      int64        // Total estimated bytes freed
+	DryRun          bool         // Whether nothing was actually deleted
+}
+
+// ReleaseUsage is the disk usage of one release.
+type ReleaseUsage struct {
+	Release
+	DiskBytes int64 // Bytes not already counted for a release listed earlier in the report
+	Expired   bool  // Whether Cleanup(KeepN) would remove the release
+}
+
+// RetentionStats describes disk usage across an environment's releases.
+// Releases are listed kept first (newest first), then those Cleanup would
+// remove, so hardlinked files are counted against the newest kept release.
+type RetentionStats struct {
+	Env              string         // Environment name
+	KeepN            int            // Releases Cleanup keeps
+	Releases         []ReleaseUsage // Per-release usage
+	ApparentBytes    int64          // Sum of release sizes, counting hardlinks in every release
+	DiskBytes        int64          // Actual usage, counting each hardlinked file once
+	ProjectedSavings int64          // Bytes Cleanup(KeepN) would free
+}
+
+// HardlinkSavings returns the bytes saved by hardlinking unchanged files between releases.
+func (s RetentionStats) HardlinkSavings() int64 {
+	return s.ApparentBytes - s.DiskBytes
+}
+
+// ErrDirtyWorkingTree is returned when an environment requires a clean git
+// working tree and the build would include uncommitted or untracked changes.
+var ErrDirtyWorkingTree = errors.New("git working tree has uncommitted changes")
+
+// ErrInsufficientReleases is returned when a rollback asks to go back
+// further than the number of historical releases on the target.
+type ErrInsufficientReleases struct {
+	Requested int // Steps back requested
+	Available int // Non-current releases available
+}
+
+func (e ErrInsufficientReleases) Error() string {
+	return fmt.Sprintf("cannot roll back %d release(s): only %d previous release(s) available", e.Requested, e.Available)
 }
 
 // Deployer defines the interface for deployment targets.
@@ -69,8 +199,12 @@ type Deployer interface {
 	Activate(releaseID string) error
 
 	// Cleanup removes old releases, keeping the specified number.
+	// Pinned releases are never removed and do not count toward keepN.
 	Cleanup(keepN int) error
 
+	// SetPinned pins or unpins a release.
+	SetPinned(releaseID string, pinned bool) error
+
 	// HealthCheck verifies the deployment was successful.
 	HealthCheck(releaseID string) error
 
@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
 	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/deploy"
 )
 
@@ -16,6 +17,22 @@ type deployFlags struct {
 	dryRun     bool
 	full       bool
 	noBuild    bool
+	fileMode   string
+	dirMode    string
+	followLink bool
+	skipReady  bool
+	noInteract bool
+	steps      int
+	stats      bool
+	lazy       bool
+	partial    bool
+	stash      bool
+	branch     string
+	noPromote  bool
+	cleanGit   bool
+	allowDirty bool
+	envFile    string
+	subPath    string
 }
 
 // parseDeployFlags parses flags and returns command, environment, remaining args, and flags
@@ -27,6 +44,22 @@ func parseDeployFlags(args []string) (command, envName string, remaining []strin
 	dryRun := fs.Bool("dry-run", false, "Show what would be deployed without deploying")
 	full := fs.Bool("full", false, "Upload all files instead of delta")
 	noBuild := fs.Bool("no-build", false, "Skip Hugo build (use existing public/ directory)")
+	fileMode := fs.String("file-mode", "", "Octal mode for deployed files, e.g. 0644 (default: preserve)")
+	dirMode := fs.String("dir-mode", "", "Octal mode for deployed directories, e.g. 0755 (default: preserve)")
+	followLink := fs.Bool("follow-symlinks", false, "Deploy symlink targets as regular files instead of links")
+	skipReady := fs.Bool("skip-readiness-check", false, "Skip checking the target is reachable before building")
+	noInteract := fs.Bool("no-interactive", false, "Never show the interactive rollback picker")
+	steps := fs.Int("steps", 0, "Rollback: go back N releases instead of one")
+	branch := fs.String("branch", "", "Git branch to build, overriding the environment's branch")
+	cleanGit := fs.Bool("require-clean-git", false, "Fail instead of warning when the working tree has uncommitted changes")
+	allowDirty := fs.Bool("allow-dirty", false, "Only warn about uncommitted changes, even if the environment sets requireCleanGit")
+	noPromote := fs.Bool("no-auto-promote", false, "Do not deploy on to the environment's autoPromote target")
+	stash := fs.Bool("stash-before-build", false, "Stash uncommitted git changes during the build and restore them afterwards")
+	envFile := fs.String("env-file", "", "Variables for the Hugo build (default: .env if it exists)")
+	subPath := fs.String("sub-path", "", "Only deploy this directory of public/ into the live release, e.g. bible/drc")
+	partial := fs.Bool("partial-build", false, "Incremental Hugo build reusing its cache; falls back to a full build if the output diverges")
+	lazy := fs.Bool("lazy-manifest", false, "Only re-hash files whose size or mtime changed since the last manifest")
+	stats := fs.Bool("stats", false, "Manifest: list every file type in the breakdown")
 	help := fs.Bool("help", false, "Show help")
 
 	fs.Usage = func() {
@@ -46,6 +79,22 @@ func parseDeployFlags(args []string) (command, envName string, remaining []strin
 		dryRun:     *dryRun,
 		full:       *full,
 		noBuild:    *noBuild,
+		fileMode:   *fileMode,
+		dirMode:    *dirMode,
+		followLink: *followLink,
+		skipReady:  *skipReady,
+		noInteract: *noInteract,
+		steps:      *steps,
+		stats:      *stats,
+		lazy:       *lazy,
+		partial:    *partial,
+		stash:      *stash,
+		branch:     *branch,
+		noPromote:  *noPromote,
+		cleanGit:   *cleanGit,
+		allowDirty: *allowDirty,
+		envFile:    *envFile,
+		subPath:    *subPath,
 	}
 
 	remaining = fs.Args()
@@ -54,7 +103,7 @@ func parseDeployFlags(args []string) (command, envName string, remaining []strin
 
 	if len(remaining) >= 1 {
 		switch remaining[0] {
-		case "list", "rollback", "status", "manifest":
+		case "list", "rollback", "status", "manifest", "pin", "unpin", "snapshot", "restore", "env-diff", "gc", "retention-report", "config-init", "deploy-region", "init":
 			command = remaining[0]
 			if len(remaining) >= 2 {
 				envName = remaining[1]
@@ -66,51 +115,113 @@ func parseDeployFlags(args []string) (command, envName string, remaining []strin
 	return
 }
 
-// loadDeployEnv loads config and returns the environment
-func loadDeployEnv(configPath, envName string) *deploy.Environment {
+// loadDeployConfig loads the config file, exiting with an example if it is missing
+func loadDeployConfig(configPath string) *deploy.Config {
 	config, err := deploy.LoadConfig(configPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		fmt.Fprintf(os.Stderr, "\nCreate a deploy.toml in your project root:\n\n%s", deploy.ExampleConfig())
 		os.Exit(1)
 	}
+	// Keep secret:// values out of logs from here on
+	common.MaskStdio()
+	return config
+}
 
+// loadDeployEnv loads config and returns the environment
+func loadDeployEnv(configPath, envName string) *deploy.Environment {
+	config := loadDeployConfig(configPath)
 	foundEnv, ok := config.GetEnvironment(envName)
 	if !ok {
 		fmt.Fprintf(os.Stderr, "Error: unknown environment '%s'\n", envName)
 		fmt.Fprintf(os.Stderr, "Available environments: %s\n", availableEnvs(config))
-		os.Exit(1)
+		common.Exit(1)
 	}
 	return &foundEnv
 }
 
+// applyModeFlags overrides the environment's file and directory modes from flags
+func applyModeFlags(env *deploy.Environment, flags deployFlags) error {
+	if flags.fileMode != "" {
+		mode, err := deploy.ParseFileMode(flags.fileMode)
+		if err != nil {
+			return fmt.Errorf("--file-mode: %w", err)
+		}
+		env.FileMode = mode
+	}
+	if flags.dirMode != "" {
+		mode, err := deploy.ParseFileMode(flags.dirMode)
+		if err != nil {
+			return fmt.Errorf("--dir-mode: %w", err)
+		}
+		env.DirMode = mode
+	}
+	return nil
+}
+
+// deployOptions returns the deploy options set by flags
+func deployOptions(flags deployFlags) deploy.Options {
+	return deploy.Options{
+		ReleaseID:          flags.releaseID,
+		DryRun:             flags.dryRun,
+		Full:               flags.full,
+		NoBuild:            flags.noBuild,
+		FollowSymlinks:     flags.followLink,
+		SkipReadinessCheck: flags.skipReady,
+		LazyManifest:       flags.lazy,
+		PartialBuild:       flags.partial,
+		StashBeforeBuild:   flags.stash,
+		Branch:             flags.branch,
+		NoAutoPromote:      flags.noPromote,
+		RequireCleanGit:    flags.cleanGit,
+		AllowDirty:         flags.allowDirty,
+		EnvFile:            deploy.EnvFileOption(flags.envFile),
+		SubPath:            flags.subPath,
+	}
+}
+
 // cmdDeploy executes the deploy command
 func cmdDeploy(env *deploy.Environment, flags deployFlags) error {
-	opts := deploy.Options{
-		ReleaseID: flags.releaseID,
-		DryRun:    flags.dryRun,
-		Full:      flags.full,
-		NoBuild:   flags.noBuild,
+	if err := applyModeFlags(env, flags); err != nil {
+		return err
+	}
+	opts := deployOptions(flags)
+	opts.Config = loadDeployConfig(flags.configPath)
+	_, err := deploy.Deploy(*env, opts)
+	return err
+}
+
+// handleDeployRegion deploys to every environment of the region named in args
+func handleDeployRegion(args []string, flags deployFlags) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: juniper-host deploy deploy-region <region>")
+	}
+	config := loadDeployConfig(flags.configPath)
+	for i := range config.Environments {
+		if err := applyModeFlags(&config.Environments[i], flags); err != nil {
+			return err
+		}
 	}
-	return deploy.Deploy(*env, opts)
+	_, err := deploy.DeployRegion(config, args[1], deployOptions(flags))
+	return err
 }
 
 // cmdRollback executes the rollback command
-func cmdRollback(env *deploy.Environment, remaining []string) error {
+func cmdRollback(env *deploy.Environment, remaining []string, flags deployFlags) error {
 	targetRelease := ""
 	if len(remaining) >= 3 {
 		targetRelease = remaining[2]
 	}
-	return deploy.Rollback(*env, targetRelease)
+	return deploy.Rollback(*env, targetRelease, flags.steps, !flags.noInteract)
 }
 
 // cmdManifest executes the manifest command
-func cmdManifest(remaining []string, releaseID string) error {
+func cmdManifest(remaining []string, releaseID string, fullStats bool) error {
 	buildDir := "public"
 	if len(remaining) >= 2 {
 		buildDir = remaining[1]
 	}
-	return deploy.GenerateManifestOnly(buildDir, releaseID)
+	return deploy.GenerateManifestOnly(buildDir, releaseID, fullStats)
 }
 
 // commandHandler is a function that handles a deploy subcommand
@@ -127,8 +238,67 @@ func handleList(env *deploy.Environment, _ []string, _ deployFlags) error {
 }
 
 // handleRollback handles the rollback command
-func handleRollback(env *deploy.Environment, remaining []string, _ deployFlags) error {
-	return cmdRollback(env, remaining)
+func handleRollback(env *deploy.Environment, remaining []string, flags deployFlags) error {
+	return cmdRollback(env, remaining, flags)
+}
+
+// releaseArg returns the release ID argument following the environment
+func releaseArg(remaining []string) string {
+	if len(remaining) >= 3 {
+		return remaining[2]
+	}
+	return ""
+}
+
+// handlePin handles the pin command
+func handlePin(env *deploy.Environment, remaining []string, _ deployFlags) error {
+	return deploy.Pin(*env, releaseArg(remaining))
+}
+
+// handleUnpin handles the unpin command
+func handleUnpin(env *deploy.Environment, remaining []string, _ deployFlags) error {
+	return deploy.Unpin(*env, releaseArg(remaining))
+}
+
+// handleSnapshot handles the snapshot command
+func handleSnapshot(env *deploy.Environment, remaining []string, _ deployFlags) error {
+	outputPath := ""
+	if len(remaining) >= 4 {
+		outputPath = remaining[3]
+	}
+	return deploy.Snapshot(*env, releaseArg(remaining), outputPath)
+}
+
+// handleRestore handles the restore command. --release-id may follow the
+// snapshot file; --release before the command works too.
+func handleRestore(env *deploy.Environment, remaining []string, flags deployFlags) error {
+	if len(remaining) < 3 {
+		return fmt.Errorf("usage: juniper-host deploy restore <env> <snapshot-file> [--release-id=ID]")
+	}
+	releaseID := flags.releaseID
+	rest := remaining[3:]
+	for i := 0; i < len(rest); i++ {
+		switch arg := strings.TrimPrefix(rest[i], "-"); {
+		case strings.HasPrefix(arg, "-release-id="):
+			releaseID = strings.TrimPrefix(arg, "-release-id=")
+		case arg == "-release-id" && i+1 < len(rest):
+			i++
+			releaseID = rest[i]
+		default:
+			return fmt.Errorf("usage: juniper-host deploy restore <env> <snapshot-file> [--release-id=ID]")
+		}
+	}
+	return deploy.Restore(*env, remaining[2], releaseID)
+}
+
+// handleEnvDiff handles the env-diff command
+func handleEnvDiff(env *deploy.Environment, remaining []string, flags deployFlags) error {
+	if len(remaining) < 3 {
+		return fmt.Errorf("usage: juniper-host deploy env-diff <env1> <env2>")
+	}
+	other := loadDeployEnv(flags.configPath, remaining[2])
+	deploy.PrintEnvDiff(*env, *other)
+	return nil
 }
 
 // handleStatus handles the status command
@@ -136,18 +306,98 @@ func handleStatus(env *deploy.Environment, _ []string, _ deployFlags) error {
 	return deploy.Status(*env)
 }
 
+// handleRetentionReport handles the retention-report command
+func handleRetentionReport(env *deploy.Environment, _ []string, _ deployFlags) error {
+	stats, err := deploy.RetentionReport(*env)
+	if err != nil {
+		return err
+	}
+	deploy.PrintRetentionReport(*env, stats)
+	return nil
+}
+
 // handleManifest handles the manifest command
 func handleManifest(_ *deploy.Environment, remaining []string, flags deployFlags) error {
-	return cmdManifest(remaining, flags.releaseID)
+	return cmdManifest(remaining, flags.releaseID, flags.stats)
 }
 
 // commandHandlers maps commands to their handlers
 var commandHandlers = map[string]commandHandler{
-	"deploy":   handleDeploy,
-	"list":     handleList,
-	"rollback": handleRollback,
-	"status":   handleStatus,
-	"manifest": handleManifest,
+	"deploy":           handleDeploy,
+	"list":             handleList,
+	"rollback":         handleRollback,
+	"status":           handleStatus,
+	"manifest":         handleManifest,
+	"pin":              handlePin,
+	"unpin":            handleUnpin,
+	"snapshot":         handleSnapshot,
+	"restore":          handleRestore,
+	"env-diff":         handleEnvDiff,
+	"retention-report": handleRetentionReport,
+}
+
+// handleGC removes releases beyond keepN in every environment
+func handleGC(remaining []string, flags deployFlags) error {
+	dryRun := flags.dryRun
+	for _, a := range remaining[1:] {
+		if a == "--dry-run" || a == "-dry-run" {
+			dryRun = true
+		}
+	}
+	_, err := deploy.GarbageCollect(loadDeployConfig(flags.configPath), dryRun)
+	return err
+}
+
+// handleConfigInit writes a deploy.toml from a few prompts
+func handleConfigInit(remaining []string, flags deployFlags) error {
+	var force, toStdout bool
+	for _, a := range remaining[1:] {
+		switch a {
+		case "--force", "-force":
+			force = true
+		case "--stdout", "-stdout":
+			toStdout = true
+		default:
+			return fmt.Errorf("usage: juniper-host deploy config-init [--force] [--stdout]")
+		}
+	}
+	return deploy.ConfigInit(flags.configPath, force, toStdout)
+}
+
+// parseInitArgs returns the project name and options of the init command
+func parseInitArgs(args []string) (name, target string, force bool, err error) {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "--force" || a == "-force":
+			force = true
+		case a == "--target" || a == "-target":
+			if i+1 == len(args) {
+				return "", "", false, fmt.Errorf("--target needs a value")
+			}
+			i++
+			target = args[i]
+		case strings.HasPrefix(a, "--target=") || strings.HasPrefix(a, "-target="):
+			target = a[strings.Index(a, "=")+1:]
+		case name == "" && !strings.HasPrefix(a, "-"):
+			name = a
+		default:
+			return "", "", false, fmt.Errorf("unexpected argument %q", a)
+		}
+	}
+	if name == "" {
+		return "", "", false, fmt.Errorf("missing project name")
+	}
+	return name, target, force, nil
+}
+
+// handleInit scaffolds a new project in the current directory
+func handleInit(remaining []string) error {
+	name, target, force, err := parseInitArgs(remaining[1:])
+	if err != nil {
+		return fmt.Errorf("%w\nusage: juniper-host deploy init <project-name> [--target=user@host] [--force]", err)
+	}
+	return deploy.InitProject(name, target, force)
 }
 
 // runDeployCommand executes the deploy subcommand
@@ -162,11 +412,27 @@ func runDeployCommand(command string, env *deploy.Environment, remaining []strin
 // Run executes the deploy subcommand with the given arguments.
 func Run(args []string) {
 	command, envName, remaining, flags := parseDeployFlags(args)
-	env := loadDeployEnv(flags.configPath, envName)
+	defer common.RestoreStdio()
 
-	if err := runDeployCommand(command, env, remaining, flags); err != nil {
+	var err error
+	switch command {
+	case "gc":
+		// gc spans every environment, so none is loaded
+		err = handleGC(remaining, flags)
+	case "deploy-region":
+		// A region spans several environments, loaded by the handler
+		err = handleDeployRegion(remaining, flags)
+	case "config-init":
+		err = handleConfigInit(remaining, flags)
+	case "init":
+		err = handleInit(remaining)
+	default:
+		env := loadDeployEnv(flags.configPath, envName)
+		err = runDeployCommand(command, env, remaining, flags)
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		common.Exit(1)
 	}
 }
 
@@ -184,9 +450,20 @@ Environments:
 Commands:
   [env]              Deploy to environment (default)
   list [env]         List releases on target
-  rollback [env]     Rollback to previous release
+  rollback [env]     Rollback (pick a release interactively in a terminal)
+                     Use --steps N to go back N releases
   status [env]       Show current deployment status
-  manifest [dir]     Generate build manifest only
+  deploy-region <region>  Deploy to every environment of a region in turn
+  pin <env> <id>     Protect a release from cleanup
+  unpin <env> <id>   Allow a pinned release to be cleaned up
+  snapshot [env] [id] [output]  Archive a release (default: current) as .tar.xz
+  restore <env> <file> [--release-id=ID]  Deploy and activate a snapshot archive
+  env-diff <a> <b>   Compare two environment configurations
+  gc [--dry-run]     Remove releases beyond keepN in every environment
+  retention-report [env]  Show disk usage per release and cleanup savings
+  manifest [dir]     Generate build manifest only (--stats for all file types)
+  config-init [--force] [--stdout]  Write a commented deploy.toml
+  init <name> [--target=user@host] [--force]  Scaffold a new project here
 
 Flags:
 `)
@@ -0,0 +1,307 @@
+package diagnose
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// caddyfile is the Caddy configuration written by the setup wizard
+	caddyfile = "/var/lib/caddy/Caddyfile"
+
+	// healthzURL is served by Caddy from the current release
+	healthzURL = "http://localhost/healthz.json"
+
+	// minFreePercent is the free space below which a filesystem fails
+	minFreePercent = 20
+
+	// minCertDays is how long the TLS certificate must stay valid
+	minCertDays = 14
+
+	// tlsTimeout bounds the TLS handshake with the site
+	tlsTimeout = 10 * time.Second
+
+	// stagingParent is where deploy-juniper extracts a release before moving
+	// it into place; an interrupted deploy leaves its tmp.* directory behind
+	stagingParent = "/var/www"
+
+	// staleStagingMinutes is the age after which a staging directory is
+	// considered abandoned rather than in use by a running deploy
+	staleStagingMinutes = 60
+)
+
+// checkedFilesystems are the mount points whose free space is checked
+var checkedFilesystems = []string{"/", "/var/www"}
+
+// requiredBinaries must be on the server's PATH for deploys and upgrades
+var requiredBinaries = []string{"xz", "tar", "hugo", "git"}
+
+// allChecks returns the checks run by diagnose; domain overrides the site
+// domain read from the Caddyfile for the TLS check
+func allChecks(domain string) []check {
+	return []check{
+		{"NixOS configuration", checkNixConfig},
+		{"Caddy configuration", checkCaddyConfig},
+		{"Disk space", checkDiskSpace},
+		{"Current release healthz.json", checkHealthz},
+		{"TLS certificate", func(sh shell) result { return checkTLS(sh, domain, dialCertificate) }},
+		{"Required binaries", checkBinaries},
+		{"Interrupted deploys", checkStaleStaging},
+	}
+}
+
+// sshCheck verifies the remote host is reachable before anything else runs
+var sshCheck = check{"SSH connectivity", checkSSH}
+
+// checkSSH runs a no-op command on the host
+func checkSSH(sh shell) result {
+	if !sh.remote() {
+		return skip("running on the server itself")
+	}
+	if _, err := sh.output("true"); err != nil {
+		return fail("%v", err)
+	}
+	return pass("connected")
+}
+
+// lastLine returns the last non-empty line of output, for error details
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// checkNixConfig evaluates and builds the system configuration without
+// activating it
+func checkNixConfig(sh shell) result {
+	out, err := sh.output("nixos-rebuild dry-build 2>&1")
+	if err != nil {
+		if detail := lastLine(out); detail != "" {
+			return fail("nixos-rebuild dry-build failed: %s", detail)
+		}
+		return fail("nixos-rebuild dry-build failed: %v", err)
+	}
+	return pass("nixos-rebuild dry-build succeeded")
+}
+
+// checkCaddyConfig validates the Caddyfile
+func checkCaddyConfig(sh shell) result {
+	out, err := sh.output(fmt.Sprintf("caddy validate --config %s --adapter caddyfile 2>&1", caddyfile))
+	if err != nil {
+		if detail := lastLine(out); detail != "" {
+			return fail("caddy validate failed: %s", detail)
+		}
+		return fail("caddy validate failed: %v", err)
+	}
+	return pass("%s is valid", caddyfile)
+}
+
+// parseUsePercent parses df --output=pcent,target output into the use
+// percentage of each mount point, in order
+func parseUsePercent(output string) ([]string, map[string]int, error) {
+	var mounts []string
+	usage := make(map[string]int)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		pct, mount, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !ok || pct == "Use%" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(pct, "%"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("unexpected df output %q", scanner.Text())
+		}
+		mount = strings.TrimSpace(mount)
+		if _, seen := usage[mount]; !seen {
+			mounts = append(mounts, mount)
+		}
+		usage[mount] = n
+	}
+	if len(mounts) == 0 {
+		return nil, nil, fmt.Errorf("no filesystems in df output")
+	}
+	return mounts, usage, nil
+}
+
+// checkDiskSpace requires minFreePercent free on the filesystems holding
+// the system and the site
+func checkDiskSpace(sh shell) result {
+	out, err := sh.output("df --output=pcent,target " + strings.Join(checkedFilesystems, " ") + " 2>/dev/null")
+	mounts, usage, parseErr := parseUsePercent(out)
+	if parseErr != nil {
+		if err != nil {
+			return fail("df failed: %v", err)
+		}
+		return fail("%v", parseErr)
+	}
+	var low, ok []string
+	for _, mount := range mounts {
+		free := 100 - usage[mount]
+		entry := fmt.Sprintf("%s %d%% free", mount, free)
+		if free < minFreePercent {
+			low = append(low, entry)
+		} else {
+			ok = append(ok, entry)
+		}
+	}
+	if len(low) > 0 {
+		return fail("less than %d%% free: %s", minFreePercent, strings.Join(low, ", "))
+	}
+	return pass("%s", strings.Join(ok, ", "))
+}
+
+// checkHealthz fetches healthz.json from Caddy on the server
+func checkHealthz(sh shell) result {
+	out, err := sh.output(fmt.Sprintf("curl -fsS --max-time 10 %s 2>&1", healthzURL))
+	if err != nil {
+		if detail := lastLine(out); detail != "" {
+			return fail("%s", detail)
+		}
+		return fail("%v", err)
+	}
+	var healthz struct {
+		ReleaseID string `json:"releaseId"`
+	}
+	if err := json.Unmarshal([]byte(out), &healthz); err != nil {
+		return fail("%s is not valid JSON", healthzURL)
+	}
+	if healthz.ReleaseID == "" {
+		return pass("served")
+	}
+	return pass("release %s", healthz.ReleaseID)
+}
+
+// caddyfileSite returns the first domain the Caddyfile serves and whether
+// it uses Caddy's internal (self-signed) certificate authority. It returns
+// "" when only ports such as :80 are served.
+func caddyfileSite(content string) (string, bool) {
+	selfSigned := strings.Contains(content, "tls internal")
+	for _, line := range strings.Split(content, "\n") {
+		if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '#' {
+			continue
+		}
+		addresses, ok := strings.CutSuffix(strings.TrimSpace(line), "{")
+		if !ok {
+			continue
+		}
+		for _, addr := range strings.FieldsFunc(addresses, func(r rune) bool { return r == ',' || r == ' ' }) {
+			if strings.HasPrefix(addr, ":") || strings.HasPrefix(addr, "(") || strings.Contains(addr, "://") ||
+				addr == "localhost" || net.ParseIP(addr) != nil {
+				continue
+			}
+			return addr, selfSigned
+		}
+	}
+	return "", selfSigned
+}
+
+// certDialer returns the expiry of the certificate served for domain
+type certDialer func(domain string, insecure bool) (time.Time, error)
+
+// dialCertificate connects to domain on port 443 and returns the expiry of
+// the certificate it presents. insecure skips verification, for Caddy's
+// self-signed certificates.
+func dialCertificate(domain string, insecure bool) (time.Time, error) {
+	dialer := &net.Dialer{Timeout: tlsTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(domain, "443"), &tls.Config{
+		ServerName:         domain,
+		InsecureSkipVerify: insecure, // #nosec G402 -- only for self-signed mode, where expiry is all that is checked
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return time.Time{}, fmt.Errorf("no certificate presented")
+	}
+	return certs[0].NotAfter, nil
+}
+
+// checkTLS checks the site's certificate is valid for at least minCertDays.
+// The domain is read from the Caddyfile unless given.
+func checkTLS(sh shell, domain string, dial certDialer) result {
+	selfSigned := false
+	if domain == "" {
+		content, err := sh.output("cat " + caddyfile)
+		if err != nil {
+			return skip("cannot read %s; pass --domain to check a site", caddyfile)
+		}
+		if domain, selfSigned = caddyfileSite(content); domain == "" {
+			return skip("the Caddyfile serves no domain over TLS")
+		}
+	}
+	notAfter, err := dial(domain, selfSigned)
+	if err != nil {
+		return fail("%s: %v", domain, err)
+	}
+	days := int(time.Until(notAfter).Hours() / 24)
+	if days < minCertDays {
+		return fail("%s expires in %d day(s) (%s)", domain, days, notAfter.Format("2006-01-02"))
+	}
+	return pass("%s valid for %d more days", domain, days)
+}
+
+// checkBinaries lists the required binaries missing from the server's PATH
+func checkBinaries(sh shell) result {
+	script := fmt.Sprintf("for b in %s; do command -v \"$b\" >/dev/null 2>&1 || echo \"$b\"; done",
+		strings.Join(requiredBinaries, " "))
+	out, err := sh.output(script)
+	if err != nil {
+		return fail("%v", err)
+	}
+	if missing := strings.Fields(out); len(missing) > 0 {
+		return fail("missing %s", strings.Join(missing, ", "))
+	}
+	return pass("%s", strings.Join(requiredBinaries, ", "))
+}
+
+// stagingNameRe matches the directory names mktemp gives staging directories
+var stagingNameRe = regexp.MustCompile(`^tmp\.[A-Za-z0-9]+$`)
+
+// staleStagingDirs lists the staging directories from the find output that
+// are safe to remove: direct children of stagingParent named like mktemp's
+func staleStagingDirs(output string) []string {
+	var dirs []string
+	for _, dir := range strings.Fields(output) {
+		name, ok := strings.CutPrefix(dir, stagingParent+"/")
+		if ok && stagingNameRe.MatchString(name) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// checkStaleStaging looks for staging directories deploy-juniper left
+// behind when it was interrupted; --fix removes them
+func checkStaleStaging(sh shell) result {
+	out, err := sh.output(fmt.Sprintf("[ ! -d %[1]s ] || find %[1]s -mindepth 1 -maxdepth 1 -type d -name 'tmp.*' -mmin +%[2]d",
+		stagingParent, staleStagingMinutes))
+	if err != nil {
+		return fail("%v", err)
+	}
+	dirs := staleStagingDirs(out)
+	if len(dirs) == 0 {
+		return pass("no abandoned staging directories in %s", stagingParent)
+	}
+	res := fail("%d abandoned staging director%s: %s", len(dirs), plural(len(dirs), "y", "ies"), strings.Join(dirs, " "))
+	res.fix = func() error {
+		_, err := sh.output("rm -rf -- " + strings.Join(dirs, " "))
+		return err
+	}
+	return res
+}
+
+// plural returns one or many depending on n
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
@@ -0,0 +1,179 @@
+// Package diagnose runs troubleshooting checks against a Juniper Bible
+// server, locally or over SSH, and optionally fixes what it safely can.
+package diagnose
+
+import (
+	"flag"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// maxExitCode caps the exit status, which counts failed checks
+const maxExitCode = 255
+
+// status is the outcome of one check
+type status int
+
+const (
+	statusPass status = iota
+	statusFail
+	statusSkip
+)
+
+// result is the outcome of one check. fix, when set on a failure, attempts
+// to resolve it; the check is run again afterwards.
+type result struct {
+	status status
+	detail string
+	fix    func() error
+}
+
+// pass, fail and skip build results with a detail message
+func pass(format string, a ...any) result {
+	return result{status: statusPass, detail: fmt.Sprintf(format, a...)}
+}
+
+func fail(format string, a ...any) result {
+	return result{status: statusFail, detail: fmt.Sprintf(format, a...)}
+}
+
+func skip(format string, a ...any) result {
+	return result{status: statusSkip, detail: fmt.Sprintf(format, a...)}
+}
+
+// shell runs a script on the server being diagnosed
+type shell interface {
+	// output runs script with sh and returns its stdout
+	output(script string) (string, error)
+
+	// remote reports whether the server is reached over SSH
+	remote() bool
+}
+
+// runner runs shell commands locally or on a remote host
+type runner struct {
+	host   string // SSH target; empty runs locally
+	sshKey string // SSH identity file (optional)
+}
+
+// output runs script with sh and returns its stdout
+func (r runner) output(script string) (string, error) {
+	if r.host == "" {
+		return common.RunOutput("sh", "-c", script)
+	}
+	var args []string
+	if r.sshKey != "" {
+		args = append(args, "-i", r.sshKey)
+	}
+	args = append(args, "-o", "StrictHostKeyChecking=accept-new", "-o", "BatchMode=yes", r.host, script)
+	out, err := exec.Command("ssh", args...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return string(out), fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return string(out), err
+	}
+	return string(out), nil
+}
+
+// remote reports whether commands run over SSH
+func (r runner) remote() bool {
+	return r.host != ""
+}
+
+// check is one named diagnostic
+type check struct {
+	name string
+	run  func(sh shell) result
+}
+
+// printResult prints one check as a colored pass, fail or skip line
+func printResult(name string, res result) {
+	line := name
+	if res.detail != "" {
+		line += ": " + res.detail
+	}
+	switch res.status {
+	case statusPass:
+		common.Success(line)
+	case statusFail:
+		common.Error(line)
+	default:
+		fmt.Printf("%s- %s (skipped)%s\n", common.Yellow, line, common.Reset)
+	}
+}
+
+// runCheck runs one check and, when fix is set, tries to fix a fixable
+// failure and runs the check again. It reports whether the check failed.
+func runCheck(sh shell, c check, fix bool) bool {
+	res := c.run(sh)
+	printResult(c.name, res)
+	if res.status != statusFail {
+		return false
+	}
+	if res.fix == nil {
+		return true
+	}
+	if !fix {
+		fmt.Println("    Run with --fix to resolve this automatically")
+		return true
+	}
+	if err := res.fix(); err != nil {
+		common.Error(fmt.Sprintf("Could not fix %s: %v", c.name, err))
+		return true
+	}
+	res = c.run(sh)
+	printResult(c.name+" (after fix)", res)
+	return res.status == statusFail
+}
+
+// runChecks runs the SSH check and then every check in checks, returning
+// the number that failed. When the host cannot be reached the rest are
+// skipped, since each would only fail the same way.
+func runChecks(sh shell, checks []check, fix bool) int {
+	if runCheck(sh, sshCheck, fix) {
+		for _, c := range checks {
+			printResult(c.name, skip("host unreachable"))
+		}
+		return 1
+	}
+	failures := 0
+	for _, c := range checks {
+		if runCheck(sh, c, fix) {
+			failures++
+		}
+	}
+	return failures
+}
+
+// Run executes the diagnose command
+func Run(args []string) {
+	fs := flag.NewFlagSet("diagnose", flag.ExitOnError)
+	host := fs.String("host", "", "Remote host (e.g., root@server); omit on the server itself")
+	sshKey := fs.String("i", "", "SSH identity file (optional)")
+	domain := fs.String("domain", "", "Domain whose TLS certificate is checked (default: read from the Caddyfile)")
+	fix := fs.Bool("fix", false, "Attempt to resolve fixable problems")
+	if err := fs.Parse(args); err != nil {
+		common.Error(fmt.Sprintf("Failed to parse arguments: %v", err))
+		common.Exit(1)
+	}
+
+	r := runner{host: *host, sshKey: *sshKey}
+	target := "local"
+	if r.host != "" {
+		target = r.host
+	}
+	common.Header(fmt.Sprintf("Juniper Bible - Diagnose (%s)", target))
+
+	failures := runChecks(r, allChecks(*domain), *fix)
+	fmt.Println()
+	if failures == 0 {
+		common.Success("All checks passed")
+		return
+	}
+	common.Error(fmt.Sprintf("%d check(s) failed", failures))
+	common.Exit(min(failures, maxExitCode))
+}
@@ -0,0 +1,216 @@
+// Package diskusage reports filesystem and release directory usage on a
+// Juniper Bible server, locally or over SSH.
+package diskusage
+
+import (
+	"flag"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+const (
+	// releasesDir holds the deployed site releases
+	releasesDir = "/var/www/juniperbible/releases"
+
+	// warnPercent is the usage above which a filesystem is flagged in red
+	warnPercent = 90
+)
+
+// dfCommand lists real filesystems in POSIX format, which never wraps long
+// device names onto a second line
+var dfCommand = []string{"df", "-hP", "-x", "tmpfs", "-x", "devtmpfs", "-x", "squashfs", "-x", "overlay"}
+
+// filesystemUsage is one row of df output
+type filesystemUsage struct {
+	Filesystem string
+	Size       string
+	Used       string
+	Avail      string
+	UsePercent int
+	MountedOn  string
+}
+
+// releaseUsage is the size of one release directory as reported by du
+type releaseUsage struct {
+	Name string
+	Size string
+}
+
+// parseDF parses df -h output. Lines wrapped by df implementations without
+// -P (a long device name alone on its line) are joined with the next line.
+// Mount points containing spaces are kept whole.
+func parseDF(output string) ([]filesystemUsage, error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "Filesystem") {
+		return nil, fmt.Errorf("unexpected df output: missing header")
+	}
+
+	var usage []filesystemUsage
+	var pending string
+	for _, line := range lines[1:] {
+		fields := strings.Fields(pending + " " + line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 6 {
+			pending = strings.Join(fields, " ")
+			continue
+		}
+		pending = ""
+		pct, err := strconv.Atoi(strings.TrimSuffix(fields[4], "%"))
+		if err != nil {
+			if fields[4] == "-" {
+				continue // Pseudo filesystem without a size
+			}
+			return nil, fmt.Errorf("invalid use%% %q for %s", fields[4], fields[0])
+		}
+		usage = append(usage, filesystemUsage{
+			Filesystem: fields[0],
+			Size:       fields[1],
+			Used:       fields[2],
+			Avail:      fields[3],
+			UsePercent: pct,
+			MountedOn:  strings.Join(fields[5:], " "),
+		})
+	}
+	if pending != "" {
+		return nil, fmt.Errorf("truncated df output after %q", pending)
+	}
+	sort.SliceStable(usage, func(i, j int) bool {
+		return usage[i].UsePercent > usage[j].UsePercent
+	})
+	return usage, nil
+}
+
+// parseDU parses du -sh output of the form "<size>\t<path>", naming each
+// entry after the last element of its path
+func parseDU(output string) []releaseUsage {
+	var usage []releaseUsage
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		size, path, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		path = strings.TrimSuffix(path, "/")
+		name := path[strings.LastIndex(path, "/")+1:]
+		usage = append(usage, releaseUsage{Name: name, Size: strings.TrimSpace(size)})
+	}
+	return usage
+}
+
+// runner runs a shell command locally or on a remote host
+type runner struct {
+	host   string // SSH target; empty runs locally
+	sshKey string // SSH identity file (optional)
+}
+
+// output runs script with sh and returns its stdout
+func (r runner) output(script string) (string, error) {
+	if r.host == "" {
+		return common.RunOutput("sh", "-c", script)
+	}
+	var args []string
+	if r.sshKey != "" {
+		args = append(args, "-i", r.sshKey)
+	}
+	args = append(args, "-o", "StrictHostKeyChecking=accept-new", "-o", "BatchMode=yes", r.host, script)
+	out, err := exec.Command("ssh", args...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", err
+	}
+	return string(out), nil
+}
+
+// printFilesystems prints the df table, flagging nearly full filesystems
+func printFilesystems(usage []filesystemUsage) {
+	fmt.Printf("%-24s %8s %8s %8s %5s  %s\n", "FILESYSTEM", "SIZE", "USED", "AVAIL", "USE%", "MOUNTED ON")
+	for _, u := range usage {
+		color, reset := "", ""
+		if u.UsePercent > warnPercent {
+			color, reset = common.Red, common.Reset
+		}
+		fmt.Printf("%s%-24s %8s %8s %8s %4d%%  %s%s\n",
+			color, u.Filesystem, u.Size, u.Used, u.Avail, u.UsePercent, u.MountedOn, reset)
+	}
+	for _, u := range usage {
+		if u.UsePercent > warnPercent {
+			fmt.Printf("%s⚠ %s is %d%% full%s\n", common.Red, u.MountedOn, u.UsePercent, common.Reset)
+		}
+	}
+}
+
+// printReleases prints per-release sizes and the total on disk. Each release
+// counts every file it links (du --count-links); the total counts files
+// hardlinked between releases once.
+func printReleases(r runner) {
+	out, err := r.output(fmt.Sprintf("du -sh --count-links %s/*/ 2>/dev/null", releasesDir))
+	releases := parseDU(out)
+	if err != nil || len(releases) == 0 {
+		common.Info(fmt.Sprintf("No releases found in %s", releasesDir))
+		return
+	}
+	fmt.Printf("%-28s %8s\n", "RELEASE", "SIZE")
+	for _, rel := range releases {
+		fmt.Printf("%-28s %8s\n", rel.Name, rel.Size)
+	}
+	out, err = r.output(fmt.Sprintf("du -sh %s", releasesDir))
+	if total := parseDU(out); err == nil && len(total) == 1 {
+		fmt.Printf("%-28s %8s\n", "Total on disk", total[0].Size)
+	}
+}
+
+// Run executes the disk-usage command
+func Run(args []string) {
+	fs := flag.NewFlagSet("disk-usage", flag.ExitOnError)
+	host := fs.String("host", "", "Remote host (e.g., root@server); omit on the server itself")
+	sshKey := fs.String("i", "", "SSH identity file (optional)")
+	threshold := fs.Int("threshold", 0, "Exit with status 1 if any filesystem is more than N% full (0 disables)")
+	if err := fs.Parse(args); err != nil {
+		common.Error(fmt.Sprintf("Failed to parse arguments: %v", err))
+		common.Exit(1)
+	}
+	if *threshold < 0 || *threshold > 100 {
+		common.Error(fmt.Sprintf("--threshold must be between 0 and 100, got %d", *threshold))
+		common.Exit(1)
+	}
+
+	r := runner{host: *host, sshKey: *sshKey}
+	target := "local"
+	if r.host != "" {
+		target = r.host
+	}
+	common.Header(fmt.Sprintf("Juniper Bible - Disk Usage (%s)", target))
+
+	out, err := r.output(strings.Join(dfCommand, " "))
+	if err != nil {
+		common.Error(fmt.Sprintf("df failed: %v", err))
+		common.Exit(1)
+	}
+	usage, err := parseDF(out)
+	if err != nil {
+		common.Error(err.Error())
+		common.Exit(1)
+	}
+	printFilesystems(usage)
+	fmt.Println()
+	printReleases(r)
+
+	if *threshold == 0 {
+		return
+	}
+	for _, u := range usage {
+		if u.UsePercent > *threshold {
+			fmt.Println()
+			common.Error(fmt.Sprintf("%s exceeds the %d%% threshold", u.MountedOn, *threshold))
+			common.Exit(1)
+		}
+	}
+}
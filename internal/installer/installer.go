@@ -1,6 +1,7 @@
 package installer
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
@@ -35,26 +36,69 @@ func checkMounts() {
 	}
 }
 
-// downloadAndInstall generates config, downloads config, and runs nixos-install
-func downloadAndInstall() {
+// configPath is the configuration installed into the new system
+const configPath = "/mnt/etc/nixos/configuration.nix"
+
+// setup is what install fills into configuration.nix from its flags; empty
+// fields are left for the user to edit by hand
+type setup struct {
+	sshKeys []string // Keys authorized for the deploy and root users
+	disk    string   // GRUB boot device
+}
+
+// configure fills the SSH keys and boot device into the installed
+// configuration, returning what was actually applied
+func configure(s setup) setup {
+	var applied setup
+	if keys := common.UsableSSHKeys(s.sshKeys); len(keys) > 0 {
+		err := common.PatchConfigFile(configPath, func(content string) (string, error) {
+			return common.InjectSSHKeys(content, keys)
+		})
+		if err != nil {
+			common.Error(fmt.Sprintf("Failed to inject SSH keys: %v", err))
+			os.Exit(1)
+		}
+		common.Success(fmt.Sprintf("%d SSH key(s) configured for deploy and root users", len(keys)))
+		for _, key := range keys {
+			fmt.Printf("    %s\n", common.DescribeSSHKey(key))
+		}
+		applied.sshKeys = keys
+	}
+	if s.disk != "" {
+		err := common.PatchConfigFile(configPath, func(content string) (string, error) {
+			return common.SetBootDevice(content, s.disk)
+		})
+		if err != nil {
+			common.Error(fmt.Sprintf("Failed to configure bootloader: %v", err))
+			os.Exit(1)
+		}
+		common.Success("Bootloader configured for " + s.disk)
+		applied.disk = s.disk
+	}
+	return applied
+}
+
+// downloadAndInstall generates config, downloads or copies config, fills in
+// what the flags provide, and runs nixos-install
+func downloadAndInstall(source common.ConfigSource, configSHA256 string, skipVerify bool, s setup) setup {
 	if err := os.MkdirAll("/mnt/etc/nixos", 0755); err != nil {
 		common.Error(fmt.Sprintf("Failed to create /mnt/etc/nixos: %v", err))
 		os.Exit(1)
 	}
 
 	common.Info("Generating hardware configuration...")
-	if err := common.Run("nixos-generate-config", "--root", "/mnt"); err != nil {
+	if err := common.RunTimeout(common.GenerateConfigTimeout, "nixos-generate-config", "--root", "/mnt"); err != nil {
 		common.Error(fmt.Sprintf("Failed to generate hardware config: %v", err))
 		os.Exit(1)
 	}
 
 	fmt.Println()
-	common.Info("Downloading Juniper Bible configuration...")
-	configURL := common.RepoBase + "/configuration.nix"
-	if err := common.DownloadFile(configURL, "/mnt/etc/nixos/configuration.nix"); err != nil {
-		common.Error(fmt.Sprintf("Failed to download configuration: %v", err))
+	common.Info("Installing Juniper Bible configuration from " + source.String() + "...")
+	if err := source.Install(configPath, configSHA256, skipVerify); err != nil {
+		common.Error(fmt.Sprintf("Failed to install configuration: %v", err))
 		os.Exit(1)
 	}
+	applied := configure(s)
 
 	fmt.Println()
 	common.Info("Installing NixOS...")
@@ -65,32 +109,65 @@ func downloadAndInstall() {
 		common.Error(fmt.Sprintf("Installation failed: %v", err))
 		os.Exit(1)
 	}
+	return applied
 }
 
-// printPostInstallInstructions prints instructions after installation
-func printPostInstallInstructions() {
+// printPostInstallInstructions prints what is left to do before rebooting.
+// Manual edits are only listed for what the flags did not configure.
+func printPostInstallInstructions(applied setup) {
 	fmt.Println()
 	common.Header("Installation complete!")
-	fmt.Println("IMPORTANT: Before rebooting, you should:")
-	fmt.Println()
-	fmt.Println("1. Edit /mnt/etc/nixos/configuration.nix to add your SSH key:")
-	fmt.Println("   nano /mnt/etc/nixos/configuration.nix")
-	fmt.Println()
-	fmt.Println("   Find BOTH of these lines and add your key to each:")
-	fmt.Println(`   users.users.deploy.openssh.authorizedKeys.keys = [`)
-	fmt.Println(`     "ssh-ed25519 AAAA... your-key-here"`)
-	fmt.Println(`   ];`)
-	fmt.Println(`   users.users.root.openssh.authorizedKeys.keys = [`)
-	fmt.Println(`     "ssh-ed25519 AAAA... your-key-here"`)
-	fmt.Println(`   ];`)
+	if len(applied.sshKeys) > 0 {
+		common.Success(fmt.Sprintf("SSH keys: %d key(s) authorized for deploy and root", len(applied.sshKeys)))
+	}
+	if applied.disk != "" {
+		common.Success("Boot device: " + applied.disk)
+	}
+	if len(applied.sshKeys) > 0 || applied.disk != "" {
+		fmt.Println()
+	}
+	manual := len(applied.sshKeys) == 0 || applied.disk == ""
+	if manual {
+		fmt.Println("IMPORTANT: Before rebooting, you should:")
+	} else {
+		fmt.Println("Before rebooting:")
+	}
 	fmt.Println()
-	fmt.Println("2. Set your domain (if not juniperbible.org):")
+
+	step := 0
+	next := func(title string) {
+		step++
+		fmt.Printf("%d. %s\n", step, title)
+	}
+	if len(applied.sshKeys) == 0 {
+		next("Edit /mnt/etc/nixos/configuration.nix to add your SSH key:")
+		fmt.Println("   nano /mnt/etc/nixos/configuration.nix")
+		fmt.Println()
+		fmt.Println("   Find BOTH of these lines and add your key to each:")
+		fmt.Println(`   users.users.deploy.openssh.authorizedKeys.keys = [`)
+		fmt.Println(`     "ssh-ed25519 AAAA... your-key-here"`)
+		fmt.Println(`   ];`)
+		fmt.Println(`   users.users.root.openssh.authorizedKeys.keys = [`)
+		fmt.Println(`     "ssh-ed25519 AAAA... your-key-here"`)
+		fmt.Println(`   ];`)
+		fmt.Println("   (or run install again with --ssh-key, --ssh-keys-file or --github-user)")
+		fmt.Println()
+	}
+	if applied.disk == "" {
+		next("Set the boot loader device to your disk (for BIOS boot):")
+		fmt.Println(`   boot.loader.grub.device = "/dev/vda";  ->  your disk, e.g. "/dev/sda"`)
+		fmt.Println("   (or run install again with --disk)")
+		fmt.Println()
+	}
+	next("Set your domain (if not juniperbible.org):")
 	fmt.Println(`   services.caddy.virtualHosts."your-domain.com".extraConfig = ...`)
 	fmt.Println()
-	fmt.Println("3. Rebuild to apply changes:")
-	fmt.Println("   nixos-install --no-root-passwd")
-	fmt.Println()
-	fmt.Println("4. Reboot:")
+	if manual {
+		next("Rebuild to apply changes:")
+		fmt.Println("   nixos-install --no-root-passwd")
+		fmt.Println()
+	}
+	next("Reboot:")
 	fmt.Println("   reboot")
 	fmt.Println()
 	fmt.Println("After reboot, SSH in as 'root' to run the setup wizard:")
@@ -104,6 +181,37 @@ func printPostInstallInstructions() {
 
 // Run executes the install command (requires pre-mounted /mnt)
 func Run(args []string) {
+	fs := flag.NewFlagSet("install", flag.ExitOnError)
+	configSHA256 := fs.String("config-sha256", "", "Expected SHA-256 of configuration.nix")
+	configFile := fs.String("config-file", "", "Install this local configuration.nix instead of downloading it (offline installs)")
+	configURL := fs.String("config-url", "", "Download configuration.nix from this URL (e.g. an internal mirror)")
+	skipVerify := fs.Bool("insecure-skip-verify", false, "Do not verify the configuration.nix signature (unsafe)")
+	var sshKeys common.StringList
+	fs.Var(&sshKeys, "ssh-key", "SSH public key (repeat for several keys)")
+	sshKeysFile := fs.String("ssh-keys-file", "", "Path to an SSH public key or authorized_keys file (every key is installed)")
+	fs.StringVar(sshKeysFile, "ssh-key-file", "", "Deprecated alias for --ssh-keys-file")
+	githubUser := fs.String("github-user", "", "Install the SSH keys published at https://github.com/NAME.keys")
+	gitlabUser := fs.String("gitlab-user", "", "Install the SSH keys published at https://gitlab.com/NAME.keys")
+	disk := fs.String("disk", "", "Disk GRUB is installed to, e.g. /dev/sda (replaces the default /dev/vda)")
+	if err := fs.Parse(args); err != nil {
+		common.Error(fmt.Sprintf("Failed to parse arguments: %v", err))
+		os.Exit(1)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "ssh-key-file" {
+			common.Warning("--ssh-key-file is deprecated; use --ssh-keys-file")
+		}
+	})
+	if *disk != "" && !common.IsValidDiskPath(*disk) {
+		common.Error(fmt.Sprintf("Invalid --disk %q", *disk))
+		os.Exit(1)
+	}
+	source, err := common.NewConfigSource(*configFile, *configURL)
+	if err != nil {
+		common.Error(err.Error())
+		os.Exit(1)
+	}
+
 	if !common.IsRoot() {
 		common.Error("Must be run as root")
 		fmt.Println("Usage: sudo juniper-host install")
@@ -112,6 +220,16 @@ func Run(args []string) {
 
 	common.Header("Juniper Bible - NixOS Host Installation")
 	checkMounts()
-	downloadAndInstall()
-	printPostInstallInstructions()
+	keys, err := common.SSHKeyOptions{
+		Keys:       sshKeys,
+		KeysFile:   *sshKeysFile,
+		GitHubUser: *githubUser,
+		GitLabUser: *gitlabUser,
+	}.Resolve()
+	if err != nil {
+		common.Error(err.Error())
+		os.Exit(1)
+	}
+	applied := downloadAndInstall(source, *configSHA256, *skipVerify, setup{sshKeys: keys, disk: *disk})
+	printPostInstallInstructions(applied)
 }
@@ -0,0 +1,145 @@
+// Package logs shows service logs from a Juniper Bible server, locally or
+// over SSH.
+package logs
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+const (
+	// defaultLines is how many lines are shown before following
+	defaultLines = 50
+
+	// deployLog is where deployments to the server are recorded
+	deployLog = "/var/www/juniperbible/deployments.log"
+)
+
+// Services accepted by --service
+const (
+	serviceCaddy   = "caddy"
+	serviceRebuild = "nixos-rebuild"
+	serviceDeploy  = "deploy"
+)
+
+// rebuildUnits are the systemd units nixos-rebuild switch and automatic
+// upgrades log to
+var rebuildUnits = []string{"nixos-rebuild-switch-to-configuration", "nixos-upgrade"}
+
+// logCommand returns the command that prints the last lines of service's log
+func logCommand(service string, lines int, follow bool) ([]string, error) {
+	var cmd []string
+	switch service {
+	case serviceCaddy:
+		cmd = []string{"journalctl", "-u", "caddy"}
+	case serviceRebuild:
+		cmd = []string{"journalctl"}
+		for _, unit := range rebuildUnits {
+			cmd = append(cmd, "-u", unit)
+		}
+	case serviceDeploy:
+		cmd = []string{"tail", "-n", strconv.Itoa(lines)}
+		if follow {
+			cmd = append(cmd, "--follow")
+		}
+		return append(cmd, deployLog), nil
+	default:
+		return nil, fmt.Errorf("unknown service %q (use %s, %s or %s)", service, serviceCaddy, serviceRebuild, serviceDeploy)
+	}
+	cmd = append(cmd, "--no-pager", "-n", strconv.Itoa(lines))
+	if follow {
+		cmd = append(cmd, "--follow")
+	}
+	return cmd, nil
+}
+
+// sshCommand wraps cmd to run on host. Following allocates a remote
+// terminal so the remote process is hung up when the connection closes
+// instead of being left running.
+func sshCommand(host, sshKey string, cmd []string, follow bool) []string {
+	args := []string{"ssh"}
+	if sshKey != "" {
+		args = append(args, "-i", sshKey)
+	}
+	args = append(args, "-o", "StrictHostKeyChecking=accept-new")
+	if follow {
+		args = append(args, "-tt")
+	}
+	return append(args, host, strings.Join(cmd, " "))
+}
+
+// run executes args with the terminal attached. Interrupts are passed on
+// to the child rather than killing this process first, so ssh can close the
+// session and the remote journalctl or tail exits with it.
+func run(args []string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && !exitErr.Exited() {
+		return nil // Stopped by the forwarded interrupt
+	}
+	return err
+}
+
+// Run executes the logs command
+func Run(args []string) {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	host := fs.String("host", "", "Remote host (e.g., root@server); omit on the server itself")
+	sshKey := fs.String("i", "", "SSH identity file (optional)")
+	service := fs.String("service", serviceCaddy, "Log to show: caddy, nixos-rebuild or deploy")
+	lines := fs.Int("lines", defaultLines, "Number of lines to show")
+	follow := fs.Bool("follow", false, "Keep printing new lines until interrupted")
+	if err := fs.Parse(args); err != nil {
+		common.Error(fmt.Sprintf("Failed to parse arguments: %v", err))
+		common.Exit(1)
+	}
+	if *lines < 1 {
+		common.Error(fmt.Sprintf("--lines must be at least 1, got %d", *lines))
+		common.Exit(1)
+	}
+
+	cmd, err := logCommand(*service, *lines, *follow)
+	if err != nil {
+		common.Error(err.Error())
+		common.Exit(1)
+	}
+	if *host != "" {
+		cmd = sshCommand(*host, *sshKey, cmd, *follow)
+	}
+	if err := run(cmd); err != nil {
+		common.Error(fmt.Sprintf("%s failed: %v", cmd[0], err))
+		common.Exit(1)
+	}
+}
@@ -0,0 +1,132 @@
+// Package remoteexec runs a single command on a Juniper Bible server over
+// SSH, passing its output and exit status through.
+package remoteexec
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+const (
+	// timeoutStatus is the exit status when --timeout stops the command,
+	// as with timeout(1)
+	timeoutStatus = 124
+
+	// failedStatus is the exit status when ssh could not be run at all,
+	// matching ssh's own status for connection errors
+	failedStatus = 255
+)
+
+// sshCommand returns the ssh arguments that run command on host. With tty a
+// remote terminal is allocated, so interactive programs and Ctrl+C behave as
+// in a login shell; with piped set stdin is forwarded to the command, and
+// otherwise the command gets no stdin so it cannot wait on the terminal.
+func sshCommand(host, sshKey string, command []string, tty, piped bool) []string {
+	args := common.SSHArgs(sshKey)
+	switch {
+	case piped:
+	case tty:
+		args = append(args, "-t")
+	default:
+		args = append(args, "-n")
+	}
+	args = append(args, "--", host)
+	return append(args, command...)
+}
+
+// run executes ssh with args, stopping it after timeout when that is set,
+// and returns the exit status to pass on. Interrupts are forwarded to ssh
+// rather than killing this process first, so the status is still that of
+// the remote command.
+func run(args []string, timeout time.Duration) (int, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return failedStatus, err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	common.LogCommand("ssh", args, err)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return timeoutStatus, &common.TimeoutError{Name: "ssh", Timeout: timeout}
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if exitErr.Exited() {
+			return exitErr.ExitCode(), nil
+		}
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+	}
+	if err != nil {
+		return failedStatus, err
+	}
+	return 0, nil
+}
+
+// Run executes the remote-exec command
+func Run(args []string) {
+	fs := flag.NewFlagSet("remote-exec", flag.ExitOnError)
+	host := fs.String("host", "", "Remote host (e.g., root@server); may be given as the first argument instead")
+	sshKey := fs.String("i", "", "SSH identity file (optional)")
+	timeout := fs.Duration("timeout", 0, "Stop the command after this long, e.g. 30s (default: no limit)")
+	noTTY := fs.Bool("no-tty", false, "Do not allocate a remote terminal")
+	if err := fs.Parse(args); err != nil {
+		common.Error(fmt.Sprintf("Failed to parse arguments: %v", err))
+		common.Exit(1)
+	}
+	command := fs.Args()
+	if *host == "" && len(command) > 0 {
+		*host, command = command[0], command[1:]
+	}
+	if *host == "" || len(command) == 0 {
+		common.Error("Usage: juniper-host remote-exec [options] <host> <command> [args...]")
+		common.Exit(1)
+	}
+	if *timeout < 0 {
+		common.Error(fmt.Sprintf("--timeout must not be negative, got %s", *timeout))
+		common.Exit(1)
+	}
+
+	piped := !common.IsInteractive()
+	tty := !*noTTY && common.StdoutIsTerminal()
+	status, err := run(sshCommand(*host, *sshKey, command, tty, piped), *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "remote-exec: %v\n", err)
+	}
+	os.Exit(status)
+}
@@ -0,0 +1,274 @@
+// Package sshkeys adds and removes authorized SSH keys in configuration.nix
+// on one or more Juniper Bible servers, locally or over SSH.
+package sshkeys
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// defaultUsers are the accounts configuration.nix authorizes keys for
+const defaultUsers = "deploy,root"
+
+// readScript prints configuration.nix
+const readScript = `cat /etc/nixos/configuration.nix`
+
+// writeScript replaces configuration.nix with stdin, keeping its mode, and
+// rebuilds. A failed rebuild restores the previous file.
+const writeScript = `set -eu
+CONFIG=/etc/nixos/configuration.nix
+BACKUP="$CONFIG.pre-ssh-keys"
+cp -p "$CONFIG" "$BACKUP"
+cp -p "$CONFIG" "$CONFIG.new"
+cat > "$CONFIG.new"
+mv "$CONFIG.new" "$CONFIG"
+echo "==> Rebuilding NixOS..."
+if ! nixos-rebuild switch; then
+  echo "==> Rebuild failed, restoring $BACKUP..."
+  mv "$BACKUP" "$CONFIG"
+  exit 1
+fi`
+
+// editFunc changes one user's keys, reporting whether anything changed
+type editFunc func(user string, keys []string) ([]string, bool, error)
+
+// shellCommand runs script on host, or on this machine when host is empty
+func shellCommand(host string, sshOpts []string, script string) *exec.Cmd {
+	if host == "" {
+		return exec.Command("sh", "-c", script)
+	}
+	return exec.Command("ssh", append(slices.Clone(sshOpts), host, script)...)
+}
+
+// readConfig returns the host's configuration.nix
+func readConfig(host string, sshOpts []string) (string, error) {
+	cmd := shellCommand(host, sshOpts, readScript)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("reading configuration.nix: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// writeConfig installs content as the host's configuration.nix and rebuilds
+func writeConfig(host string, sshOpts []string, content string) error {
+	cmd := shellCommand(host, sshOpts, writeScript)
+	cmd.Stdin = strings.NewReader(content)
+	cmd.Stdout = io.MultiWriter(os.Stdout, common.LogWriter())
+	cmd.Stderr = io.MultiWriter(os.Stderr, common.LogWriter())
+	err := cmd.Run()
+	common.LogCommand(cmd.Path, cmd.Args[1:], err)
+	return err
+}
+
+// hostName names host in messages
+func hostName(host string) string {
+	if host == "" {
+		return "localhost"
+	}
+	return host
+}
+
+// editKeys applies edit to each user's keys on host and rebuilds, skipping
+// the rebuild when no list changed
+func editKeys(host string, users []string, sshOpts []string, edit editFunc) error {
+	content, err := readConfig(host, sshOpts)
+	if err != nil {
+		return err
+	}
+	updated := content
+	for _, user := range users {
+		if !common.IsValidUserName(user) {
+			return fmt.Errorf("invalid user name %q", user)
+		}
+		keys, err := common.UserSSHKeys(updated, user)
+		if err != nil {
+			return err
+		}
+		keys, changed, err := edit(user, keys)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+		if updated, err = common.SetUserSSHKeys(updated, user, keys); err != nil {
+			return err
+		}
+	}
+	if updated == content {
+		common.Info(hostName(host) + ": nothing to change")
+		return nil
+	}
+	return writeConfig(host, sshOpts, updated)
+}
+
+// addKeyEdit appends key unless the user already has it
+func addKeyEdit(host, key string) editFunc {
+	return func(user string, keys []string) ([]string, bool, error) {
+		if slices.Contains(keys, key) {
+			common.Info(fmt.Sprintf("%s: %s already has this key", hostName(host), user))
+			return keys, false, nil
+		}
+		common.Success(fmt.Sprintf("%s: adding key for %s", hostName(host), user))
+		return append(keys, key), true, nil
+	}
+}
+
+// removeKeyEdit drops the keys matching fingerprint, refusing to leave the
+// user without any key
+func removeKeyEdit(host, fingerprint string) editFunc {
+	return func(user string, keys []string) ([]string, bool, error) {
+		kept := slices.DeleteFunc(slices.Clone(keys), func(key string) bool {
+			fp, err := common.SSHKeyFingerprint(key)
+			return err == nil && fp == fingerprint
+		})
+		if len(kept) == len(keys) {
+			common.Info(fmt.Sprintf("%s: %s has no key %s", hostName(host), user, fingerprint))
+			return keys, false, nil
+		}
+		if len(kept) == 0 {
+			return nil, false, fmt.Errorf("removing %s would leave %s without SSH keys", fingerprint, user)
+		}
+		common.Success(fmt.Sprintf("%s: removing key for %s", hostName(host), user))
+		return kept, true, nil
+	}
+}
+
+// normalizeFingerprint accepts a fingerprint with or without the SHA256: prefix
+func normalizeFingerprint(fingerprint string) string {
+	return "SHA256:" + strings.TrimPrefix(strings.TrimSpace(fingerprint), "SHA256:")
+}
+
+// AddKey authorizes key for user on host and rebuilds. Adding a key the user
+// already has changes nothing. An empty host edits this machine.
+func AddKey(host, user, key string, sshOpts []string) error {
+	if !common.IsValidSSHKey(key) {
+		return errors.New("not a valid SSH public key")
+	}
+	return editKeys(host, []string{user}, sshOpts, addKeyEdit(host, key))
+}
+
+// RemoveKey removes the key with the given SHA256 fingerprint from user on
+// host and rebuilds. An empty host edits this machine.
+func RemoveKey(host, user, keyFingerprint string, sshOpts []string) error {
+	return editKeys(host, []string{user}, sshOpts, removeKeyEdit(host, normalizeFingerprint(keyFingerprint)))
+}
+
+// keyFlags are the options shared by add-key and remove-key
+type keyFlags struct {
+	hosts   common.StringList
+	sshKey  string
+	users   string
+	sshOpts []string
+}
+
+// parseKeyFlags registers the shared options, parses args and checks them
+func parseKeyFlags(fs *flag.FlagSet, args []string) keyFlags {
+	var f keyFlags
+	fs.Var(&f.hosts, "host", "Remote host, repeatable (omit on the server itself)")
+	fs.StringVar(&f.sshKey, "i", "", "SSH identity file (optional)")
+	fs.StringVar(&f.users, "user", defaultUsers, "Comma-separated users whose keys change")
+	if err := fs.Parse(args); err != nil {
+		common.Error(fmt.Sprintf("Failed to parse arguments: %v", err))
+		common.Exit(1)
+	}
+	if len(f.hosts) == 0 && !common.FileExists("/etc/nixos/configuration.nix") {
+		common.Error("No host specified and not running on NixOS")
+		fmt.Println()
+		fmt.Printf("Usage: juniper-host %s --host=root@server [--host=...]\n", fs.Name())
+		common.Exit(1)
+	}
+	if len(f.hosts) == 0 && !common.IsRoot() {
+		common.Error("Must be run as root")
+		common.Exit(1)
+	}
+	if f.sshKey != "" {
+		f.sshOpts = append(f.sshOpts, "-i", f.sshKey)
+	}
+	f.sshOpts = append(f.sshOpts, "-o", "StrictHostKeyChecking=accept-new")
+	return f
+}
+
+// userList splits --user, dropping empty entries
+func (f keyFlags) userList() []string {
+	var users []string
+	for _, u := range strings.Split(f.users, ",") {
+		if u = strings.TrimSpace(u); u != "" && !slices.Contains(users, u) {
+			users = append(users, u)
+		}
+	}
+	return users
+}
+
+// hostList returns --host values, or the local machine when there are none
+func (f keyFlags) hostList() []string {
+	if len(f.hosts) == 0 {
+		return []string{""}
+	}
+	return f.hosts
+}
+
+// runOnHosts applies edit on every host, continuing past failures, and
+// exits 1 if any host failed
+func runOnHosts(f keyFlags, edit func(host string) editFunc) {
+	users := f.userList()
+	if len(users) == 0 {
+		common.Error("--user must name at least one user")
+		common.Exit(1)
+	}
+	var failed []string
+	for _, host := range f.hostList() {
+		common.Info("Updating " + hostName(host) + "...")
+		if err := editKeys(host, users, f.sshOpts, edit(host)); err != nil {
+			common.Error(fmt.Sprintf("%s: %v", hostName(host), err))
+			failed = append(failed, hostName(host))
+		}
+	}
+	if len(failed) > 0 {
+		common.Error("Failed on: " + strings.Join(failed, ", "))
+		common.Exit(1)
+	}
+}
+
+// RunAdd implements add-key
+func RunAdd(args []string) {
+	fs := flag.NewFlagSet("add-key", flag.ExitOnError)
+	key := fs.String("key", "", "SSH public key to authorize")
+	f := parseKeyFlags(fs, args)
+	*key = strings.TrimSpace(*key)
+	if !common.IsValidSSHKey(*key) {
+		common.Error("--key must be a valid SSH public key of type " + common.SSHKeyTypesDescription())
+		common.Exit(1)
+	}
+	if _, _, err := common.ValidateSSHKeyStrength(*key); err != nil {
+		common.Warning(fmt.Sprintf("SSH key is weaker than recommended: %v", err))
+	}
+	common.Header("Juniper Bible - Add SSH Key")
+	runOnHosts(f, func(host string) editFunc { return addKeyEdit(host, *key) })
+}
+
+// RunRemove implements remove-key
+func RunRemove(args []string) {
+	fs := flag.NewFlagSet("remove-key", flag.ExitOnError)
+	fingerprint := fs.String("fingerprint", "", "SHA256 fingerprint of the key to remove (ssh-keygen -lf KEY)")
+	f := parseKeyFlags(fs, args)
+	if *fingerprint == "" {
+		common.Error("--fingerprint is required")
+		common.Exit(1)
+	}
+	fp := normalizeFingerprint(*fingerprint)
+	common.Header("Juniper Bible - Remove SSH Key")
+	runOnHosts(f, func(host string) editFunc { return removeKeyEdit(host, fp) })
+}
@@ -0,0 +1,148 @@
+package upgrade
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// Exit statuses for --check; errors exit 1
+const (
+	checkExitCurrent = 0
+	checkExitUpdate  = 10
+)
+
+// maxCheckLines caps the changed lines --check prints
+const maxCheckLines = 20
+
+// sshKeySectionRe matches an authorizedKeys.keys list, which differs on
+// every server and is carried over by upgrade
+var sshKeySectionRe = regexp.MustCompile(`(authorizedKeys\.keys = \[)[\s\S]*?(\];)`)
+
+// normalizeConfig drops the ref record and empties the SSH key lists so
+// only upstream changes remain
+func normalizeConfig(content string) string {
+	return sshKeySectionRe.ReplaceAllString(refLineRe.ReplaceAllString(content, ""), "${1} ${2}")
+}
+
+// readCurrentConfig returns the installed configuration.nix, over SSH when
+// host is set
+func readCurrentConfig(host, sshKeyPath string) (string, error) {
+	if host == "" {
+		data, err := os.ReadFile("/etc/nixos/configuration.nix")
+		return string(data), err
+	}
+	args := append(common.SSHArgs(sshKeyPath), host, "cat /etc/nixos/configuration.nix")
+	cmd := exec.Command("ssh", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	common.LogCommand("ssh", args, err)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// changedLines diffs two configurations and returns the added and removed
+// lines prefixed with + and -
+func changedLines(dir, current, latest string) ([]string, error) {
+	currentPath := filepath.Join(dir, "current.nix")
+	latestPath := filepath.Join(dir, "latest.nix")
+	if err := os.WriteFile(currentPath, []byte(current), 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(latestPath, []byte(latest), 0600); err != nil {
+		return nil, err
+	}
+	out, err := exec.Command("diff", "-U0", currentPath, latestPath).Output()
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		return nil, fmt.Errorf("diff failed: %w", err)
+	}
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "---") {
+			continue
+		}
+		if strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// printCheckSummary reports the number of changed lines and the first few
+func printCheckSummary(lines []string) {
+	added := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, "+") {
+			added++
+		}
+	}
+	common.Warning(fmt.Sprintf("Update available: %d line(s) added, %d removed", added, len(lines)-added))
+	for i, line := range lines {
+		if i == maxCheckLines {
+			fmt.Printf("  ... and %d more\n", len(lines)-maxCheckLines)
+			break
+		}
+		fmt.Println("  " + line)
+	}
+}
+
+// runCheck compares the configuration at the requested ref with the
+// installed one, SSH keys and preserved settings aside, reports both refs,
+// and exits checkExitCurrent or checkExitUpdate. Nothing is written outside
+// a temporary directory.
+func runCheck(host, sshKeyPath string, fetch fetchOptions) {
+	current, err := readCurrentConfig(host, sshKeyPath)
+	if err != nil {
+		common.Error(fmt.Sprintf("Failed to read current configuration: %v", err))
+		common.Exit(1)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "juniper-upgrade-check-")
+	if err != nil {
+		common.Error(fmt.Sprintf("Failed to create temporary directory: %v", err))
+		common.Exit(1)
+	}
+	latestPath := filepath.Join(tmpDir, "configuration.nix")
+	if err := fetch.download(latestPath); err != nil {
+		os.RemoveAll(tmpDir)
+		common.Error(fmt.Sprintf("Failed to download configuration: %v", err))
+		common.Exit(1)
+	}
+	latest, err := os.ReadFile(latestPath)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		common.Error(fmt.Sprintf("Failed to read downloaded configuration: %v", err))
+		common.Exit(1)
+	}
+
+	upgraded, _ := preserveSettings(current, string(latest))
+	lines, err := changedLines(tmpDir, normalizeConfig(current), normalizeConfig(upgraded))
+	os.RemoveAll(tmpDir)
+	if err != nil {
+		common.Error(err.Error())
+		common.Exit(1)
+	}
+	currentRef := configRef(current)
+	if currentRef == "" {
+		currentRef = "unknown (not recorded)"
+	}
+	common.Info("Current ref: " + currentRef)
+	common.Info("Latest ref:  " + fetch.ref)
+	if len(lines) == 0 {
+		common.Success("Configuration is up to date")
+		os.Exit(checkExitCurrent)
+	}
+	printCheckSummary(lines)
+	os.Exit(checkExitUpdate)
+}
@@ -0,0 +1,65 @@
+package upgrade
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// Exit statuses for --diff-only, following diff(1)
+const (
+	diffExitSame    = 0
+	diffExitChanged = 2
+)
+
+// exitWithDiff prints the diff of oldPath and newPath, removes cleanup, and
+// exits with diffExitSame or diffExitChanged
+func exitWithDiff(oldPath, newPath, cleanup string, p preservation) {
+	changed, err := showUpgradeDiff(oldPath, newPath, p)
+	os.RemoveAll(cleanup)
+	if err != nil {
+		common.Error(fmt.Sprintf("diff failed: %v", err))
+		common.Exit(1)
+	}
+	if !changed {
+		common.Success("Configuration is up to date")
+		os.Exit(diffExitSame)
+	}
+	os.Exit(diffExitChanged)
+}
+
+// runLocalDiff downloads the latest configuration and shows how it differs
+// from /etc/nixos/configuration.nix without applying anything
+func runLocalDiff(fetch fetchOptions) {
+	common.Header("Juniper Bible - Upgrade Preview")
+	newPath := "/etc/nixos/configuration.nix.new"
+	p := downloadConfig("/etc/nixos/configuration.nix", newPath, fetch)
+	exitWithDiff("/etc/nixos/configuration.nix", newPath, newPath, p)
+}
+
+// runRemoteDiff copies the remote configuration with scp and shows how the
+// latest configuration differs from it, without changing the remote host
+func runRemoteDiff(host, sshKeyPath string, fetch fetchOptions) {
+	common.Header("Juniper Bible - Remote Upgrade Preview")
+	common.Info(fmt.Sprintf("Target: %s", host))
+
+	tmpDir, err := os.MkdirTemp("", "juniper-upgrade-diff-")
+	if err != nil {
+		common.Error(fmt.Sprintf("Failed to create temporary directory: %v", err))
+		common.Exit(1)
+	}
+	currentPath := filepath.Join(tmpDir, "configuration.nix")
+	newPath := currentPath + ".new"
+
+	common.Info("Fetching remote configuration...")
+	if err := copyRemoteConfig(common.SSHArgs(sshKeyPath), host, currentPath); err != nil {
+		os.RemoveAll(tmpDir)
+		common.Error(fmt.Sprintf("Failed to copy remote configuration: %v", err))
+		common.Exit(1)
+	}
+
+	p := downloadConfig(currentPath, newPath, fetch)
+	exitWithDiff(currentPath, newPath, tmpDir, p)
+}
@@ -0,0 +1,311 @@
+package upgrade
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// defaultFleetConcurrency is how many hosts a fleet upgrade runs at once
+const defaultFleetConcurrency = 4
+
+// fleetFlags are handled by the fleet runner and not passed on to each host
+var fleetFlags = map[string]bool{"host": true, "hosts-file": true, "i": true, "concurrency": true, "serial": true}
+
+// fleetTarget is one host of a fleet run
+type fleetTarget struct {
+	host   string
+	sshKey string // Identity file; empty uses ssh's default
+}
+
+// fleetResult is how one host's run ended
+type fleetResult struct {
+	target   fleetTarget
+	ran      bool
+	status   int // Exit status of the run
+	err      error
+	duration time.Duration
+}
+
+// fleetOptions configures a fleet run
+type fleetOptions struct {
+	concurrency int
+	serial      bool           // One host at a time, stopping at the first failure
+	statuses    map[int]string // Exit statuses that are not failures, with their labels
+}
+
+// parseHostsFile reads one target per line, optionally followed by an
+// identity file for that host; blank lines and # comments are skipped
+func parseHostsFile(path, defaultKey string) ([]fleetTarget, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var targets []fleetTarget
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			targets = append(targets, fleetTarget{host: fields[0], sshKey: defaultKey})
+		case 2:
+			targets = append(targets, fleetTarget{host: fields[0], sshKey: fields[1]})
+		default:
+			return nil, fmt.Errorf("%s:%d: expected a host and an optional identity file", path, n)
+		}
+	}
+	return targets, scanner.Err()
+}
+
+// fleetTargets combines the --host values and --hosts-file entries
+func fleetTargets(hosts []string, hostsFile, sshKey string) ([]fleetTarget, error) {
+	var targets []fleetTarget
+	for _, h := range hosts {
+		targets = append(targets, fleetTarget{host: h, sshKey: sshKey})
+	}
+	if hostsFile != "" {
+		fromFile, err := parseHostsFile(hostsFile, sshKey)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, fromFile...)
+	}
+	return targets, nil
+}
+
+// childArgs returns the upgrade arguments every host runs with: each flag
+// set on the command line except the fleet's own
+func childArgs(fs *flag.FlagSet) []string {
+	var args []string
+	fs.Visit(func(f *flag.Flag) {
+		if !fleetFlags[f.Name] {
+			args = append(args, fmt.Sprintf("--%s=%s", f.Name, f.Value.String()))
+		}
+	})
+	return args
+}
+
+// prefixWriter writes each line to out behind a prefix. Lines are written
+// whole under mu so hosts running together never mix within a line; with
+// partial set, an unfinished line such as a prompt is written at once.
+type prefixWriter struct {
+	mu      *sync.Mutex
+	out     io.Writer
+	prefix  string
+	partial bool
+	buf     []byte
+	midLine bool // The last write to out did not end a line
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+	}
+	if w.partial && len(w.buf) > 0 {
+		w.emit(w.buf)
+		w.buf = nil
+	}
+	return len(p), nil
+}
+
+// emit writes b, starting with the prefix unless it continues a line
+func (w *prefixWriter) emit(b []byte) {
+	if !w.midLine {
+		io.WriteString(w.out, w.prefix)
+	}
+	w.out.Write(b)
+	w.midLine = b[len(b)-1] != '\n'
+}
+
+// Flush writes any unfinished last line and ends it
+func (w *prefixWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.emit(w.buf)
+		w.buf = nil
+	}
+	if w.midLine {
+		io.WriteString(w.out, "\n")
+		w.midLine = false
+	}
+}
+
+// runFleetHost runs juniper-host upgrade for one target, streaming its
+// output with a [host] prefix. stdin is only passed on when hosts run one
+// at a time, so prompts can be answered.
+func runFleetHost(exe string, args []string, t fleetTarget, mu *sync.Mutex, oneAtATime bool) fleetResult {
+	cmdArgs := []string{"upgrade"}
+	if path := common.LogPath(); path != "" {
+		cmdArgs = []string{"--log-file=" + path, "upgrade"}
+	}
+	cmdArgs = append(cmdArgs, args...)
+	cmdArgs = append(cmdArgs, "--host="+t.host)
+	if t.sshKey != "" {
+		cmdArgs = append(cmdArgs, "-i", t.sshKey)
+	}
+
+	prefix := fmt.Sprintf("%s[%s]%s ", common.Bold, t.host, common.Reset)
+	stdout := &prefixWriter{mu: mu, out: os.Stdout, prefix: prefix, partial: oneAtATime}
+	stderr := &prefixWriter{mu: mu, out: os.Stderr, prefix: prefix, partial: oneAtATime}
+	cmd := exec.Command(exe, cmdArgs...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if oneAtATime {
+		cmd.Stdin = os.Stdin
+	}
+
+	start := time.Now()
+	err := cmd.Run()
+	stdout.Flush()
+	stderr.Flush()
+	r := fleetResult{target: t, ran: true, duration: time.Since(start)}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		r.status = exitErr.ExitCode()
+	default:
+		r.status = -1
+		r.err = err
+	}
+	return r
+}
+
+// failed reports whether the host's run failed
+func (o fleetOptions) failed(r fleetResult) bool {
+	_, ok := o.statuses[r.status]
+	return r.err != nil || !ok
+}
+
+// label describes how the host's run ended
+func (o fleetOptions) label(r fleetResult) string {
+	switch {
+	case !r.ran:
+		return "skipped"
+	case r.err != nil:
+		return "failed: " + r.err.Error()
+	case o.failed(r):
+		return fmt.Sprintf("failed (exit %d)", r.status)
+	}
+	return o.statuses[r.status]
+}
+
+// runFleet runs args on every target and returns the results in target
+// order. Targets a --serial run never reached are marked as not run.
+func runFleet(exe string, args []string, targets []fleetTarget, o fleetOptions) []fleetResult {
+	results := make([]fleetResult, len(targets))
+	for i, t := range targets {
+		results[i].target = t
+	}
+	var mu sync.Mutex
+	oneAtATime := o.serial || o.concurrency == 1 || len(targets) == 1
+
+	if o.serial {
+		for i, t := range targets {
+			results[i] = runFleetHost(exe, args, t, &mu, true)
+			if o.failed(results[i]) {
+				break
+			}
+		}
+		return results
+	}
+
+	sem := make(chan struct{}, o.concurrency)
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = runFleetHost(exe, args, t, &mu, oneAtATime)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// printFleetSummary prints one row per host
+func printFleetSummary(results []fleetResult, o fleetOptions) {
+	width := len("Host")
+	for _, r := range results {
+		width = max(width, len(r.target.host))
+	}
+	fmt.Println()
+	common.Header("Fleet Summary")
+	fmt.Printf("%-*s  %-8s  %s\n", width, "Host", "Time", "Result")
+	for _, r := range results {
+		elapsed := "-"
+		if r.ran {
+			elapsed = r.duration.Round(time.Second).String()
+		}
+		label := o.label(r)
+		color := common.Green
+		switch {
+		case !r.ran:
+			color = common.Yellow
+		case o.failed(r):
+			color = common.Red
+		}
+		common.Logf("FLEET", "%s: %s", r.target.host, label)
+		fmt.Printf("%-*s  %-8s  %s%s%s\n", width, r.target.host, elapsed, color, label, common.Reset)
+	}
+}
+
+// fleetExitStatus is 1 if any host failed or was skipped, otherwise the
+// highest status of the hosts, so --check reports an update on any of them
+func fleetExitStatus(results []fleetResult, o fleetOptions) int {
+	status := 0
+	for _, r := range results {
+		if !r.ran || o.failed(r) {
+			return 1
+		}
+		status = max(status, r.status)
+	}
+	return status
+}
+
+// runFleetUpgrade runs the upgrade on every target as a separate
+// juniper-host process and exits with fleetExitStatus
+func runFleetUpgrade(fs *flag.FlagSet, targets []fleetTarget, o fleetOptions) {
+	exe, err := os.Executable()
+	if err != nil {
+		common.Error(fmt.Sprintf("Failed to find juniper-host: %v", err))
+		common.Exit(1)
+	}
+	mode := fmt.Sprintf("%d at a time", o.concurrency)
+	if o.serial {
+		mode = "one at a time, stopping at the first failure"
+	}
+	common.Header("Juniper Bible - Fleet Upgrade")
+	common.Info(fmt.Sprintf("%d hosts, %s", len(targets), mode))
+	fmt.Println()
+
+	results := runFleet(exe, childArgs(fs), targets, o)
+	printFleetSummary(results, o)
+	os.Exit(fleetExitStatus(results, o))
+}
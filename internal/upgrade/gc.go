@@ -0,0 +1,168 @@
+package upgrade
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// gcOlderThan is how old a NixOS generation must be before garbage collection removes it
+const gcOlderThan = "30d"
+
+// systemProfile holds the NixOS system generations
+const systemProfile = "/nix/var/nix/profiles/system"
+
+// gcOptions says whether and how garbage is collected after an upgrade
+type gcOptions struct {
+	enabled bool
+	keep    int // Newest system generations to keep; 0 removes those older than gcOlderThan
+}
+
+// describe says which generations collection removes
+func (o gcOptions) describe() string {
+	if o.keep > 0 {
+		return fmt.Sprintf("all but the newest %d system generations", o.keep)
+	}
+	return "generations older than " + gcOlderThan
+}
+
+// commands returns the commands that delete generations and collect garbage
+func (o gcOptions) commands() [][]string {
+	if o.keep > 0 {
+		return [][]string{
+			{"nix-env", "--profile", systemProfile, "--delete-generations", fmt.Sprintf("+%d", o.keep)},
+			{"nix-collect-garbage"},
+		}
+	}
+	return [][]string{{"nix-collect-garbage", "--delete-older-than", gcOlderThan}}
+}
+
+// script collects garbage on a remote host and reports the space reclaimed;
+// failures only warn
+func (o gcOptions) script() string {
+	var cmds []string
+	for _, c := range o.commands() {
+		cmds = append(cmds, strings.Join(c, " ")+" >/dev/null")
+	}
+	return fmt.Sprintf(`GC_BEFORE=$(df -B1 --output=avail /nix 2>/dev/null | tail -n 1 | tr -d ' ' || true)
+echo "==> Disk space before GC: $(numfmt --to=iec "${GC_BEFORE:-0}") available"
+echo "==> Collecting garbage (%s)..."
+if %s && nixos-rebuild boot --install-bootloader >/dev/null; then
+  echo "==> Garbage collection complete"
+else
+  echo "==> Warning: garbage collection failed (upgrade itself succeeded)"
+fi
+GC_AFTER=$(df -B1 --output=avail /nix 2>/dev/null | tail -n 1 | tr -d ' ' || true)
+GC_FREED=$(( ${GC_AFTER:-0} - ${GC_BEFORE:-0} ))
+if [ "$GC_FREED" -lt 0 ]; then GC_FREED=0; fi
+echo "==> Reclaimed $(numfmt --to=iec "$GC_FREED") ($(numfmt --to=iec "${GC_AFTER:-0}") available)"`, o.describe(), strings.Join(cmds, " && "))
+}
+
+// formatBytes renders n in binary units the way numfmt --to=iec does
+func formatBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d", n)
+	}
+	v, i := float64(n)/1024, 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if v < 10 {
+		return fmt.Sprintf("%.1f%c", v, units[i])
+	}
+	return fmt.Sprintf("%.0f%c", v, units[i])
+}
+
+// nixStoreAvailable returns the free bytes on the Nix store filesystem
+func nixStoreAvailable() (int64, error) {
+	out, err := common.RunOutput("df", "-B1", "--output=avail", "/nix")
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(out, "\n")
+	return strconv.ParseInt(strings.TrimSpace(lines[len(lines)-1]), 10, 64)
+}
+
+// collectGarbage removes old NixOS generations, prunes their boot entries
+// and reports the space reclaimed. Failures only warn so they never fail an
+// otherwise successful upgrade.
+func collectGarbage(o gcOptions) {
+	fmt.Println()
+	before, beforeErr := nixStoreAvailable()
+	if beforeErr == nil {
+		common.Info(fmt.Sprintf("Disk space before GC: %s available", formatBytes(before)))
+	}
+	common.Info(fmt.Sprintf("Collecting garbage (%s)...", o.describe()))
+	for _, c := range o.commands() {
+		if err := common.RunQuiet(c[0], c[1:]...); err != nil {
+			common.Warning(fmt.Sprintf("Garbage collection failed: %v", err))
+			return
+		}
+	}
+	common.Info("Pruning old boot entries...")
+	if err := common.RunQuiet("nixos-rebuild", "boot", "--install-bootloader"); err != nil {
+		common.Warning(fmt.Sprintf("Failed to prune boot entries: %v", err))
+	}
+	after, err := nixStoreAvailable()
+	if err != nil || beforeErr != nil {
+		common.Warning("Could not measure the space reclaimed")
+		return
+	}
+	common.Success(fmt.Sprintf("Reclaimed %s (%s available)", formatBytes(max(after-before, 0)), formatBytes(after)))
+}
+
+// runRemoteGC collects garbage on a remote host over SSH
+func runRemoteGC(host, sshKeyPath string) {
+	common.Header("Juniper Bible - Remote Garbage Collection")
+	common.Info(fmt.Sprintf("Target: %s", host))
+
+	sshArgs := common.SSHArgs(sshKeyPath)
+	testSSHConnection(sshArgs, host)
+
+	sshCmd := exec.Command("ssh", append(sshArgs, host, "bash", "-c", gcOptions{enabled: true}.script())...)
+	sshCmd.Stdout = io.MultiWriter(os.Stdout, common.LogWriter())
+	sshCmd.Stderr = io.MultiWriter(os.Stderr, common.LogWriter())
+	err := sshCmd.Run()
+	common.LogCommand("ssh", append(sshArgs, host, "bash", "-c", "<gc script>"), err)
+	if err != nil {
+		common.Error(fmt.Sprintf("Remote garbage collection failed: %v", err))
+		common.Exit(1)
+	}
+}
+
+// RunGC executes the gc command
+func RunGC(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	host := fs.String("host", "", "Remote host (e.g., root@server or root@192.168.1.1)")
+	sshKey := fs.String("i", "", "SSH identity file (optional)")
+	if err := fs.Parse(args); err != nil {
+		common.Error(fmt.Sprintf("Failed to parse arguments: %v", err))
+		common.Exit(1)
+	}
+
+	if *host != "" {
+		runRemoteGC(*host, *sshKey)
+		return
+	}
+	if !common.FileExists("/etc/nixos/configuration.nix") {
+		common.Error("No host specified and not running on NixOS")
+		fmt.Println()
+		fmt.Println("Usage: juniper-host gc --host=root@server")
+		fmt.Println("       juniper-host gc  (when running on the server itself)")
+		common.Exit(1)
+	}
+	if !common.IsRoot() {
+		common.Error("Must be run as root")
+		common.Exit(1)
+	}
+	common.Header("Juniper Bible - Garbage Collection")
+	collectGarbage(gcOptions{enabled: true})
+}
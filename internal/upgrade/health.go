@@ -0,0 +1,177 @@
+package upgrade
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// healthzURL is fetched on the server after a rebuild to check the site is up
+const healthzURL = "http://localhost/healthz.json"
+
+// healthzTimeout bounds the healthz.json request
+const healthzTimeout = 10 * time.Second
+
+// healthReport is the outcome of the checks run after a rebuild
+type healthReport struct {
+	passed    []string
+	failed    []string
+	lockedOut bool // No new SSH connection could be made after the rebuild
+}
+
+// ok reports whether every check passed
+func (h healthReport) ok() bool {
+	return len(h.failed) == 0
+}
+
+// summary lists the failed checks, or the passed ones when all passed
+func (h healthReport) summary() string {
+	if !h.ok() {
+		return strings.Join(h.failed, "; ")
+	}
+	return strings.Join(h.passed, "; ")
+}
+
+// addUnits records which of verifiedUnits are active
+func (h *healthReport) addUnits(inactive []string) {
+	if len(inactive) == 0 {
+		h.passed = append(h.passed, strings.Join(verifiedUnits, " and ")+" active")
+		return
+	}
+	h.failed = append(h.failed, strings.Join(inactive, " and ")+" not active")
+}
+
+// addHealthz records whether healthz.json was served
+func (h *healthReport) addHealthz(err error) {
+	if err != nil {
+		common.Error(fmt.Sprintf("healthz.json: %v", err))
+		h.failed = append(h.failed, "healthz.json not served")
+		return
+	}
+	common.Success("healthz.json served")
+	h.passed = append(h.passed, "healthz.json served")
+}
+
+// fetchHealthz requests healthzURL on this machine
+func fetchHealthz() error {
+	client := &http.Client{Timeout: healthzTimeout}
+	resp, err := client.Get(healthzURL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &common.HTTPError{StatusCode: resp.StatusCode, URL: healthzURL}
+	}
+	return nil
+}
+
+// verifyLocalHealth checks the services and the site after a local rebuild
+func verifyLocalHealth() healthReport {
+	fmt.Println()
+	var h healthReport
+	h.addUnits(verifyUnits())
+	h.addHealthz(fetchHealthz())
+	return h
+}
+
+// remoteHealthScript prints one "unit NAME STATE" line per verified unit and
+// a "healthz ok" or "healthz failed" line
+var remoteHealthScript = fmt.Sprintf(`for unit in %s; do
+  echo "unit $unit $(systemctl is-active "$unit" 2>/dev/null || true)"
+done
+if curl -fsS -o /dev/null --max-time %d %s; then
+  echo "healthz ok"
+else
+  echo "healthz failed"
+fi`, strings.Join(verifiedUnits, " "), int(healthzTimeout.Seconds()), healthzURL)
+
+// verifyRemoteHealth opens a new SSH connection, proving the rebuild did not
+// lock us out, and checks the services and the site on host
+func verifyRemoteHealth(sshArgs []string, host string) healthReport {
+	fmt.Println()
+	common.Info("Verifying the server over a new SSH connection...")
+	var h healthReport
+	args := append(slices.Clone(sshArgs), host, remoteHealthScript)
+	var stderr bytes.Buffer
+	cmd := exec.Command("ssh", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	common.LogCommand("ssh", append(slices.Clone(sshArgs), host, "<health check>"), err)
+	if err != nil {
+		common.Error(fmt.Sprintf("SSH reconnection failed: %v %s", err, strings.TrimSpace(stderr.String())))
+		h.failed = append(h.failed, "SSH reconnection failed")
+		h.lockedOut = true
+		return h
+	}
+	common.Success("SSH reconnected")
+	h.passed = append(h.passed, "SSH reconnected")
+
+	var inactive []string
+	healthzErr := fmt.Errorf("no result")
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) >= 2 && fields[0] == "unit":
+			state := strings.Join(fields[2:], " ")
+			if state == "active" {
+				common.Success(fields[1] + " is active")
+				continue
+			}
+			common.Error(fmt.Sprintf("%s is not active (%s)", fields[1], state))
+			inactive = append(inactive, fields[1])
+		case len(fields) == 2 && fields[0] == "healthz":
+			healthzErr = nil
+			if fields[1] != "ok" {
+				healthzErr = fmt.Errorf("%s did not return 200", healthzURL)
+			}
+		}
+	}
+	h.addUnits(inactive)
+	h.addHealthz(healthzErr)
+	return h
+}
+
+// confirmRestore decides whether to restore the pre-upgrade configuration
+// after failed checks: always with --auto-restore, never with --yes alone,
+// otherwise by asking
+func confirmRestore(yes, autoRestore bool) bool {
+	if autoRestore {
+		common.Info("Restoring the pre-upgrade configuration (--auto-restore)...")
+		return true
+	}
+	if yes {
+		return false
+	}
+	fmt.Println()
+	return common.Confirm("Restore the pre-upgrade configuration and rebuild?", false)
+}
+
+// reportFailedHealth ends an upgrade of host ("" for this machine) whose
+// checks failed, saying whether the pre-upgrade configuration was restored
+func reportFailedHealth(h healthReport, host string, restored bool, restoreErr error) {
+	fmt.Println()
+	switch {
+	case restored && restoreErr == nil:
+		common.Error(fmt.Sprintf("Upgrade failed verification (%s); the pre-upgrade configuration was restored", h.summary()))
+	case restored:
+		common.Error(fmt.Sprintf("Upgrade failed verification (%s) and restoring failed: %v", h.summary(), restoreErr))
+	case h.lockedOut:
+		common.Error(fmt.Sprintf("Upgrade applied but failed verification (%s)", h.summary()))
+		fmt.Println("Run 'juniper-host upgrade --rollback' from the server's console to restore the previous configuration.")
+	default:
+		common.Error(fmt.Sprintf("Upgrade applied but failed verification (%s)", h.summary()))
+		command := "juniper-host upgrade --rollback"
+		if host != "" {
+			command += " --host=" + host
+		}
+		fmt.Printf("Run '%s' to restore the previous configuration.\n", command)
+	}
+	common.Exit(1)
+}
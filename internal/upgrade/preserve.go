@@ -0,0 +1,111 @@
+package upgrade
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// preservedSetting is a configuration.nix assignment that upgrade carries
+// over from the current configuration, usually set by bootstrap or the wizard
+type preservedSetting struct {
+	name string         // Option path, for messages
+	re   *regexp.Regexp // Matches the whole assignment
+}
+
+// preservedSettings are carried over in addition to the SSH keys
+var preservedSettings = []preservedSetting{
+	{"networking.hostName", regexp.MustCompile(`networking\.hostName = "[^"]*";`)},
+	{"time.timeZone", regexp.MustCompile(`time\.timeZone = "[^"]*";`)},
+	{"swapDevices", regexp.MustCompile(`swapDevices = \[[^\]]*\];`)},
+	{"services.openssh.ports", regexp.MustCompile(`services\.openssh\.ports = \[[^\]]*\];`)},
+	{"services.openssh.settings.PermitRootLogin", regexp.MustCompile(`PermitRootLogin = "[^"]*";`)},
+	{"networking.firewall.allowedTCPPorts", regexp.MustCompile(`networking\.firewall\.allowedTCPPorts = \[[^\]]*\];`)},
+	{"networking.firewall.allowedUDPPorts", regexp.MustCompile(`networking\.firewall\.allowedUDPPorts = \[[^\]]*\];`)},
+}
+
+// addedSnippetRe matches the comment heading a snippet bootstrap appended,
+// which upgrade has no way to map into the new configuration
+var addedSnippetRe = regexp.MustCompile(`(?m)^[ \t]*# .*\(added by juniper-host [^)]*\)[ \t]*$`)
+
+// preservation reports what carrying over the settings did
+type preservation struct {
+	carried []string // Assignments copied from the current configuration
+	lost    []string // Settings and snippets the new configuration has no place for
+}
+
+// oneLine collapses an assignment spanning several lines for display
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// preserveSettings copies every preserved setting from current into latest.
+// Settings latest already has with the same value are not reported; ones it
+// has no assignment for are reported as lost, as are bootstrap snippets.
+// An unattended upgrade timer is carried over whole.
+func preserveSettings(current, latest string) (string, preservation) {
+	var p preservation
+	for _, s := range preservedSettings {
+		value := s.re.FindString(current)
+		if value == "" {
+			continue
+		}
+		loc := s.re.FindStringIndex(latest)
+		if loc == nil {
+			p.lost = append(p.lost, oneLine(value))
+			continue
+		}
+		if latest[loc[0]:loc[1]] == value {
+			continue
+		}
+		latest = latest[:loc[0]] + value + latest[loc[1]:]
+		p.carried = append(p.carried, oneLine(value))
+	}
+	if updated, ok := carryUpgradeTimer(current, latest); ok {
+		latest = updated
+		p.carried = append(p.carried, "systemd.timers."+timerUnit+" (--install-timer)")
+	}
+	for _, marker := range addedSnippetRe.FindAllString(current, -1) {
+		if marker = strings.TrimSpace(marker); !strings.Contains(latest, marker) {
+			p.lost = append(p.lost, marker)
+		}
+	}
+	return latest, p
+}
+
+// printCarried lists the settings copied from the current configuration
+func (p preservation) printCarried() {
+	if len(p.carried) == 0 {
+		return
+	}
+	fmt.Println()
+	common.Info("Carried over from the current configuration:")
+	for _, s := range p.carried {
+		fmt.Println("    " + s)
+	}
+}
+
+// printLost lists what the upgrade drops, so it can be re-applied by hand
+func (p preservation) printLost() {
+	if len(p.lost) == 0 {
+		return
+	}
+	fmt.Println()
+	common.Warning("Will be lost (no matching setting in the new configuration):")
+	for _, s := range p.lost {
+		fmt.Println("    " + s)
+	}
+}
+
+// showUpgradeDiff prints the carried-over settings, the diff of the two
+// configurations, and what will be lost, reporting whether they differ
+func showUpgradeDiff(oldPath, newPath string, p preservation) (bool, error) {
+	p.printCarried()
+	fmt.Println()
+	common.Info("Configuration changes:")
+	changed, err := showDiff(oldPath, newPath)
+	p.printLost()
+	return changed, err
+}
@@ -0,0 +1,137 @@
+package upgrade
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+const (
+	// bootedSystem is the NixOS system the machine booted into
+	bootedSystem = "/run/booted-system"
+
+	// currentSystem is the NixOS system the last rebuild activated
+	currentSystem = "/run/current-system"
+
+	// defaultRebootDelay gives logged-in users time to cancel a scheduled reboot
+	defaultRebootDelay = 5 * time.Minute
+
+	// rebootMessage is broadcast to logged-in users when a reboot is scheduled
+	rebootMessage = "juniper-host upgrade: rebooting to apply the upgrade"
+)
+
+// rebootLinks are the parts of a NixOS system that only take effect on reboot
+var rebootLinks = []string{"kernel", "initrd", "kernel-modules"}
+
+// rebootOptions controls what happens when an upgrade needs a reboot
+type rebootOptions struct {
+	ifNeeded bool          // Schedule the reboot instead of only reporting it
+	delay    time.Duration // Time before the scheduled reboot
+}
+
+// minutes returns the delay in whole minutes for shutdown(8), rounded up
+func (o rebootOptions) minutes() int {
+	return int((o.delay + time.Minute - 1) / time.Minute)
+}
+
+// localRebootChanges returns the rebootLinks whose booted and current
+// targets differ on this machine
+func localRebootChanges() []string {
+	var changed []string
+	for _, link := range rebootLinks {
+		booted, errBooted := filepath.EvalSymlinks(filepath.Join(bootedSystem, link))
+		current, errCurrent := filepath.EvalSymlinks(filepath.Join(currentSystem, link))
+		if errBooted == nil && errCurrent == nil && booted != current {
+			changed = append(changed, link)
+		}
+	}
+	return changed
+}
+
+// remoteRebootScript prints each of rebootLinks whose booted and current
+// targets differ
+var remoteRebootScript = fmt.Sprintf(`for link in %s; do
+  [ -e %s/$link ] && [ -e %s/$link ] || continue
+  [ "$(readlink -f %[2]s/$link)" = "$(readlink -f %[3]s/$link)" ] || echo "$link"
+done`, strings.Join(rebootLinks, " "), bootedSystem, currentSystem)
+
+// remoteRebootChanges returns the rebootLinks whose booted and current
+// targets differ on host
+func remoteRebootChanges(sshArgs []string, host string) ([]string, error) {
+	args := append(slices.Clone(sshArgs), host, remoteRebootScript)
+	out, err := exec.Command("ssh", args...).Output()
+	common.LogCommand("ssh", append(slices.Clone(sshArgs), host, "<reboot check>"), err)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// shutdownArgs returns the shutdown(8) arguments scheduling the reboot
+func (o rebootOptions) shutdownArgs() []string {
+	return []string{"-r", fmt.Sprintf("+%d", o.minutes()), rebootMessage}
+}
+
+// handleReboot reports whether the rebuild of host ("" for this machine)
+// needs a reboot and, with --reboot-if-needed, schedules it with schedule
+func handleReboot(changed []string, host string, o rebootOptions, schedule func() error) {
+	fmt.Println()
+	if len(changed) == 0 {
+		common.Success("No reboot required")
+		return
+	}
+	common.Warning(fmt.Sprintf("Reboot required (changed since boot: %s)", strings.Join(changed, ", ")))
+
+	if !o.ifNeeded {
+		fmt.Println("Reboot the server to finish the upgrade, or upgrade with --reboot-if-needed.")
+		return
+	}
+	if err := schedule(); err != nil {
+		common.Error(fmt.Sprintf("Failed to schedule reboot: %v", err))
+		return
+	}
+	if o.minutes() == 0 {
+		common.Success("Rebooting now")
+		return
+	}
+	common.Success(fmt.Sprintf("Reboot scheduled in %d minute(s)", o.minutes()))
+	cancel := "shutdown -c"
+	if host != "" {
+		cancel = "juniper-host remote-exec " + host + " shutdown -c"
+	}
+	fmt.Printf("Cancel it with '%s'.\n", cancel)
+}
+
+// checkLocalReboot handles a reboot needed by a local rebuild
+func checkLocalReboot(o rebootOptions) {
+	handleReboot(localRebootChanges(), "", o, func() error {
+		return common.Run("shutdown", o.shutdownArgs()...)
+	})
+}
+
+// checkRemoteReboot handles a reboot needed by a rebuild of host
+func checkRemoteReboot(sshArgs []string, host string, o rebootOptions) {
+	changed, err := remoteRebootChanges(sshArgs, host)
+	if err != nil {
+		common.Warning(fmt.Sprintf("Could not check whether a reboot is required: %v", err))
+		return
+	}
+	handleReboot(changed, host, o, func() error {
+		quoted := make([]string, 0, len(o.shutdownArgs()))
+		for _, arg := range o.shutdownArgs() {
+			quoted = append(quoted, shellQuote(arg))
+		}
+		args := append(slices.Clone(sshArgs), host, "shutdown "+strings.Join(quoted, " "))
+		output, err := exec.Command("ssh", args...).CombinedOutput()
+		common.LogCommand("ssh", args, err)
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,26 @@
+package upgrade
+
+import (
+	"regexp"
+)
+
+// refCommentPrefix starts the first line of an upgraded configuration.nix,
+// recording the ref it was installed from
+const refCommentPrefix = "# juniper-host ref: "
+
+// refLineRe matches the ref record at the top of a configuration
+var refLineRe = regexp.MustCompile(`\A` + regexp.QuoteMeta(refCommentPrefix) + `(\S+)[ \t]*(\n|\z)`)
+
+// configRef returns the ref recorded in content, or "" for configurations
+// installed before refs were recorded
+func configRef(content string) string {
+	if m := refLineRe.FindStringSubmatch(content); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// setConfigRef records ref at the top of content, replacing any earlier record
+func setConfigRef(content, ref string) string {
+	return refCommentPrefix + ref + "\n" + refLineRe.ReplaceAllString(content, "")
+}
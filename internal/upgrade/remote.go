@@ -0,0 +1,194 @@
+package upgrade
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// copyRemoteConfig copies the host's configuration.nix to dest with scp
+func copyRemoteConfig(sshArgs []string, host, dest string) error {
+	scpArgs := append(append([]string{}, sshArgs...), host+":/etc/nixos/configuration.nix", dest)
+	output, err := exec.Command("scp", scpArgs...).CombinedOutput()
+	common.LogCommand("scp", scpArgs, err)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// shellQuote quotes s as a single POSIX shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// getApplyScript returns the script that installs the configuration read from
+// stdin on the remote host and rebuilds. The host's file must still have
+// currentSHA256, so edits made there since it was copied are never lost.
+func getApplyScript(currentSHA256 string, configOnly bool, change configChange, gc gcOptions) string {
+	return fmt.Sprintf(`set -euo pipefail
+
+CONFIG="/etc/nixos/configuration.nix"
+BACKUP="$CONFIG.pre-upgrade-$(date +%%Y%%m%%d-%%H%%M%%S)"
+
+if ! echo "%s  $CONFIG" | sha256sum -c --quiet >/dev/null 2>&1; then
+  echo "==> $CONFIG changed since it was copied; run upgrade again"
+  exit 1
+fi
+
+echo "==> Backing up current configuration..."
+cp -p "$CONFIG" "$BACKUP"
+
+echo "==> Applying new configuration..."
+cp -p "$CONFIG" "$CONFIG.new"
+cat > "$CONFIG.new"
+mv "$CONFIG.new" "$CONFIG"
+%s
+
+%s`, currentSHA256, pruneBackupsScript, getRebuildScript(configOnly, change, gc))
+}
+
+// confirmRemoteUpgrade says what applying will do and asks for confirmation
+func confirmRemoteUpgrade(host string, yes, configOnly bool, gc gcOptions) bool {
+	if yes {
+		return true
+	}
+	fmt.Println()
+	switch {
+	case configOnly:
+		fmt.Println("The configuration will be replaced without rebuilding NixOS.")
+	case gc.enabled:
+		fmt.Printf("NixOS will be rebuilt, then %s removed.\n", gc.describe())
+	default:
+		fmt.Println("NixOS will be rebuilt with the new configuration.")
+	}
+	return common.Confirm(fmt.Sprintf("Apply this upgrade to %s?", host), true)
+}
+
+// runRemoteUpgrade prepares the new configuration locally, exactly as a
+// local upgrade does, then pushes it to the host and rebuilds there
+func runRemoteUpgrade(host, sshKeyPath string, yes, configOnly, autoRestore bool, gc gcOptions, reboot rebootOptions, fetch fetchOptions) {
+	common.Header("Juniper Bible - Remote Upgrade")
+	common.Info(fmt.Sprintf("Target: %s", host))
+
+	sshArgs := common.SSHArgs(sshKeyPath)
+	testSSHConnection(sshArgs, host)
+
+	tmpDir, err := os.MkdirTemp("", "juniper-upgrade-")
+	if err != nil {
+		common.Error(fmt.Sprintf("Failed to create temporary directory: %v", err))
+		common.Exit(1)
+	}
+	currentPath := filepath.Join(tmpDir, "configuration.nix")
+	newPath := currentPath + ".new"
+
+	common.Info("Fetching remote configuration...")
+	if err := copyRemoteConfig(sshArgs, host, currentPath); err != nil {
+		os.RemoveAll(tmpDir)
+		common.Error(fmt.Sprintf("Failed to copy remote configuration: %v", err))
+		common.Exit(1)
+	}
+	p := downloadConfig(currentPath, newPath, fetch)
+	current, errCurrent := os.ReadFile(currentPath)
+	updated, errUpdated := os.ReadFile(newPath)
+	if err := errors.Join(errCurrent, errUpdated); err != nil {
+		os.RemoveAll(tmpDir)
+		common.Error(fmt.Sprintf("Failed to read configuration: %v", err))
+		common.Exit(1)
+	}
+	if classifyChange(string(current), string(updated)) == configUnchanged {
+		os.RemoveAll(tmpDir)
+		fmt.Println()
+		common.Success("No configuration changes detected")
+		if gc.enabled && !configOnly {
+			collectRemoteGarbage(sshArgs, host, gc)
+		}
+		return
+	}
+	showUpgradeDiff(currentPath, newPath, p) // Errors only hide the diff
+	os.RemoveAll(tmpDir)
+
+	if !confirmRemoteUpgrade(host, yes, configOnly, gc) {
+		common.Info("Upgrade cancelled")
+		os.Exit(0)
+	}
+	applyRemoteConfig(sshArgs, host, current, updated, yes, configOnly, autoRestore, gc, reboot)
+}
+
+// applyRemoteConfig sends updated to the host, which checks its file is
+// still current, backs it up, installs updated and rebuilds. The host is
+// then checked over a new connection; when that fails the backup is
+// restored if the user agrees or autoRestore is set. A needed reboot is
+// then reported or scheduled.
+func applyRemoteConfig(sshArgs []string, host string, current, updated []byte, yes, configOnly, autoRestore bool, gc gcOptions, reboot rebootOptions) {
+	sum := sha256.Sum256(current)
+	script := getApplyScript(hex.EncodeToString(sum[:]), configOnly, classifyChange(string(current), string(updated)), gc)
+
+	fmt.Println()
+	common.Info("Applying upgrade on remote host...")
+	fmt.Println()
+
+	err := runApplyScript(sshArgs, host, script, updated)
+	if err != nil {
+		common.Error(fmt.Sprintf("Remote upgrade failed: %v", err))
+		common.Exit(1)
+	}
+
+	if configOnly {
+		fmt.Println()
+		common.Success("Remote upgrade complete!")
+		return
+	}
+	h := verifyRemoteHealth(sshArgs, host)
+	if !h.ok() {
+		restored := !h.lockedOut && confirmRestore(yes, autoRestore)
+		if restored {
+			err = restoreNewestRemoteBackup(sshArgs, host)
+		}
+		reportFailedHealth(h, host, restored, err)
+	}
+	checkRemoteReboot(sshArgs, host, reboot)
+
+	fmt.Println()
+	common.Success("Remote upgrade complete! (" + h.summary() + ")")
+}
+
+// runApplyScript runs an apply script on host with updated as its stdin
+func runApplyScript(sshArgs []string, host, script string, updated []byte) error {
+	sshCmd := exec.Command("ssh", append(sshArgs, host, "bash", "-c", shellQuote(script))...)
+	sshCmd.Stdin = bytes.NewReader(updated)
+	// Remote output goes to the log too, since it is the only record of what ran there
+	sshCmd.Stdout = io.MultiWriter(os.Stdout, common.LogWriter())
+	sshCmd.Stderr = io.MultiWriter(os.Stderr, common.LogWriter())
+	err := sshCmd.Run()
+	common.LogCommand("ssh", append(sshArgs, host, "bash", "-c", "<upgrade script>"), err)
+	return err
+}
+
+// collectRemoteGarbage collects garbage on host without an upgrade
+func collectRemoteGarbage(sshArgs []string, host string, gc gcOptions) {
+	fmt.Println()
+	if err := runApplyScript(sshArgs, host, "set -euo pipefail\n\n"+gc.script(), nil); err != nil {
+		common.Error(fmt.Sprintf("Garbage collection failed: %v", err))
+		common.Exit(1)
+	}
+}
+
+// restoreNewestRemoteBackup restores the backup the upgrade just made on host
+func restoreNewestRemoteBackup(sshArgs []string, host string) error {
+	backup, err := newestRemoteBackup(sshArgs, host)
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+	return restoreRemoteBackup(sshArgs, host, backup)
+}
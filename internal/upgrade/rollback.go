@@ -0,0 +1,288 @@
+package upgrade
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+const (
+	// nixosConfig is the configuration upgrade replaces
+	nixosConfig = "/etc/nixos/configuration.nix"
+
+	// upgradeBackupPrefix is prepended to a timestamp to form each
+	// pre-upgrade backup filename
+	upgradeBackupPrefix = nixosConfig + ".pre-upgrade"
+
+	// upgradeBackupTimeFormat is the timestamp layout used in backup filenames
+	upgradeBackupTimeFormat = "20060102-150405"
+
+	// maxUpgradeBackups is the number of pre-upgrade backups kept, each one a
+	// rollback point
+	maxUpgradeBackups = 5
+
+	// rollbackSafetyCopy keeps the configuration replaced by a rollback
+	rollbackSafetyCopy = nixosConfig + ".pre-rollback"
+)
+
+// verifiedUnits must be active after a rollback for the server to count as recovered
+var verifiedUnits = []string{"sshd", "caddy"}
+
+// upgradeBackupRe matches a pre-upgrade backup path, timestamped or from
+// versions that kept a single one
+var upgradeBackupRe = regexp.MustCompile(`^` + regexp.QuoteMeta(upgradeBackupPrefix) + `(-\d{8}-\d{6})?$`)
+
+// newUpgradeBackupPath returns a timestamped backup path for now
+func newUpgradeBackupPath() string {
+	return upgradeBackupPrefix + "-" + time.Now().Format(upgradeBackupTimeFormat)
+}
+
+// listUpgradeBackups returns the pre-upgrade backups, newest first
+func listUpgradeBackups() []string {
+	matches, err := filepath.Glob(upgradeBackupPrefix + "*")
+	if err != nil {
+		return nil
+	}
+	var backups []string
+	for _, m := range matches {
+		if upgradeBackupRe.MatchString(m) {
+			backups = append(backups, m)
+		}
+	}
+	// Timestamps sort lexically and the untimestamped backup sorts first,
+	// so reverse order is newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups
+}
+
+// pruneUpgradeBackups removes all but the newest maxUpgradeBackups backups
+func pruneUpgradeBackups() {
+	backups := listUpgradeBackups()
+	if len(backups) <= maxUpgradeBackups {
+		return
+	}
+	for _, old := range backups[maxUpgradeBackups:] {
+		if err := os.Remove(old); err != nil {
+			common.Warning(fmt.Sprintf("Failed to remove old backup %s: %v", old, err))
+		}
+	}
+}
+
+// pruneBackupsScript keeps the newest maxUpgradeBackups backups on a remote host
+var pruneBackupsScript = fmt.Sprintf(`ls -1d "$CONFIG".pre-upgrade-* 2>/dev/null | sort -r | tail -n +%d | xargs -r rm -f || true`, maxUpgradeBackups+1)
+
+// verifyUnitsScript checks verifiedUnits on a remote host
+var verifyUnitsScript = fmt.Sprintf(`echo "==> Checking services..."
+FAILED=""
+for unit in %s; do
+  if systemctl is-active --quiet "$unit"; then
+    echo "    $unit: active"
+  else
+    echo "    $unit: $(systemctl is-active "$unit" || true)"
+    FAILED="$FAILED $unit"
+  fi
+done
+if [ -n "$FAILED" ]; then
+  echo "==> Not running after rollback:$FAILED"
+  exit 1
+fi`, strings.Join(verifiedUnits, " "))
+
+// getRollbackScript returns the script restoring backup on a remote host,
+// mirroring runLocalRollback
+func getRollbackScript(backup string) string {
+	return fmt.Sprintf(`set -euo pipefail
+
+CONFIG="%s"
+BACKUP="%s"
+SAFETY="%s"
+
+echo "==> Restoring $BACKUP..."
+cp -p "$CONFIG" "$SAFETY"
+mv "$BACKUP" "$CONFIG"
+
+echo "==> Rebuilding NixOS..."
+if ! nixos-rebuild switch; then
+  echo "==> Rebuild failed, putting back the configuration from before the rollback..."
+  mv "$CONFIG" "$BACKUP"
+  cp -p "$SAFETY" "$CONFIG"
+  exit 1
+fi
+
+%s`, nixosConfig, backup, rollbackSafetyCopy, verifyUnitsScript)
+}
+
+// verifyUnits checks every unit in verifiedUnits and returns those not active
+func verifyUnits() []string {
+	common.Info("Checking services...")
+	var inactive []string
+	for _, unit := range verifiedUnits {
+		state, err := common.RunOutput("systemctl", "is-active", unit)
+		state = strings.TrimSpace(state)
+		if err != nil || state != "active" {
+			common.Error(fmt.Sprintf("%s is not active (%s)", unit, state))
+			inactive = append(inactive, unit)
+			continue
+		}
+		common.Success(unit + " is active")
+	}
+	return inactive
+}
+
+// confirmRollback asks before a backup replaces the configuration
+func confirmRollback(backup string, yes bool) bool {
+	if yes {
+		return true
+	}
+	fmt.Println()
+	return common.Confirm(fmt.Sprintf("Restore %s and rebuild?", filepath.Base(backup)), true)
+}
+
+// undoRollback puts back the configuration a failed rollback replaced,
+// keeping the backup as a rollback point
+func undoRollback(backup string, current []byte) error {
+	if err := os.Rename(nixosConfig, backup); err != nil {
+		return err
+	}
+	return os.WriteFile(nixosConfig, current, 0600)
+}
+
+// restoreLocalBackup puts backup in place of the configuration and rebuilds,
+// putting the replaced configuration back if the rebuild fails
+func restoreLocalBackup(backup string) error {
+	current, err := os.ReadFile(nixosConfig)
+	if err != nil {
+		return fmt.Errorf("read current configuration: %w", err)
+	}
+	if err := os.WriteFile(rollbackSafetyCopy, current, 0600); err != nil {
+		return fmt.Errorf("save current configuration: %w", err)
+	}
+	if err := os.Rename(backup, nixosConfig); err != nil {
+		return fmt.Errorf("restore %s: %w", backup, err)
+	}
+
+	fmt.Println()
+	common.Info("Rebuilding NixOS...")
+	if err := common.Run("nixos-rebuild", "switch"); err != nil {
+		common.Error("NixOS rebuild failed. Putting back the configuration from before the rollback...")
+		if err := undoRollback(backup, current); err != nil {
+			return fmt.Errorf("rebuild failed and putting the configuration back failed (%v); the replaced configuration is in %s", err, rollbackSafetyCopy)
+		}
+		common.Success("Configuration put back")
+		return fmt.Errorf("rebuild failed")
+	}
+	return nil
+}
+
+// runLocalRollback restores the newest pre-upgrade backup, rebuilds, and
+// checks the server came back. The backup is used up, so running it again
+// goes one upgrade further back.
+func runLocalRollback(yes bool) {
+	common.Header("Juniper Bible - Rollback Upgrade")
+
+	backups := listUpgradeBackups()
+	if len(backups) == 0 {
+		common.Error("No pre-upgrade backups found")
+		common.Exit(1)
+	}
+	backup := backups[0]
+	common.Info(fmt.Sprintf("Newest backup: %s (%d rollback point(s))", filepath.Base(backup), len(backups)))
+
+	fmt.Println()
+	common.Info("Configuration changes:")
+	changed, err := showDiff(nixosConfig, backup)
+	if err == nil && !changed {
+		common.Info("The current configuration already matches this backup")
+	}
+	if !confirmRollback(backup, yes) {
+		common.Info("Rollback cancelled")
+		os.Exit(0)
+	}
+
+	if err := restoreLocalBackup(backup); err != nil {
+		common.Error(fmt.Sprintf("Rollback failed: %v", err))
+		common.Exit(1)
+	}
+
+	fmt.Println()
+	if len(verifyUnits()) > 0 {
+		common.Error("Rollback applied, but the server did not come back cleanly")
+		common.Exit(1)
+	}
+	fmt.Println()
+	common.Success("Rolled back to " + filepath.Base(backup))
+}
+
+// newestRemoteBackup returns the newest pre-upgrade backup on host
+func newestRemoteBackup(sshArgs []string, host string) (string, error) {
+	script := fmt.Sprintf(`ls -1d %s* 2>/dev/null | sort -r`, upgradeBackupPrefix)
+	args := append(append([]string{}, sshArgs...), host, script)
+	out, err := exec.Command("ssh", args...).Output()
+	common.LogCommand("ssh", args, err)
+	if err != nil && len(out) == 0 {
+		return "", fmt.Errorf("no pre-upgrade backups found")
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); upgradeBackupRe.MatchString(line) {
+			return line, nil
+		}
+	}
+	return "", fmt.Errorf("no pre-upgrade backups found")
+}
+
+// restoreRemoteBackup runs the rollback script for backup on host
+func restoreRemoteBackup(sshArgs []string, host, backup string) error {
+	sshCmd := exec.Command("ssh", append(slices.Clone(sshArgs), host, "bash", "-c", shellQuote(getRollbackScript(backup)))...)
+	sshCmd.Stdout = io.MultiWriter(os.Stdout, common.LogWriter())
+	sshCmd.Stderr = io.MultiWriter(os.Stderr, common.LogWriter())
+	err := sshCmd.Run()
+	common.LogCommand("ssh", append(slices.Clone(sshArgs), host, "bash", "-c", "<rollback script>"), err)
+	return err
+}
+
+// runRemoteRollback restores the newest pre-upgrade backup on host the same
+// way runLocalRollback does
+func runRemoteRollback(host, sshKeyPath string, yes bool) {
+	common.Header("Juniper Bible - Remote Rollback")
+	common.Info(fmt.Sprintf("Target: %s", host))
+
+	sshArgs := common.SSHArgs(sshKeyPath)
+	testSSHConnection(sshArgs, host)
+
+	backup, err := newestRemoteBackup(sshArgs, host)
+	if err != nil {
+		common.Error(err.Error())
+		common.Exit(1)
+	}
+	common.Info("Newest backup: " + filepath.Base(backup))
+
+	fmt.Println()
+	common.Info("Configuration changes:")
+	diffArgs := append(append([]string{}, sshArgs...), host, fmt.Sprintf("diff -u %s %s", nixosConfig, backup))
+	diffCmd := exec.Command("ssh", diffArgs...)
+	diffCmd.Stdout = os.Stdout
+	diffCmd.Stderr = os.Stderr
+	diffCmd.Run() // Errors only hide the diff; diff exits 1 when files differ
+
+	if !confirmRollback(backup, yes) {
+		common.Info("Rollback cancelled")
+		os.Exit(0)
+	}
+
+	fmt.Println()
+	if err := restoreRemoteBackup(sshArgs, host, backup); err != nil {
+		common.Error(fmt.Sprintf("Remote rollback failed: %v", err))
+		common.Exit(1)
+	}
+
+	fmt.Println()
+	common.Success("Rolled back to " + filepath.Base(backup))
+}
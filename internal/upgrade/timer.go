@@ -0,0 +1,363 @@
+package upgrade
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+const (
+	// timerUnit names the service and timer that run unattended upgrades
+	timerUnit = "juniper-upgrade"
+
+	// timerStartMarker and timerEndMarker enclose the timer in configuration.nix
+	timerStartMarker = "# Unattended upgrades (added by juniper-host upgrade --install-timer)"
+	timerEndMarker   = "# End of unattended upgrades"
+
+	// timerRandomDelay spreads the upgrades of servers on the same schedule
+	timerRandomDelay = "1h"
+)
+
+// timerArgs are the juniper-host arguments the unattended upgrade runs with
+var timerArgs = []string{"upgrade", "--yes", "--gc"}
+
+// timerBlockRe matches the timer block as installed, including the newline
+// before it, so removing it leaves the configuration as it was
+var timerBlockRe = regexp.MustCompile(`(?s)\n?[ \t]*` + regexp.QuoteMeta(timerStartMarker) +
+	`\n.*?` + regexp.QuoteMeta(timerEndMarker) + `[ \t]*\n`)
+
+// onCalendarRe matches an OnCalendar expression safe to write into a Nix string
+var onCalendarRe = regexp.MustCompile(`^[A-Za-z0-9 ,:*./~+-]+$`)
+
+// timerExePathRe matches a juniper-host path usable unquoted in ExecStart
+var timerExePathRe = regexp.MustCompile(`^/[A-Za-z0-9._/+-]+$`)
+
+// upgradeTimer is the systemd service and timer running unattended upgrades
+type upgradeTimer struct {
+	schedule string // OnCalendar expression, e.g. "weekly"
+	exe      string // Absolute path of juniper-host on the server
+}
+
+// parseTimerSchedule returns the OnCalendar expression for --install-timer:
+// daily, weekly, or OnCalendar=EXPR. When systemd-analyze is available the
+// expression is checked with it, so a typo fails before the rebuild.
+func parseTimerSchedule(s string) (string, error) {
+	schedule := s
+	if s != "daily" && s != "weekly" {
+		expr, ok := strings.CutPrefix(s, "OnCalendar=")
+		if !ok {
+			return "", fmt.Errorf("expected daily, weekly or OnCalendar=EXPR, got %q", s)
+		}
+		if !onCalendarRe.MatchString(expr) {
+			return "", fmt.Errorf("invalid OnCalendar expression %q", expr)
+		}
+		schedule = expr
+	}
+	if _, err := exec.LookPath("systemd-analyze"); err != nil {
+		return schedule, nil
+	}
+	if out, err := exec.Command("systemd-analyze", "calendar", schedule).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("invalid OnCalendar expression %q: %s", schedule, strings.TrimSpace(string(out)))
+	}
+	return schedule, nil
+}
+
+// command returns the ExecStart line of the service
+func (t upgradeTimer) command() string {
+	return t.exe + " " + strings.Join(timerArgs, " ")
+}
+
+// units renders the service and timer as the unit files systemd will load
+func (t upgradeTimer) units() string {
+	return fmt.Sprintf(`# %[1]s.service
+[Unit]
+Description=Juniper Bible unattended upgrade
+
+[Service]
+Type=oneshot
+ExecStart=%[2]s
+StandardOutput=journal
+StandardError=journal
+
+# %[1]s.timer
+[Timer]
+OnCalendar=%[3]s
+Persistent=true
+RandomizedDelaySec=%[4]s
+
+[Install]
+WantedBy=timers.target
+`, timerUnit, t.command(), t.schedule, timerRandomDelay)
+}
+
+// nixConfig renders the configuration.nix block declaring the units. NIX_PATH
+// and HOME are set as for system.autoUpgrade, so nixos-rebuild finds nixpkgs,
+// and the service is not restarted by the rebuild it runs itself.
+func (t upgradeTimer) nixConfig() string {
+	return fmt.Sprintf(`
+  %[1]s
+  systemd.services.%[2]s = {
+    description = "Juniper Bible unattended upgrade";
+    path = [ "/run/current-system/sw" ];
+    environment = {
+      inherit (config.environment.sessionVariables) NIX_PATH;
+      HOME = "/root";
+    };
+    restartIfChanged = false;
+    serviceConfig = {
+      Type = "oneshot";
+      ExecStart = "%[3]s";
+      StandardOutput = "journal";
+      StandardError = "journal";
+    };
+  };
+  systemd.timers.%[2]s = {
+    wantedBy = [ "timers.target" ];
+    timerConfig = {
+      OnCalendar = "%[4]s";
+      Persistent = true;
+      RandomizedDelaySec = "%[5]s";
+    };
+  };
+  %[6]s
+`, timerStartMarker, timerUnit, common.EscapeNixString(t.command()),
+		common.EscapeNixString(t.schedule), timerRandomDelay, timerEndMarker)
+}
+
+// insertBeforeClosingBrace adds snippet at the end of the configuration's
+// top-level attribute set
+func insertBeforeClosingBrace(content, snippet string) (string, error) {
+	end := strings.LastIndex(content, "}")
+	if end < 0 {
+		return "", fmt.Errorf("closing brace not found in configuration")
+	}
+	return content[:end] + snippet + content[end:], nil
+}
+
+// setUpgradeTimer replaces any timer block in content with t's, or removes
+// it when t is nil
+func setUpgradeTimer(content string, t *upgradeTimer) (string, error) {
+	content = timerBlockRe.ReplaceAllLiteralString(content, "")
+	if t == nil {
+		return content, nil
+	}
+	return insertBeforeClosingBrace(content, t.nixConfig())
+}
+
+// carryUpgradeTimer copies the timer block from current into latest, so the
+// upgrades the timer runs do not remove it. It reports whether it did.
+func carryUpgradeTimer(current, latest string) (string, bool) {
+	block := timerBlockRe.FindString(current)
+	if block == "" || timerBlockRe.MatchString(latest) {
+		return latest, false
+	}
+	if !strings.HasPrefix(block, "\n") {
+		block = "\n" + block
+	}
+	updated, err := insertBeforeClosingBrace(latest, block)
+	if err != nil {
+		return latest, false
+	}
+	return updated, true
+}
+
+// localExecutable returns the path of this juniper-host for the service,
+// which must keep working after this run, so a temporary copy is refused
+func localExecutable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(exe, os.TempDir()+"/") {
+		return "", fmt.Errorf("%s is in a temporary directory; install juniper-host (e.g. in /usr/local/bin) and run it from there", exe)
+	}
+	if !timerExePathRe.MatchString(exe) {
+		return "", fmt.Errorf("%s contains characters not allowed in ExecStart; install juniper-host in a plain path such as /usr/local/bin", exe)
+	}
+	return exe, nil
+}
+
+// remoteExecutable returns the path of juniper-host on host
+func remoteExecutable(sshArgs []string, host string) (string, error) {
+	args := append(slices.Clone(sshArgs), host, "command -v juniper-host")
+	out, err := exec.Command("ssh", args...).Output()
+	common.LogCommand("ssh", args, err)
+	exe := strings.TrimSpace(string(out))
+	if err != nil || exe == "" {
+		return "", fmt.Errorf("juniper-host not found in the PATH on %s; install it there first", host)
+	}
+	if !timerExePathRe.MatchString(exe) {
+		return "", fmt.Errorf("%s contains characters not allowed in ExecStart", exe)
+	}
+	return exe, nil
+}
+
+// confirmTimer shows what will change and asks for confirmation. It exits
+// when there is nothing to change.
+func confirmTimer(t *upgradeTimer, content, updated string, yes bool) {
+	fmt.Println()
+	switch {
+	case t == nil && !timerBlockRe.MatchString(content):
+		common.Info("No unattended upgrade timer is installed")
+		os.Exit(0)
+	case updated == content:
+		common.Info("The unattended upgrade timer is already installed with this schedule")
+		os.Exit(0)
+	case t == nil:
+		fmt.Printf("The %s service and timer will be removed from configuration.nix and NixOS rebuilt.\n", timerUnit)
+	default:
+		common.Info("Unit definitions:")
+		fmt.Println()
+		fmt.Print(t.units())
+		fmt.Println()
+		fmt.Println("These will be added to configuration.nix, so they survive rebuilds and")
+		fmt.Println("upgrades, and NixOS rebuilt. Output goes to the journal:")
+		fmt.Printf("    journalctl -u %s\n", timerUnit)
+	}
+	if yes {
+		return
+	}
+	fmt.Println()
+	if !common.Confirm("Patch configuration.nix and rebuild?", true) {
+		common.Info("Cancelled")
+		os.Exit(0)
+	}
+}
+
+// timerDone reports the outcome of installing or removing the timer
+func timerDone(t *upgradeTimer) {
+	fmt.Println()
+	if t == nil {
+		common.Success("Unattended upgrade timer removed")
+		return
+	}
+	common.Success(fmt.Sprintf("Unattended upgrades scheduled (%s)", t.schedule))
+}
+
+// runLocalTimer installs the timer with schedule on this machine, or removes
+// it when schedule is empty, keeping the replaced configuration as a
+// rollback point
+func runLocalTimer(schedule string, yes bool) {
+	common.Header("Juniper Bible - Unattended Upgrades")
+
+	var t *upgradeTimer
+	if schedule != "" {
+		exe, err := localExecutable()
+		if err != nil {
+			common.Error(err.Error())
+			common.Exit(1)
+		}
+		t = &upgradeTimer{schedule: schedule, exe: exe}
+	}
+	data, err := os.ReadFile(nixosConfig)
+	if err != nil {
+		common.Error(fmt.Sprintf("Failed to read configuration: %v", err))
+		common.Exit(1)
+	}
+	updated, err := setUpgradeTimer(string(data), t)
+	if err != nil {
+		common.Error(fmt.Sprintf("Failed to patch configuration: %v", err))
+		common.Exit(1)
+	}
+	confirmTimer(t, string(data), updated, yes)
+
+	common.Info("Backing up current configuration...")
+	backup := newUpgradeBackupPath()
+	if err := common.Run("cp", "-p", nixosConfig, backup); err != nil {
+		common.Error(fmt.Sprintf("Failed to backup config: %v", err))
+		common.Exit(1)
+	}
+	if err := os.WriteFile(nixosConfig, []byte(updated), 0600); err != nil {
+		common.Error(fmt.Sprintf("Failed to write configuration: %v", err))
+		common.Exit(1)
+	}
+	pruneUpgradeBackups()
+
+	fmt.Println()
+	common.Info("Rebuilding NixOS...")
+	if err := common.Run("nixos-rebuild", "switch"); err != nil {
+		common.Error("NixOS rebuild failed. Restoring backup...")
+		if restoreErr := os.Rename(backup, nixosConfig); restoreErr != nil {
+			common.Error(fmt.Sprintf("Failed to restore backup: %v", restoreErr))
+		} else {
+			common.Success("Backup restored")
+		}
+		common.Exit(1)
+	}
+	if t != nil {
+		fmt.Println()
+		common.Run("systemctl", "list-timers", "--no-pager", timerUnit+".timer") // Only informational
+	}
+	timerDone(t)
+}
+
+// runRemoteTimer installs the timer with schedule on host, or removes it
+// when schedule is empty, with the same checked apply script as a remote
+// upgrade
+func runRemoteTimer(host, sshKeyPath, schedule string, yes bool) {
+	common.Header("Juniper Bible - Unattended Upgrades")
+	common.Info(fmt.Sprintf("Target: %s", host))
+
+	sshArgs := common.SSHArgs(sshKeyPath)
+	testSSHConnection(sshArgs, host)
+
+	var t *upgradeTimer
+	if schedule != "" {
+		exe, err := remoteExecutable(sshArgs, host)
+		if err != nil {
+			common.Error(err.Error())
+			common.Exit(1)
+		}
+		t = &upgradeTimer{schedule: schedule, exe: exe}
+	}
+
+	tmpDir, err := os.MkdirTemp("", "juniper-upgrade-")
+	if err != nil {
+		common.Error(fmt.Sprintf("Failed to create temporary directory: %v", err))
+		common.Exit(1)
+	}
+	currentPath := filepath.Join(tmpDir, "configuration.nix")
+	common.Info("Fetching remote configuration...")
+	err = copyRemoteConfig(sshArgs, host, currentPath)
+	var current []byte
+	if err == nil {
+		current, err = os.ReadFile(currentPath)
+	}
+	os.RemoveAll(tmpDir)
+	if err != nil {
+		common.Error(fmt.Sprintf("Failed to copy remote configuration: %v", err))
+		common.Exit(1)
+	}
+	updated, err := setUpgradeTimer(string(current), t)
+	if err != nil {
+		common.Error(fmt.Sprintf("Failed to patch configuration: %v", err))
+		common.Exit(1)
+	}
+	confirmTimer(t, string(current), updated, yes)
+
+	sum := sha256.Sum256(current)
+	fmt.Println()
+	if err := runApplyScript(sshArgs, host, getApplyScript(hex.EncodeToString(sum[:]), false, configChanged, gcOptions{}), []byte(updated)); err != nil {
+		common.Error(fmt.Sprintf("Failed to apply configuration: %v", err))
+		common.Exit(1)
+	}
+	if t != nil {
+		fmt.Println()
+		listCmd := exec.Command("ssh", append(slices.Clone(sshArgs), host, "systemctl list-timers --no-pager "+timerUnit+".timer")...)
+		listCmd.Stdout = os.Stdout
+		listCmd.Stderr = os.Stderr
+		common.LogCommand("ssh", listCmd.Args[1:], listCmd.Run()) // Only informational
+	}
+	timerDone(t)
+}
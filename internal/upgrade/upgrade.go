@@ -1,8 +1,11 @@
 package upgrade
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"os/exec"
 	"strings"
@@ -10,94 +13,343 @@ import (
 	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
 )
 
-const (
-	configURL = common.RepoBase + "/configuration.nix"
-)
+// fetchOptions controls which configuration is downloaded and how it is checked
+type fetchOptions struct {
+	ref    string // Tag, branch or commit from --ref
+	sha256 string // Expected SHA-256 from --config-sha256, if any
+	skip   bool   // --insecure-skip-verify
+}
+
+// url returns the address of configuration.nix at the ref; its signature
+// and checksum are published next to it
+func (f fetchOptions) url() string {
+	return common.RepoFileURL(f.ref, "configuration.nix")
+}
+
+// download fetches and verifies configuration.nix into dest. A 404 names
+// the ref, since a mistyped tag or commit is the usual cause.
+func (f fetchOptions) download(dest string) error {
+	err := common.DownloadVerifiedFile(f.url(), dest, f.sha256, f.skip)
+	var httpErr *common.HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w (does ref %q exist?)", err, f.ref)
+	}
+	return err
+}
 
 // Run executes the upgrade command
 func Run(args []string) {
 	fs := flag.NewFlagSet("upgrade", flag.ExitOnError)
-	host := fs.String("host", "", "Remote host (e.g., root@server or root@192.168.1.1)")
+	var hosts common.StringList
+	fs.Var(&hosts, "host", "Remote host (e.g., root@server); repeat to upgrade several")
+	hostsFile := fs.String("hosts-file", "", "File of hosts to upgrade, one per line, each optionally followed by an identity file")
+	concurrency := fs.Int("concurrency", defaultFleetConcurrency, "Hosts upgraded at once with several hosts")
+	serial := fs.Bool("serial", false, "Upgrade several hosts one at a time, stopping at the first failure")
 	sshKey := fs.String("i", "", "SSH identity file (optional)")
 	yes := fs.Bool("yes", false, "Skip confirmation prompts")
 	configOnly := fs.Bool("config-only", false, "Only update configuration, don't rebuild")
+	answers := fs.String("answers", "", "TOML file of prompt answers for runs without a terminal")
+	configSHA256 := fs.String("config-sha256", "", "Expected SHA-256 of configuration.nix")
+	skipVerify := fs.Bool("insecure-skip-verify", false, "Do not verify the configuration.nix signature (unsafe)")
+	gcAfter := fs.Bool("gc-after-upgrade", false, "Collect garbage older than "+gcOlderThan+" after a successful rebuild")
+	gcFlag := fs.Bool("gc", false, "Same as --gc-after-upgrade")
+	gcKeep := fs.Int("gc-keep", 0, "With --gc, keep the newest N system generations instead of removing those older than "+gcOlderThan)
+	autoRestore := fs.Bool("auto-restore", false, "Restore the pre-upgrade configuration without asking if the server fails its checks after the rebuild")
+	diffOnly := fs.Bool("diff-only", false, "Show the configuration diff and exit (status 0: no changes, 2: changes)")
+	rollback := fs.Bool("rollback", false, "Restore the configuration from before the last upgrade and rebuild")
+	check := fs.Bool("check", false, "Report whether an update is available and exit (status 0: current, 10: update available)")
+	ref := fs.String("ref", common.DefaultRef, "Tag, branch or commit of the configuration to install (e.g. v1.2.3)")
+	rebootIfNeeded := fs.Bool("reboot-if-needed", false, "Schedule a reboot when the rebuild changed the kernel or initrd")
+	rebootDelay := fs.Duration("reboot-delay", defaultRebootDelay, "With --reboot-if-needed, time before the reboot (0 reboots at once)")
+	installTimer := fs.String("install-timer", "", "Upgrade unattended on a schedule: daily, weekly or OnCalendar=EXPR")
+	removeTimer := fs.Bool("remove-timer", false, "Remove the timer installed by --install-timer")
 
 	if err := fs.Parse(args); err != nil {
 		common.Error(fmt.Sprintf("Failed to parse arguments: %v", err))
-		os.Exit(1)
+		common.Exit(1)
+	}
+	common.ApplyInputFlags(*yes, *answers)
+	if *configSHA256 != "" && !common.IsValidSHA256(*configSHA256) {
+		common.Error(fmt.Sprintf("Invalid --config-sha256: %q", *configSHA256))
+		common.Exit(1)
+	}
+	if !common.IsValidRef(*ref) {
+		common.Error(fmt.Sprintf("Invalid --ref: %q", *ref))
+		common.Exit(1)
+	}
+	fetch := fetchOptions{ref: *ref, sha256: strings.ToLower(*configSHA256), skip: *skipVerify}
+	if *gcKeep < 0 {
+		common.Error(fmt.Sprintf("--gc-keep must not be negative, got %d", *gcKeep))
+		common.Exit(1)
+	}
+	gc := gcOptions{enabled: *gcAfter || *gcFlag || *gcKeep > 0, keep: *gcKeep}
+	if *rebootDelay < 0 {
+		common.Error(fmt.Sprintf("--reboot-delay must not be negative, got %s", *rebootDelay))
+		common.Exit(1)
+	}
+	reboot := rebootOptions{ifNeeded: *rebootIfNeeded, delay: *rebootDelay}
+	schedule := ""
+	if *installTimer != "" {
+		if *removeTimer {
+			common.Error("--install-timer and --remove-timer cannot be used together")
+			common.Exit(1)
+		}
+		var err error
+		if schedule, err = parseTimerSchedule(*installTimer); err != nil {
+			common.Error(fmt.Sprintf("Invalid --install-timer: %v", err))
+			common.Exit(1)
+		}
+	}
+
+	if len(hosts) > 1 || *hostsFile != "" {
+		targets, err := fleetTargets(hosts, *hostsFile, *sshKey)
+		if err != nil {
+			common.Error(fmt.Sprintf("Failed to read hosts: %v", err))
+			common.Exit(1)
+		}
+		if len(targets) == 0 {
+			common.Error("No hosts to upgrade")
+			common.Exit(1)
+		}
+		if *concurrency < 1 {
+			common.Error("--concurrency must be at least 1")
+			common.Exit(1)
+		}
+		o := fleetOptions{concurrency: *concurrency, serial: *serial, statuses: map[int]string{0: "ok"}}
+		switch {
+		case *check:
+			o.statuses = map[int]string{checkExitCurrent: "up to date", checkExitUpdate: "update available"}
+		case *diffOnly:
+			o.statuses = map[int]string{diffExitSame: "no changes", diffExitChanged: "changes"}
+		default:
+			if !*serial && *concurrency > 1 && len(targets) > 1 && !*yes && *answers == "" {
+				common.Error("Upgrading hosts in parallel needs --yes or --answers; use --serial to confirm each host")
+				common.Exit(1)
+			}
+		}
+		runFleetUpgrade(fs, targets, o)
+		return
+	}
+	host := ""
+	if len(hosts) == 1 {
+		host = hosts[0]
+	}
+
+	if *rollback {
+		switch {
+		case host != "":
+			runRemoteRollback(host, *sshKey, *yes)
+		case common.FileExists(nixosConfig):
+			runLocalRollback(*yes)
+		default:
+			common.Error("No host specified and not running on NixOS")
+			common.Exit(1)
+		}
+		return
+	}
+
+	if schedule != "" || *removeTimer {
+		switch {
+		case host != "":
+			runRemoteTimer(host, *sshKey, schedule, *yes)
+		case common.FileExists(nixosConfig):
+			runLocalTimer(schedule, *yes)
+		default:
+			common.Error("No host specified and not running on NixOS")
+			common.Exit(1)
+		}
+		return
+	}
+
+	if *check {
+		if host == "" && !common.FileExists("/etc/nixos/configuration.nix") {
+			common.Error("No host specified and not running on NixOS")
+			common.Exit(1)
+		}
+		runCheck(host, *sshKey, fetch)
+		return
+	}
+
+	if *diffOnly && host != "" {
+		runRemoteDiff(host, *sshKey, fetch)
+		return
 	}
 
 	// Check if host is provided
-	if *host == "" {
+	if host == "" {
 		// Check if we're running locally on a NixOS system
 		if common.FileExists("/etc/nixos/configuration.nix") {
-			runLocalUpgrade(*yes, *configOnly)
+			if *diffOnly {
+				runLocalDiff(fetch)
+				return
+			}
+			runLocalUpgrade(*yes, *configOnly, *autoRestore, gc, reboot, fetch)
 			return
 		}
 		common.Error("No host specified and not running on NixOS")
 		fmt.Println()
 		fmt.Println("Usage: juniper-host upgrade --host=root@server")
 		fmt.Println("       juniper-host upgrade  (when running on the server itself)")
-		os.Exit(1)
+		common.Exit(1)
 	}
 
-	runRemoteUpgrade(*host, *sshKey, *yes, *configOnly)
+	runRemoteUpgrade(host, *sshKey, *yes, *configOnly, *autoRestore, gc, reboot, fetch)
 }
 
-// backupAndDownloadConfig backs up current config and downloads new one
-func backupAndDownloadConfig() (sshKeys []string) {
+// backupAndDownloadConfig backs up current config to a new rollback point
+// and downloads the new one, returning the backup path
+func backupAndDownloadConfig(fetch fetchOptions) (string, preservation) {
 	common.Info("Backing up current configuration...")
-	if err := common.Run("cp", "/etc/nixos/configuration.nix", "/etc/nixos/configuration.nix.pre-upgrade"); err != nil {
+	backup := newUpgradeBackupPath()
+	if err := common.Run("cp", "-p", nixosConfig, backup); err != nil {
 		common.Error(fmt.Sprintf("Failed to backup config: %v", err))
-		os.Exit(1)
+		common.Exit(1)
 	}
+	return backup, downloadConfig(nixosConfig, nixosConfig+".new", fetch)
+}
 
+// downloadConfig downloads the latest configuration to dest, carrying over
+// each user's SSH keys and the preserved settings from the configuration at
+// current
+func downloadConfig(current, dest string, fetch fetchOptions) preservation {
 	common.Info("Extracting SSH keys from current configuration...")
-	sshKeys = extractSSHKeys("/etc/nixos/configuration.nix")
+	data, err := os.ReadFile(current)
+	if err != nil {
+		common.Error(fmt.Sprintf("Failed to read current configuration: %v", err))
+		common.Exit(1)
+	}
+	sshKeys := extractSSHKeys(string(data))
 
-	common.Info("Downloading latest configuration...")
-	if err := common.DownloadFile(configURL, "/etc/nixos/configuration.nix.new"); err != nil {
+	common.Info(fmt.Sprintf("Downloading configuration (ref %s)...", fetch.ref))
+	if err := fetch.download(dest); err != nil {
 		common.Error(fmt.Sprintf("Failed to download configuration: %v", err))
-		os.Exit(1)
+		common.Exit(1)
 	}
 
-	if len(sshKeys) > 0 {
-		common.Info(fmt.Sprintf("Injecting %d SSH key(s) into new configuration...", len(sshKeys)))
-		if err := injectSSHKeys("/etc/nixos/configuration.nix.new", sshKeys); err != nil {
-			common.Error(fmt.Sprintf("Failed to inject SSH keys: %v", err))
-			os.Exit(1)
-		}
+	if n := countSSHKeys(sshKeys); n > 0 {
+		common.Info(fmt.Sprintf("Injecting %d SSH key(s) into new configuration...", n))
+	}
+	var p preservation
+	err = common.PatchConfigFile(dest, func(content string) (string, error) {
+		content, p = preserveSettings(string(data), content)
+		return injectSSHKeys(setConfigRef(content, fetch.ref), sshKeys)
+	})
+	if err != nil {
+		os.Remove(dest)
+		common.Error(fmt.Sprintf("Failed to carry over SSH keys and settings: %v", err))
+		common.Exit(1)
 	}
-	return
+	return p
 }
 
-// showDiffAndConfirm shows diff and asks for confirmation
-func showDiffAndConfirm(yes bool) {
-	fmt.Println()
-	common.Info("Configuration changes:")
-	diffCmd := exec.Command("diff", "-u", "/etc/nixos/configuration.nix.pre-upgrade", "/etc/nixos/configuration.nix.new")
+// showDiff prints a unified diff of two configurations and reports whether they differ
+func showDiff(oldPath, newPath string) (bool, error) {
+	diffCmd := exec.Command("diff", "-u", oldPath, newPath)
 	diffCmd.Stdout = os.Stdout
 	diffCmd.Stderr = os.Stderr
-	diffCmd.Run() // Ignore error - diff returns non-zero if files differ
+	err := diffCmd.Run()
+	common.Logf("EXEC", "%s", strings.Join(diffCmd.Args, " "))
+	// diff exits 1 when the files differ and 2 on trouble
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return true, nil
+	}
+	return false, err
+}
+
+// showDiffAndConfirm shows diff and asks for confirmation, removing the
+// backup again when cancelled
+func showDiffAndConfirm(yes bool, backup string, p preservation) {
+	showUpgradeDiff(backup, nixosConfig+".new", p) // Errors only hide the diff
 
 	if !yes {
 		fmt.Println()
 		if !common.Confirm("Apply this upgrade?", true) {
 			common.Info("Upgrade cancelled")
-			os.Remove("/etc/nixos/configuration.nix.new")
+			os.Remove(nixosConfig + ".new")
+			os.Remove(backup)
 			os.Exit(0)
 		}
 	}
 }
 
-// applyLocalConfig applies new config and optionally rebuilds NixOS
-func applyLocalConfig(configOnly bool) {
+// configChange is how a new configuration differs from the installed one
+type configChange int
+
+const (
+	configUnchanged configChange = iota // Identical apart from whitespace
+	configKeysOnly                      // Only the SSH key lists differ
+	configChanged                       // Anything else
+)
+
+// normalizeWhitespace trims every line, collapses runs of spaces and drops
+// blank lines, so re-indenting a configuration does not count as a change
+func normalizeWhitespace(content string) string {
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			lines = append(lines, strings.Join(fields, " "))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// classifyChange compares the installed configuration with the new one
+func classifyChange(current, latest string) configChange {
+	switch {
+	case normalizeWhitespace(current) == normalizeWhitespace(latest):
+		return configUnchanged
+	case normalizeWhitespace(sshKeySectionRe.ReplaceAllString(current, "${1} ${2}")) ==
+		normalizeWhitespace(sshKeySectionRe.ReplaceAllString(latest, "${1} ${2}")):
+		return configKeysOnly
+	}
+	return configChanged
+}
+
+// readConfigChange classifies how the configuration at newPath differs from
+// the one at oldPath
+func readConfigChange(oldPath, newPath string) (configChange, error) {
+	current, err := os.ReadFile(oldPath)
+	if err != nil {
+		return configChanged, err
+	}
+	latest, err := os.ReadFile(newPath)
+	if err != nil {
+		return configChanged, err
+	}
+	return classifyChange(string(current), string(latest)), nil
+}
+
+// ConfigChanged reports whether the configurations at oldPath and newPath
+// differ other than in whitespace
+func ConfigChanged(oldPath, newPath string) (bool, error) {
+	change, err := readConfigChange(oldPath, newPath)
+	return change != configUnchanged, err
+}
+
+// rebuildArgs returns the nixos-rebuild arguments for a change. A change to
+// the SSH keys alone needs no new packages, so --fast skips rebuilding Nix
+// itself before switching.
+func rebuildArgs(change configChange) []string {
+	if change == configKeysOnly {
+		return []string{"switch", "--fast"}
+	}
+	return []string{"switch"}
+}
+
+// applyLocalConfig applies new config and optionally rebuilds NixOS,
+// restoring backup if the rebuild fails. The server is then checked; when
+// that fails backup is restored if the user agrees or autoRestore is set.
+// Garbage is collected afterwards when gc is enabled, and a needed reboot
+// reported or scheduled.
+func applyLocalConfig(backup string, yes, configOnly, autoRestore bool, change configChange, gc gcOptions, reboot rebootOptions) {
 	common.Info("Applying new configuration...")
-	if err := os.Rename("/etc/nixos/configuration.nix.new", "/etc/nixos/configuration.nix"); err != nil {
+	if err := os.Rename(nixosConfig+".new", nixosConfig); err != nil {
 		common.Error(fmt.Sprintf("Failed to apply configuration: %v", err))
-		os.Exit(1)
+		common.Exit(1)
 	}
 
+	pruneUpgradeBackups()
 	if configOnly {
 		common.Success("Configuration updated (rebuild skipped)")
 		fmt.Println()
@@ -106,252 +358,135 @@ func applyLocalConfig(configOnly bool) {
 	}
 
 	fmt.Println()
-	common.Info("Rebuilding NixOS...")
-	if err := common.Run("nixos-rebuild", "switch"); err != nil {
+	if change == configKeysOnly {
+		common.Info("Rebuilding NixOS (only SSH keys changed, --fast)...")
+	} else {
+		common.Info("Rebuilding NixOS...")
+	}
+	if err := common.Run("nixos-rebuild", rebuildArgs(change)...); err != nil {
 		common.Error("NixOS rebuild failed. Restoring backup...")
-		if restoreErr := os.Rename("/etc/nixos/configuration.nix.pre-upgrade", "/etc/nixos/configuration.nix"); restoreErr != nil {
+		if restoreErr := os.Rename(backup, nixosConfig); restoreErr != nil {
 			common.Error(fmt.Sprintf("Failed to restore backup: %v", restoreErr))
 		} else {
 			common.Success("Backup restored")
 		}
-		os.Exit(1)
+		common.Exit(1)
 	}
 
+	h := verifyLocalHealth()
+	if !h.ok() {
+		restored := confirmRestore(yes, autoRestore)
+		var err error
+		if restored {
+			if err = restoreLocalBackup(backup); err == nil {
+				if inactive := verifyUnits(); len(inactive) > 0 {
+					err = fmt.Errorf("%s not active after restoring", strings.Join(inactive, " and "))
+				}
+			}
+		}
+		reportFailedHealth(h, "", restored, err)
+	}
+
+	if gc.enabled {
+		collectGarbage(gc)
+	}
+	checkLocalReboot(reboot)
+
 	fmt.Println()
-	common.Success("Upgrade complete!")
+	common.Success("Upgrade complete! (" + h.summary() + ")")
 }
 
-func runLocalUpgrade(yes, configOnly bool) {
+func runLocalUpgrade(yes, configOnly, autoRestore bool, gc gcOptions, reboot rebootOptions, fetch fetchOptions) {
 	common.Header("Juniper Bible - Local Upgrade")
 	common.Info("Checking for updates...")
 
-	backupAndDownloadConfig()
-	showDiffAndConfirm(yes)
-	applyLocalConfig(configOnly)
-}
-
-// buildSSHArgs constructs SSH command arguments
-func buildSSHArgs(sshKeyPath string) []string {
-	sshArgs := []string{}
-	if sshKeyPath != "" {
-		sshArgs = append(sshArgs, "-i", sshKeyPath)
+	backup, p := backupAndDownloadConfig(fetch)
+	change, err := readConfigChange(backup, nixosConfig+".new")
+	if err == nil && change == configUnchanged {
+		os.Remove(nixosConfig + ".new")
+		os.Remove(backup)
+		fmt.Println()
+		common.Success("No configuration changes detected")
+		if gc.enabled && !configOnly {
+			collectGarbage(gc)
+		}
+		return
 	}
-	sshArgs = append(sshArgs, "-o", "StrictHostKeyChecking=accept-new")
-	return sshArgs
+	showDiffAndConfirm(yes, backup, p)
+	applyLocalConfig(backup, yes, configOnly, autoRestore, change, gc, reboot)
 }
 
 // testSSHConnection tests SSH connectivity to the host
 func testSSHConnection(sshArgs []string, host string) {
 	common.Info("Testing SSH connection...")
 	testCmd := exec.Command("ssh", append(sshArgs, host, "echo 'Connected'")...)
-	testCmd.Stderr = os.Stderr
-	if err := testCmd.Run(); err != nil {
+	testCmd.Stderr = io.MultiWriter(os.Stderr, common.LogWriter())
+	err := testCmd.Run()
+	common.LogCommand("ssh", testCmd.Args[1:], err)
+	if err != nil {
 		common.Error(fmt.Sprintf("SSH connection failed: %v", err))
-		os.Exit(1)
+		common.Exit(1)
 	}
 	common.Success("SSH connection OK")
 }
 
 // getRebuildScript returns the rebuild portion of the upgrade script
-func getRebuildScript(configOnly bool) string {
+func getRebuildScript(configOnly bool, change configChange, gc gcOptions) string {
 	if configOnly {
 		return `echo "==> Rebuild skipped (--config-only)"`
 	}
-	return `echo "==> Rebuilding NixOS..."
-if ! nixos-rebuild switch; then
+	message := "Rebuilding NixOS..."
+	if change == configKeysOnly {
+		message = "Rebuilding NixOS (only SSH keys changed, --fast)..."
+	}
+	script := `echo "==> ` + message + `"
+if ! nixos-rebuild ` + strings.Join(rebuildArgs(change), " ") + `; then
   echo "==> Rebuild failed, restoring backup..."
   mv "$BACKUP" "$CONFIG"
   exit 1
 fi`
-}
-
-// confirmRemoteUpgrade shows what will happen and asks for confirmation
-func confirmRemoteUpgrade(yes, configOnly bool) {
-	if yes {
-		return
-	}
-	fmt.Println()
-	fmt.Println("This will:")
-	fmt.Println("  1. Backup current configuration")
-	fmt.Println("  2. Download latest configuration from GitHub")
-	fmt.Println("  3. Preserve existing SSH keys")
-	if !configOnly {
-		fmt.Println("  4. Rebuild NixOS with new configuration")
-	}
-	fmt.Println()
-	if !common.Confirm("Proceed with upgrade?", true) {
-		common.Info("Upgrade cancelled")
-		os.Exit(0)
+	if gc.enabled {
+		script += "\n\n" + gc.script()
 	}
+	return script
 }
 
-func runRemoteUpgrade(host, sshKeyPath string, yes, configOnly bool) {
-	common.Header("Juniper Bible - Remote Upgrade")
-	common.Info(fmt.Sprintf("Target: %s", host))
-
-	sshArgs := buildSSHArgs(sshKeyPath)
-	testSSHConnection(sshArgs, host)
-
-	upgradeScript := fmt.Sprintf(`
-set -euo pipefail
-
-CONFIG="/etc/nixos/configuration.nix"
-CONFIG_URL="%s"
-BACKUP="$CONFIG.pre-upgrade"
-
-echo "==> Backing up current configuration..."
-cp "$CONFIG" "$BACKUP"
-
-echo "==> Extracting SSH keys..."
-DEPLOY_KEYS=$(grep -A20 'users.users.deploy.openssh.authorizedKeys.keys' "$CONFIG" | grep -oP '^\s*"(ssh-ed25519|ssh-rsa|ecdsa-sha2-nistp[0-9]+)\s+[A-Za-z0-9+/]+=*(\s+[^"]*)?(?=")' | head -20 || true)
-ROOT_KEYS=$(grep -A20 'users.users.root.openssh.authorizedKeys.keys' "$CONFIG" | grep -oP '^\s*"(ssh-ed25519|ssh-rsa|ecdsa-sha2-nistp[0-9]+)\s+[A-Za-z0-9+/]+=*(\s+[^"]*)?(?=")' | head -20 || true)
-
-echo "==> Downloading latest configuration..."
-curl -fsSL "$CONFIG_URL" -o "$CONFIG.new"
-
-echo "==> Injecting SSH keys..."
-if [ -n "$DEPLOY_KEYS" ]; then
-  sed -i '/users.users.deploy.openssh.authorizedKeys.keys = \[/,/\];/{
-    /# "ssh-ed25519 AAAA... your-key-here"/d
-  }' "$CONFIG.new"
-  while IFS= read -r key; do
-    [ -z "$key" ] && continue
-    key_line=$(echo "$key" | sed 's/^\s*/    /')'"'
-    sed -i "/users.users.deploy.openssh.authorizedKeys.keys = \[/a\\$key_line" "$CONFIG.new"
-  done <<< "$DEPLOY_KEYS"
-fi
+// preservedUsers are the accounts whose SSH keys carry over to the new configuration
+var preservedUsers = []string{"deploy", "root"}
 
-if [ -n "$ROOT_KEYS" ]; then
-  sed -i '/users.users.root.openssh.authorizedKeys.keys = \[/,/\];/{
-    /# "ssh-ed25519 AAAA... your-key-here"/d
-  }' "$CONFIG.new"
-  while IFS= read -r key; do
-    [ -z "$key" ] && continue
-    key_line=$(echo "$key" | sed 's/^\s*/    /')'"'
-    sed -i "/users.users.root.openssh.authorizedKeys.keys = \[/a\\$key_line" "$CONFIG.new"
-  done <<< "$ROOT_KEYS"
-fi
-
-echo "==> Showing diff..."
-diff -u "$BACKUP" "$CONFIG.new" || true
-
-echo ""
-echo "==> Applying new configuration..."
-mv "$CONFIG.new" "$CONFIG"
-
-%s
-
-echo ""
-echo "==> Upgrade complete!"
-`, configURL, getRebuildScript(configOnly))
-
-	confirmRemoteUpgrade(yes, configOnly)
-
-	fmt.Println()
-	common.Info("Running upgrade on remote host...")
-	fmt.Println()
-
-	sshCmd := exec.Command("ssh", append(sshArgs, host, "bash", "-c", upgradeScript)...)
-	sshCmd.Stdout = os.Stdout
-	sshCmd.Stderr = os.Stderr
-	if err := sshCmd.Run(); err != nil {
-		common.Error(fmt.Sprintf("Remote upgrade failed: %v", err))
-		os.Exit(1)
-	}
-
-	fmt.Println()
-	common.Success("Remote upgrade complete!")
-}
-
-// isSSHKeyLine checks if a line contains an SSH key
-func isSSHKeyLine(line string) bool {
-	line = strings.TrimSpace(line)
-	return strings.HasPrefix(line, "\"ssh-") || strings.HasPrefix(line, "\"ecdsa-")
-}
-
-// extractKeyFromLine extracts the SSH key from a quoted line
-func extractKeyFromLine(line string) string {
-	return strings.Trim(strings.TrimSpace(line), "\"")
-}
-
-// containsKey checks if a key already exists in the slice
-func containsKey(keys []string, key string) bool {
-	for _, k := range keys {
-		if k == key {
-			return true
+// extractSSHKeys returns each preserved user's keys from configuration.nix
+// content, omitting users without a key list
+func extractSSHKeys(content string) map[string][]string {
+	keys := make(map[string][]string)
+	for _, user := range preservedUsers {
+		if userKeys, err := common.UserSSHKeys(content, user); err == nil && len(userKeys) > 0 {
+			keys[user] = userKeys
 		}
 	}
-	return false
-}
-
-// processSSHKeyLine processes a single line and adds key to slice if valid
-func processSSHKeyLine(line string, keys *[]string) {
-	if !isSSHKeyLine(line) {
-		return
-	}
-	key := extractKeyFromLine(line)
-	if key != "" && !containsKey(*keys, key) {
-		*keys = append(*keys, key)
-	}
-}
-
-// parseLine determines if we enter/exit keys section and processes key lines
-func parseLine(line string, inKeysSection bool, keys *[]string) bool {
-	if strings.Contains(line, "authorizedKeys.keys = [") {
-		return true
-	}
-	if strings.Contains(line, "];") {
-		return false
-	}
-	if inKeysSection {
-		processSSHKeyLine(line, keys)
-	}
-	return inKeysSection
-}
-
-func extractSSHKeys(configPath string) []string {
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		return nil
-	}
-
-	var keys []string
-	inKeysSection := false
-	for _, line := range strings.Split(string(data), "\n") {
-		inKeysSection = parseLine(line, inKeysSection, &keys)
-	}
 	return keys
 }
 
-func injectSSHKeys(configPath string, keys []string) error {
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		return err
+// countSSHKeys returns the number of keys across all users
+func countSSHKeys(keys map[string][]string) int {
+	n := 0
+	for _, userKeys := range keys {
+		n += len(userKeys)
 	}
+	return n
+}
 
-	content := string(data)
-
-	// Build the keys string
-	var keysStr strings.Builder
-	for _, key := range keys {
-		// Escape for Nix
-		escapedKey := strings.ReplaceAll(key, `\`, `\\`)
-		escapedKey = strings.ReplaceAll(escapedKey, `"`, `\"`)
-		escapedKey = strings.ReplaceAll(escapedKey, `$`, `\$`)
-		keysStr.WriteString(fmt.Sprintf("    \"%s\"\n", escapedKey))
+// injectSSHKeys replaces each user's key list in configuration.nix content.
+// A user with keys but no list in content is an error, since upgrading would
+// lock them out.
+func injectSSHKeys(content string, keys map[string][]string) (string, error) {
+	for _, user := range preservedUsers {
+		if len(keys[user]) == 0 {
+			continue
+		}
+		var err error
+		if content, err = common.SetUserSSHKeys(content, user, keys[user]); err != nil {
+			return "", err
+		}
 	}
-
-	// Replace placeholder in deploy user keys
-	content = strings.Replace(content,
-		"users.users.deploy.openssh.authorizedKeys.keys = [\n    # \"ssh-ed25519 AAAA... your-key-here\"\n  ];",
-		fmt.Sprintf("users.users.deploy.openssh.authorizedKeys.keys = [\n%s  ];", keysStr.String()),
-		1)
-
-	// Replace placeholder in root user keys
-	content = strings.Replace(content,
-		"users.users.root.openssh.authorizedKeys.keys = [\n    # \"ssh-ed25519 AAAA... your-key-here\"\n  ];",
-		fmt.Sprintf("users.users.root.openssh.authorizedKeys.keys = [\n%s  ];", keysStr.String()),
-		1)
-
-	return os.WriteFile(configPath, []byte(content), 0600)
+	return content, nil
 }
@@ -0,0 +1,173 @@
+package wizard
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// defaultAPIProxyPath is the path prefix proxied to the API backend
+const defaultAPIProxyPath = "/api/"
+
+// maxProxyHeaders bounds how many upstream headers the wizard collects
+const maxProxyHeaders = 20
+
+// apiProxyConfig describes an optional backend API served under the site
+type apiProxyConfig struct {
+	url     string            // Upstream, e.g. http://127.0.0.1:9000; empty disables the proxy
+	path    string            // Path prefix proxied, ending in a slash
+	headers map[string]string // Extra headers sent to the upstream
+}
+
+// headerNameRe matches an HTTP header field name
+var headerNameRe = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+.^_|~-]+$`)
+
+// apiProxyPathRe matches a path prefix safe to place in a Caddyfile matcher
+var apiProxyPathRe = regexp.MustCompile(`^/[A-Za-z0-9._~/-]*$`)
+
+// validateAPIProxyURL checks raw is an http or https upstream Caddy can
+// proxy to. Caddy upstreams cannot carry a path, so only a bare "/" is allowed.
+func validateAPIProxyURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("missing host")
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("only scheme, host and port are allowed")
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// normalizeAPIProxyPath checks p is an absolute path prefix and adds the
+// trailing slash, so /api does not also match /apiary
+func normalizeAPIProxyPath(p string) (string, error) {
+	if !apiProxyPathRe.MatchString(p) {
+		return "", fmt.Errorf("must start with / and contain only letters, digits and ._~-/")
+	}
+	if !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return p, nil
+}
+
+// parseProxyHeader splits "Name: value" into a header name and value
+func parseProxyHeader(line string) (string, string, error) {
+	name, value, ok := strings.Cut(line, ":")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !ok || !headerNameRe.MatchString(name) {
+		return "", "", fmt.Errorf("expected Name: value")
+	}
+	if value == "" || strings.ContainsAny(value, "\"\\\r\n") {
+		return "", "", fmt.Errorf("value must be non-empty and contain no quotes or backslashes")
+	}
+	return name, value, nil
+}
+
+// promptAPIURL asks for the upstream until it is valid or left empty
+func promptAPIURL() string {
+	for {
+		raw := common.Prompt("API backend URL (or Enter to skip)", "")
+		if raw == "" {
+			return ""
+		}
+		upstream, err := validateAPIProxyURL(raw)
+		if err == nil {
+			return upstream
+		}
+		common.Error(fmt.Sprintf("Invalid URL: %v", err))
+	}
+}
+
+// promptAPIPath asks for the proxied path prefix until it is valid
+func promptAPIPath() string {
+	for {
+		p, err := normalizeAPIProxyPath(common.Prompt("Path to proxy", defaultAPIProxyPath))
+		if err == nil {
+			return p
+		}
+		common.Error(fmt.Sprintf("Invalid path: %v", err))
+	}
+}
+
+// promptProxyHeaders collects extra upstream headers, one per line
+func promptProxyHeaders() map[string]string {
+	headers := make(map[string]string)
+	for len(headers) < maxProxyHeaders {
+		line := common.Prompt("Upstream header as Name: value (or Enter to finish)", "")
+		if line == "" {
+			break
+		}
+		name, value, err := parseProxyHeader(line)
+		if err != nil {
+			common.Error(fmt.Sprintf("Invalid header: %v", err))
+			continue
+		}
+		headers[name] = value
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	return headers
+}
+
+// promptAPIProxy asks whether part of the site is served by a backend API
+func promptAPIProxy() apiProxyConfig {
+	fmt.Println()
+	fmt.Println("If part of the site is served by a backend API, Caddy can proxy a path")
+	fmt.Println("prefix such as /api/ to it. Leave the URL empty to serve static files only.")
+	fmt.Println()
+	upstream := promptAPIURL()
+	if upstream == "" {
+		return apiProxyConfig{}
+	}
+	return apiProxyConfig{url: upstream, path: promptAPIPath(), headers: promptProxyHeaders()}
+}
+
+// apiProxyName returns a display string for the API proxy
+func apiProxyName(p apiProxyConfig) string {
+	if p.url == "" {
+		return "None"
+	}
+	return p.path + " -> " + p.url
+}
+
+// renderAPIProxy renders the handle block proxying the API path, or nothing
+// when no upstream is configured
+func renderAPIProxy(p apiProxyConfig) string {
+	if p.url == "" {
+		return ""
+	}
+	path := p.path
+	if path == "" {
+		path = defaultAPIProxyPath
+	}
+	var b strings.Builder
+	b.WriteString("\n  # Backend API\n")
+	fmt.Fprintf(&b, "  handle %s* {\n", path)
+	if len(p.headers) == 0 {
+		fmt.Fprintf(&b, "    reverse_proxy %s\n", p.url)
+	} else {
+		fmt.Fprintf(&b, "    reverse_proxy %s {\n", p.url)
+		names := make([]string, 0, len(p.headers))
+		for name := range p.headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&b, "      header_up %s \"%s\"\n", name, p.headers[name])
+		}
+		b.WriteString("    }\n")
+	}
+	b.WriteString("  }\n")
+	return b.String()
+}
@@ -0,0 +1,271 @@
+package wizard
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// Markers around the auto-deploy units patched into configuration.nix
+const (
+	autoDeployBegin  = "  # BEGIN juniper auto-deploy (managed by juniper-host wizard)"
+	autoDeployEnd    = "  # END juniper auto-deploy"
+	autoDeployJitter = "30m"
+)
+
+// autoDeployPreset is a named OnCalendar schedule offered by the wizard
+type autoDeployPreset struct {
+	name     string
+	calendar string
+}
+
+var autoDeployPresets = []autoDeployPreset{
+	{"Nightly (03:00)", "*-*-* 03:00:00"},
+	{"Every 6 hours", "*-*-* 00/6:00:00"},
+	{"Hourly", "hourly"},
+	{"Weekly (Sunday 03:00)", "Sun *-*-* 03:00:00"},
+}
+
+var emailRe = regexp.MustCompile(`^[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}$`)
+
+// autoDeployConfig holds the scheduled deploy settings; a zero value disables it
+type autoDeployConfig struct {
+	calendar string
+	email    string
+}
+
+// currentAutoDeploySchedule returns the OnCalendar value currently in configuration.nix
+func currentAutoDeploySchedule() string {
+	data, err := os.ReadFile(nixosConfig)
+	if err != nil {
+		return ""
+	}
+	content := string(data)
+	start := strings.Index(content, autoDeployBegin)
+	end := strings.Index(content, autoDeployEnd)
+	if start < 0 || end < start {
+		return ""
+	}
+	m := regexp.MustCompile(`OnCalendar = "([^"]*)";`).FindStringSubmatch(content[start:end])
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// isValidCalendar checks an OnCalendar expression with systemd-analyze
+func isValidCalendar(expr string) bool {
+	if expr == "" || strings.ContainsAny(expr, "\"\\$\n") {
+		return false
+	}
+	_, err := common.RunOutput("systemd-analyze", "calendar", expr)
+	return err == nil
+}
+
+// promptCalendar asks for a custom OnCalendar expression
+func promptCalendar() string {
+	const maxRetries = 3
+	for attempts := 0; attempts < maxRetries; attempts++ {
+		expr := common.Prompt("OnCalendar expression (see man systemd.time)", "")
+		if isValidCalendar(expr) {
+			return expr
+		}
+		common.Error("Invalid OnCalendar expression.")
+	}
+	common.Warning("Too many invalid attempts. Auto-deploy left disabled.")
+	return ""
+}
+
+// promptFailureEmail asks whether failures should be emailed, returning the address
+func promptFailureEmail() string {
+	if !common.Confirm("Email failure reports?", false) {
+		return ""
+	}
+	common.Info("Requires a working sendmail (e.g. programs.msmtp) on this server")
+	for attempts := 0; attempts < 3; attempts++ {
+		email := common.Prompt("Send failure reports to", "")
+		if emailRe.MatchString(email) {
+			return email
+		}
+		common.Error("Invalid email address.")
+	}
+	common.Warning("No valid address given. Failures will only be logged to the journal.")
+	return ""
+}
+
+// promptAutoDeploy collects the auto-deploy schedule and failure handling
+func promptAutoDeploy() autoDeployConfig {
+	fmt.Println("Optionally refresh the site from the latest release on a schedule.")
+	fmt.Printf("Runs /etc/deploy-juniper.sh with up to %s random delay; output goes to the journal.\n\n", autoDeployJitter)
+	if current := currentAutoDeploySchedule(); current != "" {
+		fmt.Printf("Current schedule: %s%s%s\n\n", common.Cyan, current, common.Reset)
+	}
+
+	fmt.Println("  0) Disabled")
+	for i, p := range autoDeployPresets {
+		fmt.Printf("  %d) %s\n", i+1, p.name)
+	}
+	fmt.Printf("  %d) Custom OnCalendar expression\n\n", len(autoDeployPresets)+1)
+
+	var cfg autoDeployConfig
+	choice := common.Prompt("Select schedule", "0")
+	switch {
+	case choice == "0":
+		return cfg
+	case choice == fmt.Sprint(len(autoDeployPresets)+1):
+		cfg.calendar = promptCalendar()
+	default:
+		for i, p := range autoDeployPresets {
+			if choice == fmt.Sprint(i+1) {
+				cfg.calendar = p.calendar
+			}
+		}
+		if cfg.calendar == "" {
+			common.Warning("Invalid selection. Auto-deploy left disabled.")
+			return cfg
+		}
+	}
+	if cfg.calendar == "" {
+		return cfg
+	}
+	cfg.email = promptFailureEmail()
+	return cfg
+}
+
+// buildAutoDeployNix renders the systemd service and timer for configuration.nix
+func buildAutoDeployNix(cfg autoDeployConfig) string {
+	var b strings.Builder
+	b.WriteString(autoDeployBegin + "\n")
+	b.WriteString(`  systemd.services.juniper-auto-deploy = {
+    description = "Deploy latest Juniper Bible release";
+    after = [ "network-online.target" ];
+    wants = [ "network-online.target" ];
+    path = with pkgs; [ bash coreutils curl gnutar xz ];
+    serviceConfig = {
+      Type = "oneshot";
+      ExecStart = "/etc/deploy-juniper.sh";
+      StandardOutput = "journal";
+      StandardError = "journal";
+    };
+`)
+	if cfg.email != "" {
+		b.WriteString(`    onFailure = [ "juniper-auto-deploy-notify.service" ];
+`)
+	}
+	b.WriteString(fmt.Sprintf(`  };
+
+  systemd.timers.juniper-auto-deploy = {
+    wantedBy = [ "timers.target" ];
+    timerConfig = {
+      OnCalendar = "%s";
+      RandomizedDelaySec = "%s";
+      Persistent = true;
+    };
+  };
+`, common.EscapeNixString(cfg.calendar), autoDeployJitter))
+	if cfg.email != "" {
+		b.WriteString(fmt.Sprintf(`
+  systemd.services.juniper-auto-deploy-notify = {
+    description = "Email Juniper Bible auto-deploy failures";
+    path = [ "/run/wrappers" pkgs.systemd ];
+    serviceConfig.Type = "oneshot";
+    script = ''
+      if ! command -v sendmail >/dev/null; then
+        echo "sendmail not available; cannot email failure report to %[1]s"
+        exit 0
+      fi
+      {
+        echo "To: %[1]s"
+        echo "Subject: [${config.networking.hostName}] Juniper Bible auto-deploy failed"
+        echo
+        journalctl -u juniper-auto-deploy.service -n 50 --no-pager
+      } | sendmail -t
+    '';
+  };
+`, cfg.email))
+	}
+	b.WriteString(autoDeployEnd + "\n")
+	return b.String()
+}
+
+// updateAutoDeploy replaces, inserts, or removes the auto-deploy block in config content
+func updateAutoDeploy(content string, cfg autoDeployConfig) (string, error) {
+	block := ""
+	if cfg.calendar != "" {
+		block = buildAutoDeployNix(cfg)
+	}
+	return replaceManagedBlock(content, autoDeployBegin, autoDeployEnd, block)
+}
+
+// replaceManagedBlock removes the begin/end-marked block from a NixOS
+// configuration and, if block is non-empty, appends it before the final
+// closing brace
+func replaceManagedBlock(content, begin, end, block string) (string, error) {
+	if start := strings.Index(content, begin); start >= 0 {
+		stop := strings.Index(content, end)
+		if stop < start {
+			return "", fmt.Errorf("unterminated %q block in configuration", strings.TrimSpace(begin))
+		}
+		stop += len(end)
+		if stop < len(content) && content[stop] == '\n' {
+			stop++
+		}
+		// Drop the blank line inserted ahead of the block
+		if strings.HasSuffix(content[:start], "\n\n") {
+			start--
+		}
+		content = content[:start] + content[stop:]
+	}
+	if block == "" {
+		return content, nil
+	}
+
+	closing := strings.LastIndex(content, "\n}")
+	if closing < 0 {
+		return "", fmt.Errorf("failed to find end of configuration")
+	}
+	return content[:closing+1] + "\n" + block + content[closing+1:], nil
+}
+
+// updateAutoDeployConfig patches the auto-deploy units into configuration.nix
+func updateAutoDeployConfig(cfg autoDeployConfig) error {
+	data, err := os.ReadFile(nixosConfig)
+	if err != nil {
+		return err
+	}
+	content, err := updateAutoDeploy(string(data), cfg)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(nixosConfig, []byte(content), 0600)
+}
+
+// applyAutoDeploy writes the auto-deploy configuration, exiting on failure
+func applyAutoDeploy(cfg autoDeployConfig) {
+	if err := updateAutoDeployConfig(cfg); err != nil {
+		common.Error(fmt.Sprintf("Failed to update auto-deploy configuration: %v", err))
+		os.Exit(1)
+	}
+	if cfg.calendar == "" {
+		common.Success("Auto-deploy disabled")
+		return
+	}
+	common.Success("Auto-deploy scheduled: " + cfg.calendar)
+}
+
+// runAutoDeploy reconfigures only the auto-deploy schedule on a set-up server
+func runAutoDeploy() {
+	if !common.IsRoot() {
+		common.Error("Must be run as root")
+		os.Exit(1)
+	}
+	fmt.Printf("%sAuto-Deploy Schedule%s\n\n", common.Bold, common.Reset)
+	cfg := promptAutoDeploy()
+
+	backupConfig()
+	applyAutoDeploy(cfg)
+	rebuildNixOS()
+}
@@ -0,0 +1,136 @@
+package wizard
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+const (
+	// backupPrefix is prepended to a timestamp to form each backup filename
+	backupPrefix = nixosConfig + ".backup-"
+	// maxBackups is the number of configuration backups kept after rotation
+	maxBackups = 5
+	// backupTimeFormat is the timestamp layout used in backup filenames
+	backupTimeFormat = "20060102-150405"
+)
+
+// listBackups returns all configuration backups, newest first
+func listBackups() []string {
+	matches, err := filepath.Glob(backupPrefix + "*")
+	if err != nil {
+		return nil
+	}
+	// Timestamps sort lexically, so reverse order is newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(matches)))
+	return matches
+}
+
+// latestBackup returns the most recent configuration backup, or "" if none exist
+func latestBackup() string {
+	backups := listBackups()
+	if len(backups) == 0 {
+		return ""
+	}
+	return backups[0]
+}
+
+// pruneBackups removes all but the newest keep backups
+func pruneBackups(keep int) {
+	backups := listBackups()
+	if len(backups) <= keep {
+		return
+	}
+	for _, old := range backups[keep:] {
+		if err := os.Remove(old); err != nil {
+			common.Warning(fmt.Sprintf("Failed to remove old backup %s: %v", old, err))
+		}
+	}
+}
+
+// createBackup writes a timestamped copy of the NixOS configuration and rotates old ones
+func createBackup() (string, error) {
+	path := backupPrefix + time.Now().Format(backupTimeFormat)
+	if err := copyFile(nixosConfig, path); err != nil {
+		return "", err
+	}
+	pruneBackups(maxBackups)
+	return path, nil
+}
+
+// backupLabel returns a human-readable label for a backup path
+func backupLabel(path string) string {
+	stamp := strings.TrimPrefix(path, backupPrefix)
+	t, err := time.ParseInLocation(backupTimeFormat, stamp, time.Local)
+	if err != nil {
+		return filepath.Base(path)
+	}
+	return fmt.Sprintf("%s  (%s)", filepath.Base(path), t.Format("2006-01-02 15:04:05"))
+}
+
+// chooseBackup lists backups and prompts for one to restore
+func chooseBackup(backups []string) string {
+	fmt.Println("Available configuration backups (newest first):")
+	fmt.Println()
+	for i, b := range backups {
+		fmt.Printf("  %d) %s\n", i+1, backupLabel(b))
+	}
+	fmt.Println()
+
+	choice := common.Prompt("Backup to restore", "1")
+	n, err := strconv.Atoi(choice)
+	if err != nil || n < 1 || n > len(backups) {
+		common.Error(fmt.Sprintf("Invalid selection: %s", choice))
+		os.Exit(1)
+	}
+	return backups[n-1]
+}
+
+// runRestoreConfig restores a chosen configuration backup after validating it
+func runRestoreConfig() {
+	common.Header("Juniper Bible - Restore Configuration")
+
+	backups := listBackups()
+	if len(backups) == 0 {
+		common.Error("No configuration backups found")
+		os.Exit(1)
+	}
+	chosen := chooseBackup(backups)
+
+	current, err := os.ReadFile(nixosConfig)
+	if err != nil {
+		common.Error(fmt.Sprintf("Failed to read current configuration: %v", err))
+		os.Exit(1)
+	}
+
+	if err := copyFile(chosen, nixosConfig); err != nil {
+		common.Error(fmt.Sprintf("Failed to restore %s: %v", chosen, err))
+		os.Exit(1)
+	}
+
+	common.Info("Validating restored configuration (nixos-rebuild dry-build)...")
+	if err := common.RunLogged(rebuildLog, "nixos-rebuild", "dry-build"); err != nil {
+		common.Error("Restored configuration failed validation. Keeping current configuration.")
+		if writeErr := os.WriteFile(nixosConfig, current, 0600); writeErr != nil {
+			common.Error(fmt.Sprintf("Failed to put back current configuration: %v", writeErr))
+		}
+		os.Exit(1)
+	}
+	common.Success("Restored configuration is valid")
+
+	if !common.Confirm("Apply restored configuration now (nixos-rebuild switch)?", true) {
+		fmt.Println("Configuration file restored. Run 'nixos-rebuild switch' to apply it.")
+		return
+	}
+	if err := common.RunLogged(rebuildLog, "nixos-rebuild", "switch"); err != nil {
+		common.Error(fmt.Sprintf("NixOS rebuild failed: %v", err))
+		os.Exit(1)
+	}
+	common.Success("Configuration restored from " + filepath.Base(chosen))
+}
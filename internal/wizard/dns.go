@@ -0,0 +1,222 @@
+package wizard
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// dnsEnvFile holds DNS provider credentials; the caddy service loads it as an
+// EnvironmentFile so secrets stay out of the Caddyfile
+const dnsEnvFile = "/var/lib/caddy/dns.env"
+
+// dnsCredential is a single secret a DNS provider needs
+type dnsCredential struct {
+	env    string // Environment variable name written to dnsEnvFile
+	prompt string // Prompt shown to the user
+	secret bool   // Read without echo
+}
+
+// credentialPatterns validates credentials whose format is known, keyed by
+// environment variable
+var credentialPatterns = map[string]*regexp.Regexp{
+	"AWS_ACCESS_KEY_ID": regexp.MustCompile(`^AKIA[A-Z0-9]{16}$`),
+}
+
+// dnsProvider describes a Caddy DNS-01 provider module
+type dnsProvider struct {
+	key         string          // Caddy module name (dns.providers.<key>)
+	name        string          // Display name
+	plugin      string          // Go module path of the caddy-dns plugin
+	credentials []dnsCredential // Secrets to collect
+	stanza      string          // Body of the "dns" directive, referencing {env.*}
+}
+
+// dnsProviders lists the providers offered by the wizard, in menu order
+var dnsProviders = []dnsProvider{
+	{
+		key:         "cloudflare",
+		name:        "Cloudflare",
+		plugin:      "github.com/caddy-dns/cloudflare",
+		credentials: []dnsCredential{{"CF_API_TOKEN", "Cloudflare API token (Zone:DNS:Edit)", true}},
+		stanza:      "dns cloudflare {env.CF_API_TOKEN}",
+	},
+	{
+		key:         "hetzner",
+		name:        "Hetzner DNS",
+		plugin:      "github.com/caddy-dns/hetzner",
+		credentials: []dnsCredential{{"HETZNER_API_TOKEN", "Hetzner DNS API token", true}},
+		stanza:      "dns hetzner {env.HETZNER_API_TOKEN}",
+	},
+	{
+		key:         "desec",
+		name:        "deSEC",
+		plugin:      "github.com/caddy-dns/desec",
+		credentials: []dnsCredential{{"DESEC_TOKEN", "deSEC API token", true}},
+		stanza:      "dns desec {\n      token {env.DESEC_TOKEN}\n    }",
+	},
+	{
+		key:    "route53",
+		name:   "AWS Route53",
+		plugin: "github.com/caddy-dns/route53",
+		credentials: []dnsCredential{
+			{"AWS_ACCESS_KEY_ID", "AWS access key ID", false},
+			{"AWS_SECRET_ACCESS_KEY", "AWS secret access key", true},
+			{"AWS_REGION", "AWS region (e.g., us-east-1)", false},
+		},
+		stanza: "dns route53 {\n      access_key_id {env.AWS_ACCESS_KEY_ID}\n      secret_access_key {env.AWS_SECRET_ACCESS_KEY}\n      region {env.AWS_REGION}\n    }",
+	},
+}
+
+// dnsConfig holds the chosen DNS provider and collected credentials
+type dnsConfig struct {
+	provider dnsProvider
+	values   map[string]string // Environment variable -> secret value
+}
+
+// printDNSProviders displays the DNS provider menu
+func printDNSProviders() {
+	fmt.Println()
+	fmt.Println("Which DNS provider hosts your domain?")
+	fmt.Println()
+	for i, p := range dnsProviders {
+		fmt.Printf("  %d) %s\n", i+1, p.name)
+	}
+	fmt.Printf("  %d) Other / manual\n", len(dnsProviders)+1)
+	fmt.Println()
+}
+
+// promptManualProvider asks for an arbitrary Caddy DNS provider module
+func promptManualProvider() (dnsProvider, bool) {
+	key := common.Prompt("Caddy DNS provider module name (e.g., digitalocean)", "")
+	if key == "" || !common.IsValidHostname(key) {
+		common.Warning("Invalid provider name.")
+		return dnsProvider{}, false
+	}
+	return manualDNSProvider(key), true
+}
+
+// manualDNSProvider describes a provider not in dnsProviders
+func manualDNSProvider(key string) dnsProvider {
+	return dnsProvider{
+		key:         key,
+		name:        key,
+		plugin:      "github.com/caddy-dns/" + key,
+		credentials: []dnsCredential{{"DNS_API_TOKEN", "API token for " + key, true}},
+		stanza:      fmt.Sprintf("dns %s {env.DNS_API_TOKEN}", key),
+	}
+}
+
+// findDNSProvider returns the provider for a module key, falling back to manual
+func findDNSProvider(key string) dnsProvider {
+	for _, p := range dnsProviders {
+		if p.key == key {
+			return p
+		}
+	}
+	return manualDNSProvider(key)
+}
+
+// selectDNSProvider prompts for a provider from the menu
+func selectDNSProvider() (dnsProvider, bool) {
+	printDNSProviders()
+	choice := common.Prompt("DNS provider", "1")
+	n, err := strconv.Atoi(choice)
+	if err != nil || n < 1 || n > len(dnsProviders)+1 {
+		common.Warning(fmt.Sprintf("Invalid selection: %s", choice))
+		return dnsProvider{}, false
+	}
+	if n == len(dnsProviders)+1 {
+		return promptManualProvider()
+	}
+	return dnsProviders[n-1], true
+}
+
+// collectDNSCredentials prompts for each credential the provider needs
+func collectDNSCredentials(p dnsProvider) (map[string]string, bool) {
+	values := make(map[string]string)
+	for _, c := range p.credentials {
+		var v string
+		if c.secret {
+			v = common.PromptSecret(c.prompt)
+		} else {
+			v = common.Prompt(c.prompt, "")
+		}
+		if v == "" || strings.ContainsAny(v, "\n\r") {
+			return nil, false
+		}
+		if re, ok := credentialPatterns[c.env]; ok && !re.MatchString(v) {
+			common.Warning(fmt.Sprintf("%s does not look valid (expected %s).", c.prompt, re.String()))
+			return nil, false
+		}
+		values[c.env] = v
+	}
+	return values, true
+}
+
+// promptDNSProvider selects a DNS provider and collects its credentials
+func promptDNSProvider() (dnsConfig, bool) {
+	provider, ok := selectDNSProvider()
+	if !ok {
+		return dnsConfig{}, false
+	}
+	values, ok := collectDNSCredentials(provider)
+	if !ok {
+		common.Warning("Credentials required for DNS-01.")
+		return dnsConfig{}, false
+	}
+	warnMissingDNSPlugin(provider)
+	return dnsConfig{provider: provider, values: values}, true
+}
+
+// caddyHasModule reports whether the installed caddy binary includes a module
+func caddyHasModule(module string) bool {
+	out, err := exec.Command("caddy", "list-modules").Output()
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) == module {
+			return true
+		}
+	}
+	return false
+}
+
+// warnMissingDNSPlugin warns when the installed Caddy lacks the provider plugin
+func warnMissingDNSPlugin(p dnsProvider) {
+	if caddyHasModule("dns.providers." + p.key) {
+		return
+	}
+	fmt.Println()
+	common.Warning(fmt.Sprintf("The installed Caddy does not appear to include the %s DNS plugin.", p.name))
+	fmt.Println("  Add it in /etc/nixos/configuration.nix, for example:")
+	fmt.Println()
+	fmt.Println("    services.caddy.package = pkgs.caddy.withPlugins {")
+	fmt.Printf("      plugins = [ \"%s@<version>\" ];\n", p.plugin)
+	fmt.Println("      hash = \"<hash reported by the first failed build>\";")
+	fmt.Println("    };")
+	fmt.Println()
+}
+
+// escapeEnvValue quotes a value for a systemd EnvironmentFile
+func escapeEnvValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	return `"` + v + `"`
+}
+
+// writeDNSEnvFile writes provider credentials to the caddy environment file
+func writeDNSEnvFile(dns dnsConfig) error {
+	var b strings.Builder
+	b.WriteString("# DNS-01 credentials for Caddy (" + dns.provider.name + ") - written by juniper-host wizard\n")
+	for _, c := range dns.provider.credentials {
+		b.WriteString(fmt.Sprintf("%s=%s\n", c.env, escapeEnvValue(dns.values[c.env])))
+	}
+	return os.WriteFile(dnsEnvFile, []byte(b.String()), 0600)
+}
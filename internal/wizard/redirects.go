@@ -0,0 +1,401 @@
+package wizard
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+const (
+	redirectsFile = "/etc/juniper/redirects.toml"
+
+	// Markers around the rendered redirects so they can be replaced in place
+	redirectsBegin = "  # BEGIN redirects (managed by juniper-host redirects)"
+	redirectsEnd   = "  # END redirects"
+)
+
+// defaultRedirectsTOML seeds redirectsFile the first time it is needed
+const defaultRedirectsTOML = `# Custom redirects rendered into the Caddyfile site_config snippet.
+# Manage with: juniper-host redirects add|remove|import|list
+
+[[redirects]]
+from = "/religion/*"
+to = "/bible/drc/isa/42/"
+status = 301
+
+[[redirects]]
+from = "/licenses/*"
+to = "/license/"
+status = 301
+`
+
+// splat in a target is replaced with whatever the trailing * of the source matched
+const splat = ":splat"
+
+// Redirect is a single path redirect, or a rewrite with status 200
+type Redirect struct {
+	From       string `toml:"from"`
+	To         string `toml:"to"`
+	Status     int    `toml:"status"`
+	UnlessFile bool   `toml:"unlessFile,omitempty"` // Skip when a file exists at the path (Netlify rules without !)
+}
+
+// redirectsConfig is the redirects.toml file layout
+type redirectsConfig struct {
+	Redirects []Redirect `toml:"redirects"`
+}
+
+// validRedirectStatus lists the HTTP status codes accepted for redirects;
+// 200 rewrites to the target instead of redirecting
+var validRedirectStatus = map[int]bool{200: true, 301: true, 302: true, 307: true, 308: true}
+
+// unsafeTargetChars may not appear in a target: whitespace and braces would
+// break out of the Caddyfile directive, the rest are shell metacharacters
+const unsafeTargetChars = " \t\r\n{}\"'`$;|<>\\"
+
+// namedPlaceholderRe matches Netlify placeholders other than :splat, e.g. /:year
+var namedPlaceholderRe = regexp.MustCompile(`/:[A-Za-z]`)
+
+// validateRedirect checks a redirect is safe to render into a Caddyfile
+func validateRedirect(r Redirect) error {
+	if !strings.HasPrefix(r.From, "/") || strings.ContainsAny(r.From, " \t\r\n{}") {
+		return fmt.Errorf("invalid source path %q (must start with / and contain no spaces or braces)", r.From)
+	}
+	if namedPlaceholderRe.MatchString(r.From) {
+		return fmt.Errorf("invalid source path %q (named placeholders are not supported; use a trailing * and :splat)", r.From)
+	}
+	if r.To == "" || strings.ContainsAny(r.To, unsafeTargetChars) {
+		return fmt.Errorf("invalid target %q (must not be empty or contain spaces, braces, quotes or shell metacharacters)", r.To)
+	}
+	rest := strings.ReplaceAll(r.To, splat, "")
+	if i := strings.Index(rest, "://"); i >= 0 {
+		rest = rest[i+3:]
+	}
+	if namedPlaceholderRe.MatchString(rest) {
+		return fmt.Errorf("invalid target %q (only the :splat placeholder is supported)", r.To)
+	}
+	if strings.Contains(r.To, splat) && !strings.HasSuffix(r.From, "*") {
+		return fmt.Errorf("target %q uses :splat but source %q does not end in *", r.To, r.From)
+	}
+	if !validRedirectStatus[r.Status] {
+		return fmt.Errorf("invalid status %d (use 301, 302, 307, 308, or 200 to rewrite)", r.Status)
+	}
+	if r.Status == 200 && !strings.HasPrefix(r.To, "/") {
+		return fmt.Errorf("rewrite target %q must be a path on this site", r.To)
+	}
+	return nil
+}
+
+// loadRedirects reads redirectsFile, creating it with defaults if missing
+func loadRedirects() ([]Redirect, error) {
+	if !common.FileExists(redirectsFile) {
+		if err := os.MkdirAll(filepath.Dir(redirectsFile), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(redirectsFile, []byte(defaultRedirectsTOML), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	var cfg redirectsConfig
+	if _, err := toml.DecodeFile(redirectsFile, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", redirectsFile, err)
+	}
+	for _, r := range cfg.Redirects {
+		if err := validateRedirect(r); err != nil {
+			return nil, fmt.Errorf("%s: %w", redirectsFile, err)
+		}
+	}
+	return cfg.Redirects, nil
+}
+
+// saveRedirects writes the redirects back to redirectsFile
+func saveRedirects(redirects []Redirect) error {
+	var buf bytes.Buffer
+	buf.WriteString("# Custom redirects rendered into the Caddyfile site_config snippet.\n")
+	buf.WriteString("# Manage with: juniper-host redirects add|remove|import|list\n\n")
+	if err := toml.NewEncoder(&buf).Encode(redirectsConfig{Redirects: redirects}); err != nil {
+		return err
+	}
+	return os.WriteFile(redirectsFile, buf.Bytes(), 0644)
+}
+
+// renderRedirect renders one redirect as a named matcher and a redir, or a
+// rewrite for status 200. A :splat target matches the source with a regexp
+// and substitutes its capture.
+func renderRedirect(n int, r Redirect) string {
+	name := fmt.Sprintf("redirect%d", n)
+	matcher, target := "path "+r.From, r.To
+	if strings.Contains(r.To, splat) {
+		prefix := regexp.QuoteMeta(strings.TrimSuffix(r.From, "*"))
+		matcher = fmt.Sprintf("path_regexp %s ^%s(.*)$", name, prefix)
+		target = strings.ReplaceAll(r.To, splat, "{re."+name+".1}")
+	}
+
+	var b strings.Builder
+	if r.UnlessFile {
+		b.WriteString(fmt.Sprintf("  @%s {\n    %s\n    not file\n  }\n", name, matcher))
+	} else {
+		b.WriteString(fmt.Sprintf("  @%s %s\n", name, matcher))
+	}
+	if r.Status == 200 {
+		b.WriteString(fmt.Sprintf("  rewrite @%s %s\n", name, target))
+	} else {
+		b.WriteString(fmt.Sprintf("  redir @%s %s %d\n", name, target, r.Status))
+	}
+	return b.String()
+}
+
+// renderRedirects renders redirects as Caddyfile matcher/redir pairs between markers
+func renderRedirects(redirects []Redirect) string {
+	var b strings.Builder
+	b.WriteString(redirectsBegin + "\n")
+	for i, r := range redirects {
+		b.WriteString(renderRedirect(i+1, r))
+	}
+	b.WriteString(redirectsEnd)
+	return b.String()
+}
+
+// parseNetlifyRedirect parses one "<from> <to> [status[!]]" line of a
+// Netlify _redirects file. Without !, a rule only applies when no file
+// exists at the path, as on Netlify.
+func parseNetlifyRedirect(line string) (Redirect, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return Redirect{}, fmt.Errorf("expected <from> <to> [status]")
+	}
+	if len(fields) > 3 {
+		return Redirect{}, fmt.Errorf("query parameters and conditions are not supported")
+	}
+	r := Redirect{From: fields[0], To: fields[1], Status: 301, UnlessFile: true}
+	if strings.Contains(r.From, "://") {
+		return Redirect{}, fmt.Errorf("domain-level source %q is not supported", r.From)
+	}
+	if len(fields) == 3 {
+		code := fields[2]
+		if strings.HasSuffix(code, "!") {
+			code, r.UnlessFile = strings.TrimSuffix(code, "!"), false
+		}
+		status, err := strconv.Atoi(code)
+		if err != nil {
+			return Redirect{}, fmt.Errorf("invalid status %q", fields[2])
+		}
+		r.Status = status
+	}
+	return r, validateRedirect(r)
+}
+
+// importNetlifyRedirects reads a Netlify _redirects file, skipping blank
+// lines and comments. Errors name the offending line.
+func importNetlifyRedirects(path string) ([]Redirect, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var redirects []Redirect
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseNetlifyRedirect(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		redirects = append(redirects, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return redirects, nil
+}
+
+// replaceRedirectsBlock swaps the managed redirects block in Caddyfile content
+func replaceRedirectsBlock(content string, redirects []Redirect) (string, error) {
+	start := strings.Index(content, redirectsBegin)
+	end := strings.Index(content, redirectsEnd)
+	if start < 0 || end < start {
+		return "", fmt.Errorf("managed redirects block not found in %s (re-run the wizard to regenerate it)", caddyfile)
+	}
+	return content[:start] + renderRedirects(redirects) + content[end+len(redirectsEnd):], nil
+}
+
+// applyRedirects rewrites the Caddyfile redirects, validates, and reloads Caddy.
+// The previous Caddyfile is restored if validation fails.
+func applyRedirects(redirects []Redirect) error {
+	old, err := os.ReadFile(caddyfile)
+	if err != nil {
+		return err
+	}
+	content, err := replaceRedirectsBlock(string(old), redirects)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(caddyfile, []byte(content), 0644); err != nil {
+		return err
+	}
+
+	if err := common.Run("caddy", "validate", "--config", caddyfile, "--adapter", "caddyfile"); err != nil {
+		if restoreErr := os.WriteFile(caddyfile, old, 0644); restoreErr != nil {
+			return fmt.Errorf("caddyfile invalid (%v) and restore failed: %w", err, restoreErr)
+		}
+		return fmt.Errorf("caddyfile validation failed, previous version restored: %w", err)
+	}
+	if err := common.Run("systemctl", "reload", "caddy"); err != nil {
+		return fmt.Errorf("reload caddy: %w", err)
+	}
+	return nil
+}
+
+// listRedirects prints the configured redirects
+func listRedirects(redirects []Redirect) {
+	if len(redirects) == 0 {
+		fmt.Println("No redirects configured")
+		return
+	}
+	for _, r := range redirects {
+		note := ""
+		if r.Status == 200 {
+			note = " (rewrite)"
+		}
+		if r.UnlessFile {
+			note += " (unless file exists)"
+		}
+		fmt.Printf("  %-30s -> %-30s %d%s\n", r.From, r.To, r.Status, note)
+	}
+}
+
+// addRedirect adds or replaces the redirect for args[0]
+func addRedirect(redirects []Redirect, args []string) ([]Redirect, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("usage: juniper-host redirects add <from> <to> [status]")
+	}
+	r := Redirect{From: args[0], To: args[1], Status: 301}
+	if len(args) >= 3 {
+		status, err := strconv.Atoi(args[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid status %q", args[2])
+		}
+		r.Status = status
+	}
+	if err := validateRedirect(r); err != nil {
+		return nil, err
+	}
+	for i := range redirects {
+		if redirects[i].From == r.From {
+			redirects[i] = r
+			return redirects, nil
+		}
+	}
+	return append(redirects, r), nil
+}
+
+// removeRedirect removes the redirect whose source is args[0]
+func removeRedirect(redirects []Redirect, args []string) ([]Redirect, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("usage: juniper-host redirects remove <from>")
+	}
+	for i, r := range redirects {
+		if r.From == args[0] {
+			return append(redirects[:i], redirects[i+1:]...), nil
+		}
+	}
+	return nil, fmt.Errorf("no redirect from %s", args[0])
+}
+
+// mergeRedirects adds imported redirects, replacing any with the same source
+func mergeRedirects(redirects, imported []Redirect) []Redirect {
+	for _, r := range imported {
+		replaced := false
+		for i := range redirects {
+			if redirects[i].From == r.From {
+				redirects[i], replaced = r, true
+				break
+			}
+		}
+		if !replaced {
+			redirects = append(redirects, r)
+		}
+	}
+	return redirects
+}
+
+// importRedirects merges the redirects from a Netlify _redirects file
+func importRedirects(redirects []Redirect, args []string) ([]Redirect, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("usage: juniper-host redirects import <_redirects file>")
+	}
+	imported, err := importNetlifyRedirects(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(imported) == 0 {
+		return nil, fmt.Errorf("no redirects found in %s", args[0])
+	}
+	listRedirects(imported)
+	return mergeRedirects(redirects, imported), nil
+}
+
+// editRedirects applies an add/remove edit, saves it, and updates Caddy
+func editRedirects(redirects []Redirect, sub string, args []string) error {
+	var err error
+	switch sub {
+	case "add":
+		redirects, err = addRedirect(redirects, args)
+	case "remove":
+		redirects, err = removeRedirect(redirects, args)
+	case "import":
+		redirects, err = importRedirects(redirects, args)
+	default:
+		return fmt.Errorf("unknown redirects command '%s' (use add, remove, import, or list)", sub)
+	}
+	if err != nil {
+		return err
+	}
+	if err := saveRedirects(redirects); err != nil {
+		return err
+	}
+	return applyRedirects(redirects)
+}
+
+// RunRedirects executes the redirects command
+func RunRedirects(args []string) {
+	sub := "list"
+	if len(args) > 0 {
+		sub = args[0]
+		args = args[1:]
+	}
+
+	redirects, err := loadRedirects()
+	if err != nil {
+		common.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if sub == "list" {
+		listRedirects(redirects)
+		return
+	}
+
+	if !common.IsRoot() {
+		common.Error("Must be run as root")
+		os.Exit(1)
+	}
+	if err := editRedirects(redirects, sub, args); err != nil {
+		common.Error(err.Error())
+		os.Exit(1)
+	}
+	common.Success("Redirects updated and Caddy reloaded")
+}
@@ -0,0 +1,204 @@
+package wizard
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// stateFile persists answers between wizard runs so a dropped session can resume
+const stateFile = "/var/lib/juniper/wizard-state.json"
+
+// wizardState is the on-disk form of wizardConfig.
+// DNS credentials and the tunnel token are secrets and are never saved; they
+// are re-prompted on resume.
+type wizardState struct {
+	Completed    int               `json:"completed"` // Number of steps finished
+	Hostname     string            `json:"hostname,omitempty"`
+	Domain       string            `json:"domain,omitempty"`
+	TLSMode      string            `json:"tlsMode,omitempty"`
+	DNSProvider  string            `json:"dnsProvider,omitempty"`
+	CertPath     string            `json:"certPath,omitempty"`
+	KeyPath      string            `json:"keyPath,omitempty"`
+	SSHKeys      []string          `json:"sshKeys,omitempty"`
+	Schedule     string            `json:"schedule,omitempty"`
+	NotifyEmail  string            `json:"notifyEmail,omitempty"`
+	PushAssets   bool              `json:"pushAssets,omitempty"`
+	APIProxyURL  string            `json:"apiProxyURL,omitempty"`
+	APIProxyPath string            `json:"apiProxyPath,omitempty"`
+	ProxyHeaders map[string]string `json:"proxyHeaders,omitempty"`
+	DeployNow    bool              `json:"deployNow"`
+	Preset       bool              `json:"preset,omitempty"` // Written by bootstrap rather than an interrupted run
+}
+
+// newWizardState captures cfg after the given number of completed steps
+func newWizardState(cfg wizardConfig, completed int) wizardState {
+	return wizardState{
+		Completed:    completed,
+		Hostname:     cfg.hostname,
+		Domain:       cfg.domain,
+		TLSMode:      cfg.tlsMode,
+		DNSProvider:  cfg.dns.provider.key,
+		CertPath:     cfg.certPath,
+		KeyPath:      cfg.keyPath,
+		SSHKeys:      cfg.sshKeys,
+		Schedule:     cfg.autoDeploy.calendar,
+		NotifyEmail:  cfg.autoDeploy.email,
+		PushAssets:   cfg.pushAssets,
+		APIProxyURL:  cfg.apiProxy.url,
+		APIProxyPath: cfg.apiProxy.path,
+		ProxyHeaders: cfg.apiProxy.headers,
+		DeployNow:    cfg.deployNow,
+	}
+}
+
+// config converts the saved state back into a wizardConfig without secrets
+func (s wizardState) config() wizardConfig {
+	cfg := wizardConfig{
+		hostname:   s.Hostname,
+		domain:     s.Domain,
+		tlsMode:    s.TLSMode,
+		certPath:   s.CertPath,
+		keyPath:    s.KeyPath,
+		sshKeys:    s.SSHKeys,
+		autoDeploy: autoDeployConfig{calendar: s.Schedule, email: s.NotifyEmail},
+		pushAssets: s.PushAssets,
+		apiProxy:   apiProxyConfig{url: s.APIProxyURL, path: s.APIProxyPath, headers: s.ProxyHeaders},
+		deployNow:  s.DeployNow,
+	}
+	if s.DNSProvider != "" {
+		cfg.dns.provider = findDNSProvider(s.DNSProvider)
+	}
+	return cfg
+}
+
+// SavePreset records the hostname and domain chosen during bootstrap in the
+// state file under root, so the first wizard run pre-fills them and skips
+// the steps already answered
+func SavePreset(root, hostname, domain string) error {
+	s := wizardState{Hostname: hostname, Domain: domain, Preset: true}
+	if hostname != "" {
+		s.Completed = 1
+		if domain != "" {
+			s.Completed = 2
+		}
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(root, stateFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// saveWizardState writes the state file; failures only warn since resuming is optional
+func saveWizardState(cfg wizardConfig, completed int) {
+	data, err := json.MarshalIndent(newWizardState(cfg, completed), "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(stateFile), 0700); err == nil {
+			err = os.WriteFile(stateFile, data, 0600)
+		}
+	}
+	if err != nil {
+		common.Warning(fmt.Sprintf("Failed to save wizard progress: %v", err))
+	}
+}
+
+// loadWizardState reads the state file, returning false if none is usable
+func loadWizardState() (wizardState, bool) {
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		return wizardState{}, false
+	}
+	var s wizardState
+	if err := json.Unmarshal(data, &s); err != nil || (s.Completed < 1 && !s.Preset) {
+		return wizardState{}, false
+	}
+	return s, true
+}
+
+// clearWizardState removes the state file
+func clearWizardState() {
+	if err := os.Remove(stateFile); err != nil && !os.IsNotExist(err) {
+		common.Warning(fmt.Sprintf("Failed to remove %s: %v", stateFile, err))
+	}
+}
+
+// printSavedState shows the answers collected in a previous run
+func printSavedState(s wizardState) {
+	cfg := s.config()
+	if s.Preset {
+		fmt.Printf("%sSet during bootstrap:%s\n\n", common.Bold, common.Reset)
+	} else {
+		fmt.Printf("%sA previous setup was interrupted after step %d of %d.%s\n\n", common.Bold, s.Completed, wizardSteps, common.Reset)
+	}
+	rows := []struct {
+		step  int
+		label string
+		value string
+	}{
+		{1, "Hostname", cfg.hostname},
+		{2, "Domain", cfg.domain},
+		{3, "TLS Mode", tlsModeName(cfg)},
+		{4, "SSH Keys", fmt.Sprintf("%d key(s)", len(cfg.sshKeys))},
+		{5, "Schedule", autoDeployName(cfg.autoDeploy)},
+	}
+	for _, r := range rows {
+		if s.Preset && r.value == "" {
+			continue
+		}
+		if r.step > s.Completed && !(s.Preset && r.step <= 2) {
+			break
+		}
+		fmt.Printf("  %-9s %s%s%s\n", r.label+":", common.Cyan, r.value, common.Reset)
+	}
+	fmt.Println()
+}
+
+// resumeWizard offers to continue from saved state, returning the config and
+// the number of steps already completed
+func resumeWizard() (wizardConfig, int) {
+	s, ok := loadWizardState()
+	if !ok {
+		return wizardConfig{}, 0
+	}
+	printSavedState(s)
+	if s.Preset {
+		if !common.Confirm("Keep these settings?", true) {
+			return s.config(), 0
+		}
+		return s.config(), s.Completed
+	}
+	if !common.Confirm("Resume where you left off?", true) {
+		clearWizardState()
+		return wizardConfig{}, 0
+	}
+
+	cfg := s.config()
+	completed := s.Completed
+	if completed >= 3 && cfg.tlsMode == TLSModeACMEDNS {
+		fmt.Printf("\nRe-enter %s credentials (they are not saved between runs).\n", cfg.dns.provider.name)
+		values, ok := collectDNSCredentials(cfg.dns.provider)
+		if !ok {
+			common.Warning("Credentials required for DNS-01. Returning to the TLS step.")
+			return cfg, 2
+		}
+		cfg.dns.values = values
+	}
+	if completed >= 3 && cfg.tlsMode == TLSModeCloudflaredTunnel {
+		fmt.Println("\nRe-enter the Cloudflare Tunnel token (it is not saved between runs).")
+		token, ok := promptTunnelToken()
+		if !ok {
+			common.Warning("A tunnel token is required. Returning to the TLS step.")
+			return cfg, 2
+		}
+		cfg.tunnelToken = token
+	}
+	return cfg, completed
+}
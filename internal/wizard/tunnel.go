@@ -0,0 +1,148 @@
+package wizard
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+const (
+	// tunnelEnvFile holds the Cloudflare Tunnel token; cloudflared loads it as
+	// an EnvironmentFile so the token stays out of configuration.nix
+	tunnelEnvFile = "/var/lib/juniper/cloudflared.env"
+
+	// tunnelOrigin is the local HTTP listener the tunnel forwards to
+	tunnelOrigin = "localhost:8080"
+
+	// Markers around the cloudflared service patched into configuration.nix
+	tunnelBegin = "  # BEGIN cloudflared tunnel (managed by juniper-host wizard)"
+	tunnelEnd   = "  # END cloudflared tunnel"
+)
+
+// tunnelTokenRe matches a tunnel token: 40+ hex characters, or the base64
+// token shown by the Cloudflare dashboard and `cloudflared tunnel token`
+var tunnelTokenRe = regexp.MustCompile(`^([0-9A-Fa-f]{40,}|[A-Za-z0-9+/_-]{40,}={0,2})$`)
+
+// isValidTunnelToken reports whether token looks like a Cloudflare Tunnel token
+func isValidTunnelToken(token string) bool {
+	return tunnelTokenRe.MatchString(token)
+}
+
+// promptTunnelToken asks for the tunnel token, returning false if none was valid
+func promptTunnelToken() (string, bool) {
+	fmt.Println()
+	fmt.Println("Create a tunnel in the Cloudflare Zero Trust dashboard, point its public")
+	fmt.Printf("hostname at %shttp://%s%s, and paste the connector token below.\n", common.Cyan, tunnelOrigin, common.Reset)
+	fmt.Println()
+	const maxRetries = 3
+	for attempts := 0; attempts < maxRetries; attempts++ {
+		token := common.PromptSecret("Tunnel token")
+		if isValidTunnelToken(token) {
+			return token, true
+		}
+		common.Error("Invalid tunnel token. Expected at least 40 hex or base64 characters.")
+	}
+	return "", false
+}
+
+// handleCloudflaredMode handles Cloudflare Tunnel mode configuration
+func handleCloudflaredMode() (tlsMode, token string) {
+	token, ok := promptTunnelToken()
+	if !ok {
+		common.Warning("Falling back to self-signed.")
+		return TLSModeSelfSigned, ""
+	}
+	common.Info("Using Cloudflare Tunnel (no inbound ports 80/443 needed)")
+	return TLSModeCloudflaredTunnel, token
+}
+
+// writeTunnelEnvFile writes the tunnel token for the cloudflared service
+func writeTunnelEnvFile(token string) error {
+	content := "# Cloudflare Tunnel token - written by juniper-host wizard\n" +
+		"TUNNEL_TOKEN=" + escapeEnvValue(token) + "\n"
+	if err := os.MkdirAll("/var/lib/juniper", 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(tunnelEnvFile, []byte(content), 0600)
+}
+
+// buildTunnelNix renders the cloudflared service for configuration.nix
+func buildTunnelNix() string {
+	return tunnelBegin + "\n" + fmt.Sprintf(`  systemd.services.cloudflared = {
+    description = "Cloudflare Tunnel to Caddy on %s";
+    after = [ "network-online.target" "caddy.service" ];
+    wants = [ "network-online.target" ];
+    wantedBy = [ "multi-user.target" ];
+    serviceConfig = {
+      ExecStart = "${pkgs.cloudflared}/bin/cloudflared tunnel --no-autoupdate run";
+      EnvironmentFile = "%s";
+      DynamicUser = true;
+      Restart = "always";
+      RestartSec = 5;
+    };
+  };
+`, tunnelOrigin, tunnelEnvFile) + tunnelEnd + "\n"
+}
+
+// updateTunnel inserts the cloudflared block when enabled and removes it otherwise
+func updateTunnel(content string, enabled bool) (string, error) {
+	block := ""
+	if enabled {
+		block = buildTunnelNix()
+	}
+	return replaceManagedBlock(content, tunnelBegin, tunnelEnd, block)
+}
+
+// applyTunnel writes the token and patches the cloudflared service into
+// configuration.nix, or removes it when another TLS mode was chosen
+func applyTunnel(cfg wizardConfig) {
+	enabled := cfg.tlsMode == TLSModeCloudflaredTunnel
+	if enabled {
+		if err := writeTunnelEnvFile(cfg.tunnelToken); err != nil {
+			common.Error(fmt.Sprintf("Failed to write tunnel token: %v", err))
+			os.Exit(1)
+		}
+		common.Success("Tunnel token written to " + tunnelEnvFile)
+	}
+
+	data, err := os.ReadFile(nixosConfig)
+	if err == nil {
+		var content string
+		if content, err = updateTunnel(string(data), enabled); err == nil && content != string(data) {
+			err = os.WriteFile(nixosConfig, []byte(content), 0600)
+		}
+	}
+	if err != nil {
+		common.Error(fmt.Sprintf("Failed to update cloudflared configuration: %v", err))
+		os.Exit(1)
+	}
+	if enabled {
+		common.Success("cloudflared service configured")
+	}
+}
+
+// tunnelCaddyfile renders the Caddyfile for Cloudflare Tunnel mode: only the
+// admin API and a loopback HTTP listener for cloudflared, no :80 or :443
+func tunnelCaddyfile(siteConfigSnippet string) string {
+	port := tunnelOrigin[strings.LastIndex(tunnelOrigin, ":"):]
+	return fmt.Sprintf(`# Juniper Bible - TLS Mode: Cloudflare Tunnel
+# TLS terminates at Cloudflare; cloudflared forwards to http://%s
+{
+  admin localhost:2019
+  auto_https off
+  log {
+    level ERROR
+  }
+}
+
+%s
+
+http://%s {
+  bind 127.0.0.1
+  import site_config
+}
+`, tunnelOrigin, siteConfigSnippet, port)
+}
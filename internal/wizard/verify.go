@@ -0,0 +1,148 @@
+package wizard
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
+)
+
+// certExpiryWarning is how close to expiry a certificate is flagged
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// verifyResult is one row of the post-setup verification table
+type verifyResult struct {
+	name   string
+	ok     bool
+	detail string
+	hint   string
+}
+
+// fetch performs a GET and returns the response with its body closed
+func fetch(url string, insecure bool) (*http.Response, error) {
+	client := &http.Client{
+		Timeout: 15 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure}, // #nosec G402 -- only for self-signed mode
+		},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// verifyLocalHTTP checks the site answers on localhost
+func verifyLocalHTTP(tlsMode string) verifyResult {
+	url := "http://localhost/healthz.json"
+	if tlsMode == TLSModeCloudflaredTunnel {
+		url = "http://" + tunnelOrigin + "/healthz.json"
+	}
+	r := verifyResult{name: "Local HTTP (" + url + ")"}
+	resp, err := fetch(url, false)
+	if err != nil {
+		r.detail = err.Error()
+		r.hint = "Check Caddy is running: systemctl status caddy"
+		return r
+	}
+	r.detail = resp.Status
+	r.ok = resp.StatusCode == http.StatusOK
+	if !r.ok {
+		r.hint = "Site may not be deployed yet: run deploy-juniper"
+	}
+	return r
+}
+
+// verifyPublicHTTPS checks the site over HTTPS on the public domain
+func verifyPublicHTTPS(domain, tlsMode string) (verifyResult, *http.Response) {
+	url := fmt.Sprintf("https://%s/healthz.json", domain)
+	r := verifyResult{name: "Public HTTPS (" + url + ")"}
+	insecure := tlsMode == TLSModeSelfSigned
+	if insecure {
+		r.name += " [self-signed, verification skipped]"
+	}
+	resp, err := fetch(url, insecure)
+	if err != nil {
+		r.detail = err.Error()
+		r.hint = fmt.Sprintf("Check DNS for %s points here (%s) and ports 80/443 are open in your firewall/VPS provider", domain, common.GetIP())
+		if tlsMode == TLSModeCloudflaredTunnel {
+			r.hint = fmt.Sprintf("Check the tunnel is connected (systemctl status cloudflared) and its public hostname %s routes to http://%s", domain, tunnelOrigin)
+		}
+		return r, nil
+	}
+	r.detail = resp.Status
+	r.ok = resp.StatusCode == http.StatusOK
+	if !r.ok {
+		r.hint = "Site may not be deployed yet: run deploy-juniper"
+	}
+	return r, resp
+}
+
+// verifyCertificate checks issuer and expiry of the served certificate
+func verifyCertificate(resp *http.Response) verifyResult {
+	r := verifyResult{name: "TLS certificate"}
+	if resp == nil || resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		r.detail = "no certificate received"
+		r.hint = "Check certificate issuance logs: journalctl -u caddy | grep -i acme"
+		return r
+	}
+	cert := resp.TLS.PeerCertificates[0]
+	remaining := time.Until(cert.NotAfter)
+	r.detail = fmt.Sprintf("issuer %q, expires %s", cert.Issuer.CommonName, cert.NotAfter.Format("2006-01-02"))
+	r.ok = remaining > certExpiryWarning
+	if !r.ok {
+		r.hint = "Certificate expires soon; check renewal: journalctl -u caddy | grep -i acme"
+	}
+	return r
+}
+
+// collectVerifyResults runs the checks relevant to the chosen TLS mode
+func collectVerifyResults(cfg wizardConfig) []verifyResult {
+	results := []verifyResult{verifyLocalHTTP(cfg.tlsMode)}
+	if cfg.tlsMode == TLSModeHTTPOnly || cfg.domain == "localhost" {
+		return results
+	}
+	httpsResult, resp := verifyPublicHTTPS(cfg.domain, cfg.tlsMode)
+	results = append(results, httpsResult)
+	if cfg.tlsMode == TLSModeACMEHTTP || cfg.tlsMode == TLSModeACMEDNS {
+		results = append(results, verifyCertificate(resp))
+	}
+	return results
+}
+
+// printVerifyResults prints a pass/fail table followed by hints for failures
+func printVerifyResults(results []verifyResult) {
+	for _, r := range results {
+		status := common.Green + "PASS" + common.Reset
+		if !r.ok {
+			status = common.Red + "FAIL" + common.Reset
+		}
+		fmt.Printf("  [%s] %s\n", status, r.name)
+		fmt.Printf("         %s\n", r.detail)
+	}
+
+	first := true
+	for _, r := range results {
+		if r.ok || r.hint == "" {
+			continue
+		}
+		if first {
+			fmt.Println()
+			fmt.Println("Hints:")
+			first = false
+		}
+		fmt.Printf("  - %s\n", r.hint)
+	}
+	fmt.Println()
+}
+
+// verifySetup fetches the site to confirm it is actually being served.
+// Failures are reported only; nothing is rolled back.
+func verifySetup(cfg wizardConfig) {
+	fmt.Printf("%sVerifying setup...%s\n\n", common.Bold, common.Reset)
+	printVerifyResults(collectVerifyResults(cfg))
+}
@@ -1,9 +1,9 @@
 package wizard
 
 import (
+	"flag"
 	"fmt"
 	"os"
-	"regexp"
 	"strings"
 
 	"github.com/JuniperBible/Public.Tool.Server.JuniperBible/internal/common"
@@ -13,32 +13,39 @@ const (
 	nixosConfig   = "/etc/nixos/configuration.nix"
 	caddyfile     = "/var/lib/caddy/Caddyfile"
 	setupDoneFlag = "/etc/juniper-setup-complete"
+	rebuildLog    = "/var/log/juniper-wizard-rebuild.log"
+	wizardSteps   = 6
 )
 
 // TLS mode constants
 const (
-	TLSModeACMEHTTP   = "1"
-	TLSModeACMEDNS    = "2"
-	TLSModeCustomCert = "3"
-	TLSModeHTTPOnly   = "4"
-	TLSModeSelfSigned = "5"
+	TLSModeACMEHTTP          = "1"
+	TLSModeACMEDNS           = "2"
+	TLSModeCustomCert        = "3"
+	TLSModeHTTPOnly          = "4"
+	TLSModeSelfSigned        = "5"
+	TLSModeCloudflaredTunnel = "6"
 )
 
 // wizardConfig holds all collected wizard configuration
 type wizardConfig struct {
-	hostname   string
-	domain     string
-	tlsMode    string
-	cfAPIToken string
-	certPath   string
-	keyPath    string
-	sshKeys    []string
-	deployNow  bool
+	hostname    string
+	domain      string
+	tlsMode     string
+	dns         dnsConfig
+	certPath    string
+	keyPath     string
+	sshKeys     []string
+	tunnelToken string
+	autoDeploy  autoDeployConfig
+	pushAssets  bool
+	apiProxy    apiProxyConfig
+	deployNow   bool
 }
 
 // promptHostname prompts for and validates hostname
 func promptHostname(current string) string {
-	common.Step(1, 5, "Hostname")
+	common.Step(1, wizardSteps, "Hostname")
 	fmt.Printf("Current hostname: %s%s%s\n\n", common.Cyan, current, common.Reset)
 	const maxRetries = 5
 	for attempts := 0; attempts < maxRetries; attempts++ {
@@ -55,14 +62,18 @@ func promptHostname(current string) string {
 	return current
 }
 
-// promptDomain prompts for and validates domain
-func promptDomain() string {
-	common.Step(2, 5, "Domain")
+// promptDomain prompts for and validates domain, offering current as the
+// default when bootstrap already chose one
+func promptDomain(current string) string {
+	if current == "" {
+		current = "localhost"
+	}
+	common.Step(2, wizardSteps, "Domain")
 	fmt.Println("Enter your domain (e.g., juniperbible.org)")
 	fmt.Println()
 	const maxRetries = 5
 	for attempts := 0; attempts < maxRetries; attempts++ {
-		domain := common.Prompt("Domain", "localhost")
+		domain := common.Prompt("Domain", current)
 		if common.IsValidDomain(domain) {
 			return domain
 		}
@@ -75,18 +86,6 @@ func promptDomain() string {
 	return "localhost"
 }
 
-// promptACMEDNS prompts for Cloudflare API token
-func promptACMEDNS() (token string, fallback bool) {
-	fmt.Println()
-	fmt.Println("Enter your Cloudflare API token (needs Zone:DNS:Edit permission):")
-	token = common.Prompt("CF API Token", "")
-	if token == "" {
-		common.Warning("API token required for DNS-01. Falling back to self-signed.")
-		return "", true
-	}
-	return token, false
-}
-
 // promptCustomCert prompts for certificate paths
 func promptCustomCert() (certPath, keyPath string, fallback bool) {
 	fmt.Println()
@@ -101,24 +100,26 @@ func promptCustomCert() (certPath, keyPath string, fallback bool) {
 
 // printTLSOptions displays TLS mode options
 func printTLSOptions() {
-	common.Step(3, 5, "TLS Certificate Mode")
+	common.Step(3, wizardSteps, "TLS Certificate Mode")
 	fmt.Println("How should HTTPS certificates be handled?")
 	fmt.Println()
 	fmt.Println("  1) ACME HTTP-01  - Auto cert, requires DNS pointing directly to this server")
-	fmt.Println("  2) ACME DNS-01   - Auto cert via Cloudflare DNS (works behind proxy)")
+	fmt.Println("  2) ACME DNS-01   - Auto cert via DNS provider API (works behind proxy)")
 	fmt.Println("  3) Custom cert   - Provide your own certificate files")
 	fmt.Println("  4) HTTP only     - No HTTPS (for testing only)")
 	fmt.Println("  5) Self-signed   - Works everywhere, browser shows warning (default)")
+	fmt.Println("  6) Cloudflare Tunnel - HTTPS via cloudflared, no inbound ports 80/443")
 	fmt.Println()
 }
 
 // handleACMEDNSMode handles ACME DNS-01 mode configuration
-func handleACMEDNSMode() (tlsMode, cfAPIToken string) {
-	token, fallback := promptACMEDNS()
-	if fallback {
-		return TLSModeSelfSigned, ""
+func handleACMEDNSMode() (tlsMode string, dns dnsConfig) {
+	dns, ok := promptDNSProvider()
+	if !ok {
+		common.Warning("Falling back to self-signed.")
+		return TLSModeSelfSigned, dnsConfig{}
 	}
-	return TLSModeACMEDNS, token
+	return TLSModeACMEDNS, dns
 }
 
 // handleCustomCertMode handles custom certificate mode configuration
@@ -130,37 +131,68 @@ func handleCustomCertMode() (tlsMode, certPath, keyPath string) {
 	return TLSModeCustomCert, cert, key
 }
 
-// handleTLSMode handles the selected TLS mode and returns config values
-func handleTLSMode(mode string) (tlsMode, cfAPIToken, certPath, keyPath string) {
+// handleTLSMode handles the selected TLS mode and stores the results in cfg
+func handleTLSMode(mode string, cfg *wizardConfig) {
+	cfg.dns, cfg.certPath, cfg.keyPath, cfg.tunnelToken = dnsConfig{}, "", "", ""
 	switch mode {
 	case TLSModeACMEHTTP:
 		common.Info("Using ACME HTTP-01 challenge")
-		return mode, "", "", ""
+		cfg.tlsMode = mode
 	case TLSModeACMEDNS:
-		tlsMode, cfAPIToken = handleACMEDNSMode()
-		return tlsMode, cfAPIToken, "", ""
+		cfg.tlsMode, cfg.dns = handleACMEDNSMode()
 	case TLSModeCustomCert:
-		tlsMode, certPath, keyPath = handleCustomCertMode()
-		return tlsMode, "", certPath, keyPath
+		cfg.tlsMode, cfg.certPath, cfg.keyPath = handleCustomCertMode()
 	case TLSModeHTTPOnly:
 		common.Info("Using HTTP only (no TLS)")
-		return mode, "", "", ""
+		cfg.tlsMode = mode
+	case TLSModeCloudflaredTunnel:
+		cfg.tlsMode, cfg.tunnelToken = handleCloudflaredMode()
 	default:
 		common.Info("Using self-signed certificate")
-		return TLSModeSelfSigned, "", "", ""
+		cfg.tlsMode = TLSModeSelfSigned
 	}
 }
 
 // promptTLSMode prompts for TLS configuration
-func promptTLSMode() (tlsMode, cfAPIToken, certPath, keyPath string) {
+func promptTLSMode(cfg *wizardConfig) {
 	printTLSOptions()
 	mode := common.Prompt("TLS mode", "5")
-	return handleTLSMode(mode)
+	handleTLSMode(mode, cfg)
+}
+
+// preloadLinks are the Link header values sent with Bible pages when
+// preload hints are enabled, for assets every page needs before rendering
+var preloadLinks = []string{
+	"</main.css>; rel=preload; as=style",
+}
+
+// promptPushAssets asks whether to send preload hints for critical assets
+func promptPushAssets() bool {
+	fmt.Println()
+	fmt.Println("Bible pages load their stylesheet before anything is shown. Caddy can")
+	fmt.Println("send Link preload headers so HTTP/2 browsers fetch it right away.")
+	fmt.Println()
+	return common.Confirm("Enable HTTP/2 push hints for faster page loads?", false)
+}
+
+// renderPreloadHints renders the Link headers for Bible pages, or nothing
+// when disabled. Browsers no longer accept server push, so the hints are
+// sent as preload headers, which they fetch as soon as the headers arrive.
+func renderPreloadHints(enabled bool) string {
+	if !enabled {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\n  # Preload hints for critical assets (HTTP/2 push hints)\n")
+	for _, link := range preloadLinks {
+		b.WriteString(fmt.Sprintf("  header @bible +Link %q\n", link))
+	}
+	return b.String()
 }
 
 // printSSHKeyPromptHeader prints the SSH key prompt header
 func printSSHKeyPromptHeader() {
-	common.Step(4, 5, "SSH Keys")
+	common.Step(4, wizardSteps, "SSH Keys")
 	fmt.Println("Add SSH public keys for server access (deploy and root users).")
 	fmt.Println("Paste one key per line. Enter empty line when done.")
 	fmt.Println()
@@ -175,12 +207,17 @@ func collectSSHKeys(maxKeys int) []string {
 		if key == "" {
 			break
 		}
-		if common.IsValidSSHKey(key) {
-			sshKeys = append(sshKeys, key)
-			common.Success("Key added")
-		} else {
-			common.Error("Invalid key format. Keys should be: ssh-ed25519, ssh-rsa, or ecdsa-sha2-nistp256/384/521")
+		if err := common.CheckSSHKey(key); err != nil {
+			common.Error(fmt.Sprintf("Invalid key: %v", err))
+			continue
+		}
+		if _, _, err := common.ValidateSSHKeyStrength(key); err != nil {
+			common.Error(fmt.Sprintf("Key rejected: %v", err))
+			fmt.Println("Use an ssh-ed25519 key (ssh-keygen -t ed25519), or rerun with --min-rsa-bits to lower the policy.")
+			continue
 		}
+		sshKeys = append(sshKeys, key)
+		common.Success("Key added: " + common.DescribeSSHKey(key))
 	}
 	return sshKeys
 }
@@ -209,22 +246,44 @@ func promptSSHKeys() []string {
 	return sshKeys
 }
 
-// showSummary displays configuration summary and prompts for confirmation
-func showSummary(cfg wizardConfig) {
-	tlsModeName := map[string]string{
-		TLSModeACMEHTTP:   "ACME HTTP-01",
-		TLSModeACMEDNS:    "ACME DNS-01 (Cloudflare)",
-		TLSModeCustomCert: "Custom certificate",
-		TLSModeHTTPOnly:   "HTTP only",
-		TLSModeSelfSigned: "Self-signed",
+// tlsModeName returns a display name for the configured TLS mode
+func tlsModeName(cfg wizardConfig) string {
+	return map[string]string{
+		TLSModeACMEHTTP:          "ACME HTTP-01",
+		TLSModeACMEDNS:           fmt.Sprintf("ACME DNS-01 (%s)", cfg.dns.provider.name),
+		TLSModeCustomCert:        "Custom certificate",
+		TLSModeHTTPOnly:          "HTTP only",
+		TLSModeSelfSigned:        "Self-signed",
+		TLSModeCloudflaredTunnel: "Cloudflare Tunnel",
 	}[cfg.tlsMode]
+}
 
+// autoDeployName returns a display string for the auto-deploy schedule
+func autoDeployName(ad autoDeployConfig) string {
+	if ad.calendar == "" {
+		return "Disabled"
+	}
+	if ad.email != "" {
+		return ad.calendar + " (failures emailed to " + ad.email + ")"
+	}
+	return ad.calendar
+}
+
+// showSummary displays configuration summary and prompts for confirmation
+func showSummary(cfg wizardConfig) {
 	common.ClearScreen()
 	fmt.Printf("%sConfiguration Summary%s\n\n", common.Bold, common.Reset)
 	fmt.Printf("  Hostname: %s%s%s\n", common.Cyan, cfg.hostname, common.Reset)
 	fmt.Printf("  Domain:   %s%s%s\n", common.Cyan, cfg.domain, common.Reset)
-	fmt.Printf("  TLS Mode: %s%s%s\n", common.Cyan, tlsModeName, common.Reset)
+	fmt.Printf("  TLS Mode: %s%s%s\n", common.Cyan, tlsModeName(cfg), common.Reset)
 	fmt.Printf("  SSH Keys: %s%d key(s)%s\n", common.Cyan, len(cfg.sshKeys), common.Reset)
+	fmt.Printf("  Schedule: %s%s%s\n", common.Cyan, autoDeployName(cfg.autoDeploy), common.Reset)
+	pushStr := "No"
+	if cfg.pushAssets {
+		pushStr = "Yes"
+	}
+	fmt.Printf("  Preload:  %s%s%s\n", common.Cyan, pushStr, common.Reset)
+	fmt.Printf("  API:      %s%s%s\n", common.Cyan, apiProxyName(cfg.apiProxy), common.Reset)
 	deployStr := "No"
 	if cfg.deployNow {
 		deployStr = "Yes"
@@ -233,17 +292,20 @@ func showSummary(cfg wizardConfig) {
 	fmt.Println()
 
 	if !common.Confirm("Apply this configuration?", true) {
+		clearWizardState()
 		fmt.Println("Setup cancelled. Run 'juniper-host wizard' to try again.")
 		os.Exit(1)
 	}
 }
 
-// backupConfig backs up the NixOS configuration
+// backupConfig writes a timestamped backup of the NixOS configuration
 func backupConfig() {
-	if err := copyFile(nixosConfig, nixosConfig+".backup"); err != nil {
+	path, err := createBackup()
+	if err != nil {
 		common.Error(fmt.Sprintf("Failed to backup config: %v", err))
 		os.Exit(1)
 	}
+	common.Success("Configuration backed up to " + path)
 }
 
 // updateNixOSConfig updates hostname and SSH keys in the config
@@ -257,24 +319,64 @@ func updateNixOSConfig(hostname string, sshKeys []string) {
 
 // generateCaddyConfig generates the Caddyfile configuration
 func generateCaddyConfig(cfg wizardConfig) {
-	if err := generateCaddyfile(cfg.domain, cfg.tlsMode, cfg.cfAPIToken, cfg.certPath, cfg.keyPath); err != nil {
+	if cfg.tlsMode == TLSModeACMEDNS {
+		if err := writeDNSEnvFile(cfg.dns); err != nil {
+			common.Error(fmt.Sprintf("Failed to write DNS credentials: %v", err))
+			os.Exit(1)
+		}
+		common.Success("DNS credentials written to " + dnsEnvFile)
+	}
+	if err := generateCaddyfile(cfg.domain, cfg.tlsMode, cfg.dns.provider.stanza, cfg.certPath, cfg.keyPath, cfg.pushAssets, cfg.apiProxy); err != nil {
 		common.Error(fmt.Sprintf("Failed to generate Caddyfile: %v", err))
 		os.Exit(1)
 	}
 	common.Success("Caddyfile generated")
 }
 
-// rebuildNixOS rebuilds NixOS with the new configuration
+// restoreLatestBackup copies the most recent backup over the NixOS configuration
+func restoreLatestBackup() bool {
+	backup := latestBackup()
+	if backup == "" {
+		common.Error("No backup found to restore")
+		return false
+	}
+	if err := copyFile(backup, nixosConfig); err != nil {
+		common.Error(fmt.Sprintf("Failed to restore backup: %v", err))
+		fmt.Printf("  Manual restore: sudo cp %s %s\n", backup, nixosConfig)
+		return false
+	}
+	common.Success("Backup restored")
+	return true
+}
+
+// validateNixOSConfig runs a dry build so config errors surface before switching
+func validateNixOSConfig() {
+	fmt.Println()
+	fmt.Println("Validating configuration (nixos-rebuild dry-build)...")
+	if err := common.RunLogged(rebuildLog, "nixos-rebuild", "dry-build"); err != nil {
+		common.Error("Configuration failed validation. Restoring backup...")
+		fmt.Printf("  Build log: %s\n", rebuildLog)
+		restoreLatestBackup()
+		os.Exit(1)
+	}
+	common.Success("Configuration is valid")
+}
+
+// rebuildNixOS validates and then switches to the new configuration
 func rebuildNixOS() {
+	validateNixOSConfig()
+
 	fmt.Println()
 	fmt.Println("Rebuilding NixOS (this may take a minute)...")
-	if err := common.Run("nixos-rebuild", "switch"); err != nil {
+	if err := common.RunLogged(rebuildLog, "nixos-rebuild", "switch"); err != nil {
 		common.Error("NixOS rebuild failed. Restoring backup...")
-		if restoreErr := copyFile(nixosConfig+".backup", nixosConfig); restoreErr != nil {
-			common.Error(fmt.Sprintf("Failed to restore backup: %v", restoreErr))
-			fmt.Printf("  Manual restore: sudo cp %s.backup %s\n", nixosConfig, nixosConfig)
-		} else {
-			common.Success("Backup restored")
+		fmt.Printf("  Build log: %s\n", rebuildLog)
+		if restoreLatestBackup() && common.Confirm("Re-apply the restored configuration (nixos-rebuild switch)?", true) {
+			if err := common.RunLogged(rebuildLog, "nixos-rebuild", "switch"); err != nil {
+				common.Error(fmt.Sprintf("Rebuild of restored configuration failed. See %s", rebuildLog))
+			} else {
+				common.Success("System switched back to the previous configuration")
+			}
 		}
 		os.Exit(1)
 	}
@@ -288,6 +390,8 @@ func applyConfiguration(cfg wizardConfig) {
 
 	backupConfig()
 	updateNixOSConfig(cfg.hostname, cfg.sshKeys)
+	applyAutoDeploy(cfg.autoDeploy)
+	applyTunnel(cfg)
 	generateCaddyConfig(cfg)
 	rebuildNixOS()
 
@@ -321,8 +425,24 @@ func showCompletionMessage(domain string) {
 	} else {
 		fmt.Printf("  Website: %shttp://%s%s\n", common.Cyan, domain, common.Reset)
 	}
-	fmt.Printf("  SSH:     %sssh deploy@%s%s\n", common.Cyan, common.GetIP(), common.Reset)
-	fmt.Printf("  Admin:   %sssh root@%s%s  (for system administration)\n", common.Cyan, common.GetIP(), common.Reset)
+	addrs := common.PublicAddresses().List()
+	if len(addrs) == 0 {
+		addrs = []string{"N/A"}
+	}
+	for i, ip := range addrs {
+		label := "SSH:"
+		if i > 0 {
+			label = ""
+		}
+		fmt.Printf("  %-8s %sssh deploy@%s%s\n", label, common.Cyan, ip, common.Reset)
+	}
+	for i, ip := range addrs {
+		label, note := "Admin:", "  (for system administration)"
+		if i > 0 {
+			label, note = "", ""
+		}
+		fmt.Printf("  %-8s %sssh root@%s%s%s\n", label, common.Cyan, ip, common.Reset, note)
+	}
 	fmt.Println()
 	fmt.Println("Useful commands:")
 	fmt.Println("  deploy-juniper              - Update the site")
@@ -330,32 +450,77 @@ func showCompletionMessage(domain string) {
 	fmt.Println()
 }
 
+// parseFlags applies the input flags and returns the subcommand, if any
+func parseFlags(args []string) string {
+	sub := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		sub, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet("wizard", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "Accept defaults for unanswered prompts when there is no terminal")
+	answers := fs.String("answers", "", "TOML file of prompt answers for runs without a terminal")
+	minRSABits := fs.Int("min-rsa-bits", common.DefaultMinRSABits, "Reject RSA SSH keys shorter than this (0 disables)")
+	if err := fs.Parse(args); err != nil {
+		common.Error(fmt.Sprintf("Failed to parse arguments: %v", err))
+		os.Exit(1)
+	}
+	common.ApplyInputFlags(*yes, *answers)
+	common.SetMinRSABits(*minRSABits)
+	return sub
+}
+
 // Run executes the setup wizard
 func Run(args []string) {
+	switch parseFlags(args) {
+	case "restore-config":
+		runRestoreConfig()
+		return
+	case "auto-deploy":
+		runAutoDeploy()
+		return
+	}
+
 	if common.FileExists(setupDoneFlag) {
 		return
 	}
 
 	hostname := common.GetHostname()
 	common.ClearScreen()
-	common.Banner(hostname, common.GetIP(), common.GetOSVersion(), common.GetKernel())
+	common.Banner(hostname, common.GetAddresses(), common.GetOSVersion(), common.GetKernel())
 	common.WaitForEnter("Press Enter to continue...")
 
-	var cfg wizardConfig
-	cfg.hostname = promptHostname(hostname)
-	cfg.domain = promptDomain()
-	cfg.tlsMode, cfg.cfAPIToken, cfg.certPath, cfg.keyPath = promptTLSMode()
-	cfg.sshKeys = promptSSHKeys()
-
-	common.Step(5, 5, "Deploy Site")
-	fmt.Println("Would you like to deploy Juniper Bible now?")
-	fmt.Println()
-	cfg.deployNow = common.Confirm("Deploy site?", true)
+	cfg, completed := resumeWizard()
+	steps := []func(*wizardConfig){
+		func(c *wizardConfig) { c.hostname = promptHostname(hostname) },
+		func(c *wizardConfig) { c.domain = promptDomain(c.domain) },
+		func(c *wizardConfig) {
+			promptTLSMode(c)
+			c.pushAssets = promptPushAssets()
+			c.apiProxy = promptAPIProxy()
+		},
+		func(c *wizardConfig) { c.sshKeys = promptSSHKeys() },
+		func(c *wizardConfig) {
+			common.Step(5, wizardSteps, "Auto-Deploy")
+			c.autoDeploy = promptAutoDeploy()
+		},
+		func(c *wizardConfig) {
+			common.Step(6, wizardSteps, "Deploy Site")
+			fmt.Println("Would you like to deploy Juniper Bible now?")
+			fmt.Println()
+			c.deployNow = common.Confirm("Deploy site?", true)
+		},
+	}
+	for i := completed; i < len(steps); i++ {
+		steps[i](&cfg)
+		saveWizardState(cfg, i+1)
+	}
 
 	showSummary(cfg)
 	applyConfiguration(cfg)
+	clearWizardState()
 	deploySite(cfg.deployNow)
 	showCompletionMessage(cfg.domain)
+	verifySetup(cfg)
 }
 
 func copyFile(src, dst string) error {
@@ -377,75 +542,41 @@ func copyFile(src, dst string) error {
 	return nil
 }
 
-// updateHostname updates the hostname in the config content
-func updateHostname(content, hostname string) (string, error) {
-	hostnameRe := regexp.MustCompile(`networking\.hostName = "[^"]*"`)
-	escapedHostname := escapeNixString(hostname)
-	newContent := hostnameRe.ReplaceAllLiteralString(content, fmt.Sprintf(`networking.hostName = "%s"`, escapedHostname))
-	if newContent == content {
-		return "", fmt.Errorf("failed to find hostname configuration in file")
-	}
-	return newContent, nil
-}
-
-// buildSSHKeysNix builds the Nix SSH keys list string
-func buildSSHKeysNix(sshKeys []string) string {
-	var keysList strings.Builder
-	for _, key := range sshKeys {
-		escapedKey := escapeNixString(key)
-		keysList.WriteString(fmt.Sprintf("    \"%s\"\n", escapedKey))
-	}
-	return keysList.String()
-}
-
-// updateUserSSHKeys updates SSH keys for a specific user in the config
-func updateUserSSHKeys(content, user, keysListStr string) string {
-	var keysNix strings.Builder
-	keysNix.WriteString(fmt.Sprintf("users.users.%s.openssh.authorizedKeys.keys = [\n", user))
-	keysNix.WriteString(keysListStr)
-	keysNix.WriteString("  ];")
-
-	pattern := fmt.Sprintf(`users\.users\.%s\.openssh\.authorizedKeys\.keys = \[[\s\S]*?\];`, user)
-	keysRe := regexp.MustCompile(pattern)
-	return keysRe.ReplaceAllLiteralString(content, keysNix.String())
-}
-
 func updateConfig(hostname string, sshKeys []string) error {
 	data, err := os.ReadFile(nixosConfig)
 	if err != nil {
 		return err
 	}
 
-	content, err := updateHostname(string(data), hostname)
+	content, err := common.UpdateHostname(string(data), hostname)
 	if err != nil {
 		return err
 	}
 
 	if len(sshKeys) > 0 {
-		beforeSSHKeys := content
-		keysListStr := buildSSHKeysNix(sshKeys)
-		content = updateUserSSHKeys(content, "deploy", keysListStr)
-		content = updateUserSSHKeys(content, "root", keysListStr)
-		if content == beforeSSHKeys {
-			return fmt.Errorf("failed to find SSH key configuration sections in file")
+		for _, user := range []string{"deploy", "root"} {
+			if content, err = common.SetUserSSHKeys(content, user, sshKeys); err != nil {
+				return err
+			}
 		}
 	}
 
 	return os.WriteFile(nixosConfig, []byte(content), 0600)
 }
 
-func generateCaddyfile(domain, tlsMode, cfAPIToken, certPath, keyPath string) error {
+func generateCaddyfile(domain, tlsMode, dnsStanza, certPath, keyPath string, pushAssets bool, apiProxy apiProxyConfig) error {
+	redirects, err := loadRedirects()
+	if err != nil {
+		return err
+	}
+
 	// Shared site configuration snippet (imported by each server block)
-	siteConfigSnippet := `(site_config) {
+	siteConfigSnippet := fmt.Sprintf(`(site_config) {
   root * /var/www/juniperbible
   encode gzip
 
-  # Static redirects (301) - matches _redirects
-  @religion path /religion/*
-  redir @religion /bible/drc/isa/42/ 301
-
-  @licenses path /licenses/*
-  redir @licenses /license/ 301
+  # Redirects from %s
+%s
 
   # SPA-style rewrites for compare page clean URLs
   # Matches: /bible/compare/{bibles}/{book}/{chapter}[/{verse}][/{mode}]
@@ -453,7 +584,7 @@ func generateCaddyfile(domain, tlsMode, cfAPIToken, certPath, keyPath string) er
     path_regexp ^/bible/compare/[^/]+/[^/]+/[^/]+
   }
   rewrite @compare_spa /bible/compare/index.html
-
+%s
   file_server {
     precompressed br gzip
   }
@@ -467,14 +598,14 @@ func generateCaddyfile(domain, tlsMode, cfAPIToken, certPath, keyPath string) er
     path /bible/*
   }
   header @bible Cache-Control "public, max-age=86400"
-
+%s
   header {
     X-Content-Type-Options nosniff
     X-Frame-Options DENY
     Referrer-Policy strict-origin-when-cross-origin
     Permissions-Policy "camera=(), microphone=(), geolocation=()"
   }
-}`
+}`, redirectsFile, renderRedirects(redirects), renderAPIProxy(apiProxy), renderPreloadHints(pushAssets))
 
 	var content string
 
@@ -496,7 +627,8 @@ func generateCaddyfile(domain, tlsMode, cfAPIToken, certPath, keyPath string) er
 `, siteConfigSnippet, domain)
 
 	case TLSModeACMEDNS:
-		content = fmt.Sprintf(`# Juniper Bible - TLS Mode: ACME DNS-01 (Cloudflare)
+		content = fmt.Sprintf(`# Juniper Bible - TLS Mode: ACME DNS-01
+# Provider credentials are loaded from %s
 {
   log {
     level ERROR
@@ -507,12 +639,12 @@ func generateCaddyfile(domain, tlsMode, cfAPIToken, certPath, keyPath string) er
 
 %s {
   tls {
-    dns cloudflare %s
+    %s
   }
   import site_config
   header Strict-Transport-Security "max-age=31536000; includeSubDomains"
 }
-`, siteConfigSnippet, domain, cfAPIToken)
+`, dnsEnvFile, siteConfigSnippet, domain, dnsStanza)
 
 	case TLSModeCustomCert:
 		content = fmt.Sprintf(`# Juniper Bible - TLS Mode: Custom Certificate
@@ -531,6 +663,9 @@ func generateCaddyfile(domain, tlsMode, cfAPIToken, certPath, keyPath string) er
 }
 `, siteConfigSnippet, domain, certPath, keyPath)
 
+	case TLSModeCloudflaredTunnel:
+		content = tunnelCaddyfile(siteConfigSnippet)
+
 	case TLSModeHTTPOnly:
 		content = fmt.Sprintf(`# Juniper Bible - TLS Mode: HTTP Only
 {
@@ -575,11 +710,3 @@ func generateCaddyfile(domain, tlsMode, cfAPIToken, certPath, keyPath string) er
 
 	return os.WriteFile(caddyfile, []byte(content), 0644)
 }
-
-// escapeNixString escapes special characters for Nix string literals
-func escapeNixString(s string) string {
-	s = strings.ReplaceAll(s, `\`, `\\`)
-	s = strings.ReplaceAll(s, `"`, `\"`)
-	s = strings.ReplaceAll(s, `$`, `\$`)
-	return s
-}